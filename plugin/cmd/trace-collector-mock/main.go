@@ -0,0 +1,69 @@
+// trace-collector-mock is a stand-in tracking endpoint for local testing: it
+// records every payload the plugin POSTs, prints one JSON line per event and
+// serves the recorded events on GET /events (DELETE /events clears them).
+//
+//	trace-collector-mock -addr :8089 -out /tmp/events.ndjson
+//	curl -s localhost:8089/events | jq '.[].meta.status'
+//
+// -status and -delay make the collector misbehave, to check that the gateway
+// does not care.
+// -ack answers X-Trace-Receipt for the acknowledged delivery of the http
+// sink.
+//
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"trace-plugin/internal/mockcollector"
+)
+
+func main() {
+	addr := flag.String("addr", ":8089", "listen address")
+	status := flag.Int("status", http.StatusOK, "status answered to every POST")
+	delay := flag.Duration("delay", 0, "delay before answering a POST (e.g. 3s)")
+	keep := flag.Int("keep", 10000, "events kept for GET /events (0 = all)")
+	out := flag.String("out", "", "also append events to this NDJSON file")
+	quiet := flag.Bool("quiet", false, "do not print events on stdout")
+	ack := flag.Bool("ack", false, "acknowledge events with X-Trace-Receipt (http ack)")
+	flag.Parse()
+
+	var mu sync.Mutex
+	var file *os.File
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		file = f
+	}
+
+	c := mockcollector.New()
+	c.Status, c.Delay, c.Max, c.Ack = *status, *delay, *keep, *ack
+	c.OnEvent = func(e mockcollector.Event) {
+		line, _ := json.Marshal(e)
+		line = append(line, '\n')
+		mu.Lock()
+		defer mu.Unlock()
+		if !*quiet {
+			os.Stdout.Write(line)
+		}
+		if file != nil {
+			file.Write(line)
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "trace-collector-mock listening on", *addr)
+	if err := http.ListenAndServe(*addr, c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
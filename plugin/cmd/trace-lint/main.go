@@ -0,0 +1,419 @@
+// trace-lint checks the plugin configuration of every backend in a
+// krakend.json without starting KrakenD, and shows what the plugin would do
+// with sample requests: whether they are captured, the event fields, and the
+// bodies after redaction and transforms.
+//
+//	trace-lint -config krakend.json -request "POST /orders" -request "GET /orders/7 500"
+//	trace-lint -config krakend.json -requests samples.json
+//
+// samples.json is a list of requests (paths are gateway paths, matched against
+// the endpoint patterns; the response fields are optional):
+//
+//	[{"method": "POST", "path": "/orders?dry=1", "headers": {"Content-Type": "application/json"},
+//	  "body": "{\"card\":\"4111…\"}", "status": 201, "response_body": "{\"id\":7}"}]
+//
+// Nothing is sent and no directories are created; the exit status is 1 when a
+// backend has an invalid configuration. Flexible-config templates must be
+// rendered first.
+//
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"trace-plugin/internal/capture"
+	"trace-plugin/internal/config"
+	"trace-plugin/internal/sink"
+)
+
+const pluginName = "krakend-trace-plugin"
+
+type sample struct {
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	Status       int               `json:"status"`
+	RespHeaders  map[string]string `json:"response_headers"`
+	ResponseBody string            `json:"response_body"`
+}
+
+type krakendConfig struct {
+	Endpoints []struct {
+		Endpoint string `json:"endpoint"`
+		Method   string `json:"method"`
+		Backend  []struct {
+			Host        []string               `json:"host"`
+			URLPattern  string                 `json:"url_pattern"`
+			ExtraConfig map[string]interface{} `json:"extra_config"`
+		} `json:"backend"`
+	} `json:"endpoints"`
+}
+
+type requests []string
+
+func (r *requests) String() string     { return strings.Join(*r, ", ") }
+func (r *requests) Set(v string) error { *r = append(*r, v); return nil }
+
+func main() {
+	file := flag.String("config", "krakend.json", "KrakenD configuration file")
+	samplesFile := flag.String("requests", "", "JSON file with sample requests")
+	var quick requests
+	flag.Var(&quick, "request", "sample request \"METHOD /path [status]\" (repeatable)")
+	profilesFile := flag.String("profiles", os.Getenv(config.ProfilesEnv), "capture profiles file")
+	flag.Parse()
+	os.Setenv(config.ProfilesEnv, *profilesFile)
+	capture.SetLogger(notes)
+
+	raw, err := os.ReadFile(*file)
+	if err != nil {
+		fail(err)
+	}
+	var kc krakendConfig
+	if err := json.Unmarshal(raw, &kc); err != nil {
+		fail(fmt.Errorf("%s: %w", *file, err))
+	}
+	samples, err := loadSamples(*samplesFile, quick)
+	if err != nil {
+		fail(err)
+	}
+
+	found, invalid := 0, 0
+	for _, e := range kc.Endpoints {
+		method := strings.ToUpper(e.Method)
+		if method == "" {
+			method = http.MethodGet
+		}
+		for _, b := range e.Backend {
+			pc, _ := b.ExtraConfig["plugin/http-client"].(map[string]interface{})
+			if name, _ := pc["name"].(string); name != pluginName {
+				continue
+			}
+			found++
+			host := ""
+			if len(b.Host) > 0 {
+				host = b.Host[0]
+			}
+			fmt.Printf("%s %s → %s%s\n", method, e.Endpoint, host, b.URLPattern)
+			if !lint(pc, e.Endpoint, method, host, b.URLPattern, samples) {
+				invalid++
+			}
+			fmt.Println()
+		}
+	}
+	fmt.Printf("%d backend(s) with %s, %d invalid\n", found, pluginName, invalid)
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "trace-lint:", err)
+	os.Exit(2)
+}
+
+// lint prints the findings for one backend and reports whether it is valid.
+func lint(pc map[string]interface{}, endpoint, method, host, pattern string, samples []sample) bool {
+	block, ok := pc[pluginName].(map[string]interface{})
+	if !ok {
+		fmt.Printf("  error  no %q block next to the plugin name\n", pluginName)
+		return false
+	}
+	block, err := config.Resolve(block)
+	if err != nil {
+		fmt.Printf("  error  %v\n", strings.TrimPrefix(err.Error(), capture.Tag+" "))
+		return false
+	}
+	for _, k := range config.Unknown(block) {
+		fmt.Printf("  warn   unknown key %q\n", k)
+	}
+	c, err := config.Validate(block)
+	if err != nil {
+		fmt.Printf("  error  %v\n", strings.TrimPrefix(err.Error(), capture.Tag+" "))
+		return false
+	}
+	switch ep, _ := block["endpoint"].(string); {
+	case ep == "":
+		fmt.Println("  info   no endpoint set: events carry the substituted path only")
+	case ep != endpoint:
+		fmt.Printf("  warn   endpoint %q differs from the KrakenD endpoint %q\n", ep, endpoint)
+	}
+	for _, k := range []string{"sink_tls", "upstream_tls"} {
+		if v, _ := block[k].(map[string]interface{}); v["insecure_skip_verify"] == true {
+			fmt.Printf("  warn   %s: insecure_skip_verify is set, certificates are not verified\n", k)
+		}
+	}
+	fmt.Printf("  ok     %s\n", describe(c, block))
+
+	re := endpointRegexp(endpoint)
+	for _, s := range samples {
+		u, err := url.Parse(s.Path)
+		if err != nil || s.Method != method {
+			continue
+		}
+		m := re.FindStringSubmatch(u.Path)
+		if m == nil {
+			continue
+		}
+		simulate(c, s, backendURL(host, pattern, re.SubexpNames(), m, u.RawQuery))
+	}
+	return true
+}
+
+func describe(c *capture.Config, block map[string]interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sink %s", sink.Kind(c.URL, block))
+	if c.URL.Scheme != "local" {
+		fmt.Fprintf(&b, " → %s", c.URL.Redacted())
+	}
+	fmt.Fprintf(&b, ", payload %s, timeout %v, max_capture %d KB", c.Format.Name, c.Timeout, c.MaxCapture/1024)
+	if c.CaptureTail > 0 {
+		fmt.Fprintf(&b, " + %d KB tail", c.CaptureTail/1024)
+	}
+	var features []string
+	add := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	add(c.GraphQL != nil, "graphql")
+	add(c.XML != nil, "xml")
+	add(c.Protobuf != nil, "protobuf")
+	add(c.NormalizeJSON != 0, "normalize_json")
+	add(len(c.Extract) > 0, fmt.Sprintf("extract_fields(%d)", len(c.Extract)))
+	add(c.CaptureIf != nil, "capture_if")
+	add(len(c.Transform) > 0, fmt.Sprintf("transform(%d)", len(c.Transform)))
+	add(c.Starlark != nil, "starlark")
+	add(c.WASM != nil, "wasm")
+	add(c.Shadow != nil, "shadow")
+	add(c.RecentEvents > 0, fmt.Sprintf("recent_events(%d) on :%d", c.RecentEvents, c.AdminPort))
+	add(c.AdminPort > 0 && c.RecentEvents == 0, fmt.Sprintf("admin server on :%d", c.AdminPort))
+	add(!c.Base64Bodies, "raw binary bodies")
+	add(!c.Charsets, "charsets kept")
+	add(!c.Decompress, "compressed bodies kept")
+	if c.Tenant != nil {
+		routes, _ := block["tenant"].(map[string]interface{})["routes"].(map[string]interface{})
+		features = append(features, fmt.Sprintf("tenant routing (%d routes)", len(routes)))
+	}
+	add(c.TenantLimits != nil, "tenant limits")
+	if urls, ok := block["tracking_urls"].([]interface{}); ok {
+		features = append(features, fmt.Sprintf("balanced over %d tracking_urls", len(urls)))
+	}
+	add(c.SelfTest != 0, "self_test")
+	add(c.DryRun, "dry_run (nothing is sent)")
+	add(c.Queue != nil, "delivery queue")
+	add(c.Overflow != nil, "overflow policy "+c.Overflow.Policy())
+	add(c.Stats != nil, "pipeline_stats events")
+	add(c.SplitPhases, "split_phases")
+	add(c.Consent != nil, "consent gating")
+	add(len(c.Classification) > 0, "classification "+strings.Join(c.Classification, ","))
+	add(c.RetentionDays > 0, fmt.Sprintf("retention %d days", c.RetentionDays))
+	add(c.Tokenize != nil, "tokenize")
+	add(c.AnonymizeIP != nil, "anonymize_ip")
+	add(c.Cookies != nil, "cookies")
+	add(c.TLSMeta != nil, "tls_meta")
+	add(c.Headers != nil, "capture_headers")
+	add(c.Audit != nil, "audit chain")
+	add(block["sink_tls"] != nil, "sink_tls")
+	add(c.Upstream != nil, "upstream_tls")
+	add(block["vault"] != nil, "vault secrets")
+	add(c.SyncDelivery, "sync delivery")
+	add(c.Dedupe != nil, "dedupe")
+	add(c.Health != nil, "sink health_check")
+	add(c.Sampling != nil, "sampling")
+	add(c.Flag != nil, "feature_flag gate")
+	add(c.DrainTimeout > 0, "drain on teardown ("+c.DrainTimeout.String()+")")
+	add(c.MaxPending > 0, fmt.Sprintf("pending memory budget %d MB", c.MaxPending>>20))
+	if h, ok := block["http"].(map[string]interface{}); ok {
+		add(h["ack"] != nil, "acknowledged delivery")
+		add(h["batch"] != nil && h["batch"] != false, "CloudEvents batched mode")
+	}
+	if rules, ok := block["sink_rules"].([]interface{}); ok {
+		features = append(features, fmt.Sprintf("sink_rules(%d)", len(rules)))
+	}
+	add(block["fault_injection"] != nil, "fault_injection (testing only, needs "+sink.FaultEnv+"=1)")
+	if len(features) > 0 {
+		fmt.Fprintf(&b, "\n         %s", strings.Join(features, ", "))
+	}
+	return b.String()
+}
+
+// simulate runs one sample through the capture pipeline and prints the event.
+func simulate(c *capture.Config, s sample, target string) {
+	req, err := http.NewRequest(s.Method, target, strings.NewReader(s.Body))
+	if err != nil {
+		fmt.Printf("  sample %s %s: %v\n", s.Method, s.Path, err)
+		return
+	}
+	req.RemoteAddr = "203.0.113.10:40000"
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	body := []byte(s.Body)
+	ev := capture.NewEvent(c, req, body[:min(len(body), c.MaxCapture)])
+	ev.Status = s.Status
+	ev.RespHeader = http.Header{}
+	for k, v := range s.RespHeaders {
+		ev.RespHeader.Set(k, v)
+	}
+	resp := []byte(s.ResponseBody)
+	ev.RespBody = resp[:min(len(resp), c.MaxCapture)]
+	ev.Meta.Set("status", strconv.Itoa(s.Status))
+
+	sim := *c
+	sim.Verbose = true // pipeline notes (failing capture_if, script errors) go to notes
+	notes.lines = notes.lines[:0]
+	note := ""
+	if sim.Format.Name == "avro" { // encoding looks up the schema id in the registry
+		sim.Format, note = capture.PayloadFormats["v1"], " (avro not encoded offline, v1 size)"
+	}
+	payload, kept := capture.Simulate(&sim, ev)
+	fmt.Printf("  sample %s %s (%d): ", s.Method, s.Path, s.Status)
+	if kept {
+		fmt.Printf("captured, %d B payload%s\n", len(payload), note)
+	} else {
+		fmt.Println("dropped (capture_if, transform, starlark or wasm)")
+	}
+	for _, l := range notes.lines {
+		fmt.Printf("         note: %s\n", l)
+	}
+	if !kept {
+		return
+	}
+	keys := make([]string, 0, len(ev.Meta))
+	for k := range ev.Meta {
+		if k != "instance_id" && k != "seq" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("         %s=%s\n", k, ev.Meta.Get(k))
+	}
+	if len(ev.ReqBody) > 0 {
+		fmt.Printf("         request body:  %s\n", excerpt(ev.ReqBody))
+	}
+	if len(ev.RespBody) > 0 {
+		fmt.Printf("         response body: %s\n", excerpt(ev.RespBody))
+	}
+}
+
+// noteLogger collects the pipeline's debug lines for the current sample.
+type noteLogger struct{ lines []string }
+
+var notes = &noteLogger{}
+
+func (l *noteLogger) Debug(v ...interface{}) {
+	if len(v) > 0 && v[0] == capture.Tag {
+		v = v[1:]
+	}
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+func (l *noteLogger) Info(...interface{})     {}
+func (l *noteLogger) Warning(...interface{})  {}
+func (l *noteLogger) Error(...interface{})    {}
+func (l *noteLogger) Critical(...interface{}) {}
+func (l *noteLogger) Fatal(...interface{})    {}
+
+func excerpt(b []byte) string {
+	b = bytes.ReplaceAll(b, []byte("\n"), []byte(`\n`))
+	if len(b) > 200 {
+		return string(b[:200]) + "…"
+	}
+	return string(b)
+}
+
+/* ───────── endpoints & samples ───────── */
+
+var paramRe = regexp.MustCompile(`\{([^}/]+)\}`)
+
+// endpointRegexp matches gateway paths of a KrakenD endpoint pattern;
+// {param} segments become named groups and a trailing * matches the rest.
+func endpointRegexp(endpoint string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	rest := endpoint
+	for {
+		loc := paramRe.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			break
+		}
+		b.WriteString(regexp.QuoteMeta(rest[:loc[0]]))
+		fmt.Fprintf(&b, "(?P<%s>[^/]+)", regexp.QuoteMeta(rest[loc[2]:loc[3]]))
+		rest = rest[loc[1]:]
+	}
+	if strings.HasSuffix(rest, "*") {
+		b.WriteString(regexp.QuoteMeta(strings.TrimSuffix(rest, "*")) + ".*")
+	} else {
+		b.WriteString(regexp.QuoteMeta(rest))
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil { // parameter names that are not valid group names
+		return regexp.MustCompile("^" + paramRe.ReplaceAllString(regexp.QuoteMeta(endpoint), "[^/]+") + "$")
+	}
+	return re
+}
+
+// backendURL substitutes the matched parameters into the backend url_pattern.
+func backendURL(host, pattern string, names, match []string, query string) string {
+	u := pattern
+	for i, n := range names {
+		if n != "" {
+			u = strings.ReplaceAll(u, "{"+n+"}", match[i])
+		}
+	}
+	if host == "" {
+		host = "http://backend"
+	}
+	u = strings.TrimSuffix(host, "/") + u
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+func loadSamples(file string, quick []string) ([]sample, error) {
+	var out []sample
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &out); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for _, q := range quick {
+		f := strings.Fields(q)
+		if len(f) < 2 {
+			return nil, fmt.Errorf("-request %q: want \"METHOD /path [status]\"", q)
+		}
+		s := sample{Method: f[0], Path: f[1]}
+		if len(f) > 2 {
+			s.Status, _ = strconv.Atoi(f[2])
+		}
+		out = append(out, s)
+	}
+	for i := range out {
+		out[i].Method = strings.ToUpper(out[i].Method)
+		if out[i].Method == "" {
+			out[i].Method = http.MethodGet
+		}
+		if out[i].Status == 0 {
+			out[i].Status = http.StatusOK
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,95 @@
+// trace-query reads the database written by the plugin's "sqlite" sink and
+// prints the matching events, oldest first, one JSON document per line.
+//
+//	trace-query -db /var/lib/krakend/traces.db -since 2h -where status=500 -where endpoint=/users/{id}
+//
+// The store is in WAL mode, so it can be queried while the gateway writes.
+//
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type filters []string
+
+func (f *filters) String() string     { return strings.Join(*f, ",") }
+func (f *filters) Set(v string) error { *f = append(*f, v); return nil }
+
+func main() {
+	db := flag.String("db", "traces.db", "database of the sqlite sink")
+	since := flag.Duration("since", 0, "only events newer than this (e.g. 30m, 6h)")
+	limit := flag.Int("limit", 0, "stop after this many events (0 = all)")
+	var where filters
+	flag.Var(&where, "where", "meta field filter key=value (repeatable)")
+	flag.Parse()
+
+	if _, err := os.Stat(*db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conn, err := sql.Open("sqlite", "file:"+*db+"?mode=ro&"+url.Values{"_pragma": {"busy_timeout(5000)"}}.Encode())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	query, args := buildQuery(*since, where, *limit)
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *db, err)
+		os.Exit(1)
+	}
+	defer rows.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for rows.Next() {
+		var doc string
+		if rows.Scan(&doc) == nil {
+			out.WriteString(doc)
+			out.WriteByte('\n')
+		}
+	}
+	if err := rows.Err(); err != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *db, err)
+		os.Exit(1)
+	}
+}
+
+// buildQuery turns the flags into SQL over the traces table. Meta fields
+// are read from the document, so any of them can be filtered on.
+func buildQuery(since time.Duration, where filters, limit int) (string, []interface{}) {
+	var cond []string
+	var args []interface{}
+	if since > 0 {
+		cond = append(cond, "at >= ?")
+		args = append(args, time.Now().Add(-since).UnixMilli())
+	}
+	for _, w := range where {
+		k, v, _ := strings.Cut(w, "=")
+		cond = append(cond, "json_extract(doc, ?) = ?")
+		args = append(args, "$.meta."+strconv.Quote(k), v)
+	}
+	q := "SELECT doc FROM traces"
+	if len(cond) > 0 {
+		q += " WHERE " + strings.Join(cond, " AND ")
+	}
+	q += " ORDER BY id"
+	if limit > 0 {
+		q += " LIMIT " + strconv.Itoa(limit)
+	}
+	return q, args
+}
@@ -0,0 +1,381 @@
+// trace-replay reads captured events and sends the original requests again
+// to another base URL, turning captures into a load / regression corpus.
+//
+//	trace-replay -target http://staging:8080 -concurrency 8 -speed 2 /var/lib/krakend/traces
+//
+// Inputs are files or directories: databases of the "sqlite" sink (*.db),
+// HAR files (*.har, such as the "file" sink's) and the -out file of
+// trace-collector-mock. Requests keep their method, path, query and body;
+// HAR captures also keep their headers (except redacted ones). -speed 1
+// replays with the recorded spacing, 0 (default) as fast as the workers go.
+//
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type request struct {
+	at     time.Time
+	method string
+	url    *url.URL
+	header http.Header
+	body   []byte
+	status int // recorded, 0 when unknown
+}
+
+type headers []string
+
+func (h *headers) String() string     { return strings.Join(*h, ", ") }
+func (h *headers) Set(v string) error { *h = append(*h, v); return nil }
+
+func main() {
+	target := flag.String("target", "", "base URL the requests are sent to (mandatory)")
+	concurrency := flag.Int("concurrency", 4, "parallel requests")
+	speed := flag.Float64("speed", 0, "replay speed relative to the capture (1 = recorded spacing, 0 = no delay)")
+	limit := flag.Int("limit", 0, "stop after this many requests (0 = all)")
+	timeout := flag.Duration("timeout", 10*time.Second, "per request timeout")
+	diff := flag.Bool("diff", false, "print requests whose status differs from the recorded one")
+	var extra headers
+	flag.Var(&extra, "header", "header added to every request, \"Name: value\" (repeatable)")
+	flag.Parse()
+
+	base, err := url.Parse(*target)
+	if *target == "" || err != nil || base.Host == "" {
+		fmt.Fprintln(os.Stderr, "trace-replay: -target must be an absolute URL")
+		os.Exit(2)
+	}
+	var reqs []request
+	for _, arg := range flag.Args() {
+		r, err := load(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		reqs = append(reqs, r...)
+	}
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].at.Before(reqs[j].at) })
+	if *limit > 0 && len(reqs) > *limit {
+		reqs = reqs[:*limit]
+	}
+	if len(reqs) == 0 {
+		fmt.Fprintln(os.Stderr, "trace-replay: no requests found")
+		os.Exit(1)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	work := make(chan request)
+	var mu sync.Mutex
+	var st stats
+	var wg sync.WaitGroup
+	for i := 0; i < max(*concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				status, d, err := send(client, base, r, extra)
+				mu.Lock()
+				st.add(status, d, err)
+				switch {
+				case !*diff:
+				case err != nil:
+					fmt.Printf("%s %s: %v\n", r.method, r.url.RequestURI(), err)
+				case r.status != 0 && status != r.status:
+					fmt.Printf("%s %s: recorded %d, got %d\n", r.method, r.url.RequestURI(), r.status, status)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// the scheduler keeps the recorded spacing, scaled by -speed
+	start := time.Now()
+	for _, r := range reqs {
+		if *speed > 0 {
+			due := time.Duration(float64(r.at.Sub(reqs[0].at)) / *speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		work <- r
+	}
+	close(work)
+	wg.Wait()
+	st.print(time.Since(start))
+}
+
+func send(client *http.Client, base *url.URL, r request, extra headers) (int, time.Duration, error) {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + r.url.Path
+	u.RawQuery = r.url.RawQuery
+	req, err := http.NewRequest(r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	for k, vs := range r.header {
+		req.Header[k] = vs
+	}
+	for _, h := range extra {
+		if k, v, ok := strings.Cut(h, ":"); ok {
+			req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, time.Since(t0), err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(t0), nil
+}
+
+/* ───────── summary ───────── */
+
+type stats struct {
+	durations []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+func (s *stats) add(status int, d time.Duration, err error) {
+	if err != nil {
+		s.errors++
+		return
+	}
+	if s.statuses == nil {
+		s.statuses = map[int]int{}
+	}
+	s.statuses[status]++
+	s.durations = append(s.durations, d)
+}
+
+func (s *stats) print(total time.Duration) {
+	n := len(s.durations)
+	fmt.Printf("%d requests in %v, %d errors\n", n+s.errors, total.Round(time.Millisecond), s.errors)
+	codes := make([]int, 0, len(s.statuses))
+	for c := range s.statuses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		fmt.Printf("  %d: %d\n", c, s.statuses[c])
+	}
+	if n == 0 {
+		return
+	}
+	sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+	p := func(q float64) time.Duration { return s.durations[int(q*float64(n-1))].Round(time.Microsecond) }
+	fmt.Printf("  latency p50 %v  p90 %v  p99 %v  max %v\n", p(.5), p(.9), p(.99), s.durations[n-1].Round(time.Microsecond))
+}
+
+/* ───────── inputs ───────── */
+
+func load(path string) ([]request, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return loadFile(path)
+	}
+	var out []request
+	for _, pattern := range []string{"*.db", "*.har"} {
+		names, _ := filepath.Glob(filepath.Join(path, pattern))
+		sort.Strings(names)
+		for _, name := range names {
+			r, err := loadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r...)
+		}
+	}
+	return out, nil
+}
+
+func loadFile(name string) ([]request, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, 16)
+	if n, _ := io.ReadFull(f, magic); string(magic[:n]) == "SQLite format 3\x00" {
+		return loadDB(name)
+	}
+	f.Seek(0, io.SeekStart)
+	if strings.HasSuffix(name, ".har") {
+		var h struct {
+			Log struct {
+				Entries []harEntry `json:"entries"`
+			} `json:"log"`
+		}
+		if err := json.NewDecoder(f).Decode(&h); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var out []request
+		for _, e := range h.Log.Entries {
+			if r, ok := e.request(); ok {
+				out = append(out, r)
+			}
+		}
+		return out, nil
+	}
+
+	var out []request
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 1<<20), 64<<20)
+	for sc.Scan() {
+		if r, ok := parseLine(sc.Bytes()); ok {
+			out = append(out, r)
+		}
+	}
+	return out, sc.Err()
+}
+
+// loadDB reads the event documents of a sqlite sink database.
+func loadDB(name string) ([]request, error) {
+	db, err := sql.Open("sqlite", "file:"+name+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT doc FROM traces ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer rows.Close()
+	var out []request
+	for rows.Next() {
+		var doc []byte
+		if rows.Scan(&doc) != nil {
+			continue
+		}
+		if r, ok := parseLine(doc); ok {
+			out = append(out, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
+
+// parseLine reads a sqlite sink document, a HAR entry or a mock collector event.
+func parseLine(line []byte) (request, bool) {
+	var doc struct {
+		Timestamp time.Time `json:"@timestamp"`
+		Request   *struct {
+			Method string `json:"method"`
+			URL    string `json:"url"`
+			Body   string `json:"body"`
+		} `json:"request"`
+		Response struct {
+			Status int `json:"status"`
+		} `json:"response"`
+		Meta map[string]string `json:"meta"`
+
+		Received time.Time         `json:"received"` // trace-collector-mock
+		Fields   map[string]string `json:"fields"`
+
+		StartedDateTime string `json:"startedDateTime"` // HAR entry
+	}
+	if json.Unmarshal(line, &doc) != nil {
+		return request{}, false
+	}
+	if doc.StartedDateTime != "" {
+		var e harEntry
+		if json.Unmarshal(line, &e) != nil {
+			return request{}, false
+		}
+		return e.request()
+	}
+	r := request{at: doc.Timestamp}
+	raw, body := "", ""
+	switch {
+	case doc.Request != nil:
+		r.method, raw, body = doc.Request.Method, doc.Request.URL, doc.Request.Body
+		r.status = doc.Response.Status
+	case doc.Fields != nil:
+		r.method, raw, body = doc.Fields["method"], doc.Fields["requestUrl"], doc.Fields["requestBody"]
+		r.at = doc.Received
+		r.status, _ = strconv.Atoi(doc.Meta["status"])
+	default:
+		return request{}, false
+	}
+	if r.method == "" { // v1 payloads do not record it
+		r.method = http.MethodGet
+		if body != "" {
+			r.method = http.MethodPost
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || raw == "" {
+		return request{}, false
+	}
+	r.url = u
+	r.body = []byte(body)
+	if doc.Meta["request_body_encoding"] == "base64" {
+		if b, err := base64.StdEncoding.DecodeString(body); err == nil {
+			r.body = b
+		}
+	}
+	return r, true
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		Method   string `json:"method"`
+		URL      string `json:"url"`
+		Headers  []struct{ Name, Value string }
+		PostData *struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+// skipHeaders are not replayed: redacted by the capture, or set by the client.
+var skipHeaders = map[string]bool{"Content-Length": true, "Connection": true, "Host": true, "Accept-Encoding": true}
+
+func (e *harEntry) request() (request, bool) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil || e.Request.URL == "" {
+		return request{}, false
+	}
+	r := request{at: e.StartedDateTime, method: e.Request.Method, url: u, header: http.Header{}, status: e.Response.Status}
+	for _, h := range e.Request.Headers {
+		k := http.CanonicalHeaderKey(h.Name)
+		if h.Value == "[redacted]" || skipHeaders[k] {
+			continue
+		}
+		r.header.Add(k, h.Value)
+	}
+	if e.Request.PostData != nil {
+		r.body = []byte(e.Request.PostData.Text)
+	}
+	return r, true
+}
@@ -0,0 +1,393 @@
+// trace-viewer is a small drop-in tracking endpoint with a search UI: point
+// tracking_url at it and browse the captures.
+//
+//	trace-viewer -addr :8090 -db /var/lib/trace-viewer/events.db -max 50000
+//	# "tracking_url": "http://trace-viewer:8090/ingest"
+//
+// It accepts POSTs of the v1, ecs and har payload formats (other payloads are
+// kept verbatim) on any path, serves the UI on / and a JSON API:
+//
+//	GET /api/events?q=timeout&status=5xx&method=POST&endpoint=/orders/{id}&request_id=…&since=1h&limit=100
+//	GET /api/events/{id}
+//
+// Lists are newest first and leave out the bodies. Events are kept in an
+// embedded SQLite database (-db, ":memory:" for none), the newest -max of
+// them. It is meant for development and small installations, not as a
+// production collector.
+//
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"trace-plugin/internal/mockcollector"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+func main() {
+	addr := flag.String("addr", ":8090", "listen address")
+	db := flag.String("db", "trace-viewer.db", `SQLite database the events are kept in (":memory:" = none)`)
+	keep := flag.Int("max", 50000, "events kept, oldest dropped first")
+	flag.Parse()
+
+	s, err := openStore(*db, max(*keep, 1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("trace-viewer: %d events in %s", s.count(), *db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", s.ingest)
+	mux.HandleFunc("GET /api/events", s.list)
+	mux.HandleFunc("GET /api/events/{id}", s.get)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	log.Printf("trace-viewer: listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+/* ───────── events ───────── */
+
+type record struct {
+	ID         uint64            `json:"id"`
+	Received   time.Time         `json:"received"`
+	At         time.Time         `json:"at"` // the capture time, when the format has it
+	Format     string            `json:"format"`
+	Method     string            `json:"method,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	DurationMS float64           `json:"duration_ms,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	ReqBody    string            `json:"request_body,omitempty"`
+	RespBody   string            `json:"response_body,omitempty"`
+	Raw        string            `json:"raw,omitempty"` // payloads in no known format
+}
+
+// decode reads one payload; HAR logs may hold several entries.
+func decode(e mockcollector.Event) []record {
+	base := record{Received: e.Received, At: e.Received}
+	if e.Fields != nil {
+		r := base
+		r.Format, r.Meta = "v1", e.Meta
+		if e.Fields["schema_version"] == "2" {
+			r.Format = "v2"
+		}
+		r.Method, r.URL = e.Fields["method"], e.Fields["requestUrl"] // v1 has no method
+		r.ReqBody, r.RespBody = e.Fields["requestBody"], e.Fields["responseBody"]
+		r.Status, _ = strconv.Atoi(e.Meta["status"])
+		return []record{r}
+	}
+	if e.Doc == nil {
+		r := base
+		r.Format, r.Raw = "raw", e.Body
+		return []record{r}
+	}
+
+	var doc struct {
+		Timestamp time.Time `json:"@timestamp"`
+		ECS       *struct{} `json:"ecs"`
+		Event     struct {
+			Duration int64 `json:"duration"`
+		} `json:"event"`
+		HTTP struct {
+			Request struct {
+				Method string `json:"method"`
+				Body   struct {
+					Content string `json:"content"`
+				} `json:"body"`
+			} `json:"request"`
+			Response struct {
+				StatusCode int `json:"status_code"`
+				Body       struct {
+					Content string `json:"content"`
+				} `json:"body"`
+			} `json:"response"`
+		} `json:"http"`
+		URL struct {
+			Full string `json:"full"`
+		} `json:"url"`
+		Client struct {
+			IP string `json:"ip"`
+		} `json:"client"`
+		Labels  map[string]string `json:"labels"`
+		KrakenD map[string]string `json:"krakend"`
+
+		Log *struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if json.Unmarshal(e.Doc, &doc) != nil {
+		r := base
+		r.Format, r.Raw = "raw", e.Body
+		return []record{r}
+	}
+	switch {
+	case doc.Log != nil:
+		out := make([]record, 0, len(doc.Log.Entries))
+		for _, h := range doc.Log.Entries {
+			r := base
+			r.Format, r.At, r.DurationMS = "har", h.StartedDateTime, h.Time
+			r.Method, r.URL, r.Status = h.Request.Method, h.Request.URL, h.Response.Status
+			if h.Request.PostData != nil {
+				r.ReqBody = h.Request.PostData.Text
+			}
+			r.RespBody = h.Response.Content.Text
+			out = append(out, r)
+		}
+		return out
+	case doc.ECS != nil:
+		r := base
+		r.Format, r.At, r.DurationMS = "ecs", doc.Timestamp, float64(doc.Event.Duration)/1e6
+		r.Method, r.URL, r.Status = doc.HTTP.Request.Method, doc.URL.Full, doc.HTTP.Response.StatusCode
+		r.ReqBody, r.RespBody = doc.HTTP.Request.Body.Content, doc.HTTP.Response.Body.Content
+		r.Meta = map[string]string{}
+		for k, v := range doc.KrakenD {
+			r.Meta[k] = v
+		}
+		for k, v := range doc.Labels {
+			r.Meta["label."+k] = v
+		}
+		if doc.Client.IP != "" {
+			r.Meta["client_ip"] = doc.Client.IP
+		}
+		return []record{r}
+	}
+	r := base
+	r.Format, r.Raw = "json", e.Body
+	return []record{r}
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         struct {
+		Method   string `json:"method"`
+		URL      string `json:"url"`
+		PostData *struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status  int `json:"status"`
+		Content struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+/* ───────── store ───────── */
+
+// store keeps the records in SQLite; meta is a JSON object column.
+type store struct {
+	db  *sql.DB
+	max int
+
+	mu   sync.Mutex // serializes pruning
+	adds int
+}
+
+const schema = `CREATE TABLE IF NOT EXISTS events (
+	id            INTEGER PRIMARY KEY,
+	received      INTEGER NOT NULL, -- unix milliseconds
+	at            INTEGER NOT NULL,
+	format        TEXT NOT NULL,
+	method        TEXT NOT NULL,
+	url           TEXT NOT NULL,
+	status        INTEGER NOT NULL,
+	duration_ms   REAL NOT NULL,
+	endpoint      TEXT NOT NULL,
+	request_id    TEXT NOT NULL,
+	meta          TEXT NOT NULL,
+	request_body  TEXT NOT NULL,
+	response_body TEXT NOT NULL,
+	raw           TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_received ON events (received);`
+
+func openStore(path string, keep int) (*store, error) {
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"journal_mode(wal)", "synchronous(normal)", "busy_timeout(5000)"}}.Encode()
+	if path == ":memory:" {
+		dsn = ":memory:"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer, and one database for :memory:
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &store{db: db, max: keep}, nil
+}
+
+func (s *store) count() int {
+	var n int
+	s.db.QueryRow(`SELECT count(*) FROM events`).Scan(&n)
+	return n
+}
+
+func (s *store) add(rs []record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range rs {
+		meta, _ := json.Marshal(r.Meta)
+		if _, err := tx.Exec(`INSERT INTO events (received, at, format, method, url, status, duration_ms,
+			endpoint, request_id, meta, request_body, response_body, raw) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			r.Received.UnixMilli(), r.At.UnixMilli(), r.Format, r.Method, r.URL, r.Status, r.DurationMS,
+			r.Meta["endpoint"], r.Meta["request_id"], string(meta), r.ReqBody, r.RespBody, r.Raw); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// trimmed in batches, not on every add
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.adds += len(rs); s.adds >= max(s.max/4, 1) {
+		s.adds = 0
+		_, err = s.db.Exec(`DELETE FROM events WHERE id <= (SELECT max(id) FROM events) - ?`, s.max)
+	}
+	return err
+}
+
+const columns = `id, received, at, format, method, url, status, duration_ms, meta, request_body, response_body, raw`
+
+func scan(rows interface{ Scan(...interface{}) error }) (record, error) {
+	var r record
+	var received, at int64
+	var meta string
+	err := rows.Scan(&r.ID, &received, &at, &r.Format, &r.Method, &r.URL, &r.Status, &r.DurationMS,
+		&meta, &r.ReqBody, &r.RespBody, &r.Raw)
+	r.Received, r.At = time.UnixMilli(received).UTC(), time.UnixMilli(at).UTC()
+	json.Unmarshal([]byte(meta), &r.Meta)
+	return r, err
+}
+
+/* ───────── HTTP ───────── */
+
+func (s *store) ingest(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.add(decode(mockcollector.Decode(r.URL.Path, r.Header.Get("Content-Type"), body))); err != nil {
+		log.Printf("trace-viewer: storing an event: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *store) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	query, args := filter(q)
+	rows, err := s.db.Query(`SELECT `+columns+` FROM events`+query+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	out := []record{}
+	for rows.Next() {
+		e, err := scan(rows)
+		if err != nil {
+			continue
+		}
+		e.ReqBody, e.RespBody, e.Raw = "", "", ""
+		out = append(out, e)
+	}
+	writeJSON(w, out)
+}
+
+// filter turns the list parameters into a WHERE clause. status accepts an
+// exact status ("404") or a class ("5xx"); q searches the URL, bodies and
+// field values, case-insensitively.
+func filter(q url.Values) (string, []interface{}) {
+	var cond []string
+	var args []interface{}
+	if d, err := time.ParseDuration(q.Get("since")); err == nil && d > 0 {
+		cond = append(cond, "received >= ?")
+		args = append(args, time.Now().Add(-d).UnixMilli())
+	}
+	switch st := strings.ToLower(q.Get("status")); {
+	case st == "":
+	case len(st) == 3 && strings.HasSuffix(st, "xx"):
+		class, _ := strconv.Atoi(st[:1])
+		cond = append(cond, "status / 100 = ?")
+		args = append(args, class)
+	default:
+		status, _ := strconv.Atoi(st)
+		cond = append(cond, "status = ?")
+		args = append(args, status)
+	}
+	for _, col := range []string{"method", "endpoint", "request_id"} {
+		if v := q.Get(col); v != "" {
+			cond = append(cond, col+" = ? COLLATE NOCASE")
+			args = append(args, v)
+		}
+	}
+	if text := q.Get("q"); text != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+		var any []string
+		for _, col := range []string{"url", "request_body", "response_body", "raw"} {
+			any = append(any, col+` LIKE ? ESCAPE '\'`)
+			args = append(args, like)
+		}
+		any = append(any, `EXISTS (SELECT 1 FROM json_each(meta) WHERE value LIKE ? ESCAPE '\')`)
+		args = append(args, like)
+		cond = append(cond, "("+strings.Join(any, " OR ")+")")
+	}
+	if len(cond) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(cond, " AND "), args
+}
+
+func (s *store) get(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	e, err := scan(s.db.QueryRow(`SELECT `+columns+` FROM events WHERE id = ?`, id))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, e)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,4285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"trace-plugin/internal/capture"
+	"trace-plugin/internal/mockcollector"
+)
+
+/* ───────── harness ───────── */
+
+// The integration tests run the handler returned by registerClients between
+// an httptest backend and the mock collector, the way KrakenD wires it.
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(v ...interface{})    {}
+func (nopLogger) Info(v ...interface{})     {}
+func (nopLogger) Warning(v ...interface{})  {}
+func (nopLogger) Error(v ...interface{})    {}
+func (nopLogger) Critical(v ...interface{}) {}
+func (nopLogger) Fatal(v ...interface{})    {}
+
+type harness struct {
+	t         *testing.T
+	backend   *httptest.Server
+	collector *mockcollector.Collector
+	tracking  *httptest.Server
+	handler   http.Handler
+}
+
+// newHarness starts a backend serving h and a collector, and registers the
+// plugin with block; tracking_url defaults to the collector.
+func newHarness(t *testing.T, h http.HandlerFunc, block map[string]interface{}) *harness {
+	t.Helper()
+	capture.SetLogger(nopLogger{})
+	hs := &harness{t: t, backend: httptest.NewServer(h), collector: mockcollector.New()}
+	hs.tracking = httptest.NewServer(hs.collector)
+	t.Cleanup(hs.backend.Close)
+	t.Cleanup(hs.tracking.Close)
+	if _, ok := block["tracking_url"]; !ok {
+		block["tracking_url"] = hs.tracking.URL + "/track"
+	}
+	var err error
+	hs.handler, err = ClientRegisterer.registerClients(context.Background(),
+		map[string]interface{}{string(ClientRegisterer): block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs
+}
+
+// do sends a request through the plugin to the backend.
+func (hs *harness) do(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	hs.t.Helper()
+	req, err := http.NewRequest(method, hs.backend.URL+path, strings.NewReader(body))
+	if err != nil {
+		hs.t.Fatal(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	hs.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// events waits for n events and fails the test when fewer arrive.
+func (hs *harness) events(n int) []mockcollector.Event {
+	hs.t.Helper()
+	evs := hs.collector.Wait(n, 2*time.Second)
+	if len(evs) < n {
+		hs.t.Fatalf("collector got %d events, want %d", len(evs), n)
+	}
+	return evs
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Backend", "echo")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"method": r.Method, "path": r.URL.Path, "body": string(b)})
+}
+
+/* ───────── capture ───────── */
+
+func TestV1EndToEnd(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"labels":      map[string]interface{}{"env": "test"},
+		"endpoint":    "/orders/{id}",
+		"tag_headers": map[string]interface{}{"X-Channel": "channel"},
+	})
+	rec := hs.do("POST", "/orders/7?expand=items", `{"qty":2}`, http.Header{"X-Channel": {"mobile"}})
+
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Backend") != "echo" {
+		t.Fatalf("client got %d %v", rec.Code, rec.Header())
+	}
+	ev := hs.events(1)[0]
+	if ev.Path != "/track" || ev.ContentType != "text/plain" {
+		t.Errorf("posted to %s as %s", ev.Path, ev.ContentType)
+	}
+	if got := ev.Fields["responseBody"]; got != rec.Body.String() {
+		t.Errorf("responseBody = %q, client got %q", got, rec.Body.String())
+	}
+	if got := ev.Fields["requestBody"]; got != `{"qty":2}` {
+		t.Errorf("requestBody = %q", got)
+	}
+	if got := ev.Fields["requestQuery"]; got != "expand=items" {
+		t.Errorf("requestQuery = %q", got)
+	}
+	if got := ev.Fields["requestUrl"]; got != hs.backend.URL+"/orders/7?expand=items" {
+		t.Errorf("requestUrl = %q", got)
+	}
+	for k, want := range map[string]string{
+		"status": "201", "endpoint": "/orders/{id}", "label.env": "test", "channel": "mobile",
+		"backend": strings.TrimPrefix(hs.backend.URL, "http://"), "instance_id": capture.InstanceID(),
+	} {
+		if ev.Meta[k] != want {
+			t.Errorf("meta %s = %q, want %q", k, ev.Meta[k], want)
+		}
+	}
+	if ev.Meta["seq"] == "" {
+		t.Error("meta seq missing")
+	}
+}
+
+func TestTagHeadersRejectReservedFields(t *testing.T) {
+	capture.SetLogger(nopLogger{})
+	for _, name := range []string{"instance_id", "seq", "backend", "client_ip", "label.env",
+		"tenant", "error_class", "request_body_skipped", "sample_rate"} {
+		_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+			string(ClientRegisterer): map[string]interface{}{"tracking_url": "http://127.0.0.1:1/track",
+				"tag_headers": map[string]interface{}{"X-Spoof": name}}})
+		if err == nil || !strings.Contains(err.Error(), "built-in field") {
+			t.Errorf("tag_headers to %s: err = %v, want it rejected", name, err)
+		}
+	}
+}
+
+func TestV2KeepsDelimitersInBodies(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"payload_format": "v2"})
+	body := "{/requestBody},{$meta}status=500{/meta}\nmeta 3\nx=1\n"
+	rec := hs.do("PUT", "/raw?a=1", body, nil)
+	ev := hs.events(1)[0]
+	if ev.ContentType != "text/plain; version=2" || ev.Fields["schema_version"] != "2" {
+		t.Errorf("content type %q, schema_version %q", ev.ContentType, ev.Fields["schema_version"])
+	}
+	if ev.Fields["requestBody"] != body || ev.Fields["responseBody"] != rec.Body.String() || ev.Fields["method"] != "PUT" {
+		t.Errorf("sections = %q", ev.Fields)
+	}
+	if ev.Meta["status"] != "201" {
+		t.Errorf("meta status = %q, want 201", ev.Meta["status"])
+	}
+}
+
+func TestUpstreamErrorIsTracked(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{})
+	hs.backend.Close() // connection refused
+	rec := hs.do("POST", "/down", `{"id":1}`, nil)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("client got %d", rec.Code)
+	}
+	ev := hs.events(1)[0]
+	if ev.Meta["status"] != "502" || ev.Meta["error_class"] != "connection_refused" || ev.Meta["error"] == "" {
+		t.Errorf("meta = %v", ev.Meta)
+	}
+	if ev.Fields["requestBody"] != `{"id":1}` || ev.Fields["responseBody"] != rec.Body.String() {
+		t.Errorf("sections = %q, client got %q", ev.Fields, rec.Body.String())
+	}
+}
+
+func TestUpstreamTargetIsRecorded(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{})
+	hs.do("GET", "/one", "", nil)
+	hs.do("GET", "/two", "", nil)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(hs.backend.URL, "http://"))
+	evs := hs.events(2)
+	for i, reused := range []string{"false", "true"} {
+		m := evs[i].Meta
+		if m["upstream.ip"] != "127.0.0.1" || m["upstream.port"] != port || m["upstream.attempts"] != "1" || m["upstream.conn_reused"] != reused {
+			t.Errorf("event %d upstream fields = %q %q %q %q", i, m["upstream.ip"], m["upstream.port"], m["upstream.attempts"], m["upstream.conn_reused"])
+		}
+	}
+
+	hs.backend.Close()
+	hs.do("GET", "/down", "", nil)
+	if m := hs.events(3)[2].Meta; m["upstream.ip"] != "127.0.0.1" || m["upstream.port"] != port {
+		t.Errorf("failed call upstream fields = %q %q, want the dialed address", m["upstream.ip"], m["upstream.port"])
+	}
+}
+
+func TestEmptyResponsesAreMarked(t *testing.T) {
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}, map[string]interface{}{"max_capture_kb": 0.001})
+	hs.do("DELETE", "/gone", "", nil)
+	hs.do("HEAD", "/item", "", nil)
+	hs.do("GET", "/item", "", nil)
+	got := map[string]string{}
+	for _, ev := range hs.events(3) {
+		got[ev.Meta["status"]+" "+ev.Fields["requestUrl"][len(hs.backend.URL):]+" "+ev.Meta["response_size"]] += ev.Meta["response_body"]
+	}
+	for k, want := range map[string]string{"204 /gone 0": "none", "200 /item 0": "none", "200 /item 2": "clipped"} {
+		if got[k] != want {
+			t.Errorf("%s: response_body %q, want %q (all: %v)", k, got[k], want, got)
+		}
+	}
+}
+
+func TestMaxCaptureClipsOnlyTheTrace(t *testing.T) {
+	big := strings.Repeat("x", 3000)
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, big)
+	}, map[string]interface{}{"max_capture_kb": 1.0})
+	rec := hs.do("POST", "/", strings.Repeat("y", 2000), nil)
+
+	if rec.Body.String() != big {
+		t.Fatalf("client got %d bytes, want %d", rec.Body.Len(), len(big))
+	}
+	ev := hs.events(1)[0]
+	if n := len(ev.Fields["responseBody"]); n != 1024 {
+		t.Errorf("captured response %d bytes, want 1024", n)
+	}
+	if n := len(ev.Fields["requestBody"]); n != 1024 {
+		t.Errorf("captured request %d bytes, want 1024", n)
+	}
+}
+
+func TestHeadAndTailCapture(t *testing.T) {
+	tail := strings.Repeat("t", 491) + `{"error":"disk full"}` // 512 bytes
+	body := strings.Repeat("h", 1024) + strings.Repeat("m", 5000) + tail
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		for b := body; b != ""; b = b[min(len(b), 97):] { // odd chunks cross the head/tail borders
+			io.WriteString(w, b[:min(len(b), 97)])
+		}
+	}, map[string]interface{}{"max_capture_kb": 1.0, "capture_tail_kb": 0.5})
+	rec := hs.do("POST", "/", strings.Repeat("y", 1024)+strings.Repeat("z", 100)+strings.Repeat("e", 512), nil)
+
+	if rec.Body.String() != body {
+		t.Fatalf("client got %d bytes, want %d", rec.Body.Len(), len(body))
+	}
+	ev := hs.events(1)[0]
+	want := strings.Repeat("h", 1024) + "\n[… 5000 bytes skipped …]\n" + body[len(body)-512:]
+	if got := ev.Fields["responseBody"]; got != want || !strings.HasSuffix(got, `{"error":"disk full"}`) {
+		t.Errorf("responseBody = %d bytes ending %q", len(got), got[max(0, len(got)-40):])
+	}
+	if ev.Meta["response_body"] != "clipped" || ev.Meta["response_body_skipped"] != "5000" {
+		t.Errorf("response meta = %q, skipped %q", ev.Meta["response_body"], ev.Meta["response_body_skipped"])
+	}
+	if got := ev.Fields["requestBody"]; got != strings.Repeat("y", 1024)+"\n[… 100 bytes skipped …]\n"+strings.Repeat("e", 512) ||
+		ev.Meta["request_body_skipped"] != "100" {
+		t.Errorf("requestBody = %q…, skipped %q", got[:min(len(got), 40)], ev.Meta["request_body_skipped"])
+	}
+}
+
+func TestSlowCollectorDoesNotBlockClient(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"timeout_ms": 300.0})
+	hs.collector.Delay = time.Second
+	hs.collector.Status = http.StatusServiceUnavailable
+
+	start := time.Now()
+	rec := hs.do("GET", "/slow", "", nil)
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("request took %v with a slow collector", d)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Errorf("client got %d", rec.Code)
+	}
+}
+
+func TestSyncDeliveryWaitsForTheSink(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"delivery_mode": "sync", "timeout_ms": 2000.0})
+	hs.collector.Delay = 150 * time.Millisecond
+
+	start := time.Now()
+	hs.do("POST", "/audit", `{"op":"delete"}`, nil)
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("request returned after %v, before the sink answered", d)
+	}
+	if n := len(hs.collector.Events()); n != 1 {
+		t.Errorf("collector has %d events when the request returns, want 1", n)
+	}
+
+	hs = newHarness(t, echo, map[string]interface{}{"delivery_mode": "sync", "timeout_ms": 100.0})
+	hs.collector.Delay = 400 * time.Millisecond
+	start = time.Now()
+	hs.do("GET", "/audit", "", nil)
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("sync wait took %v, want it bounded by timeout_ms", d)
+	}
+}
+
+func TestSendOutlivesTheRequestContext(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{})
+	hs.collector.Delay = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", hs.backend.URL+"/canceled", nil).WithContext(ctx)
+	req.RequestURI = ""
+	hs.handler.ServeHTTP(httptest.NewRecorder(), req)
+	cancel() // KrakenD cancels the request context once the handler returns
+
+	if ev := hs.events(1)[0]; !strings.HasSuffix(ev.Fields["requestUrl"], "/canceled") {
+		t.Errorf("requestUrl = %q", ev.Fields["requestUrl"])
+	}
+}
+
+func TestTLSMetadata(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"tls_meta": map[string]interface{}{"version_header": "X-Tls-Version"}})
+	hs.do("GET", "/mtls", "", http.Header{"X-Tls-Version": {"TLSv1.3"}, "X-Forwarded-Client-Cert": {
+		`By=spiffe://gw;Hash=ab12;Subject="CN=svc-a,O=Example";URI=spiffe://svc-a,By=spiffe://lb;Subject="CN=lb"`}})
+	meta := hs.events(1)[0].Meta
+	if meta["tls.version"] != "1.3" || meta["tls.client_subject"] != "CN=svc-a,O=Example" {
+		t.Errorf("tls fields from headers = %q / %q", meta["tls.version"], meta["tls.client_subject"])
+	}
+
+	hs = newHarness(t, echo, map[string]interface{}{"tls_meta": true})
+	req := httptest.NewRequest("GET", hs.backend.URL+"/direct", nil)
+	req.RequestURI = ""
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		NegotiatedProtocol: "h2"}
+	hs.handler.ServeHTTP(httptest.NewRecorder(), req)
+	meta = hs.events(1)[0].Meta
+	if meta["tls.version"] != "1.2" || meta["tls.cipher"] != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" || meta["tls.alpn"] != "h2" {
+		t.Errorf("tls fields from the connection = %v", meta)
+	}
+}
+
+// metadataService sends the requests for host to srv instead.
+type metadataService struct {
+	host string
+	srv  *httptest.Server
+}
+
+func (m metadataService) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == m.host {
+		r = r.Clone(r.Context())
+		r.URL.Host = strings.TrimPrefix(m.srv.URL, "http://")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCloudMetadata(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" &&
+			r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") != "":
+			fmt.Fprint(w, "imds-token")
+		case r.URL.Path == "/latest/dynamic/instance-identity/document" && r.Header.Get("X-Aws-Ec2-Metadata-Token") == "imds-token":
+			fmt.Fprint(w, `{"instanceId":"i-0abc","region":"eu-west-1","availabilityZone":"eu-west-1b"}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer imds.Close()
+	prev := http.DefaultClient.Transport
+	http.DefaultClient.Transport = metadataService{host: "169.254.169.254", srv: imds}
+	defer func() { http.DefaultClient.Transport = prev }()
+
+	hs := newHarness(t, echo, map[string]interface{}{"cloud_metadata": "aws"})
+	// the lookup runs in the background: the first events may come without it
+	deadline := time.Now().Add(2 * time.Second)
+	for n := 1; ; n++ {
+		hs.do("GET", "/where", "", nil)
+		meta := hs.events(n)[n-1].Meta
+		if meta["cloud.provider"] != "" {
+			if meta["cloud.provider"] != "aws" || meta["cloud.instance_id"] != "i-0abc" ||
+				meta["cloud.region"] != "eu-west-1" || meta["cloud.availability_zone"] != "eu-west-1b" {
+				t.Errorf("cloud fields = %v", meta)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no cloud.* fields after 2s")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBytesInAndOut(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("o"), 3000))
+	}, map[string]interface{}{"admin_port": float64(port), "endpoint": "/uploads", "max_capture_kb": 1.0})
+	type stat struct {
+		Requests int64
+		BytesIn  int64 `json:"bytes_in"`
+		BytesOut int64 `json:"bytes_out"`
+	}
+	uploads := func() stat { // the totals are per process, so compare before and after
+		t.Helper()
+		resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/bandwidth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var stats struct{ Endpoints map[string]stat }
+		json.NewDecoder(resp.Body).Decode(&stats)
+		return stats.Endpoints["/uploads"]
+	}
+	before := uploads()
+	hs.do("POST", "/uploads/1", strings.Repeat("i", 5000), nil)
+	hs.do("POST", "/uploads/2", "small", nil)
+
+	for i, ev := range hs.events(2) {
+		if want := []string{"5000", "5"}[i]; ev.Meta["request_size"] != want || ev.Meta["response_size"] != "3000" {
+			t.Errorf("event %d: request_size %q, response_size %q", i, ev.Meta["request_size"], ev.Meta["response_size"])
+		}
+	}
+	after := uploads()
+	if got := (stat{after.Requests - before.Requests, after.BytesIn - before.BytesIn, after.BytesOut - before.BytesOut}); got != (stat{2, 5005, 6000}) {
+		t.Errorf("bandwidth grew by %+v, want 2 requests, 5005 bytes in, 6000 out", got)
+	}
+}
+
+func TestTimestampsAndDurations(t *testing.T) {
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("late"))
+	}, map[string]interface{}{})
+	before := time.Now()
+	hs.do("GET", "/timed", "", nil)
+
+	m := hs.events(1)[0].Meta
+	received, err1 := time.Parse(time.RFC3339, m["received_at"])
+	completed, err2 := time.Parse(time.RFC3339, m["completed_at"])
+	if err1 != nil || err2 != nil || !strings.HasSuffix(m["received_at"], "Z") || len(m["received_at"]) != len("2006-01-02T15:04:05.000Z") {
+		t.Fatalf("received_at %q, completed_at %q: want RFC 3339 UTC with milliseconds", m["received_at"], m["completed_at"])
+	}
+	total, _ := strconv.ParseFloat(m["duration_ms"], 64)
+	upstream, _ := strconv.ParseFloat(m["upstream_ms"], 64)
+	if received.Before(before.Truncate(time.Millisecond)) || completed.Sub(received) < 50*time.Millisecond {
+		t.Errorf("received_at %v, completed_at %v", received, completed)
+	}
+	if upstream < 30 || total < upstream+20 {
+		t.Errorf("upstream_ms %v, duration_ms %v", upstream, total)
+	}
+}
+
+func TestBinaryBodiesAreBase64(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00}
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}, map[string]interface{}{})
+	rec := hs.do("GET", "/logo.png", "", nil)
+
+	if !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Fatal("client body changed")
+	}
+	ev := hs.events(1)[0]
+	if ev.Fields["responseBody"] != "iVBORw0KGgoA" || ev.Meta["response_body_encoding"] != "base64" {
+		t.Errorf("responseBody = %q, meta %v", ev.Fields["responseBody"], ev.Meta)
+	}
+}
+
+/* ───────── filtering & transforms ───────── */
+
+func TestCaptureIfAndTransform(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"capture_if": `request.method == "POST"`,
+		"transform": []interface{}{
+			map[string]interface{}{"set": map[string]interface{}{"route": "request.path"}},
+			map[string]interface{}{"redact": map[string]interface{}{
+				"pattern": `"secret":"[^"]*"`, "with": `"secret":"***"`, "in": []interface{}{"request.body"}}},
+		},
+	})
+	hs.do("GET", "/skipped", "", nil)
+	hs.do("POST", "/kept", `{"secret":"hunter2"}`, nil)
+
+	ev := hs.events(1)[0]
+	if ev.Meta["route"] != "/kept" {
+		t.Errorf("route = %q, want /kept", ev.Meta["route"])
+	}
+	if got := ev.Fields["requestBody"]; got != `{"secret":"***"}` {
+		t.Errorf("requestBody = %q", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(hs.collector.Events()); n != 1 {
+		t.Errorf("collector got %d events, want 1", n)
+	}
+}
+
+func TestExtractAndNormalize(t *testing.T) {
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{ \"order\": { \"id\": \"o-9\" },\n  \"a\": 1 }")
+	}, map[string]interface{}{
+		"normalize_json": "canonical",
+		"extract_fields": map[string]interface{}{"order_id": map[string]interface{}{"path": "$.order.id"}},
+	})
+	hs.do("GET", "/", "", nil)
+
+	ev := hs.events(1)[0]
+	if got := ev.Fields["responseBody"]; got != `{"a":1,"order":{"id":"o-9"}}` {
+		t.Errorf("responseBody = %q", got)
+	}
+	if ev.Meta["order_id"] != "o-9" {
+		t.Errorf("order_id = %q", ev.Meta["order_id"])
+	}
+}
+
+func TestDedupeHoldsBackRepeats(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"dedupe": map[string]interface{}{"window_s": 0.3}})
+	for i := 0; i < 4; i++ {
+		hs.do("GET", "/health", "", nil)
+	}
+	hs.do("GET", "/other", "", nil)
+	time.Sleep(100 * time.Millisecond)
+	if n := len(hs.collector.Events()); n != 2 {
+		t.Fatalf("collector got %d events within the window, want 2", n)
+	}
+
+	last := hs.events(3)[2]
+	if !strings.HasSuffix(last.Fields["requestUrl"], "/health") || last.Meta["repeats"] != "3" || last.Meta["repeats_since"] == "" {
+		t.Errorf("closing event %s meta = %v, want /health with repeats=3", last.Fields["requestUrl"], last.Meta)
+	}
+	hs.do("GET", "/health", "", nil) // a new window
+	if evs := hs.events(4); evs[3].Meta["repeats"] != "" {
+		t.Errorf("first event of the next window has repeats=%s", evs[3].Meta["repeats"])
+	}
+}
+
+func TestDedupeWindowSlides(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"dedupe": map[string]interface{}{"window_s": 0.3, "max_window_s": 0.8}})
+	for i := 0; i < 4; i++ { // 0.6s of repeats, each within window_s of the last
+		hs.do("GET", "/health", "", nil)
+		time.Sleep(200 * time.Millisecond)
+	}
+	if n := len(hs.collector.Events()); n != 1 {
+		t.Fatalf("collector got %d events while the repeats kept coming, want 1", n)
+	}
+	if ev := hs.events(2)[1]; ev.Meta["repeats"] != "3" {
+		t.Errorf("closing event repeats = %s, want 3", ev.Meta["repeats"])
+	}
+
+	for i := 0; i < 7; i++ { // a storm longer than max_window_s
+		hs.do("GET", "/storm", "", nil)
+		time.Sleep(150 * time.Millisecond)
+	}
+	closed := false
+	for _, ev := range hs.events(4)[2:] {
+		closed = closed || ev.Meta["repeats"] != "" && strings.HasSuffix(ev.Fields["requestUrl"], "/storm")
+	}
+	if !closed {
+		t.Error("no /storm window closed by max_window_s while the storm lasted")
+	}
+}
+
+func TestGraphQLOperations(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "v2", "graphql": map[string]interface{}{"redact_variables": true},
+	})
+	jsonCT := http.Header{"Content-Type": {"application/json"}}
+	hs.do("POST", "/graphql", `{"query":"query A { a } query Order($id: ID!) { order(id: $id, first: 10) { total } }",`+
+		`"operationName":"Order","variables":{"id":"ord-1","card":"4111<1111>"}}`, jsonCT)
+	hs.do("GET", "/graphql?query="+url.QueryEscape("query A {a}\nquery Order($id: ID!) {\n  # cached\n  order(id: $id, first: 25) { total }\n}")+
+		"&operationName=Order", "", nil)
+	hs.do("POST", "/graphql", `mutation { cancel(id: "ord-1") { ok } }`, http.Header{"Content-Type": {"application/graphql"}})
+	hs.do("POST", "/graphql", `{"items":[]}`, jsonCT)
+
+	byOp := map[string]mockcollector.Event{}
+	var ops []string
+	for _, ev := range hs.events(4) {
+		op := ev.Fields["method"] + " " + ev.Meta["graphql.operation_type"] + " " + ev.Meta["graphql.operation_name"]
+		byOp[op] = ev
+		ops = append(ops, op)
+	}
+	named, get, mutation := byOp["POST query Order"], byOp["GET query Order"], byOp["POST mutation "]
+	if sort.Strings(ops); strings.Join(ops, "|") != "GET query Order|POST  |POST mutation |POST query Order" ||
+		byOp["POST  "].Meta["graphql.query_hash"] != "" {
+		t.Fatalf("operations %q", ops)
+	}
+	if h := named.Meta["graphql.query_hash"]; len(h) != 64 || h != get.Meta["graphql.query_hash"] ||
+		h == mutation.Meta["graphql.query_hash"] {
+		t.Errorf("hashes %s / %s / %s: want the first two alike", h, get.Meta["graphql.query_hash"], mutation.Meta["graphql.query_hash"])
+	}
+	if body := named.Fields["requestBody"]; strings.Contains(body, "ord-1") || strings.Contains(body, "4111") ||
+		!strings.Contains(body, `"variables":{"card":"[redacted]","id":"[redacted]"}`) {
+		t.Errorf("captured body %s", body)
+	}
+}
+
+func TestSOAPEnvelopes(t *testing.T) {
+	soap := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<LoginResponse><Token>tok-123</Token><Password>echoed</Password></LoginResponse></s:Body></s:Envelope>`)
+	}
+	hs := newHarness(t, soap, map[string]interface{}{
+		"payload_format": "v2",
+		"xml":            map[string]interface{}{"redact": []interface{}{"//Password", "/Envelope/Header/Security"}, "replacement": "[x]"},
+	})
+	login := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Header><wsse:Security xmlns:wsse="urn:wsse"><wsse:Token>secret-token</wsse:Token></wsse:Security></soap:Header>
+  <soap:Body><Login xmlns="urn:acme"><User>ada</User><Password>hunter2</Password></Login></soap:Body>
+</soap:Envelope>`
+	hs.do("POST", "/soap11", login, http.Header{"Content-Type": {"text/xml"}, "Soapaction": {`"urn:acme/Login"`}})
+	ev := hs.events(1)[0]
+	if ev.Meta["xml.root"] != "Envelope" || ev.Meta["soap.version"] != "1.1" || ev.Meta["soap.operation"] != "Login" ||
+		ev.Meta["soap.action"] != "urn:acme/Login" {
+		t.Errorf("meta %v", ev.Meta)
+	}
+	want := strings.NewReplacer("secret-token</wsse:Token>", "", "<wsse:Token>", "", "hunter2", "[x]").Replace(login)
+	want = strings.Replace(want, `xmlns:wsse="urn:wsse">`, `xmlns:wsse="urn:wsse">[x]`, 1)
+	if ev.Fields["requestBody"] != want {
+		t.Errorf("request body\n%s\nwant\n%s", ev.Fields["requestBody"], want)
+	}
+	if body := ev.Fields["responseBody"]; !strings.Contains(body, "<Token>tok-123</Token><Password>[x]</Password>") {
+		t.Errorf("response body %s", body)
+	}
+
+	hs.do("POST", "/soap12", `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><GetOrder/></env:Body></env:Envelope>`,
+		http.Header{"Content-Type": {`application/soap+xml; charset=utf-8; action="urn:acme/GetOrder"`}})
+	hs.do("POST", "/plain", `<order id="1"><Password>p</Password></order>`, http.Header{"Content-Type": {"application/xml"}})
+	evs := hs.events(3)[1:]
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Fields["requestUrl"] > evs[j].Fields["requestUrl"] })
+	if m := evs[0].Meta; m["soap.version"] != "1.2" || m["soap.operation"] != "GetOrder" || m["soap.action"] != "urn:acme/GetOrder" {
+		t.Errorf("soap 1.2 meta %v", m)
+	}
+	if m := evs[1].Meta; m["xml.root"] != "order" || m["soap.version"] != "" ||
+		evs[1].Fields["requestBody"] != `<order id="1"><Password>[x]</Password></order>` {
+		t.Errorf("plain xml: meta %v, body %s", m, evs[1].Fields["requestBody"])
+	}
+}
+
+func TestProtobufBodies(t *testing.T) {
+	// protoc -o for: package acme.v1; enum State { NEW = 0; PAID = 1; }
+	// message CreateOrderRequest { string sku = 1; int64 qty = 2; }
+	// message Order { string order_id = 1; State state = 2; }
+	field := func(name string, number, kind uint64, typeName string) []byte {
+		f := cat(pbString(1, name), pbVarint(3, number), pbVarint(4, 1), pbVarint(5, kind))
+		if typeName != "" {
+			f = cat(f, pbString(6, typeName))
+		}
+		return pbBytes(2, f)
+	}
+	file := cat(pbString(1, "acme/v1/orders.proto"), pbString(2, "acme.v1"),
+		pbBytes(4, cat(pbString(1, "CreateOrderRequest"), field("sku", 1, 9, ""), field("qty", 2, 3, ""))),
+		pbBytes(4, cat(pbString(1, "Order"), field("order_id", 1, 9, ""), field("state", 2, 14, ".acme.v1.State"))),
+		pbBytes(5, cat(pbString(1, "State"),
+			pbBytes(2, cat(pbString(1, "NEW"), pbVarint(2, 0))), pbBytes(2, cat(pbString(1, "PAID"), pbVarint(2, 1))))))
+	set := filepath.Join(t.TempDir(), "api.pb")
+	os.WriteFile(set, pbBytes(1, file), 0o600)
+
+	order := cat(pbString(1, "o-42"), pbVarint(2, 1))
+	grpc := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Write(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(order))))
+		w.Write(order)
+	}
+	hs := newHarness(t, grpc, map[string]interface{}{
+		"payload_format": "v2",
+		"protobuf": map[string]interface{}{"descriptor_set": set,
+			"request_type": "acme.v1.CreateOrderRequest", "response_type": "acme.v1.Order"},
+	})
+	hs.do("POST", "/acme.v1.Orders/Create", string(cat(pbString(1, "A-1"), pbVarint(2, 3))),
+		http.Header{"Content-Type": {"application/x-protobuf"}})
+	ev := hs.events(1)[0]
+	hs.do("POST", "/acme.v1.Orders/Create", `{"sku":"A-1"}`, http.Header{"Content-Type": {"application/json"}})
+	evs := hs.events(2)
+	if ev.Fields["requestBody"] != `{"qty":"3","sku":"A-1"}` || ev.Fields["responseBody"] != `{"orderId":"o-42","state":"PAID"}` {
+		t.Errorf("bodies %s / %s", ev.Fields["requestBody"], ev.Fields["responseBody"])
+	}
+	if ev.Meta["protobuf.request_type"] != "acme.v1.CreateOrderRequest" || ev.Meta["protobuf.response_type"] != "acme.v1.Order" {
+		t.Errorf("meta %v", ev.Meta)
+	}
+	// a JSON request is left alone; the response is still decoded
+	if ev := evs[1]; ev.Fields["requestBody"] != `{"sku":"A-1"}` || ev.Meta["protobuf.request_type"] != "" ||
+		ev.Meta["protobuf.response_type"] != "acme.v1.Order" {
+		t.Errorf("json request: body %s, meta %v", ev.Fields["requestBody"], ev.Meta)
+	}
+}
+
+func cat(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+func pbVarint(field, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, field<<3), v)
+}
+
+func pbBytes(field uint64, b []byte) []byte {
+	return append(binary.AppendUvarint(binary.AppendUvarint(nil, field<<3|2), uint64(len(b))), b...)
+}
+
+func pbString(field uint64, s string) []byte { return pbBytes(field, []byte(s)) }
+
+func TestWASMTransform(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "transform.wasm")
+	os.WriteFile(module, wasmModule(`{"meta":{"tier":"gold"},"response":{"body":"[wasm]"}}`, 2000), 0o600)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "v2",
+		"wasm":           map[string]interface{}{"module": module, "max_instances": 2.0},
+	})
+	hs.do("POST", "/big", strings.Repeat("x", 4000), nil) // dropped by the module
+	hs.do("GET", "/small", "", nil)
+
+	ev := hs.events(1)[0]
+	if !strings.HasSuffix(ev.Fields["requestUrl"], "/small") {
+		t.Fatalf("got the event for %s, want the big one dropped", ev.Fields["requestUrl"])
+	}
+	if ev.Meta["tier"] != "gold" || ev.Meta["endpoint"] != "" || ev.Fields["responseBody"] != "[wasm]" {
+		t.Errorf("event not rewritten by the module: meta %v, response body %q", ev.Meta, ev.Fields["responseBody"])
+	}
+	if n := len(hs.collector.Wait(2, 300*time.Millisecond)); n != 1 {
+		t.Errorf("collector got %d events, want 1", n)
+	}
+
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": hs.tracking.URL,
+			"wasm": map[string]interface{}{"module": filepath.Join(t.TempDir(), "none.wasm")}},
+	}); err == nil || !strings.Contains(err.Error(), "wasm") {
+		t.Errorf("missing module: %v", err)
+	}
+}
+
+// wasmModule assembles a module for the transform ABI: it drops documents
+// longer than dropAbove bytes and answers out for the others.
+func wasmModule(out string, dropAbove int) []byte {
+	leb := func(v int64) []byte { // signed LEB128, which also reads back right as unsigned for v >= 0
+		var b []byte
+		for {
+			c := byte(v & 0x7f)
+			v >>= 7
+			if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+				return append(b, c)
+			}
+			b = append(b, c|0x80)
+		}
+	}
+	vec := func(items ...[]byte) []byte {
+		b := leb(int64(len(items)))
+		for _, it := range items {
+			b = append(b, it...)
+		}
+		return b
+	}
+	name := func(s string) []byte { return append(leb(int64(len(s))), s...) }
+	section := func(id byte, body []byte) []byte {
+		return append(append([]byte{id}, leb(int64(len(body)))...), body...)
+	}
+	const outPtr, inPtr = 16, 4096
+
+	alloc := cat([]byte{0, 0x41}, leb(inPtr), []byte{0x0b})           // i32.const inPtr
+	transform := cat([]byte{0, 0x20, 1, 0x41}, leb(int64(dropAbove)), // local.get 1; i32.const
+		[]byte{0x4b, 0x04, 0x40, 0x42, 0, 0x0f, 0x0b, 0x42}, // i32.gt_u; if: i64.const 0, return; i64.const
+		leb(outPtr<<32|int64(len(out))), []byte{0x0b})
+	return cat([]byte("\x00asm\x01\x00\x00\x00"),
+		section(1, vec([]byte{0x60, 1, 0x7f, 1, 0x7f}, []byte{0x60, 2, 0x7f, 0x7f, 1, 0x7e})),
+		section(3, vec([]byte{0}, []byte{1})),
+		section(5, vec([]byte{0, 1})),
+		section(7, vec(cat(name("memory"), []byte{2, 0}), cat(name("alloc"), []byte{0, 0}), cat(name("transform"), []byte{0, 1}))),
+		section(10, vec(cat(leb(int64(len(alloc))), alloc), cat(leb(int64(len(transform))), transform))),
+		section(11, vec(cat([]byte{0, 0x41}, leb(outPtr), []byte{0x0b}, name(out)))))
+}
+
+/* ───────── formats & local sinks ───────── */
+
+func TestStarlarkTransform(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "transform.star")
+	os.WriteFile(script, []byte(`
+def transform(event):
+    path = event["request"]["path"]
+    if path == "/internal":
+        return False
+    if path == "/loop":
+        while True:
+            pass
+    if path == "/replace":
+        return {"meta": {"only": "this"}}
+    body = json.decode(event["request"]["body"] or "{}")
+    if "card" in body:
+        body["card"] = "****"
+        event["request"]["body"] = json.encode(body)
+    event["meta"]["tier"] = "gold" if event["response"]["status"] < 400 else "errors"
+    event["meta"].pop("backend")
+`), 0o600)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "v2",
+		"starlark":       map[string]interface{}{"script": script, "max_steps": 10000.0},
+	})
+	next := func(n int, path string) mockcollector.Event {
+		t.Helper()
+		ev := hs.events(n)[n-1]
+		if !strings.HasSuffix(ev.Fields["requestUrl"], path) {
+			t.Fatalf("event %d is for %s, want %s", n, ev.Fields["requestUrl"], path)
+		}
+		return ev
+	}
+
+	hs.do("POST", "/pay", `{"card":"4111111111111111","sku":"a"}`, nil)
+	ev := next(1, "/pay")
+	if ev.Fields["requestBody"] != `{"card":"****","sku":"a"}` || ev.Meta["tier"] != "gold" ||
+		ev.Meta["backend"] != "" || ev.Meta["status"] != "201" {
+		t.Errorf("event not changed in place: meta %v, request body %q", ev.Meta, ev.Fields["requestBody"])
+	}
+	if !strings.Contains(ev.Fields["responseBody"], "4111111111111111") {
+		t.Errorf("response body %q, want it untouched", ev.Fields["responseBody"])
+	}
+
+	hs.do("GET", "/internal", "", nil) // dropped
+	hs.do("GET", "/loop", "", nil)     // over max_steps: kept unchanged
+	if ev := next(2, "/loop"); ev.Meta["tier"] != "" || ev.Meta["backend"] == "" {
+		t.Errorf("event of a failed script was changed: %v", ev.Meta)
+	}
+	hs.do("GET", "/replace", "", nil)
+	if ev := next(3, "/replace"); len(ev.Meta) != 1 || ev.Meta["only"] != "this" ||
+		!strings.Contains(ev.Fields["responseBody"], "/replace") {
+		t.Errorf("returned event not applied: meta %v, response body %q", ev.Meta, ev.Fields["responseBody"])
+	}
+
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": hs.tracking.URL,
+			"starlark": map[string]interface{}{"source": "def other(event):\n    return event\n"}},
+	}); err == nil || !strings.Contains(err.Error(), "does not define transform") {
+		t.Errorf("script without transform: %v", err)
+	}
+}
+
+func TestCookiesAreBrokenOutAndMasked(t *testing.T) {
+	var seen string
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("Cookie")
+		w.Header().Add("Set-Cookie", "sid=s3cr3t; Path=/; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=light")
+	}, map[string]interface{}{"cookies": map[string]interface{}{"allow": []interface{}{"theme", "SessionID", "sid"}}})
+	rec := hs.do("GET", "/account", "", http.Header{"Cookie": {"theme=dark; sessionid=abc; tracking=x"}})
+
+	if seen != "theme=dark; sessionid=abc; tracking=x" || len(rec.Header().Values("Set-Cookie")) != 2 {
+		t.Errorf("backend saw Cookie %q, client got Set-Cookie %q", seen, rec.Header().Values("Set-Cookie"))
+	}
+	mask := func(v string) string {
+		sum := sha256.Sum256([]byte(v))
+		return "masked:" + hex.EncodeToString(sum[:6])
+	}
+	meta := hs.events(1)[0].Meta
+	for k, want := range map[string]string{
+		"cookie.theme": "dark", "cookie.sessionid": mask("abc"), "cookie.tracking": "",
+		"set_cookie.sid": mask("s3cr3t") + "; Path=/; HttpOnly", "set_cookie.theme": "light",
+	} {
+		if meta[k] != want {
+			t.Errorf("%s = %q, want %q", k, meta[k], want)
+		}
+	}
+}
+
+func TestCharsetsAreTranscoded(t *testing.T) {
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=Shift_JIS")
+		w.Write([]byte{0x93, 0xfa, 0x96, 0x7b, ' ', 0xb1, 0xb2}) // 日本 ｱｲ
+	}, map[string]interface{}{})
+	rec := hs.do("POST", "/menu", "caf\xe9 \x80", http.Header{"Content-Type": {"text/plain; charset=ISO-8859-1"}})
+	hs.do("POST", "/feed", "<?xml version=\"1.0\" encoding=\"windows-1251\"?><t>\xcf\xf0\xe8\xe2\xe5\xf2</t>", nil)
+	hs.do("POST", "/legacy", "\xc4\xe3", http.Header{"Content-Type": {"text/plain; charset=GBK"}})
+
+	if rec.Body.String() != "\x93\xfa\x96\x7b \xb1\xb2" {
+		t.Errorf("client got %q", rec.Body.String())
+	}
+	evs := hs.events(3)
+	for i, want := range []struct{ body, resp, reqCS, respCS string }{
+		{"café €", "日本 ｱｲ", "iso-8859-1", "shift_jis"},
+		{`<?xml version="1.0" encoding="UTF-8"?><t>Привет</t>`, "", "windows-1251", "shift_jis"},
+		{"xOM=", "", "", "shift_jis"}, // kept, so base64
+	} {
+		ev := evs[i]
+		if ev.Fields["requestBody"] != want.body || want.resp != "" && ev.Fields["responseBody"] != want.resp {
+			t.Errorf("event %d: bodies %q / %q", i, ev.Fields["requestBody"], ev.Fields["responseBody"])
+		}
+		if ev.Meta["request_charset"] != want.reqCS || ev.Meta["response_charset"] != want.respCS {
+			t.Errorf("event %d: charsets %q / %q", i, ev.Meta["request_charset"], ev.Meta["response_charset"])
+		}
+	}
+	if got := evs[2].Meta["request_charset_unsupported"]; got != "gbk" {
+		t.Errorf("request_charset_unsupported = %q, want gbk", got)
+	}
+}
+
+func TestCompressedBodiesAreDecoded(t *testing.T) {
+	const doc = `{"items":[{"id":1,"name":"The quick brown fox"},{"id":2,"name":"jumps over the lazy dog"}],"total":2}`
+	br, _ := hex.DecodeString("1b6400002c0b6cf70bd448a8c3049c1ab97db4675f52a1ed2599195bb3e874f569911899ad2d7286a7a7c2de" +
+		"5a04642eaf4e0ef080fcdfd2a0059cb5002c550ebdf12fc3e5029bc7c2603a48bf887c314f334c4c9b6b35faf75387b614c4")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"order":42}`))
+	zw.Close()
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(br)
+	}, map[string]interface{}{})
+	rec := hs.do("POST", "/orders", gz.String(), http.Header{"Content-Encoding": {"gzip"}})
+
+	if !bytes.Equal(rec.Body.Bytes(), br) || rec.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("client got %q encoded %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+	ev := hs.events(1)[0]
+	if ev.Fields["requestBody"] != `{"order":42}` || ev.Fields["responseBody"] != doc {
+		t.Errorf("bodies %q / %q", ev.Fields["requestBody"], ev.Fields["responseBody"])
+	}
+	if ev.Meta["request_content_encoding"] != "gzip" || ev.Meta["response_content_encoding"] != "br" ||
+		ev.Meta["response_body_encoding"] != "" {
+		t.Errorf("meta %v", ev.Meta)
+	}
+}
+
+func TestRequestTrailersAndExpect(t *testing.T) {
+	var trailer string
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		trailer = r.Trailer.Get("X-Checksum")
+	}, map[string]interface{}{})
+	req, _ := http.NewRequest("PUT", hs.backend.URL+"/upload", strings.NewReader("chunk one, chunk two"))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	req.Header.Set("Expect", "100-continue")
+	req.Trailer = http.Header{"X-Checksum": {"sha256:abc"}, "X-Parts": nil}
+	hs.handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if trailer != "sha256:abc" {
+		t.Errorf("backend got trailer %q", trailer)
+	}
+	meta := hs.events(1)[0].Meta
+	for k, want := range map[string]string{
+		"request_transfer_encoding": "chunked", "request_trailers": "X-Checksum,X-Parts",
+		"request_trailer.X-Checksum": "sha256:abc", "expect": "100-continue", "upgrade": "",
+	} {
+		if meta[k] != want {
+			t.Errorf("%s = %q, want %q", k, meta[k], want)
+		}
+	}
+}
+
+func TestCaptureHeadersPerSide(t *testing.T) {
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Backend-Id", "b-7")
+		w.Header().Set("X-Internal-Trace", "t")
+		w.Header().Set("Set-Cookie", "sid=1")
+	}, map[string]interface{}{"payload_format": "har", "capture_headers": map[string]interface{}{
+		"request": map[string]interface{}{"deny": []interface{}{"x-api-*"}},
+		"response": map[string]interface{}{"allow": []interface{}{"Cache-Control", "X-Backend-*", "Set-Cookie"},
+			"deny": []interface{}{"set-cookie"}},
+	}})
+	rec := hs.do("GET", "/catalog", "", http.Header{"X-Api-Key": {"k"}, "X-Channel": {"web"}})
+
+	if rec.Header().Get("Set-Cookie") != "sid=1" || rec.Header().Get("X-Internal-Trace") != "t" {
+		t.Errorf("client headers %v", rec.Header())
+	}
+	type headers []struct{ Name string }
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request  struct{ Headers headers }
+				Response struct{ Headers headers }
+			}
+		}
+	}
+	if err := json.Unmarshal(hs.events(1)[0].Doc, &har); err != nil || len(har.Log.Entries) != 1 {
+		t.Fatalf("not a HAR log: %v", err)
+	}
+	names := func(hs headers) string {
+		var out []string
+		for _, h := range hs {
+			out = append(out, h.Name)
+		}
+		return strings.Join(out, ",")
+	}
+	e := har.Log.Entries[0]
+	if got := names(e.Request.Headers); strings.Contains(got, "X-Api-Key") || !strings.Contains(got, "X-Channel") {
+		t.Errorf("request headers %s", got)
+	}
+	if got := names(e.Response.Headers); got != "Cache-Control,X-Backend-Id" {
+		t.Errorf("response headers %s", got)
+	}
+}
+
+func TestHARFormat(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"payload_format": "har"})
+	hs.do("PUT", "/items/1", "v", http.Header{"Authorization": {"Bearer t"}})
+
+	ev := hs.events(1)[0]
+	if ev.ContentType != "application/json" {
+		t.Errorf("content type %q", ev.ContentType)
+	}
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method  string `json:"method"`
+					Headers []struct {
+						Name, Value string
+					} `json:"headers"`
+				} `json:"request"`
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(ev.Doc, &har); err != nil || len(har.Log.Entries) != 1 {
+		t.Fatalf("not a HAR log: %v %s", err, ev.Body)
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != "PUT" || e.Response.Status != http.StatusCreated {
+		t.Errorf("entry %+v", e)
+	}
+	for _, h := range e.Request.Headers {
+		if h.Name == "Authorization" && h.Value != "[redacted]" {
+			t.Errorf("Authorization sent as %q", h.Value)
+		}
+	}
+}
+
+func TestMsgpackFormat(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"payload_format": "msgpack", "endpoint": "/items"})
+	body := strings.Repeat("\x00binary\xff", 40)
+	hs.do("POST", "/items/1?q=1", body, nil)
+
+	ev := hs.events(1)[0]
+	if ev.ContentType != "application/msgpack" {
+		t.Errorf("content type %q", ev.ContentType)
+	}
+	var doc struct {
+		Request struct {
+			Method, URL, Query string
+			Body               []byte
+		} `json:"request"`
+		Response struct {
+			Status int    `json:"status"`
+			Body   []byte `json:"body"`
+		} `json:"response"`
+		Meta map[string]string `json:"meta"`
+	}
+	if err := json.Unmarshal(ev.Doc, &doc); err != nil {
+		t.Fatalf("not a MessagePack document: %v %q", err, ev.Body)
+	}
+	if doc.Request.Method != "POST" || doc.Request.Query != "q=1" || string(doc.Request.Body) != body ||
+		doc.Response.Status != http.StatusCreated || doc.Meta["endpoint"] != "/items" {
+		t.Errorf("doc = %+v", doc)
+	}
+	if !strings.Contains(ev.Body, body) {
+		t.Errorf("request body not sent as raw bytes: %q", ev.Body)
+	}
+}
+
+func TestProtoFormat(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"payload_format": "proto", "endpoint": "/items"})
+	hs.do("POST", "/items?x=1", "\x08\x96\x01", http.Header{"Authorization": {"Bearer t"}})
+
+	ev := hs.events(1)[0]
+	if ev.ContentType != "application/x-protobuf; messageType=krakend.trace.v1.TraceEvent" {
+		t.Errorf("content type %q", ev.ContentType)
+	}
+	var doc struct {
+		Timestamp      time.Time `json:"timestamp"`
+		Seq            uint64    `json:"seq"`
+		Method         string    `json:"method"`
+		Query          string    `json:"query"`
+		Status         int       `json:"status"`
+		Endpoint       string    `json:"endpoint"`
+		RequestBody    []byte    `json:"request_body"`
+		RequestHeaders []struct {
+			Name   string   `json:"name"`
+			Values []string `json:"values"`
+		} `json:"request_headers"`
+		Meta map[string]string `json:"meta"`
+	}
+	if err := json.Unmarshal(ev.Doc, &doc); err != nil {
+		t.Fatalf("not a TraceEvent: %v %q", err, ev.Body)
+	}
+	if doc.Method != "POST" || doc.Query != "x=1" || doc.Status != http.StatusCreated || doc.Endpoint != "/items" ||
+		string(doc.RequestBody) != "\x08\x96\x01" || doc.Seq == 0 || time.Since(doc.Timestamp) > time.Minute ||
+		doc.Meta["status"] != "201" {
+		t.Errorf("doc = %+v", doc)
+	}
+	for _, h := range doc.RequestHeaders {
+		if h.Name == "Authorization" && (len(h.Values) != 1 || h.Values[0] != "[redacted]") {
+			t.Errorf("Authorization sent as %q", h.Values)
+		}
+	}
+}
+
+func TestCBORRoute(t *testing.T) {
+	col := mockcollector.New()
+	iot := httptest.NewServer(col)
+	defer iot.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"sink_rules": []interface{}{map[string]interface{}{
+		"if": "response.status >= 200", "tracking_url": iot.URL, "payload_format": "cbor"}}})
+	body := "\x00\x01sensor\xfe"
+	hs.do("POST", "/readings", body, nil)
+
+	if ev := hs.events(1)[0]; ev.Fields["requestUrl"] == "" {
+		t.Errorf("block sink got %q, want the v1 payload", ev.Body)
+	}
+	evs := col.Wait(1, 2*time.Second)
+	if len(evs) != 1 {
+		t.Fatalf("route got %d events", len(evs))
+	}
+	if evs[0].ContentType != "application/cbor" {
+		t.Errorf("content type %q", evs[0].ContentType)
+	}
+	var doc struct {
+		Request struct {
+			Method string
+			Body   []byte
+		} `json:"request"`
+		Response struct {
+			Status int `json:"status"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(evs[0].Doc, &doc); err != nil {
+		t.Fatalf("not a CBOR document: %v %q", err, evs[0].Body)
+	}
+	if doc.Request.Method != "POST" || doc.Response.Status != http.StatusCreated {
+		t.Errorf("doc = %+v", doc)
+	}
+	if dec, _ := base64.StdEncoding.DecodeString(string(doc.Request.Body)); string(dec) != body {
+		t.Errorf("request body %q, want %q as base64 (binary_bodies of the block)", doc.Request.Body, body)
+	}
+}
+
+func TestTemplateFormat(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "trace.tmpl")
+	os.WriteFile(tmpl, []byte(`{"ts":"{{rfc3339 .timestamp}}",`+
+		`"line":"{{upper .request.method}} {{.request.path}} {{.response.status}}",`+
+		`"x":{{json .request.query.x}},"auth":{{json (index .request.headers "authorization")}},`+
+		`"body":"{{base64 .request.body}}","endpoint":"{{lower .meta.endpoint}}","missing":{{json .meta.nope}}}`), 0o600)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "template", "endpoint": "/Items",
+		"template": map[string]interface{}{"file": tmpl, "content_type": "application/json"},
+	})
+	hs.do("post", "/items?x=1", "hi", http.Header{"Authorization": {"Bearer t"}})
+
+	ev := hs.events(1)[0]
+	if ev.ContentType != "application/json" {
+		t.Errorf("content type %q", ev.ContentType)
+	}
+	var doc map[string]string
+	if err := json.Unmarshal(ev.Doc, &doc); err != nil {
+		t.Fatalf("template output is not the JSON it renders: %v %q", err, ev.Body)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, doc["ts"])
+	if err != nil || time.Since(ts) > time.Minute || !strings.HasSuffix(doc["ts"], "Z") {
+		t.Errorf("ts = %q", doc["ts"])
+	}
+	if doc["line"] != "POST /items 201" || doc["x"] != "1" || doc["auth"] != "[redacted]" ||
+		doc["body"] != "aGk=" || doc["endpoint"] != "/items" || doc["missing"] != "" {
+		t.Errorf("doc = %v", doc)
+	}
+
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": hs.tracking.URL, "payload_format": "template",
+			"template": map[string]interface{}{"text": "{{.request.method"}},
+	}); err == nil || !strings.Contains(err.Error(), "template:") {
+		t.Errorf("broken template: %v", err)
+	}
+}
+
+func TestAvroFormat(t *testing.T) {
+	var calls atomic.Int32
+	var registered atomic.Value
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct{ Schema string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if u, p, _ := r.BasicAuth(); r.Method != "POST" || r.URL.Path != "/subjects/traces-value/versions" ||
+			r.Header.Get("Content-Type") != "application/vnd.schemaregistry.v1+json" || u != "sr" || p != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registered.Store(req.Schema)
+		fmt.Fprint(w, `{"id":42}`)
+	}))
+	defer registry.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "avro", "endpoint": "/items",
+		"avro": map[string]interface{}{"registry_url": registry.URL + "/", "subject": "traces-value",
+			"username": "sr", "password": "pw"},
+	})
+	hs.do("POST", "/items?x=1", `{"sku":"a"}`, nil)
+	hs.events(1)
+	hs.do("GET", "/items/7", "", nil)
+	evs := hs.events(2)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d registry calls, want the id cached after the first", n)
+	}
+	var schema struct {
+		Type   string
+		Fields []struct {
+			Name string
+			Type interface{}
+		}
+	}
+	if s, _ := registered.Load().(string); json.Unmarshal([]byte(s), &schema) != nil || schema.Type != "record" {
+		t.Fatalf("registered schema %q", s)
+	}
+	for i, want := range []struct{ method, query, body string }{{"POST", "x=1", `{"sku":"a"}`}, {"GET", "", ""}} {
+		ev := evs[i]
+		b := []byte(ev.Body)
+		if ev.ContentType != "application/octet-stream" || len(b) < 5 || b[0] != 0 || binary.BigEndian.Uint32(b[1:5]) != 42 {
+			t.Fatalf("event %d: not Confluent wire format with schema id 42: %q", i, ev.Body)
+		}
+		// decode the datum with the schema the registry was given
+		rec, rest := map[string]interface{}{}, b[5:]
+		long := func() int64 {
+			v, n := binary.Varint(rest)
+			if n <= 0 {
+				t.Fatalf("event %d: bad varint", i)
+			}
+			rest = rest[n:]
+			return v
+		}
+		str := func() string {
+			n := long()
+			s := string(rest[:n])
+			rest = rest[n:]
+			return s
+		}
+		for _, f := range schema.Fields {
+			switch typ := fmt.Sprint(f.Type); {
+			case typ == "string", typ == "bytes":
+				rec[f.Name] = str()
+			case typ == "int", strings.Contains(typ, "long"):
+				rec[f.Name] = long()
+			case strings.Contains(typ, "map"):
+				m := map[string]string{}
+				for n := long(); n != 0; n = long() {
+					for ; n > 0; n-- {
+						k := str()
+						m[k] = str()
+					}
+				}
+				rec[f.Name] = m
+			default:
+				t.Fatalf("schema type %s", typ)
+			}
+		}
+		if len(rest) != 0 {
+			t.Errorf("event %d: %d bytes after the datum", i, len(rest))
+		}
+		if rec["method"] != want.method || rec["query"] != want.query || rec["request_body"] != want.body ||
+			rec["status"] != int64(201) || rec["endpoint"] != "/items" || rec["seq"] == int64(0) ||
+			time.Since(time.UnixMilli(rec["timestamp"].(int64))) > time.Minute ||
+			!strings.Contains(rec["response_body"].(string), `"method":"`+want.method+`"`) ||
+			rec["meta"].(map[string]string)["status"] != "201" {
+			t.Errorf("event %d: %v", i, rec)
+		}
+	}
+}
+
+func TestOTLPLogsSink(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"sink": "otlp", "payload_format": "ecs", "endpoint": "/items",
+		"otlp": map[string]interface{}{"service_name": "edge", "batch_delay_ms": 0.0},
+	})
+	hs.do("POST", "/items", "hello", http.Header{
+		"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}})
+
+	ev := hs.events(1)[0]
+	if ev.Path != "/track/v1/logs" || ev.ContentType != "application/x-protobuf" {
+		t.Errorf("posted to %s as %q", ev.Path, ev.ContentType)
+	}
+	var req struct {
+		Resource map[string]interface{} `json:"resource"`
+		Records  []struct {
+			Time       uint64                 `json:"time_unix_nano"`
+			Severity   string                 `json:"severity_text"`
+			Body       string                 `json:"body"`
+			Attributes map[string]interface{} `json:"attributes"`
+			TraceID    string                 `json:"trace_id"`
+			SpanID     string                 `json:"span_id"`
+		} `json:"records"`
+	}
+	if err := json.Unmarshal(ev.Doc, &req); err != nil || len(req.Records) != 1 {
+		t.Fatalf("not an OTLP logs export: %v %s", err, ev.Doc)
+	}
+	if req.Resource["service.name"] != "edge" || req.Resource["service.instance.id"] == "" {
+		t.Errorf("resource = %v", req.Resource)
+	}
+	r := req.Records[0]
+	if r.Severity != "INFO" || time.Since(time.Unix(0, int64(r.Time))) > time.Minute ||
+		!strings.Contains(r.Body, `"hello"`) || r.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		r.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("record = %+v", r)
+	}
+	if r.Attributes["http.request.method"] != "POST" || r.Attributes["http.response.status_code"] != 201.0 ||
+		r.Attributes["http.route"] != "/items" || r.Attributes["krakend.endpoint"] != "/items" {
+		t.Errorf("attributes = %v", r.Attributes)
+	}
+}
+
+func TestCloudEventsBatch(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"payload_format": "cloudevents", "endpoint": "/items",
+		"cloudevents": map[string]interface{}{"source": "/gw/test"},
+		"http":        map[string]interface{}{"batch": map[string]interface{}{"batch_size": 3.0, "batch_delay_ms": 500.0}},
+	})
+	for _, p := range []string{"/a", "/b", "/c"} {
+		hs.do("GET", p, "", nil)
+	}
+
+	ev := hs.events(1)[0]
+	if ev.ContentType != "application/cloudevents-batch+json" {
+		t.Errorf("content type %q", ev.ContentType)
+	}
+	var batch []struct {
+		SpecVersion string `json:"specversion"`
+		ID          string `json:"id"`
+		Source      string `json:"source"`
+		Type        string `json:"type"`
+		Subject     string `json:"subject"`
+		Data        struct {
+			URL struct {
+				Path string `json:"path"`
+			} `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(ev.Doc, &batch); err != nil || len(batch) != 3 {
+		t.Fatalf("not a batch of 3 CloudEvents: %v %s", err, ev.Body)
+	}
+	for i, ce := range batch {
+		if ce.SpecVersion != "1.0" || ce.Source != "/gw/test" || ce.Type != "io.krakend.trace.v1" ||
+			ce.Subject != "/items" || ce.ID == "" || ce.Data.URL.Path != []string{"/a", "/b", "/c"}[i] {
+			t.Errorf("event %d = %+v", i, ce)
+		}
+	}
+
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": hs.tracking.URL, "http": map[string]interface{}{"batch": true}},
+	}); err == nil || !strings.Contains(err.Error(), "needs payload_format cloudevents") {
+		t.Errorf("batch without cloudevents: %v", err)
+	}
+}
+
+func TestGRPCStreamSink(t *testing.T) {
+	col := mockcollector.New()
+	srv := httptest.NewUnstartedServer(col)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	defer srv.CloseClientConnections() // the stream stays open
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "grpcs://" + srv.Listener.Addr().String(), "payload_format": "v2",
+		"sink_tls": map[string]interface{}{"ca_file": caFile, "server_name": "example.com"},
+	})
+	for _, p := range []string{"/a", "/b", "/c"} {
+		hs.do("GET", p, "", nil)
+	}
+	evs := col.Wait(3, 2*time.Second)
+	if len(evs) != 3 {
+		t.Fatalf("collector got %d events over the stream, want 3", len(evs))
+	}
+	for _, ev := range evs {
+		if ev.Path != "/krakend.trace.v1.TraceCollector/Stream" || ev.ContentType != "text/plain; version=2" ||
+			!strings.Contains(ev.Fields["requestUrl"], "/") {
+			t.Errorf("event = %+v", ev)
+		}
+	}
+
+	// the stream comes back after the connection is lost
+	srv.CloseClientConnections()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(col.Events()) < 4 && time.Now().Before(deadline) {
+		hs.do("GET", "/again", "", nil)
+		time.Sleep(50 * time.Millisecond)
+	}
+	if evs := col.Events(); len(evs) < 4 || !strings.HasSuffix(evs[3].Fields["requestUrl"], "/again") {
+		t.Fatalf("no event after reconnecting: %d events", len(evs))
+	}
+}
+
+func TestWebSocketSink(t *testing.T) {
+	col := mockcollector.New()
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws", "payload_format": "v2",
+		"websocket": map[string]interface{}{"ping_ms": 20.0, "pong_timeout_ms": 50.0},
+	})
+	hs.do("POST", "/first", "one", nil)
+	col.Wait(1, 2*time.Second)
+	time.Sleep(150 * time.Millisecond) // several pings, all answered
+	hs.do("POST", "/second", "two", nil)
+
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 {
+		t.Fatalf("collector got %d messages, want 2", len(evs))
+	}
+	for i, ev := range evs {
+		if ev.Path != "/ws" || ev.ContentType != "text/plain; version=2" ||
+			!strings.HasSuffix(ev.Fields["requestUrl"], []string{"/first", "/second"}[i]) {
+			t.Errorf("event %d = %+v", i, ev)
+		}
+	}
+	if n := col.WebSockets(); n != 1 {
+		t.Errorf("%d connections, want one kept alive by the pings", n)
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	col := mockcollector.New()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go col.ServeMQTT(l)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "mqtt://" + l.Addr().String(), "payload_format": "v2", "endpoint": "/items/{id}",
+		"mqtt": map[string]interface{}{"topic": "krakend/traces/{endpoint}", "qos": 1.0, "will": true},
+	})
+	status := "krakend/status/" + capture.InstanceID()
+	hs.do("POST", "/items/1", "one", nil)
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 || evs[0].Path != status || evs[0].Body != "online" ||
+		evs[1].Path != "krakend/traces/items/{id}" || !strings.HasSuffix(evs[1].Fields["requestUrl"], "/items/1") {
+		t.Fatalf("published %+v", evs)
+	}
+
+	// the broker publishes the will when the connection is lost
+	col.DropMQTT()
+	evs = col.Wait(3, 2*time.Second)
+	if len(evs) != 3 || evs[2].Path != status || evs[2].Body != "offline" {
+		t.Fatalf("no will after the connection was lost: %+v", evs)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(col.Events()) < 5 && time.Now().Before(deadline) {
+		hs.do("POST", "/items/2", "two", nil)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if evs = col.Events(); len(evs) < 5 || evs[3].Body != "online" {
+		t.Fatalf("no reconnect: %+v", evs)
+	}
+}
+
+// listen serves a broker of col on a free local port and returns its address.
+func TestUnixSocketSink(t *testing.T) {
+	dir, err := os.MkdirTemp("", "trace") // socket paths are short
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "agent.sock")
+	lines := make(chan string, 16)
+	var mu sync.Mutex
+	var conns []net.Conn
+	serve := func() net.Listener {
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				conns = append(conns, c)
+				mu.Unlock()
+				go func() {
+					sc := bufio.NewScanner(c)
+					for sc.Scan() {
+						lines <- sc.Text()
+					}
+				}()
+			}
+		}()
+		return l
+	}
+	l := serve()
+	t.Cleanup(func() { l.Close() })
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "unix://" + sock, "unix": map[string]interface{}{"mode": "ndjson"},
+	})
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatal("no line on the socket")
+		}
+		return ""
+	}
+
+	// one JSON document per line, all on one connection
+	hs.do("POST", "/a", `{"sku":"a"}`, http.Header{"Content-Type": {"application/json"}})
+	hs.do("GET", "/b", "", nil)
+	var got []string
+	for i := 0; i < 2; i++ {
+		line := next()
+		var doc struct {
+			Timestamp string `json:"@timestamp"`
+			Request   struct{ Method, URL, Body string }
+			Response  struct{ Status int }
+			Meta      map[string]string
+		}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if doc.Timestamp == "" || doc.Response.Status != 201 || doc.Meta["seq"] == "" {
+			t.Errorf("document %s", line)
+		}
+		got = append(got, doc.Request.Method+" "+doc.Request.URL[strings.LastIndexByte(doc.Request.URL, '/'):]+" "+doc.Request.Body)
+	}
+	if sort.Strings(got); strings.Join(got, "|") != `GET /b |POST /a {"sku":"a"}` {
+		t.Errorf("documents %q", got)
+	}
+
+	// the sink dials again once the agent restarts
+	mu.Lock()
+	for _, c := range conns {
+		c.Close()
+	}
+	mu.Unlock()
+	l.Close()
+	l = serve()
+	deadline := time.Now().Add(3 * time.Second)
+	for again := false; !again; {
+		if time.Now().After(deadline) {
+			t.Fatal("no document after the agent restarted")
+		}
+		hs.do("GET", "/again", "", nil)
+		select {
+		case line := <-lines:
+			again = strings.Contains(line, "/again")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 2 {
+		t.Errorf("%d connections, want one per agent start", len(conns))
+	}
+}
+
+func listen(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+	return l.Addr().String()
+}
+
+func TestNATSSink(t *testing.T) {
+	col := mockcollector.New()
+	addr := listen(t, col.ServeNATS)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "nats://" + addr, "payload_format": "v2", "self_test": "strict",
+		"nats": map[string]interface{}{"subject": "trace.{header.X-Tenant}.{status}", "jetstream": true},
+	})
+	hs.do("POST", "/items/1", "one", http.Header{"X-Tenant": {"acme.eu"}})
+	// strict self_test only passes once the stream acked its probe
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 || evs[0].Meta["event"] != "self_test" || evs[1].Path != "trace.acme_eu.201" ||
+		!strings.HasSuffix(evs[1].Fields["requestUrl"], "/items/1") {
+		t.Fatalf("published %+v", evs)
+	}
+	if n := hs.collector.Events(); len(n) != 0 {
+		t.Errorf("%d events went to the HTTP collector", len(n))
+	}
+}
+
+func TestRedisStreamsSink(t *testing.T) {
+	col := mockcollector.New()
+	addr := listen(t, col.ServeRedis)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "redis://:secret@" + addr + "/2", "payload_format": "v2", "endpoint": "/orders",
+		"redis": map[string]interface{}{"stream": "trace:{endpoint}", "maxlen": 1000.0, "pool_size": 2.0},
+	})
+	for _, p := range []string{"/a", "/b", "/c"} {
+		hs.do("GET", p, "", nil)
+	}
+	evs := col.Wait(3, 2*time.Second)
+	if len(evs) != 3 {
+		t.Fatalf("collector got %d entries, want 3", len(evs))
+	}
+	var paths []string
+	for _, ev := range evs {
+		if ev.Path != "trace:/orders" {
+			t.Errorf("XADD to %q", ev.Path)
+		}
+		paths = append(paths, ev.Fields["requestUrl"][strings.LastIndexByte(ev.Fields["requestUrl"], '/'):])
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, " ") != "/a /b /c" {
+		t.Errorf("entries for %v", paths)
+	}
+}
+
+func TestAMQPSink(t *testing.T) {
+	col := mockcollector.New()
+	addr := listen(t, col.ServeAMQP)
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "amqp://tracer:secret@" + addr + "/audit", "payload_format": "ecs", "self_test": "strict",
+		"max_capture_kb": 512.0,
+		"amqp":           map[string]interface{}{"exchange": "traces", "routing_key": "trace.{status}", "confirm": true},
+	})
+	big := strings.Repeat("x", 200<<10) // more than one 128 KiB body frame
+	hs.do("POST", "/orders", big, nil)
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 {
+		t.Fatalf("broker got %d publishes, want the self test and the event", len(evs))
+	}
+	var doc struct {
+		URL  struct{ Path string }
+		HTTP struct {
+			Request struct {
+				Body struct{ Content string }
+			}
+		}
+	}
+	json.Unmarshal(evs[1].Doc, &doc)
+	if evs[0].Path != "trace.200" || evs[1].Path != "trace.201" || evs[1].ContentType != "application/json" ||
+		doc.URL.Path != "/orders" || doc.HTTP.Request.Body.Content != big {
+		t.Errorf("published %q / %q as %q: %s, %d byte body", evs[0].Path, evs[1].Path, evs[1].ContentType,
+			doc.URL.Path, len(doc.HTTP.Request.Body.Content))
+	}
+}
+
+// pubsubCreds writes authorized_user credentials whose token server hands
+// out "ps-token".
+func pubsubCreds(t *testing.T) string {
+	t.Helper()
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "rt" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"ps-token","expires_in":3600}`)
+	}))
+	t.Cleanup(tokens.Close)
+	creds := filepath.Join(t.TempDir(), "adc.json")
+	os.WriteFile(creds, []byte(`{"type":"authorized_user","client_id":"c","client_secret":"s","refresh_token":"rt",`+
+		`"token_uri":"`+tokens.URL+`"}`), 0o600)
+	return creds
+}
+
+func TestPubSubSink(t *testing.T) {
+	creds := pubsubCreds(t)
+	col := mockcollector.New()
+	auth := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		col.ServeHTTP(w, r)
+	}))
+	defer api.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "pubsub://acme-prod/krakend-traces", "payload_format": "v2", "endpoint": "/orders",
+		"pubsub": map[string]interface{}{"endpoint": api.URL, "credentials_file": creds, "ordering_key": "{endpoint}",
+			"batch_size": 2.0, "batch_delay_ms": 1000.0},
+	})
+	hs.do("GET", "/a", "", nil)
+	hs.do("GET", "/b", "", nil)
+
+	evs := col.Wait(1, 2*time.Second)
+	if len(evs) != 1 || evs[0].Path != "/v1/projects/acme-prod/topics/krakend-traces:publish" {
+		t.Fatalf("publish calls %+v", evs)
+	}
+	if got := <-auth; got != "Bearer ps-token" {
+		t.Errorf("Authorization = %q", got)
+	}
+	var body struct {
+		Messages []struct {
+			Data        []byte
+			Attributes  map[string]string
+			OrderingKey string
+		}
+	}
+	if err := json.Unmarshal(evs[0].Doc, &body); err != nil || len(body.Messages) != 2 {
+		t.Fatalf("not a batch of 2 messages: %v %s", err, evs[0].Body)
+	}
+	var paths []string
+	for _, m := range body.Messages {
+		ev := mockcollector.Decode("", "", m.Data)
+		paths = append(paths, ev.Fields["requestUrl"][strings.LastIndexByte(ev.Fields["requestUrl"], '/'):])
+		if m.OrderingKey != "/orders" || m.Attributes["endpoint"] != "/orders" || m.Attributes["status"] != "201" {
+			t.Errorf("message %+v", m)
+		}
+	}
+	if sort.Strings(paths); strings.Join(paths, " ") != "/a /b" {
+		t.Errorf("messages for %v", paths)
+	}
+}
+
+func TestPartitionKeys(t *testing.T) {
+	col := mockcollector.New()
+	api := httptest.NewServer(col)
+	defer api.Close()
+	opts := func(key map[string]interface{}) map[string]interface{} {
+		o := map[string]interface{}{"endpoint": api.URL, "credentials_file": pubsubCreds(t), "batch_size": 2.0, "batch_delay_ms": 1000.0}
+		for k, v := range key {
+			o[k] = v
+		}
+		return o
+	}
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "pubsub://acme-prod/krakend-traces", "payload_format": "v2",
+		"tenant": map[string]interface{}{"header": "X-Tenant"},
+		"pubsub": opts(map[string]interface{}{"ordering_key_expr": "meta.tenant + ':' + request.path"}),
+	})
+	hs.do("GET", "/a", "", http.Header{"X-Tenant": {"acme"}})
+	hs.do("GET", "/b", "", nil) // no tenant: the expression fails, no key
+
+	evs := col.Wait(1, 2*time.Second)
+	if len(evs) != 1 {
+		t.Fatalf("publish calls %+v", evs)
+	}
+	var body struct {
+		Messages []struct {
+			Data        []byte
+			OrderingKey string
+		}
+	}
+	if err := json.Unmarshal(evs[0].Doc, &body); err != nil || len(body.Messages) != 2 {
+		t.Fatalf("not a batch of 2 messages: %v %s", err, evs[0].Body)
+	}
+	keys := map[string]string{}
+	for _, m := range body.Messages {
+		u := mockcollector.Decode("", "", m.Data).Fields["requestUrl"]
+		keys[u[strings.LastIndexByte(u, '/'):]] = m.OrderingKey
+	}
+	if keys["/a"] != "acme:/a" || keys["/b"] != "" || len(keys) != 2 {
+		t.Errorf("ordering keys by path = %v", keys)
+	}
+
+	for _, c := range []struct {
+		key  map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"ordering_key": "{tenant}", "ordering_key_expr": "meta.tenant"}, "not both"},
+		{map[string]interface{}{"ordering_key_expr": "meta.tenant +"}, "invalid ordering_key_expr"},
+	} {
+		_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+			string(ClientRegisterer): map[string]interface{}{"tracking_url": "pubsub://acme-prod/krakend-traces", "pubsub": opts(c.key)},
+		})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: %v, want %q", c.key, err, c.want)
+		}
+	}
+}
+
+func TestEventHubsSink(t *testing.T) {
+	col := mockcollector.New()
+	auth := make(chan string, 2)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		col.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	ns := srv.Listener.Addr().String()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "eventhubs://placeholder/placeholder", "payload_format": "v2",
+		"sink_tls": map[string]interface{}{"ca_file": caFile, "server_name": "example.com"},
+		"eventhubs": map[string]interface{}{
+			"connection_string": "Endpoint=sb://" + ns + "/;SharedAccessKeyName=send;SharedAccessKey=k3y;EntityPath=traces",
+			"partition_key":     "{header.X-Tenant}", "batch_size": 3.0, "batch_delay_ms": 1000.0,
+		},
+	})
+	hs.do("GET", "/a", "", http.Header{"X-Tenant": {"acme"}})
+	hs.do("GET", "/b", "", http.Header{"X-Tenant": {"globex"}})
+	hs.do("GET", "/c", "", http.Header{"X-Tenant": {"acme"}})
+
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 {
+		t.Fatalf("collector got %d posts, want one per partition key", len(evs))
+	}
+	got := map[string][]string{}
+	for _, ev := range evs {
+		if ev.Path != "/traces/messages" || ev.ContentType != "application/vnd.microsoft.servicebus.json" {
+			t.Errorf("post %s %s", ev.Path, ev.ContentType)
+		}
+		var msgs []struct {
+			Body             string
+			UserProperties   map[string]string
+			BrokerProperties map[string]string
+		}
+		if err := json.Unmarshal(ev.Doc, &msgs); err != nil {
+			t.Fatalf("not a message batch: %v %s", err, ev.Body)
+		}
+		for _, m := range msgs {
+			key := m.BrokerProperties["PartitionKey"]
+			u := mockcollector.Decode("", "", []byte(m.Body)).Fields["requestUrl"]
+			got[key] = append(got[key], u[strings.LastIndexByte(u, '/'):])
+			if m.UserProperties["status"] != "201" {
+				t.Errorf("properties %v", m.UserProperties)
+			}
+		}
+	}
+	sort.Strings(got["acme"])
+	if fmt.Sprint(got["acme"], got["globex"]) != "[/a /c] [/b]" || len(got) != 2 {
+		t.Errorf("partitions %v", got)
+	}
+
+	sas, _ := url.ParseQuery(strings.TrimPrefix(<-auth, "SharedAccessSignature "))
+	mac := hmac.New(sha256.New, []byte("k3y"))
+	mac.Write([]byte(url.QueryEscape("https://"+ns+"/traces") + "\n" + sas.Get("se")))
+	if sas.Get("sr") != "https://"+ns+"/traces" || sas.Get("skn") != "send" ||
+		sas.Get("sig") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("SAS token %v", sas)
+	}
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	type bulk struct {
+		at   time.Time
+		docs []string // index and path of each document
+	}
+	var mu sync.Mutex
+	var bulks []bulk
+	done := make(chan struct{})
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" || len(lines)%2 != 0 {
+			t.Errorf("bulk %s %s:\n%s", r.URL.Path, r.Header.Get("Content-Type"), body)
+		}
+		b := bulk{at: time.Now()}
+		var items []string
+		for i := 0; i+1 < len(lines); i += 2 {
+			var action struct {
+				Index struct {
+					Index string `json:"_index"`
+				}
+			}
+			var doc struct{ Request struct{ URL string } }
+			if err := json.Unmarshal([]byte(lines[i]), &action); err != nil || action.Index.Index == "" {
+				t.Errorf("action line %q: %v", lines[i], err)
+			}
+			if err := json.Unmarshal([]byte(lines[i+1]), &doc); err != nil {
+				t.Errorf("document line %q: %v", lines[i+1], err)
+			}
+			path := doc.Request.URL[strings.LastIndexByte(doc.Request.URL, '/'):]
+			b.docs = append(b.docs, action.Index.Index+" "+path)
+			status := 201
+			if path == "/b" {
+				status = 429
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+		mu.Lock()
+		bulks = append(bulks, b)
+		n := len(bulks)
+		mu.Unlock()
+		switch n {
+		case 1: // the whole request throttled
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2: // one document throttled
+			fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+		default:
+			fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+			close(done)
+		}
+	}))
+	defer es.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": es.URL, "sink": "elasticsearch",
+		"elasticsearch": map[string]interface{}{
+			"index": "traces-{header.X-Tenant}-{yyyy.MM.dd}", "batch_size": 3.0, "batch_delay_ms": 1000.0,
+		},
+	})
+	hs.do("GET", "/a", "", http.Header{"X-Tenant": {"Acme"}})
+	hs.do("GET", "/b", "", http.Header{"X-Tenant": {"Globex"}})
+	hs.do("GET", "/c", "", nil)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the throttled document was not resent")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	day := time.Now().UTC().Format("2006.01.02")
+	all := []string{"traces-acme-" + day + " /a", "traces-globex-" + day + " /b", "traces-unknown-" + day + " /c"}
+	for i, want := range [][]string{all, all, all[1:2]} {
+		got := append([]string(nil), bulks[i].docs...)
+		if sort.Strings(got); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("bulk %d: %v, want %v", i+1, got, want)
+		}
+	}
+	if len(bulks) != 3 {
+		t.Errorf("%d bulk requests, want 3", len(bulks))
+	}
+	// exponential backoff: 100ms, then 200ms
+	if d := bulks[1].at.Sub(bulks[0].at); d < 100*time.Millisecond {
+		t.Errorf("first retry after %v", d)
+	}
+	if d := bulks[2].at.Sub(bulks[1].at); d < 200*time.Millisecond {
+		t.Errorf("second retry after %v", d)
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	col := mockcollector.New()
+	var mu sync.Mutex
+	tenants := map[string]mockcollector.Event{}
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		tenants[r.Header.Get("X-Scope-OrgID")] = mockcollector.Decode(r.URL.Path, r.Header.Get("Content-Type"), body)
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		col.ServeHTTP(w, r)
+	}))
+	defer loki.Close()
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		echo(w, r)
+	}, map[string]interface{}{
+		"tracking_url": loki.URL, "sink": "loki", "payload_format": "v2", "endpoint": "/orders",
+		"loki": map[string]interface{}{
+			"labels": map[string]interface{}{"job": "gw", "status": "{status_class}"},
+			"tenant": "{header.X-Tenant}", "batch_size": 3.0, "batch_delay_ms": 1000.0,
+		},
+	})
+	hs.do("GET", "/a", "", http.Header{"X-Tenant": {"acme"}})
+	hs.do("GET", "/missing", "", http.Header{"X-Tenant": {"acme"}})
+	hs.do("GET", "/b", "", http.Header{"X-Tenant": {"globex"}})
+
+	if evs := col.Wait(2, 2*time.Second); len(evs) != 2 {
+		t.Fatalf("loki got %d pushes, want one per tenant", len(evs))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for tenant, want := range map[string]string{"acme": "2xx:/a 4xx:/missing", "globex": "2xx:/b"} {
+		ev := tenants[tenant]
+		if ev.Path != "/loki/api/v1/push" || ev.ContentType != "application/json" {
+			t.Errorf("%s: push %s %s", tenant, ev.Path, ev.ContentType)
+		}
+		var push struct {
+			Streams []struct {
+				Stream map[string]string
+				Values [][2]string
+			}
+		}
+		if err := json.Unmarshal(ev.Doc, &push); err != nil {
+			t.Fatalf("%s: %v %s", tenant, err, ev.Body)
+		}
+		var got []string
+		for _, st := range push.Streams {
+			if st.Stream["job"] != "gw" || len(st.Stream) != 2 {
+				t.Errorf("%s: labels %v", tenant, st.Stream)
+			}
+			for _, v := range st.Values {
+				u := mockcollector.Decode("", "", []byte(v[1])).Fields["requestUrl"]
+				if ns, err := strconv.ParseInt(v[0], 10, 64); err != nil || time.Since(time.Unix(0, ns)) > time.Minute {
+					t.Errorf("%s: timestamp %q", tenant, v[0])
+				}
+				got = append(got, st.Stream["status"]+":"+u[strings.LastIndexByte(u, '/'):])
+			}
+		}
+		if sort.Strings(got); strings.Join(got, " ") != want {
+			t.Errorf("%s: lines %v, want %s", tenant, got, want)
+		}
+	}
+}
+
+func TestClickHouseSink(t *testing.T) {
+	col := mockcollector.New()
+	reqs := make(chan *http.Request, 1)
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- r
+		col.ServeHTTP(w, r)
+	}))
+	defer ch.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": ch.URL, "sink": "clickhouse", "endpoint": "/orders", "backend": "orders-svc",
+		"clickhouse": map[string]interface{}{
+			"database": "obs", "username": "writer", "password": "pw", "async_insert": true,
+			"batch_size": 2.0, "batch_delay_ms": 1000.0,
+		},
+	})
+	hs.do("POST", "/orders?dry=1", `{"sku":"a"}`, http.Header{"Content-Type": {"application/json"}})
+	hs.do("POST", "/orders?dry=2", `{"sku":"b"}`, http.Header{"Content-Type": {"application/json"}})
+
+	evs := col.Wait(1, 2*time.Second)
+	if len(evs) != 1 {
+		t.Fatalf("clickhouse got %d inserts, want one batch", len(evs))
+	}
+	r := <-reqs
+	q := r.URL.Query()
+	if q.Get("query") != "INSERT INTO obs.krakend_traces FORMAT JSONEachRow" || q.Get("async_insert") != "1" ||
+		q.Get("wait_for_async_insert") != "1" || q.Get("date_time_input_format") != "best_effort" {
+		t.Errorf("query string %v", q)
+	}
+	if r.Header.Get("X-ClickHouse-User") != "writer" || r.Header.Get("X-ClickHouse-Key") != "pw" {
+		t.Errorf("credentials %v", r.Header)
+	}
+
+	// every row carries exactly the columns of the published table
+	ddl, err := os.ReadFile("../schema/clickhouse.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var columns []string
+	for _, m := range regexp.MustCompile(`(?m)^    (\w+) +\w`).FindAllStringSubmatch(string(ddl), -1) {
+		columns = append(columns, m[1])
+	}
+	sort.Strings(columns)
+	lines := strings.Split(strings.TrimSpace(evs[0].Body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("JSONEachRow body %q", evs[0].Body)
+	}
+	var queries []string
+	for _, line := range lines {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("row %q: %v", line, err)
+		}
+		var keys []string
+		for k := range row {
+			keys = append(keys, k)
+		}
+		if sort.Strings(keys); strings.Join(keys, ",") != strings.Join(columns, ",") {
+			t.Errorf("row columns %v, table has %v", keys, columns)
+		}
+		if _, err := time.Parse("2006-01-02 15:04:05.000", row["timestamp"].(string)); err != nil {
+			t.Errorf("timestamp %v", row["timestamp"])
+		}
+		if row["endpoint"] != "/orders" || row["backend"] != "orders-svc" || row["status"] != 201.0 ||
+			!strings.HasPrefix(row["request_body"].(string), `{"sku":`) || !strings.Contains(row["response_body"].(string), `"method":"POST"`) {
+			t.Errorf("row %v", row)
+		}
+		queries = append(queries, row["query"].(string))
+	}
+	if sort.Strings(queries); strings.Join(queries, " ") != "dry=1 dry=2" {
+		t.Errorf("queries %v", queries)
+	}
+}
+
+func TestGELFSink(t *testing.T) {
+	type gelf struct {
+		Version      string
+		Host         string
+		ShortMessage string `json:"short_message"`
+		FullMessage  string `json:"full_message"`
+		Timestamp    float64
+		Level        int
+		Endpoint     string `json:"_endpoint"`
+	}
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/boom" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		echo(w, r)
+	}
+	check := func(t *testing.T, ev mockcollector.Event, path string, status, level int) string {
+		t.Helper()
+		var m gelf
+		if err := json.Unmarshal(ev.Doc, &m); err != nil {
+			t.Fatalf("not a GELF message: %v %q", err, ev.Body)
+		}
+		if m.Version != "1.1" || m.Host == "" || m.ShortMessage != path+" "+strconv.Itoa(status) ||
+			m.Level != level || m.Endpoint != "/orders" || time.Since(time.UnixMilli(int64(m.Timestamp*1000))) > time.Minute {
+			t.Errorf("message %+v", m)
+		}
+		if strings.Contains(ev.Body, `"_id"`) {
+			t.Errorf("reserved _id field sent: %s", ev.Body)
+		}
+		return mockcollector.Decode("", "", []byte(m.FullMessage)).Fields["requestUrl"]
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		col := mockcollector.New()
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		go col.ServeGELFUDP(pc)
+		hs := newHarness(t, echo, map[string]interface{}{
+			"tracking_url": "gelf+udp://" + pc.LocalAddr().String(), "payload_format": "v2", "endpoint": "/orders",
+			"gelf": map[string]interface{}{"chunk_size": 256.0},
+		})
+		// incompressible, so the gzip'd message still spans several chunks
+		body := make([]byte, 3000)
+		rand.Read(body)
+		hs.do("POST", "/upload", base64.StdEncoding.EncodeToString(body), nil)
+		evs := col.Wait(1, 2*time.Second)
+		if len(evs) != 1 || evs[0].Path != "gelf+udp" {
+			t.Fatalf("collector got %+v", evs)
+		}
+		if u := check(t, evs[0], "/upload", 201, 6); !strings.HasSuffix(u, "/upload") {
+			t.Errorf("full_message for %q", u)
+		}
+		var m gelf
+		json.Unmarshal(evs[0].Doc, &m)
+		if !strings.Contains(m.FullMessage, base64.StdEncoding.EncodeToString(body)) {
+			t.Error("request body lost across chunks")
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		col := mockcollector.New()
+		hs := newHarness(t, failing, map[string]interface{}{
+			"tracking_url": "gelf+tcp://" + listen(t, col.ServeGELF), "payload_format": "v2", "endpoint": "/orders",
+		})
+		hs.do("GET", "/boom", "", nil)
+		col.Wait(1, 2*time.Second)
+		hs.do("GET", "/ok", "", nil)
+		evs := col.Wait(2, 2*time.Second)
+		if len(evs) != 2 || evs[0].Path != "gelf+tcp" {
+			t.Fatalf("collector got %+v", evs)
+		}
+		check(t, evs[0], "/boom", 502, 3)
+		check(t, evs[1], "/ok", 201, 6)
+	})
+}
+
+func TestStdoutSink(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	lines := make(chan string, 4)
+	go func() {
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	defer w.Close()
+
+	// the same event also goes to sqlite, to compare with its doc column
+	path := filepath.Join(t.TempDir(), "traces.db")
+	hs := newHarness(t, echo, map[string]interface{}{
+		"sink": "stdout", "endpoint": "/orders",
+		"sink_rules": []interface{}{map[string]interface{}{
+			"if": "response.status == 201", "sink": "sqlite", "sqlite": map[string]interface{}{"path": path},
+		}},
+	})
+	hs.do("POST", "/orders", `{"sku":"a",`+"\n"+`"qty":2}`, http.Header{"Content-Type": {"application/json"}})
+
+	var line string
+	select {
+	case line = <-lines:
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing on stdout")
+	}
+	var ev struct {
+		Request struct{ Method, Body string }
+	}
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Request.Method != "POST" || ev.Request.Body != "{\"sku\":\"a\",\n\"qty\":2}" {
+		t.Fatalf("line %q: %v", line, err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var doc string
+	for deadline := time.Now().Add(2 * time.Second); doc == "" && time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		db.QueryRow(`SELECT doc FROM traces`).Scan(&doc)
+	}
+	if doc != line {
+		t.Errorf("stdout line\n%s\nsqlite doc\n%s", line, doc)
+	}
+	select {
+	case extra := <-lines:
+		t.Errorf("a second line %q for one event", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "traces.db")
+	// a row from two days ago, pruned when the sink opens the store
+	os.MkdirAll(filepath.Dir(path), 0o750)
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Exec(`CREATE TABLE traces (id INTEGER PRIMARY KEY, at INTEGER NOT NULL, endpoint TEXT NOT NULL, status INTEGER NOT NULL, doc TEXT NOT NULL)`)
+	db.Exec(`INSERT INTO traces (at, endpoint, status, doc) VALUES (?, '/old', 200, '{}')`, time.Now().Add(-48*time.Hour).UnixMilli())
+
+	hs := newHarness(t, echo, map[string]interface{}{
+		"sink": "sqlite", "endpoint": "/orders",
+		"sqlite": map[string]interface{}{"path": path, "max_age_hours": 24.0, "max_mb": 0.25},
+	})
+	wait := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			var rows int
+			db.QueryRow(`SELECT count(*) FROM traces WHERE endpoint = '/orders'`).Scan(&rows)
+			if rows >= n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d rows in the store, want %d", rows, n)
+			}
+		}
+	}
+	hs.do("POST", "/orders?n=1", `{"sku":"a"}`, nil)
+	wait(1)
+
+	var mode string
+	db.QueryRow(`PRAGMA journal_mode`).Scan(&mode)
+	var old, status int
+	var doc string
+	db.QueryRow(`SELECT count(*) FROM traces WHERE endpoint = '/old'`).Scan(&old)
+	db.QueryRow(`SELECT status, doc FROM traces WHERE endpoint = '/orders'`).Scan(&status, &doc)
+	if mode != "wal" || old != 0 || status != 201 {
+		t.Errorf("journal_mode %s, %d expired rows, status %d", mode, old, status)
+	}
+	var ev struct {
+		Request struct{ Method, URL, Body string }
+		Meta    map[string]string
+	}
+	if err := json.Unmarshal([]byte(doc), &ev); err != nil || ev.Request.Method != "POST" ||
+		!strings.HasSuffix(ev.Request.URL, "/orders?n=1") || ev.Request.Body != `{"sku":"a"}` || ev.Meta["status"] != "201" {
+		t.Errorf("document %s: %v", doc, err)
+	}
+
+	// ~5 KB rows: the size cap, checked every 256 writes, keeps the newest
+	body := strings.Repeat("x", 2500)
+	for i := 0; i < 299; i++ {
+		hs.do("POST", "/orders", body, nil)
+	}
+	var rows, oldest int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		db.QueryRow(`SELECT count(*), count(*) FILTER (WHERE doc LIKE '%n=1%') FROM traces`).Scan(&rows, &oldest)
+		if oldest == 0 && rows < 150 {
+			break
+		}
+	}
+	if rows >= 150 || oldest != 0 {
+		t.Errorf("%d rows, the first event kept: %v, after 300 writes over a 0.25 MB cap", rows, oldest != 0)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"sink": "file",
+		"file": map[string]interface{}{"dir": dir},
+	})
+	hs.do("GET", "/a", "", nil)
+	hs.do("GET", "/b", "", nil)
+
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		names, _ := filepath.Glob(filepath.Join(dir, "traces-*.har"))
+		var har struct {
+			Log struct {
+				Entries []struct {
+					Response struct{ Status int }
+				}
+			}
+		}
+		if len(names) > 0 {
+			b, _ := os.ReadFile(names[0])
+			if json.Unmarshal(b, &har) == nil && len(har.Log.Entries) == 2 && har.Log.Entries[1].Response.Status == 201 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no valid HAR file with 2 entries in %s (%v)", dir, names)
+		}
+	}
+
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"sink": "file", "file": map[string]interface{}{"dir": dir, "format": "ndjson"}},
+	}); err == nil || !strings.Contains(err.Error(), "sqlite sink") {
+		t.Errorf("ndjson file sink: %v", err)
+	}
+}
+
+func TestParquetSink(t *testing.T) {
+	dir := t.TempDir()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"sink": "parquet", "endpoint": "/orders",
+		"parquet": map[string]interface{}{"dir": dir, "max_rows": 2.0},
+	})
+	hs.do("POST", "/orders?n=1", `{"sku":"a"}`, nil)
+	hs.do("POST", "/orders?n=2", `{"sku":"b"}`, nil)
+
+	var names []string
+	for deadline := time.Now().Add(2 * time.Second); len(names) == 0; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no parquet file in %s", dir)
+		}
+		names, _ = filepath.Glob(filepath.Join(dir, "dt=*", "hour=*", "part-*.parquet"))
+	}
+	now := time.Now().UTC()
+	if rel, _ := filepath.Rel(dir, filepath.Dir(names[0])); rel != now.Format("dt=2006-01-02/hour=15") {
+		t.Errorf("partition %s", rel)
+	}
+	cols, rows := readParquet(t, names[0])
+	if rows != 2 {
+		t.Fatalf("%d rows, want 2", rows)
+	}
+	if got := fmt.Sprint(cols["endpoint"], cols["status"]); got != "[/orders /orders] [201 201]" {
+		t.Errorf("endpoint, status = %s", got)
+	}
+	queries := []string{cols["query"][0].(string), cols["query"][1].(string)}
+	if sort.Strings(queries); fmt.Sprint(queries) != "[n=1 n=2]" {
+		t.Errorf("query = %v", queries)
+	}
+	for i := 0; i < rows; i++ {
+		if at := time.UnixMilli(cols["timestamp"][i].(int64)); now.Sub(at) > time.Minute {
+			t.Errorf("timestamp %s", at)
+		}
+		var meta map[string]string
+		if err := json.Unmarshal([]byte(cols["meta"][i].(string)), &meta); err != nil || meta["status"] != "201" {
+			t.Errorf("meta %q: %v", cols["meta"][i], err)
+		}
+		if body := cols["request_body"][i].(string); !strings.HasPrefix(body, `{"sku":`) {
+			t.Errorf("request_body %q", body)
+		}
+	}
+}
+
+// readParquet decodes the files the parquet sink writes: one row group of
+// REQUIRED PLAIN columns, one GZIP data page each. It returns the values by
+// column name and the row count.
+func readParquet(t *testing.T, name string) (map[string][]interface{}, int) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 12 || string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		t.Fatalf("%s: not a parquet file", name)
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&thriftReader{b: b[len(b)-8-n : len(b)-8]}).readStruct()
+
+	types := map[string]int64{}
+	for _, el := range meta[2].([]interface{})[1:] {
+		el := el.(map[int16]interface{})
+		types[string(el[4].([]byte))] = el[1].(int64)
+	}
+	rows := int(meta[3].(int64))
+	cols := map[string][]interface{}{}
+	for _, cc := range meta[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{}) {
+		md := cc.(map[int16]interface{})[3].(map[int16]interface{})
+		col := string(md[3].([]interface{})[0].([]byte))
+		r := &thriftReader{b: b[md[9].(int64):]}
+		hdr := r.readStruct()
+		zr, err := gzip.NewReader(bytes.NewReader(r.b[r.off : r.off+int(hdr[3].(int64))]))
+		if err != nil {
+			t.Fatalf("%s: %v", col, err)
+		}
+		plain, _ := io.ReadAll(zr)
+		if len(plain) != int(hdr[2].(int64)) {
+			t.Fatalf("%s: page is %d bytes, header says %d", col, len(plain), hdr[2])
+		}
+		for i := 0; i < rows; i++ {
+			switch types[col] {
+			case 1:
+				cols[col] = append(cols[col], int32(binary.LittleEndian.Uint32(plain)))
+				plain = plain[4:]
+			case 2:
+				cols[col] = append(cols[col], int64(binary.LittleEndian.Uint64(plain)))
+				plain = plain[8:]
+			case 6:
+				l := binary.LittleEndian.Uint32(plain)
+				cols[col] = append(cols[col], string(plain[4:4+l]))
+				plain = plain[4+l:]
+			}
+		}
+	}
+	if len(cols) != len(types) {
+		t.Fatalf("%d column chunks for %d schema columns", len(cols), len(types))
+	}
+	return cols, rows
+}
+
+// thriftReader is a Thrift compact protocol decoder for the types Parquet
+// metadata uses; structs decode to field id → value maps.
+type thriftReader struct {
+	b   []byte
+	off int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.off:])
+	r.off += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2: // bool
+		return typ == 1
+	case 5, 6: // i32, i64 (zigzag)
+		u := r.uvarint()
+		return int64(u>>1) ^ -int64(u&1)
+	case 8: // binary
+		n := int(r.uvarint())
+		r.off += n
+		return r.b[r.off-n : r.off]
+	case 9: // list
+		h := r.b[r.off]
+		r.off++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case 12:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("thrift type %d", typ))
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var id int16
+	for {
+		h := r.b[r.off]
+		r.off++
+		if h == 0 {
+			return fields
+		}
+		if d := int16(h >> 4); d != 0 {
+			id += d
+		} else {
+			u := r.uvarint()
+			id = int16(u>>1) ^ -int16(u&1)
+		}
+		fields[id] = r.value(h & 0x0f)
+	}
+}
+
+/* ───────── shadow ───────── */
+
+func TestShadowDiff(t *testing.T) {
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Backend", "v2")
+		w.WriteHeader(http.StatusCreated)
+		// same document as echo, other key order
+		io.WriteString(w, `{"path":"`+r.URL.Path+`","method":"GET","body":""}`)
+	}))
+	defer shadowBackend.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"shadow": map[string]interface{}{"url": shadowBackend.URL},
+	})
+	hs.do("GET", "/orders", "", nil)
+	hs.do("POST", "/orders", "x", nil) // not mirrored by default
+
+	var diff *mockcollector.Event
+	for _, ev := range hs.events(3) {
+		if ev.Meta["event"] == "shadow_diff" {
+			if diff != nil {
+				t.Fatal("more than one diff event")
+			}
+			diff = &ev
+		}
+	}
+	if diff == nil {
+		t.Fatal("no shadow_diff event")
+	}
+	for k, want := range map[string]string{
+		"shadow.status_match": "true", "shadow.body_match": "true",
+		"shadow.headers_diff": "X-Backend", "shadow.primary_status": "201",
+	} {
+		if diff.Meta[k] != want {
+			t.Errorf("%s = %q, want %q", k, diff.Meta[k], want)
+		}
+	}
+}
+
+/* ───────── admin server ───────── */
+
+func TestRecentEvents(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"admin_port": float64(port), "recent_events": float64(10),
+		"transform": []interface{}{map[string]interface{}{"redact": map[string]interface{}{
+			"pattern": `"secret":"[^"]*"`, "with": `"secret":"***"`}}},
+	})
+	id := capture.RandomID() // the buffer outlives the test
+	hs.do("POST", "/a", `{"secret":"hunter2"}`, http.Header{"X-Request-Id": {id}})
+	hs.do("GET", "/b", "", http.Header{"X-Request-Id": {"other"}})
+	hs.events(2)
+
+	var list struct {
+		Events []struct {
+			RequestID string `json:"request_id"`
+			Request   struct {
+				URL  string `json:"url"`
+				Body string `json:"body"`
+			} `json:"request"`
+		} `json:"events"`
+	}
+	base := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/traces"
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(base + "?request_id=" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Events) > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(list.Events) != 1 {
+		t.Fatalf("got %d events for %s, want 1", len(list.Events), id)
+	}
+	if ev := list.Events[0]; !strings.HasSuffix(ev.Request.URL, "/a") || ev.Request.Body != `{"secret":"***"}` {
+		t.Errorf("event = %+v, want the redacted POST /a", ev)
+	}
+}
+
+func TestStrictSelfTest(t *testing.T) {
+	capture.SetLogger(nopLogger{})
+	col := mockcollector.New()
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+	register := func(path string) error {
+		_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+			string(ClientRegisterer): map[string]interface{}{"tracking_url": srv.URL + path, "self_test": "strict"}})
+		return err
+	}
+
+	col.Status = http.StatusUnauthorized
+	if err := register("/denied"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("err = %v, want the collector's 401", err)
+	}
+	col.Status = 0
+	if err := register("/ok"); err != nil {
+		t.Fatal(err)
+	}
+	evs := col.Events()
+	if len(evs) != 2 || evs[1].Meta["event"] != "self_test" {
+		t.Fatalf("collector got %+v, want two self_test events", evs)
+	}
+}
+
+type infoLogger struct {
+	nopLogger
+	lines chan string
+}
+
+func (l infoLogger) Info(v ...interface{}) { l.lines <- fmt.Sprintln(v...) }
+
+func TestEarlyLogLinesAreReplayed(t *testing.T) {
+	if os.Getenv("TRACE_PLUGIN_EARLY_LOG") == "" {
+		// the logger is process state: run this test again in a fresh process
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEarlyLogLinesAreReplayed$")
+		cmd.Env = append(os.Environ(), "TRACE_PLUGIN_EARLY_LOG=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+	srv := httptest.NewServer(mockcollector.New())
+	defer srv.Close()
+	if _, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": srv.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	log := infoLogger{lines: make(chan string, 10)}
+	ClientRegisterer.RegisterLogger(log)
+	select {
+	case line := <-log.lines:
+		if !strings.Contains(line, "config →") {
+			t.Errorf("first line %q, want the config line logged before RegisterLogger", line)
+		}
+	default:
+		t.Error("nothing replayed into the injected logger")
+	}
+}
+
+type drainLogger struct {
+	infoLogger
+}
+
+func (l drainLogger) Warning(v ...interface{}) { l.lines <- fmt.Sprintln(v...) }
+
+func TestDrainOnTeardown(t *testing.T) {
+	col := mockcollector.New()
+	col.Delay = 100 * time.Millisecond
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	backend := httptest.NewServer(http.HandlerFunc(echo))
+	defer backend.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	capture.SetLogger(nopLogger{})
+	h, err := ClientRegisterer.registerClients(ctx, map[string]interface{}{string(ClientRegisterer): map[string]interface{}{
+		"tracking_url": tracking.URL, "endpoint": "/drain", "drain_timeout_ms": 3000.0,
+		"queue": map[string]interface{}{"workers": 1.0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(path string) {
+		req, _ := http.NewRequest("GET", backend.URL+path, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 0; i < 4; i++ {
+		do("/queued")
+	}
+	time.Sleep(30 * time.Millisecond) // one event in flight, three queued
+	log := drainLogger{infoLogger{lines: make(chan string, 10)}}
+	capture.SetLogger(log)
+	defer capture.SetLogger(nopLogger{})
+	cancel()
+
+	var line string
+	for line == "" {
+		select {
+		case l := <-log.lines:
+			if strings.Contains(l, "drained /drain:") {
+				line = l
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no drain line logged")
+		}
+	}
+	if !strings.Contains(line, "3 sent, 0 abandoned") {
+		t.Errorf("drain line %q, want the three queued events sent", line)
+	}
+	if n := len(col.Events()); n != 4 {
+		t.Errorf("collector got %d events, want 4", n)
+	}
+	do("/after")
+	time.Sleep(150 * time.Millisecond)
+	if n := len(col.Events()); n != 4 {
+		t.Errorf("collector got %d events, want the request after teardown only proxied", n)
+	}
+}
+
+func TestDryRunLogsInsteadOfSending(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"dry_run": true,
+		"transform": []interface{}{map[string]interface{}{"redact": map[string]interface{}{
+			"pattern": `"secret":"[^"]*"`, "with": `"secret":"***"`}}},
+	})
+	log := infoLogger{lines: make(chan string, 1)}
+	capture.SetLogger(log)
+	defer capture.SetLogger(nopLogger{})
+	hs.do("POST", "/orders", `{"secret":"hunter2"}`, nil)
+
+	select {
+	case line := <-log.lines:
+		if !strings.Contains(line, "dry_run") || !strings.Contains(line, `{$requestBody}{"secret":"***"}`) {
+			t.Errorf("logged %q, want the redacted payload", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing logged")
+	}
+	if n := len(hs.collector.Events()); n != 0 {
+		t.Errorf("collector got %d events, want none", n)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	capture.SetLogger(nopLogger{})
+	col := mockcollector.New()
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+	register := func() error {
+		_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+			string(ClientRegisterer): map[string]interface{}{"tracking_url": srv.URL + "/faulty", "self_test": "strict",
+				"fault_injection": map[string]interface{}{"error_rate": float64(1)}}})
+		return err
+	}
+
+	if err := register(); err == nil || !strings.Contains(err.Error(), "TRACE_PLUGIN_FAULT_INJECTION") {
+		t.Fatalf("err = %v, want fault_injection refused without the variable", err)
+	}
+	t.Setenv("TRACE_PLUGIN_FAULT_INJECTION", "1")
+	if err := register(); err == nil || !strings.Contains(err.Error(), "injected error") {
+		t.Fatalf("err = %v, want the injected error", err)
+	}
+	if n := len(col.Events()); n != 0 {
+		t.Errorf("collector got %d events, want none", n)
+	}
+}
+
+func TestBlockingBackpressureWaitsForSpace(t *testing.T) {
+	col := mockcollector.New()
+	col.Delay = 300 * time.Millisecond
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"tracking_url": tracking.URL,
+		"queue": map[string]interface{}{"size": 1.0, "workers": 1.0, "backpressure": "block", "block_ms": 2000.0}})
+	hs.do("GET", "/sending", "", nil)
+	time.Sleep(50 * time.Millisecond) // taken by the worker
+	hs.do("GET", "/queued", "", nil)
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	hs.do("GET", "/waiting", "", nil)
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Errorf("handler returned after %v, want it to wait for space", waited)
+	}
+	if evs := col.Wait(3, 3*time.Second); len(evs) != 3 {
+		t.Errorf("collector got %d events, want none dropped", len(evs))
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	for policy, want := range map[string]string{"drop_oldest": "/a /c", "metadata": "/a /b /c"} {
+		t.Run(policy, func(t *testing.T) {
+			col := mockcollector.New()
+			col.Delay = 300 * time.Millisecond
+			tracking := httptest.NewServer(col)
+			defer tracking.Close()
+			hs := newHarness(t, echo, map[string]interface{}{"tracking_url": tracking.URL,
+				"queue":    map[string]interface{}{"size": 1.0, "workers": 1.0},
+				"overflow": map[string]interface{}{"policy": policy}})
+			for _, path := range []string{"/a", "/b", "/c"} {
+				hs.do("POST", path, "body", nil)
+				time.Sleep(50 * time.Millisecond) // /a is taken by the worker, /b waits
+			}
+			evs := col.Wait(3, 2*time.Second)
+			var got []string
+			for _, ev := range evs {
+				u, _ := url.Parse(ev.Fields["requestUrl"])
+				got = append(got, u.Path)
+				if lean := ev.Meta["capture"] == "metadata_only"; lean != (u.Path == "/c" && policy == "metadata") ||
+					lean == (ev.Fields["requestBody"] == "body") {
+					t.Errorf("%s: capture %q, requestBody %q", u.Path, ev.Meta["capture"], ev.Fields["requestBody"])
+				}
+			}
+			if strings.Join(got, " ") != want {
+				t.Errorf("collector got %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestOverflowMetadataKeepsAuditChain(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyFile := filepath.Join(t.TempDir(), "audit.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	col := mockcollector.New()
+	col.Delay = 400 * time.Millisecond
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		echo(w, r)
+	}
+	hs := newHarness(t, slow, map[string]interface{}{"tracking_url": tracking.URL,
+		"queue":    map[string]interface{}{"size": 1.0, "workers": 1.0},
+		"overflow": map[string]interface{}{"policy": "metadata"},
+		"audit":    map[string]interface{}{"key_file": keyFile}})
+	// /slow is admitted with bodies and finds the queue full once answered
+	done := make(chan struct{})
+	go func() { hs.do("POST", "/slow", "body", nil); close(done) }()
+	time.Sleep(20 * time.Millisecond)
+	for _, path := range []string{"/a", "/b"} {
+		hs.do("POST", path, "body", nil)
+		time.Sleep(50 * time.Millisecond)
+	}
+	<-done
+	seqs := map[string]string{}
+	for _, ev := range col.Wait(3, 3*time.Second) {
+		u, _ := url.Parse(ev.Fields["requestUrl"])
+		seqs[u.Path] = ev.Meta["audit.seq"] + " " + ev.Meta["capture"]
+	}
+	if seqs["/a"] != "1 " || seqs["/b"] != "2 " || seqs["/slow"] != "3 metadata_only" {
+		t.Errorf("audit.seq and capture by path = %q, want /a 1, /b 2, /slow 3 metadata_only", seqs)
+	}
+}
+
+func TestPendingBudgetDegradesToMetadata(t *testing.T) {
+	col := mockcollector.New()
+	col.Delay = 300 * time.Millisecond
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"tracking_url": tracking.URL,
+		"max_pending_mb": 0.01, "queue": map[string]interface{}{"workers": 1.0}})
+	body := strings.Repeat("x", 20<<10)
+	hs.do("POST", "/first", body, nil)
+	hs.do("POST", "/second", body, nil) // the first still holds its bodies
+	if evs := col.Wait(2, 3*time.Second); len(evs) != 2 {
+		t.Fatalf("collector got %d events, want 2", len(evs))
+	}
+	time.Sleep(50 * time.Millisecond) // the worker releases after the send returns
+	hs.do("POST", "/third", body, nil)
+	evs := col.Wait(3, 3*time.Second)
+	if len(evs) != 3 {
+		t.Fatalf("collector got %d events, want 3", len(evs))
+	}
+	for _, ev := range evs {
+		full := !strings.Contains(ev.Fields["requestUrl"], "/second")
+		if got := ev.Fields["requestBody"] == body; got != full {
+			t.Errorf("%s: full body %v, want %v", ev.Fields["requestUrl"], got, full)
+		}
+		if got := ev.Meta["capture"] == "metadata_only"; got == full {
+			t.Errorf("%s: capture = %q", ev.Fields["requestUrl"], ev.Meta["capture"])
+		}
+	}
+}
+
+func TestPanicsBecomeErrorEvents(t *testing.T) {
+	t.Setenv("TRACE_PLUGIN_FAULT_INJECTION", "1")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"admin_port": float64(port),
+		"queue":           map[string]interface{}{"workers": 1.0},
+		"fault_injection": map[string]interface{}{"panic_rate": 1.0}})
+	hs.do("GET", "/first?token=secret", "", nil)
+	hs.do("GET", "/second", "", nil)
+
+	for i, ev := range hs.events(2) { // the only worker survived the first panic
+		if ev.Meta["error_class"] != "panic" || ev.Meta["panic_in"] != "queue worker" ||
+			ev.Meta["error"] != "fault injection: injected panic" || ev.Meta["status"] != "201" {
+			t.Errorf("event %d meta = %v", i, ev.Meta)
+		}
+		if ev.Fields["requestQuery"] != "" || ev.Fields["responseBody"] != "" {
+			t.Errorf("event %d kept query %q / body %q", i, ev.Fields["requestQuery"], ev.Fields["responseBody"])
+		}
+	}
+	resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/panics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats map[string]struct{ Count int }
+	json.NewDecoder(resp.Body).Decode(&stats)
+	if stats["queue worker"].Count < 2 {
+		t.Errorf("panic stats = %v, want 2 queue worker panics", stats)
+	}
+}
+
+func TestAdminRuntimeControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	admin := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	col := mockcollector.New()
+	col.Delay = 100 * time.Millisecond
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	u, _ := url.Parse(tracking.URL + "/track")
+	u.User = url.UserPassword("trace", "hunter2")
+	hs := newHarness(t, echo, map[string]interface{}{"admin_port": float64(port), "endpoint": "/control",
+		"tracking_url": u.String(), "queue": map[string]interface{}{"workers": 1.0},
+		"tokenize": map[string]interface{}{"url": tracking.URL + "/tokens", "headers": map[string]interface{}{"X-Api-Key": "k-123"},
+			"fields": []interface{}{"meta.never"}},
+		"labels": map[string]interface{}{"bus": "Endpoint=sb://ns.example/;SharedAccessKeyName=send;SharedAccessKey=abc123"}})
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get(admin + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Post(admin+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type backend struct {
+		Endpoint                        string
+		Requests, Sent, Failed, Dropped int64
+		Queued                          int
+		Config                          map[string]interface{}
+	}
+	find := func(list []backend) backend { // the last one, with -count
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].Endpoint == "/control" {
+				return list[i]
+			}
+		}
+		t.Fatalf("no /control backend in %+v", list)
+		return backend{}
+	}
+
+	for i := 0; i < 4; i++ {
+		hs.do("GET", "/queued", "", nil)
+	}
+	time.Sleep(50 * time.Millisecond) // the worker holds one event, the others wait
+	var stats struct{ Backends []backend }
+	get("/debug/stats", &stats)
+	if st := find(stats.Backends); st.Requests != 4 || st.Queued < 2 {
+		t.Errorf("stats before the flush = %+v, want 4 requests and queued events", st)
+	}
+	var flushed struct{ Flushed int }
+	post("/debug/queue/flush", &flushed)
+	if flushed.Flushed < 2 {
+		t.Errorf("flushed %d events, want the queued ones", flushed.Flushed)
+	}
+	if evs := col.Wait(4, 2*time.Second); len(evs) != 4 {
+		t.Fatalf("collector got %d events, want 4", len(evs))
+	}
+	time.Sleep(150 * time.Millisecond) // the worker's own send
+	stats.Backends = nil
+	get("/debug/stats", &stats)
+	if st := find(stats.Backends); st.Sent != 4 || st.Queued != 0 || st.Failed != 0 {
+		t.Errorf("stats after the flush = %+v, want 4 sent and none queued", st)
+	}
+
+	var state struct{ Enabled bool }
+	post("/debug/capture?enabled=false", &state)
+	t.Cleanup(func() { http.Post(admin+"/debug/capture?enabled=true", "", nil) })
+	if state.Enabled {
+		t.Fatal("capture still enabled")
+	}
+	if rec := hs.do("POST", "/off", "hello", nil); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"hello"`) {
+		t.Errorf("proxied while off: %d %q", rec.Code, rec.Body)
+	}
+	post("/debug/capture?enabled=true", &state)
+	hs.do("GET", "/on", "", nil)
+	evs := col.Wait(5, 2*time.Second)
+	if len(evs) != 5 || !strings.Contains(evs[4].Body, "/on") {
+		t.Errorf("events after the switch: %d, want only /on captured", len(evs))
+	}
+
+	var configs []backend
+	get("/debug/config", &configs)
+	cfg := find(configs).Config
+	if cfg["tracking_url"] != strings.Replace(u.String(), "hunter2", "xxxxx", 1) {
+		t.Errorf("tracking_url = %v, want the password masked", cfg["tracking_url"])
+	}
+	headers := cfg["tokenize"].(map[string]interface{})["headers"].(map[string]interface{})
+	if headers["X-Api-Key"] != "****" || cfg["endpoint"] != "/control" {
+		t.Errorf("config = %v, want header values masked", cfg)
+	}
+	if bus := cfg["labels"].(map[string]interface{})["bus"]; bus != "Endpoint=sb://ns.example/;SharedAccessKeyName=send;SharedAccessKey=****" {
+		t.Errorf("labels.bus = %v, want the SharedAccessKey masked", bus)
+	}
+}
+
+func TestUnhealthySinkDropsBodies(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer health.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"health_check": map[string]interface{}{
+		"url": health.URL + "/healthz", "interval_ms": 100.0, "fail_threshold": 2.0, "pass_threshold": 1.0}})
+	waitFor := func(want string) *mockcollector.Event {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+			n := len(hs.collector.Events())
+			hs.do("POST", "/probe", "payload", nil)
+			ev := hs.events(n + 1)[n]
+			if ev.Meta["capture"] == want {
+				return &ev
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("no event with capture=%q", want)
+		return nil
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	ev := waitFor("metadata_only")
+	if ev.Fields["requestBody"] != "" || ev.Fields["responseBody"] != "" || ev.Meta["status"] != "201" {
+		t.Errorf("unhealthy: fields = %v, meta = %v, want the status without bodies", ev.Fields, ev.Meta)
+	}
+	status.Store(http.StatusOK)
+	ev = waitFor("")
+	if !strings.Contains(ev.Fields["responseBody"], "payload") {
+		t.Errorf("healthy again: response body = %q", ev.Fields["responseBody"])
+	}
+}
+
+func TestPipelineStatsEvents(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"pipeline_stats": map[string]interface{}{"interval_s": 1.0}})
+	for i := 0; i < 3; i++ {
+		hs.do("GET", "/counted", "", nil)
+	}
+	evs := hs.collector.Wait(4, 3*time.Second)
+	var stats map[string]interface{}
+	for _, ev := range evs {
+		if ev.Meta["event"] == "pipeline_stats" {
+			if err := json.Unmarshal([]byte(ev.Fields["responseBody"]), &stats); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if stats == nil {
+		t.Fatalf("no pipeline_stats event among %d events", len(evs))
+	}
+	if stats["requests"] != 3.0 || stats["sent"] != 3.0 || stats["failed"] != 0.0 || stats["interval_s"] != 1.0 {
+		t.Errorf("stats = %v, want 3 requests sent", stats)
+	}
+	if _, ok := stats["sink_p95_ms"].(float64); !ok {
+		t.Errorf("stats = %v, want sink_p95_ms", stats)
+	}
+}
+
+func TestDiagnosticDump(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	col := mockcollector.New()
+	col.Status = http.StatusServiceUnavailable
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"admin_port": float64(port), "endpoint": "/dump",
+		"tracking_urls": []interface{}{tracking.URL + "/a", tracking.URL + "/b"},
+		"balance":       map[string]interface{}{"fail_threshold": 1.0, "cooldown_ms": 60000.0}})
+	hs.do("GET", "/lost", "", nil)
+	if evs := col.Wait(2, 2*time.Second); len(evs) != 2 { // the send and its retry on the other target
+		t.Fatalf("collector got %d events, want 2", len(evs))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var dump struct {
+		Backends []struct {
+			Endpoint string
+			Failed   int64
+			InFlight int64 `json:"in_flight"`
+		}
+		SendErrors []struct{ Endpoint, Error string } `json:"send_errors"`
+		Targets    []struct{ Target, Circuit string } `json:"tracking_targets"`
+		Sinks      map[string]json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dump); err != nil {
+		t.Fatal(err)
+	}
+	failed := false
+	for _, b := range dump.Backends {
+		failed = failed || b.Endpoint == "/dump" && b.Failed == 1 && b.InFlight == 0
+	}
+	if !failed {
+		t.Errorf("backends = %+v, want /dump with one failed send", dump.Backends)
+	}
+	if n := len(dump.SendErrors); n == 0 || dump.SendErrors[n-1].Endpoint != "/dump" {
+		t.Errorf("send errors = %+v, want the failure of /dump last", dump.SendErrors)
+	}
+	open := 0
+	for _, tg := range dump.Targets {
+		if strings.HasPrefix(tg.Target, tracking.URL) && tg.Circuit == "open" {
+			open++
+		}
+	}
+	if open != 2 || dump.Sinks[strings.TrimPrefix(tracking.URL, "http://")] == nil {
+		t.Errorf("targets = %+v, sinks = %v, want both targets open and the sink counted", dump.Targets, dump.Sinks)
+	}
+}
+
+func TestSamplingChangesAtRuntime(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	admin := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/sampling?endpoint=/sampled"
+	var doc atomic.Value
+	doc.Store(`{"rate": 0}`)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, doc.Load().(string))
+	}))
+	defer remote.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"admin_port": float64(port), "endpoint": "/sampled",
+		"sampling": map[string]interface{}{"rate": 1.0, "remote": map[string]interface{}{"url": remote.URL, "refresh_s": 1.0}}})
+	settings := func(method, query string) (rate float64, mode string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, admin+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list []struct {
+			Rate float64
+			Mode string
+		}
+		json.NewDecoder(resp.Body).Decode(&list)
+		if len(list) == 0 {
+			t.Fatal("no /sampled backend")
+		}
+		return list[len(list)-1].Rate, list[len(list)-1].Mode
+	}
+	waitFor := func(rate float64, mode string) {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if r, m := settings("GET", ""); r == rate && m == mode {
+				return
+			}
+		}
+		t.Fatalf("sampling never became %v %s", rate, mode)
+	}
+
+	waitFor(0, "full") // the remote document wins over the block
+	hs.do("POST", "/dropped", "one", nil)
+	if rate, mode := settings("POST", "&rate=1&mode=metadata"); rate != 1 || mode != "metadata" {
+		t.Fatalf("after the admin change: %v %s", rate, mode)
+	}
+	hs.do("POST", "/metadata", "two", nil)
+	ev := hs.events(1)[0]
+	if !strings.HasSuffix(ev.Fields["requestUrl"], "/metadata") || ev.Meta["capture"] != "metadata_only" ||
+		ev.Fields["requestBody"] != "" {
+		t.Errorf("event = %v %v, want /metadata without bodies", ev.Fields, ev.Meta)
+	}
+	doc.Store(`{"rate": 1, "mode": "full"}`)
+	waitFor(1, "full")
+	hs.do("POST", "/full", "three", nil)
+	evs := hs.events(2)
+	if ev := evs[1]; ev.Fields["requestBody"] != "three" || ev.Meta["capture"] != "" || ev.Meta["sample_rate"] != "" {
+		t.Errorf("event = %v %v, want /full with its body", ev.Fields, ev.Meta)
+	}
+	if len(evs) != 2 {
+		t.Errorf("got %d events, want the unsampled request left out", len(evs))
+	}
+}
+
+func TestFeatureFlagGatesCapture(t *testing.T) {
+	flags := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flags.json" {
+			io.WriteString(w, `{"trace-capture": {"default": false, "endpoints": {"/other": true}, "tenants": {"acme": true}}}`)
+			return
+		}
+		var in struct{ Context map[string]string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if r.URL.Path != "/ofrep/v1/evaluate/flags/trace-capture" || r.Header.Get("Authorization") != "Bearer t" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"errorCode": "FLAG_NOT_FOUND"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": "trace-capture",
+			"value": in.Context["targetingKey"] == "acme" && in.Context["endpoint"] == "/flagged"})
+	}))
+	defer flags.Close()
+	for name, source := range map[string]map[string]interface{}{
+		"json":  {"json": map[string]interface{}{"url": flags.URL + "/flags.json"}},
+		"ofrep": {"ofrep": map[string]interface{}{"url": flags.URL, "headers": map[string]interface{}{"Authorization": "Bearer t"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source["flag"] = "trace-capture"
+			hs := newHarness(t, echo, map[string]interface{}{"endpoint": "/flagged", "feature_flag": source,
+				"tenant": map[string]interface{}{"header": "X-Tenant"}})
+			acme := http.Header{"X-Tenant": {"acme"}}
+			for deadline := time.Now().Add(2 * time.Second); len(hs.collector.Events()) == 0; time.Sleep(20 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("acme never captured")
+				}
+				hs.do("GET", "/acme", "", acme)
+			}
+			hs.do("GET", "/initech", "", http.Header{"X-Tenant": {"initech"}})
+			hs.do("GET", "/anonymous", "", nil)
+			hs.do("GET", "/acme-again", "", acme)
+			evs := hs.events(2)
+			time.Sleep(50 * time.Millisecond)
+			if evs = hs.collector.Events(); len(evs) != 2 || !strings.HasSuffix(evs[1].Fields["requestUrl"], "/acme-again") {
+				t.Errorf("captured %d events, want only the acme requests", len(evs))
+			}
+		})
+	}
+}
+
+/* ───────── routing ───────── */
+
+func TestTenantRouting(t *testing.T) {
+	acme := mockcollector.New()
+	acmeSrv := httptest.NewServer(acme)
+	defer acmeSrv.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tenant": map[string]interface{}{"header": "X-Tenant", "claim": "org.id",
+			"routes": map[string]interface{}{"acme": map[string]interface{}{"tracking_url": acmeSrv.URL + "/acme"}}},
+	})
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"org":{"id":"acme"}}`))
+	hs.do("GET", "/by-header", "", http.Header{"X-Tenant": {"acme"}})
+	hs.do("GET", "/by-claim", "", http.Header{"Authorization": {"Bearer e30." + claims + ".sig"}})
+	hs.do("GET", "/other", "", http.Header{"X-Tenant": {"initech"}})
+
+	evs := acme.Wait(2, 2*time.Second)
+	if len(evs) != 2 {
+		t.Fatalf("acme collector got %d events, want 2", len(evs))
+	}
+	for _, ev := range evs {
+		if ev.Meta["tenant"] != "acme" || ev.Path != "/acme" {
+			t.Errorf("acme got %s with tenant %q", ev.Fields["requestUrl"], ev.Meta["tenant"])
+		}
+	}
+	if ev := hs.events(1)[0]; ev.Meta["tenant"] != "initech" {
+		t.Errorf("default sink got tenant %q, want initech", ev.Meta["tenant"])
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	limits := map[string]interface{}{
+		"events_per_sec": float64(0.001), "burst": float64(2),
+		"per_tenant": map[string]interface{}{"small": map[string]interface{}{"daily_events": float64(1)}},
+	}
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tenant": map[string]interface{}{"header": "X-Tenant", "limits": limits},
+	})
+	// a backend with other limits has a budget of its own
+	other := newHarness(t, echo, map[string]interface{}{
+		"tenant": map[string]interface{}{"header": "X-Tenant", "limits": map[string]interface{}{"burst": float64(5)}},
+	})
+	for _, tenant := range []string{"big", "big", "big", "small", "small"} {
+		hs.do("GET", "/", "", http.Header{"X-Tenant": {tenant}})
+		other.do("GET", "/", "", http.Header{"X-Tenant": {tenant}})
+	}
+	hs.events(3)
+	other.events(5)
+	time.Sleep(100 * time.Millisecond)
+	got := map[string]int{}
+	for _, ev := range hs.collector.Events() {
+		got[ev.Meta["tenant"]]++
+	}
+	if got["big"] != 2 || got["small"] != 1 {
+		t.Errorf("delivered %v, want big:2 (burst) small:1 (daily quota)", got)
+	}
+	if n := len(other.collector.Events()); n != 5 {
+		t.Errorf("other backend delivered %d events, want all 5", n)
+	}
+}
+
+func TestWeightedTrackingURLs(t *testing.T) {
+	a, b := mockcollector.New(), mockcollector.New()
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": "",
+		"tracking_urls": []interface{}{
+			map[string]interface{}{"url": srvA.URL + "/a", "weight": float64(3)}, srvB.URL + "/b"},
+		"balance": map[string]interface{}{"fail_threshold": float64(1), "cooldown_ms": float64(60000)},
+	})
+	for i := 0; i < 8; i++ {
+		hs.do("GET", "/", "", nil)
+	}
+	a.Wait(6, 2*time.Second)
+	if na, nb := len(a.Events()), len(b.Wait(2, time.Second)); na != 6 || nb != 2 {
+		t.Fatalf("a got %d, b got %d; want 6 and 2", na, nb)
+	}
+
+	// a failing target is retried on the other one, then taken out
+	a.Reset()
+	b.Reset()
+	b.Status = http.StatusServiceUnavailable
+	for i := 0; i < 8; i++ {
+		hs.do("GET", "/", "", nil)
+	}
+	if n := len(a.Wait(8, 2*time.Second)); n != 8 {
+		t.Errorf("a got %d of 8 events", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(b.Events()); n != 1 {
+		t.Errorf("b was tried %d times, want once before it is taken out", n)
+	}
+}
+
+func TestTrackingURLTemplate(t *testing.T) {
+	var got []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.RequestURI())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": srv.URL + "/{tenant}/{yyyy-mm-dd}/events?region={header.X-Region}",
+		"tenant":       map[string]interface{}{"header": "X-Tenant"},
+	})
+	hs.do("GET", "/", "", http.Header{"X-Tenant": {"a/b"}, "X-Region": {"eu&x=1"}})
+
+	want := "/a%2Fb/" + time.Now().UTC().Format("2006-01-02") + "/events?region=eu%26x%3D1"
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("requests %q, want [%q]", got, want)
+	}
+}
+
+func TestQueueFavorsErrorEvents(t *testing.T) {
+	status := func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("s"))
+		w.WriteHeader(code)
+	}
+	hs := newHarness(t, status, map[string]interface{}{
+		"queue": map[string]interface{}{"size": float64(2), "workers": float64(1)},
+	})
+	hs.collector.Delay = 200 * time.Millisecond
+
+	// 200 keeps the worker busy; 201 and 202 fill the queue, 502 pushes out
+	// 201 and 203 finds no room
+	for _, s := range []string{"200", "201", "202", "502", "203"} {
+		hs.do("GET", "/?s="+s, "", nil)
+		time.Sleep(30 * time.Millisecond)
+	}
+	hs.events(3)
+	time.Sleep(300 * time.Millisecond) // nothing else arrives
+	var got []string
+	for _, e := range hs.collector.Events() {
+		got = append(got, e.Meta["status"])
+	}
+	if want := "200 502 202"; strings.Join(got, " ") != want {
+		t.Errorf("delivered %v, want %s", got, want)
+	}
+}
+
+func TestSplitPhases(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"split_phases": true})
+	hs.do("POST", "/orders", `{"id":1}`, nil)
+	evs := hs.events(2)
+	phases := map[string]mockcollector.Event{}
+	for _, e := range evs {
+		phases[e.Meta["phase"]] = e
+	}
+	req, resp := phases["request"], phases["response"]
+	if req.Meta == nil || resp.Meta == nil {
+		t.Fatalf("phases = %v, want a request and a response event", evs)
+	}
+	if req.Meta["event_id"] == "" || req.Meta["event_id"] != resp.Meta["event_id"] {
+		t.Errorf("event_id %q / %q, want the same id on both", req.Meta["event_id"], resp.Meta["event_id"])
+	}
+	if req.Fields["responseBody"] != "" || !strings.Contains(resp.Fields["responseBody"], `"path":"/orders"`) {
+		t.Errorf("response bodies %q / %q", req.Fields["responseBody"], resp.Fields["responseBody"])
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(file, []byte(`{
+		"small":   {"max_capture_kb": 1, "labels": {"team": "core"}},
+		"tagged":  {"labels": {"team": "payments"}}
+	}`), 0o644)
+	t.Setenv("TRACE_PLUGIN_PROFILES", file)
+
+	hs := newHarness(t, echo, map[string]interface{}{"profile": []interface{}{"small", "tagged"}})
+	hs.do("POST", "/", strings.Repeat("y", 2000), nil)
+	ev := hs.events(1)[0]
+	if n := len(ev.Fields["requestBody"]); n != 1024 {
+		t.Errorf("captured request %d bytes, want 1024 from the profile", n)
+	}
+	if got := ev.Meta["label.team"]; got != "payments" {
+		t.Errorf("label.team = %q, want the later profile's", got)
+	}
+
+	_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{
+		string(ClientRegisterer): map[string]interface{}{"tracking_url": "http://x/", "profile": "missing"}})
+	if err == nil || !strings.Contains(err.Error(), `unknown profile "missing"`) {
+		t.Errorf("err = %v, want an unknown profile", err)
+	}
+}
+
+func TestSinkRules(t *testing.T) {
+	errs, audit := mockcollector.New(), mockcollector.New()
+	srvErrs, srvAudit := httptest.NewServer(errs), httptest.NewServer(audit)
+	defer srvErrs.Close()
+	defer srvAudit.Close()
+	status := func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("s"))
+		w.WriteHeader(code)
+	}
+	hs := newHarness(t, status, map[string]interface{}{
+		"sink_rules": []interface{}{
+			map[string]interface{}{"if": "response.status >= 500", "tracking_url": srvErrs.URL + "/errors"},
+			map[string]interface{}{"if": "request.path.startsWith('/admin')", "tracking_url": srvAudit.URL + "/audit", "stop": true},
+		},
+	})
+	hs.do("GET", "/ok?s=200", "", nil)
+	hs.do("GET", "/fail?s=503", "", nil)
+	hs.do("GET", "/admin/x?s=200", "", nil)
+
+	if n := len(hs.collector.Wait(2, 2*time.Second)); n != 2 {
+		t.Errorf("default sink got %d events, want 2 (not the /admin one)", n)
+	}
+	if evs := errs.Wait(1, 2*time.Second); len(evs) != 1 || evs[0].Meta["status"] != "503" {
+		t.Errorf("error sink got %v", evs)
+	}
+	if n := len(audit.Wait(1, 2*time.Second)); n != 1 {
+		t.Errorf("audit sink got %d events, want 1", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(hs.collector.Events()); n != 2 {
+		t.Errorf("default sink got %d events, want 2", n)
+	}
+}
+
+func TestHashedTrackingURLs(t *testing.T) {
+	a, b := mockcollector.New(), mockcollector.New()
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url":  "",
+		"tracking_urls": []interface{}{srvA.URL + "/a", srvB.URL + "/b"},
+		"balance":       map[string]interface{}{"strategy": "hash"},
+		"split_phases":  true, // two events per request id
+	})
+	for i := 0; i < 20; i++ {
+		id := "req-" + strconv.Itoa(i)
+		hs.do("GET", "/r/"+id, "", http.Header{"X-Request-Id": {id}})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(a.Events())+len(b.Events()) < 40 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	seen := map[string]string{} // request path → collector
+	for name, col := range map[string]*mockcollector.Collector{"a": a, "b": b} {
+		if len(col.Events()) == 0 {
+			t.Errorf("collector %s got no events", name)
+		}
+		for _, e := range col.Events() {
+			u := e.Fields["requestUrl"]
+			if prev, ok := seen[u]; ok && prev != name {
+				t.Errorf("%s went to both collectors", u)
+			}
+			seen[u] = name
+		}
+	}
+	if n := len(a.Events()) + len(b.Events()); n != 40 {
+		t.Errorf("collectors got %d events, want 40", n)
+	}
+}
+
+func TestConsentGating(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"consent": map[string]interface{}{"header": "X-Tracking-Consent", "cookie": "tc"},
+	})
+	hs.do("POST", "/a", `{"card":"4111"}`, http.Header{"X-Tracking-Consent": {"yes"}})
+	hs.do("POST", "/b", `{"card":"4111"}`, http.Header{"Cookie": {"tc=no"}})
+	hs.do("POST", "/c", `{"card":"4111"}`, nil)
+
+	got := map[string]mockcollector.Event{}
+	for _, e := range hs.events(3) {
+		got[e.Meta["consent"]] = e
+	}
+	if e := got["granted"]; !strings.Contains(e.Fields["requestBody"], "4111") {
+		t.Errorf("granted event lost its body: %v", e.Fields)
+	}
+	for _, decision := range []string{"denied", "absent"} {
+		e, ok := got[decision]
+		if !ok {
+			t.Errorf("no %s event", decision)
+		} else if e.Fields["requestBody"] != "" || e.Fields["responseBody"] != "" {
+			t.Errorf("%s event kept bodies: %v", decision, e.Fields)
+		}
+	}
+}
+
+func TestClassificationAndRetention(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{
+		"classification": []interface{}{"pii", "payment"}, "retention_days": float64(7),
+	})
+	hs.do("GET", "/cards", "", nil)
+	ev := hs.events(1)[0]
+	if ev.Meta["classification"] != "pii,payment" || ev.Meta["retention_days"] != "7" {
+		t.Errorf("meta = %v", ev.Meta)
+	}
+	want := time.Now().UTC().AddDate(0, 0, 7).Format(time.DateOnly)
+	if got := ev.Meta["retain_until"]; got != want {
+		t.Errorf("retain_until = %q, want %q", got, want)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	var calls atomic.Int32
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var in struct{ Values []string }
+		json.NewDecoder(r.Body).Decode(&in)
+		out := make([]string, len(in.Values))
+		for i, v := range in.Values {
+			out[i] = "tok_" + strconv.Itoa(len(v))
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"tokens": out})
+	}))
+	defer vault.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tokenize": map[string]interface{}{
+			"url":     vault.URL,
+			"request": []interface{}{"$.cards[*].number"},
+		},
+	})
+	body := `{"cards":[{"number":"4111111111111111"},{"number":"5500"}],"note":"<ok>"}`
+	hs.do("POST", "/pay", body, nil)
+	hs.events(1)
+	hs.do("POST", "/pay", body, nil)
+
+	for _, ev := range hs.events(2) {
+		got := ev.Fields["requestBody"]
+		if want := `{"cards":[{"number":"tok_16"},{"number":"tok_4"}],"note":"<ok>"}`; got != want {
+			t.Errorf("request body = %s, want %s", got, want)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("tokenization service called %d times, want once (cached)", n)
+	}
+}
+
+func TestTokenizeUnparsableBodies(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tokens":["tok"]}`)
+	}))
+	defer vault.Close()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, `{"ok":true}`)
+	}
+	card := "4111111111111111"
+	clipped := `{"card":"` + card + `","pad":"` + strings.Repeat("x", 2000) + `"}`
+
+	// a clipped document cannot be searched: the whole body is redacted
+	hs := newHarness(t, ok, map[string]interface{}{
+		"payload_format": "v2", "max_capture_kb": 1.0,
+		"tokenize": map[string]interface{}{"url": vault.URL, "request": []interface{}{"$.card"}},
+	})
+	hs.do("POST", "/pay", clipped, nil)
+	ev := hs.events(1)[0]
+	if ev.Fields["requestBody"] != "[untokenized]" || strings.Contains(ev.Body, card) {
+		t.Errorf("clipped body reached the sink as %q", ev.Fields["requestBody"])
+	}
+
+	// with on_error drop, the event goes; a document is still tokenized
+	hs = newHarness(t, ok, map[string]interface{}{
+		"payload_format": "v2",
+		"tokenize":       map[string]interface{}{"url": vault.URL, "request": []interface{}{"$.card"}, "on_error": "drop"},
+	})
+	hs.do("POST", "/pay", "card="+card, nil)
+	hs.do("POST", "/pay", `{"card":"`+card+`"}{"card":"`+card+`"}`, nil)
+	hs.do("POST", "/pay", `{"card":"`+card+`"}`, nil)
+	evs := hs.collector.Wait(3, 300*time.Millisecond)
+	if len(evs) != 1 || evs[0].Fields["requestBody"] != `{"card":"tok"}` {
+		for _, ev := range evs {
+			t.Logf("sent %q", ev.Fields["requestBody"])
+		}
+		t.Errorf("collector got %d events, want only the tokenized document", len(evs))
+	}
+}
+
+func TestClientIPSkipsTrustedProxies(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"trusted_proxies": []interface{}{"10.0.0.0/8", "192.0.2.7"}})
+	for i, tc := range []struct {
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"10.0.0.2:5100", http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.5, 192.0.2.7"}}, "203.0.113.5"},
+		{"198.51.100.1:5100", http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "198.51.100.1"},
+		{"10.0.0.2:5100", http.Header{"Forwarded": {`for="[2001:db8::5]:443";proto=https`},
+			"X-Forwarded-For": {"6.6.6.6"}}, "2001:db8::5"},
+		{"", http.Header{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9"},
+	} {
+		req := httptest.NewRequest("GET", hs.backend.URL+"/ip", nil)
+		req.RequestURI, req.RemoteAddr, req.Header = "", tc.remote, tc.header
+		hs.handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got := hs.events(i + 1)[i].Meta["client_ip"]; got != tc.want {
+			t.Errorf("event %d: client_ip = %q, want %q", i, got, tc.want)
+		}
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"anonymize_ip": true})
+	hs.do("GET", "/", "", http.Header{"X-Forwarded-For": {"203.0.113.77"}})
+	hs.events(1)
+	hs.do("GET", "/", "", http.Header{"X-Forwarded-For": {"2001:db8:abcd:12::1"}})
+	evs := hs.events(2)
+	if got := evs[0].Meta["client_ip"] + " " + evs[1].Meta["client_ip"]; got != "203.0.113.0 2001:db8:abcd::" {
+		t.Errorf("client_ip = %s", got)
+	}
+}
+
+func TestAnonymizeIPMasksTaggedHeaders(t *testing.T) {
+	hs := newHarness(t, echo, map[string]interface{}{"anonymize_ip": true,
+		"tag_headers": map[string]interface{}{"X-Forwarded-For": "forwarded_for", "X-Real-Ip": "real_ip"}})
+	hs.do("GET", "/", "", http.Header{"X-Forwarded-For": {"203.0.113.77, 198.51.100.9"}, "X-Real-Ip": {"203.0.113.77"}})
+	ev := hs.events(1)[0]
+	if ev.Meta["forwarded_for"] != "203.0.113.0, 198.51.100.0" || ev.Meta["real_ip"] != "203.0.113.0" {
+		t.Errorf("forwarded_for = %q, real_ip = %q, want both anonymized", ev.Meta["forwarded_for"], ev.Meta["real_ip"])
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyFile := filepath.Join(t.TempDir(), "audit.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+
+	hs := newHarness(t, echo, map[string]interface{}{
+		"audit": map[string]interface{}{"key_file": keyFile, "checkpoint_every": float64(3)},
+	})
+	for i := 0; i < 3; i++ {
+		hs.do("GET", "/"+strconv.Itoa(i), "", nil)
+		hs.events(i + 1) // one at a time, so the chain follows request order
+	}
+	evs := hs.events(4)
+	sort.Slice(evs, func(i, j int) bool {
+		a, _ := strconv.Atoi(evs[i].Meta["audit.seq"])
+		b, _ := strconv.Atoi(evs[j].Meta["audit.seq"])
+		return a < b
+	})
+	prev := strings.Repeat("0", 64)
+	for i, e := range evs {
+		if e.Meta["audit.seq"] != strconv.Itoa(i+1) || e.Meta["audit.prev"] != prev {
+			t.Fatalf("event %d: seq %s prev %s, want %d %s", i, e.Meta["audit.seq"], e.Meta["audit.prev"], i+1, prev)
+		}
+		sum := sha256.Sum256([]byte(e.Body))
+		prev = hex.EncodeToString(sum[:])
+	}
+	cp := evs[3]
+	if cp.Meta["event"] != "audit_checkpoint" {
+		t.Fatalf("last event is %q, want the checkpoint", cp.Meta["event"])
+	}
+	sig, _ := base64.StdEncoding.DecodeString(cp.Meta["audit.sig"])
+	msg := "krakend-trace-audit/v1 chain=" + cp.Meta["audit.chain"] + " seq=4 prev=" + cp.Meta["audit.prev"]
+	if !ed25519.Verify(pub, []byte(msg), sig) {
+		t.Error("checkpoint signature does not verify")
+	}
+
+	// sinks that store documents of their own cannot be verified
+	audit := map[string]interface{}{"key_file": keyFile}
+	for want, block := range map[string]map[string]interface{}{
+		"sqlite":        {"sink": "sqlite", "sqlite": map[string]interface{}{"path": filepath.Join(t.TempDir(), "t.db")}},
+		"elasticsearch": {"tracking_url": "http://127.0.0.1:1", "sink": "elasticsearch"},
+		"unix ndjson":   {"tracking_url": "unix:///tmp/t.sock", "unix": map[string]interface{}{"mode": "ndjson"}},
+		"payload_format cbor": {"tracking_url": hs.tracking.URL, "tenant": map[string]interface{}{"header": "X-Tenant-Id",
+			"routes": map[string]interface{}{"acme": map[string]interface{}{"tracking_url": hs.tracking.URL, "payload_format": "cbor"}}}},
+		"stdout": {"tracking_url": hs.tracking.URL, "sink_rules": []interface{}{
+			map[string]interface{}{"if": "response.status >= 500", "sink": "stdout"}}},
+	} {
+		block["audit"] = audit
+		_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{string(ClientRegisterer): block})
+		if err == nil || !strings.Contains(err.Error(), "invalid audit: "+want+" ") {
+			t.Errorf("audit with %s: err = %v, want it rejected", want, err)
+		}
+	}
+}
+
+func TestSigV4Signing(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	col := mockcollector.New()
+	auth := make(chan string, 1)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) || r.Header.Get("X-Amz-Security-Token") != "session" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		auth <- r.Header.Get("Authorization")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		col.ServeHTTP(w, r)
+	}))
+	defer gw.Close()
+	newHarness(t, echo, map[string]interface{}{
+		"tracking_url": gw.URL + "/prod/ingest", "self_test": "strict",
+		"http": map[string]interface{}{"sigv4": map[string]interface{}{"region": "eu-west-1", "service": "execute-api"}},
+	})
+	got := <-auth
+	want := "AWS4-HMAC-SHA256 Credential=AKIDTEST/" + time.Now().UTC().Format("20060102") +
+		"/eu-west-1/execute-api/aws4_request, SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature="
+	if !strings.HasPrefix(got, want) || len(got) != len(want)+64 {
+		t.Errorf("Authorization = %q, want %s<64 hex>", got, want)
+	}
+}
+
+func TestGCPIdentityToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	enc := base64.RawURLEncoding
+	idToken := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))) + ".sig"
+	var audience atomic.Value
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) == 3 {
+			claims, _ := enc.DecodeString(parts[1])
+			var c struct {
+				Aud string `json:"target_audience"`
+			}
+			json.Unmarshal(claims, &c)
+			audience.Store(c.Aud)
+		}
+		fmt.Fprintf(w, `{"id_token":%q}`, idToken)
+	}))
+	defer tokens.Close()
+	sa, _ := json.Marshal(map[string]string{
+		"type": "service_account", "client_email": "tracer@p.iam.gserviceaccount.com", "token_uri": tokens.URL,
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	file := filepath.Join(t.TempDir(), "sa.json")
+	os.WriteFile(file, sa, 0o600)
+
+	col := mockcollector.New()
+	auth := make(chan string, 1)
+	run := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		col.ServeHTTP(w, r)
+	}))
+	defer run.Close()
+	newHarness(t, echo, map[string]interface{}{
+		"tracking_url": run.URL + "/ingest", "self_test": "strict",
+		"http": map[string]interface{}{"gcp_auth": map[string]interface{}{"credentials_file": file}},
+	})
+	if got := <-auth; got != "Bearer "+idToken {
+		t.Errorf("Authorization = %q, want the minted ID token", got)
+	}
+	if got := audience.Load(); got != run.URL {
+		t.Errorf("target_audience = %v, want %s", got, run.URL)
+	}
+}
+
+func TestAzureClientSecret(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_SECRET", "s3cret")
+	var form atomic.Value
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form.Store(r.URL.Path + " " + r.PostForm.Get("grant_type") + " " + r.PostForm.Get("scope") + " " + r.PostForm.Get("client_secret"))
+		fmt.Fprint(w, `{"access_token":"aad-token","expires_in":3600}`)
+	}))
+	defer aad.Close()
+	col := mockcollector.New()
+	auth := make(chan string, 1)
+	apim := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		col.ServeHTTP(w, r)
+	}))
+	defer apim.Close()
+	newHarness(t, echo, map[string]interface{}{
+		"tracking_url": apim.URL + "/ingest", "self_test": "strict",
+		"http": map[string]interface{}{"azure_auth": map[string]interface{}{
+			"resource": "api://trace-collector", "tenant_id": "contoso", "client_id": "app", "authority": aad.URL,
+		}},
+	})
+	if got := <-auth; got != "Bearer aad-token" {
+		t.Errorf("Authorization = %q, want Bearer aad-token", got)
+	}
+	if got, want := form.Load(), "/contoso/oauth2/v2.0/token client_credentials api://trace-collector/.default s3cret"; got != want {
+		t.Errorf("token request = %v, want %s", got, want)
+	}
+}
+
+func TestAckedDelivery(t *testing.T) {
+	col := mockcollector.New()
+	col.Ack = true
+	var refuse atomic.Int32
+	refuse.Store(2)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refuse.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusOK) // no receipt
+			return
+		}
+		col.ServeHTTP(w, r)
+	}))
+	defer gw.Close()
+	spool := t.TempDir()
+	hs := newHarness(t, echo, map[string]interface{}{"tracking_url": gw.URL, "timeout_ms": 300.0,
+		"http": map[string]interface{}{"ack": map[string]interface{}{"backoff_ms": 10.0, "spool_dir": spool, "replay_s": 0.05}}})
+	hs.do("GET", "/retried", "", nil)
+	ev := col.Wait(1, 2*time.Second)
+	if len(ev) != 1 || !strings.HasSuffix(ev[0].Fields["requestUrl"], "/retried") {
+		t.Fatalf("collector got %v, want the event after two unacknowledged attempts", ev)
+	}
+
+	refuse.Store(1000)
+	hs.do("GET", "/spooled", "", nil)
+	time.Sleep(400 * time.Millisecond)
+	if files, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(files) != 1 {
+		t.Fatalf("spool has %d files, want 1", len(files))
+	}
+	refuse.Store(0)
+	evs := col.Wait(2, 2*time.Second)
+	if len(evs) != 2 || !strings.HasSuffix(evs[1].Fields["requestUrl"], "/spooled") {
+		t.Fatalf("collector got %d events, want the spooled one replayed", len(evs))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if files, _ := filepath.Glob(filepath.Join(spool, "*.json")); len(files) != 0 {
+		t.Errorf("spool still has %v after the receipt", files)
+	}
+}
+
+func TestOutboundTLS(t *testing.T) {
+	col := mockcollector.New()
+	tracking := httptest.NewTLSServer(col)
+	defer tracking.Close()
+	backend := httptest.NewTLSServer(http.HandlerFunc(echo))
+	defer backend.Close()
+	// both test servers present the same certificate, for example.com and 127.0.0.1
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tracking.Certificate().Raw}), 0o600)
+	tlsBlock := func() map[string]interface{} {
+		return map[string]interface{}{"ca_file": caFile, "min_version": "1.2", "server_name": "example.com",
+			"cipher_suites": []interface{}{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+	}
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": tracking.URL + "/track", "sink_tls": tlsBlock(), "upstream_tls": tlsBlock(),
+	})
+	req := httptest.NewRequest(http.MethodGet, backend.URL+"/secure", nil)
+	req.RequestURI = ""
+	rec := httptest.NewRecorder()
+	hs.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upstream over TLS: status %d, %s", rec.Code, rec.Body)
+	}
+	evs := col.Wait(1, 2*time.Second)
+	if len(evs) != 1 {
+		t.Fatalf("collector over TLS got %d events, want 1", len(evs))
+	}
+
+	_, err := ClientRegisterer.registerClients(context.Background(), map[string]interface{}{string(ClientRegisterer): map[string]interface{}{
+		"tracking_url": tracking.URL, "sink_tls": map[string]interface{}{"cipher_suites": []interface{}{"TLS_RSA_WITH_RC4_128_SHA"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "insecure cipher suite") {
+		t.Errorf("insecure cipher suite accepted: %v", err)
+	}
+}
+
+func TestVaultSecrets(t *testing.T) {
+	secretID := filepath.Join(t.TempDir(), "secret-id")
+	os.WriteFile(secretID, []byte("s3cret\n"), 0o600)
+	var key atomic.Value
+	key.Store("id:one")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["role_id"] != "tracer" || login["secret_id"] != "s3cret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"auth":{"client_token":"hvs.test","lease_duration":3600,"renewable":true}}`)
+		case "/v1/secret/data/krakend-trace":
+			if r.Header.Get("X-Vault-Token") != "hvs.test" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"data":{"es_api_key":%q}}}`, key.Load())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	auth := make(chan string, 16)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer es.Close()
+	hs := newHarness(t, echo, map[string]interface{}{
+		"tracking_url": es.URL, "sink": "elasticsearch",
+		"elasticsearch": map[string]interface{}{"api_key": "vault:secret/krakend-trace#es_api_key", "batch_delay_ms": 1.0},
+		"vault": map[string]interface{}{"address": vault.URL, "refresh_s": 0.1,
+			"approle": map[string]interface{}{"role_id": "tracer", "secret_id_file": secretID}},
+	})
+	want := func(apiKey string) {
+		t.Helper()
+		hs.do(http.MethodGet, "/v", "", nil)
+		if got := <-auth; got != "ApiKey "+base64.StdEncoding.EncodeToString([]byte(apiKey)) {
+			t.Errorf("Authorization = %q, want the api key %s from vault", got, apiKey)
+		}
+	}
+	want("id:one")
+	key.Store("id:two")
+	time.Sleep(300 * time.Millisecond)
+	want("id:two")
+}
+
+func TestSinkConnectionsAreReused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	col := mockcollector.New()
+	col.Status = http.StatusAccepted
+	tracking := httptest.NewServer(col)
+	defer tracking.Close()
+	hs := newHarness(t, echo, map[string]interface{}{"tracking_url": tracking.URL, "admin_port": float64(port)})
+	type sinkStats struct {
+		Requests    int              `json:"requests"`
+		NewConns    int              `json:"new_conns"`
+		ReusedConns int              `json:"reused_conns"`
+		Status      map[string]int64 `json:"status"`
+	}
+	// the stats are per process and host: an earlier test's collector may
+	// have had the same port
+	stats := func() sinkStats {
+		resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/debug/sinks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var all map[string]sinkStats
+		json.NewDecoder(resp.Body).Decode(&all)
+		return all[strings.TrimPrefix(tracking.URL, "http://")]
+	}
+	before := stats()
+	for i := 1; i <= 3; i++ {
+		hs.do("GET", "/keepalive", "", nil)
+		if evs := col.Wait(i, 2*time.Second); len(evs) < i {
+			t.Fatalf("collector got %d events, want %d", len(evs), i)
+		}
+		time.Sleep(20 * time.Millisecond) // let the connection go back to the pool
+	}
+	st := stats()
+	if st.Requests-before.Requests != 3 || st.NewConns-before.NewConns != 1 ||
+		st.ReusedConns-before.ReusedConns != 2 || st.Status["202"]-before.Status["202"] != 3 {
+		t.Errorf("sink stats = %+v (before %+v), want 3 more requests over one connection, all 202", st, before)
+	}
+}
+
+/* ───────── companion tools ───────── */
+
+// The cmd/ tools are built into the test's temp dir and run as processes.
+
+func buildTool(t *testing.T, name string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command("go", "build", "-o", bin, "./cmd/"+name).CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", name, err, out)
+	}
+	return bin
+}
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startViewer runs trace-viewer on db and waits for its API.
+func startViewer(t *testing.T, bin, db string, max int) string {
+	t.Helper()
+	addr := freeAddr(t)
+	cmd := exec.Command(bin, "-addr", addr, "-db", db, "-max", strconv.Itoa(max))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill(); cmd.Wait() })
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if resp, err := http.Get("http://" + addr + "/api/events"); err == nil {
+			resp.Body.Close()
+			return "http://" + addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("trace-viewer did not start")
+		}
+	}
+}
+
+func TestTraceViewer(t *testing.T) {
+	bin := buildTool(t, "trace-viewer")
+	db := filepath.Join(t.TempDir(), "events.db")
+	viewer := startViewer(t, bin, db, 3)
+
+	type record struct {
+		ID          int
+		Method, URL string
+		Status      int
+		Meta        map[string]string
+		ReqBody     string `json:"request_body"`
+		RespBody    string `json:"response_body"`
+	}
+	list := func(base, query string) []record {
+		t.Helper()
+		resp, err := http.Get(base + "/api/events?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out []record
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+
+	hs := newHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orders/2" {
+			http.Error(w, "payment timeout", http.StatusBadGateway)
+			return
+		}
+		echo(w, r)
+	}, map[string]interface{}{"tracking_url": viewer + "/ingest", "payload_format": "v2", "endpoint": "/orders/{id}"})
+	for i, body := range []string{`{"sku":"dropped"}`, `{"sku":"a"}`, `{"sku":"b"}`, `{"sku":"c"}`} {
+		hs.do("POST", "/orders/"+strconv.Itoa(i), body, nil)
+		// one at a time, so the ids follow the requests
+		stored := func() bool {
+			evs := list(viewer, "limit=1")
+			return len(evs) == 1 && strings.HasSuffix(evs[0].URL, "/orders/"+strconv.Itoa(i))
+		}
+		for deadline := time.Now().Add(2 * time.Second); !stored(); time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("trace-viewer did not store event %d", i)
+			}
+		}
+	}
+
+	// -max 3 keeps the newest three, newest first
+	all := list(viewer, "")
+	if len(all) != 3 || !strings.HasSuffix(all[0].URL, "/orders/3") || !strings.HasSuffix(all[2].URL, "/orders/1") {
+		t.Fatalf("events = %+v, want orders 3, 2, 1", all)
+	}
+	for query, want := range map[string]int{
+		"status=5xx":                        1,
+		"status=201":                        2,
+		"q=PAYMENT":                         1, // response body, any case
+		"q=sku%22:%22b":                     1,
+		"q=dropped":                         0,
+		"method=post&endpoint=/orders/{id}": 3,
+		"endpoint=/users":                   0,
+		"since=1h&limit=2":                  2,
+	} {
+		if got := list(viewer, query); len(got) != want {
+			t.Errorf("%s: %d events, want %d", query, len(got), want)
+		}
+	}
+	if all[0].ReqBody != "" {
+		t.Errorf("lists carry the bodies: %+v", all[0])
+	}
+
+	// the store survives a restart
+	restarted := startViewer(t, bin, db, 3)
+	resp, err := http.Get(restarted + "/api/events/" + strconv.Itoa(all[1].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var one record
+	json.NewDecoder(resp.Body).Decode(&one)
+	if one.Status != 502 || one.ReqBody != `{"sku":"b"}` || !strings.Contains(one.RespBody, "payment timeout") || one.Meta["endpoint"] != "/orders/{id}" {
+		t.Errorf("event %d after a restart = %+v", all[1].ID, one)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	bin := buildTool(t, "trace-replay")
+	dir := t.TempDir()
+	db, har := filepath.Join(dir, "store", "traces.db"), filepath.Join(dir, "har")
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		echo(w, r)
+	}
+	stored := newHarness(t, backend, map[string]interface{}{"sink": "sqlite", "sqlite": map[string]interface{}{"path": db}})
+	stored.do("POST", "/orders?x=1", `{"sku":"a"}`, nil)
+	stored.do("GET", "/fail", "", nil)
+	files := newHarness(t, backend, map[string]interface{}{"sink": "file", "file": map[string]interface{}{"dir": har}})
+	files.do("PUT", "/items/7", "seven", http.Header{"X-Custom": {"yes"}, "Authorization": {"Bearer secret"}})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		var rows int
+		if conn, err := sql.Open("sqlite", db); err == nil {
+			conn.QueryRow(`SELECT count(*) FROM traces`).Scan(&rows)
+			conn.Close()
+		}
+		names, _ := filepath.Glob(filepath.Join(har, "*.har"))
+		var entries struct {
+			Log struct{ Entries []json.RawMessage }
+		}
+		if len(names) > 0 {
+			b, _ := os.ReadFile(names[0])
+			json.Unmarshal(b, &entries)
+		}
+		if rows == 2 && len(entries.Log.Entries) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("captured %d rows and %d HAR entries, want 2 and 1", rows, len(entries.Log.Entries))
+		}
+	}
+
+	type replayed struct {
+		method, uri, body, custom, auth, token string
+	}
+	var mu sync.Mutex
+	var got []replayed
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, replayed{r.Method, r.URL.RequestURI(), string(b), r.Header.Get("X-Custom"), r.Header.Get("Authorization"), r.Header.Get("X-Replay")})
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer target.Close()
+
+	out, err := exec.Command(bin, "-target", target.URL+"/staging", "-concurrency", "1", "-diff",
+		"-header", "X-Replay: 1", filepath.Dir(db), har).CombinedOutput()
+	if err != nil {
+		t.Fatalf("trace-replay: %v\n%s", err, out)
+	}
+	want := []replayed{
+		{"POST", "/staging/orders?x=1", `{"sku":"a"}`, "", "", "1"},
+		{"GET", "/staging/fail", "", "", "", "1"},
+		{"PUT", "/staging/items/7", "seven", "yes", "", "1"}, // HAR keeps headers, not credentials
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("target got %v, want %v", got, want)
+	}
+	for _, line := range []string{"GET /fail: recorded 500, got 201", "3 requests in", "201: 3"} {
+		if !strings.Contains(string(out), line) {
+			t.Errorf("output has no %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestTraceLint(t *testing.T) {
+	bin := buildTool(t, "trace-lint")
+	block := func() map[string]interface{} {
+		return map[string]interface{}{
+			"tracking_url":   "http://collector:9000/track",
+			"endpoint":       "/orders/{id}",
+			"payload_format": "v2",
+			"capture_if":     "request.method != 'DELETE'",
+			"transform": []interface{}{
+				map[string]interface{}{"redact": map[string]interface{}{"pattern": `"card":"[^"]*"`, "with": `"card":"****"`}},
+				map[string]interface{}{"set": map[string]interface{}{"tier": "request.path.endsWith('/7') ? 'gold' : 'free'"}},
+			},
+		}
+	}
+	backend := func(b map[string]interface{}) []interface{} {
+		return []interface{}{map[string]interface{}{
+			"host": []string{"http://orders:8080"}, "url_pattern": "/v1/orders/{id}",
+			"extra_config": map[string]interface{}{"plugin/http-client": map[string]interface{}{
+				"name": "krakend-trace-plugin", "krakend-trace-plugin": b,
+			}},
+		}}
+	}
+	broken := block()
+	broken["payload_format"], broken["trackng_url"] = "nope", "http://typo"
+	krakend, _ := json.Marshal(map[string]interface{}{"endpoints": []interface{}{
+		map[string]interface{}{"endpoint": "/orders/{id}", "method": "POST", "backend": backend(block())},
+		map[string]interface{}{"endpoint": "/orders/{id}", "method": "DELETE", "backend": backend(block())},
+		map[string]interface{}{"endpoint": "/broken", "backend": backend(broken)},
+	}})
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "krakend.json"), krakend, 0o600)
+	os.WriteFile(filepath.Join(dir, "samples.json"), []byte(`[
+		{"method": "POST", "path": "/orders/7", "body": "{\"card\":\"4111\",\"sku\":\"a\"}", "status": 201},
+		{"method": "DELETE", "path": "/orders/7", "status": 204}
+	]`), 0o600)
+
+	cmd := exec.Command(bin, "-config", filepath.Join(dir, "krakend.json"), "-requests", filepath.Join(dir, "samples.json"))
+	out, err := cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 1 {
+		t.Fatalf("trace-lint exited with %v, want 1 for the invalid backend:\n%s", err, out)
+	}
+	for _, line := range []string{
+		"POST /orders/{id} → http://orders:8080/v1/orders/{id}",
+		"sample POST /orders/7 (201): captured",
+		"tier=gold",
+		`request body:  {"card":"****","sku":"a"}`,
+		"sample DELETE /orders/7 (204): dropped",
+		`warn   unknown key "trackng_url"`,
+		"3 backend(s) with krakend-trace-plugin, 1 invalid",
+	} {
+		if !strings.Contains(string(out), line) {
+			t.Errorf("output has no %q:\n%s", line, out)
+		}
+	}
+	if !regexp.MustCompile(`GET /broken .*\n(  warn .*\n)*  error .*nope`).Match(out) {
+		t.Errorf("no error for the broken backend:\n%s", out)
+	}
+
+	// the plugin does what the lint showed
+	b := block()
+	delete(b, "tracking_url") // the harness's collector
+	hs := newHarness(t, echo, b)
+	hs.do("DELETE", "/v1/orders/7", "", nil)
+	hs.do("POST", "/v1/orders/7", `{"card":"4111","sku":"a"}`, nil)
+	ev := hs.events(1)[0]
+	if ev.Fields["method"] != "POST" || ev.Meta["tier"] != "gold" || ev.Fields["requestBody"] != `{"card":"****","sku":"a"}` {
+		t.Errorf("plugin sent %s with tier %q and body %q", ev.Fields["method"], ev.Meta["tier"], ev.Fields["requestBody"])
+	}
+	if n := len(hs.collector.Wait(2, 300*time.Millisecond)); n != 1 {
+		t.Errorf("collector got %d events, want the DELETE dropped", n)
+	}
+}
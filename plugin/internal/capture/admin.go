@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+/* ───────── localhost admin server ───────── */
+
+// One small HTTP server per process, bound to 127.0.0.1 only, serves the
+// operator endpoints (/debug/traces, /debug/sinks, /debug/panics,
+// /debug/bandwidth, /debug/stats, /debug/dump and the runtime controls).
+// Every backend naming the same admin_port shares it; the listener is opened
+// when the configuration is parsed so a busy port fails the startup instead
+// of going unnoticed.
+//
+//	"admin_port": 9091
+
+var (
+	adminMu      sync.Mutex
+	adminMux     = http.NewServeMux()
+	adminServers = map[int]bool{}
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/traces", serveRecent)
+}
+
+// HandleAdmin adds an endpoint of another package to the admin server.
+func HandleAdmin(pattern string, h http.HandlerFunc) {
+	adminMux.HandleFunc(pattern, h)
+}
+
+// ServeAdmin starts the admin server on 127.0.0.1:port unless it is running.
+func ServeAdmin(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("admin_port must be 1-65535, not %d", port)
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if adminServers[port] {
+		return nil
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	adminServers[port] = true
+	Log("admin server on", ln.Addr())
+	go http.Serve(ln, loopbackOnly(adminMux))
+	return nil
+}
+
+// loopbackOnly refuses anything not coming from this host, e.g. through a
+// port forward added later.
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON answers an admin request with v as indented JSON.
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,191 @@
+package capture
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* ───────── audit chain ───────── */
+
+// audit links the events of a backend into a hash chain and signs periodic
+// checkpoints, so the stream a sink received can be shown to be complete and
+// unmodified:
+//
+//	"audit": {
+//	  "key_file":              "/secrets/audit-ed25519.pem",  // PKCS#8 private key
+//	  "checkpoint_every":      1000,   // events, default 1000
+//	  "checkpoint_interval_s": 60      // optional, also after this long
+//	}
+//
+// Every event carries audit.chain (random per backend and process),
+// audit.seq (1, 2, …) and audit.prev, the hex SHA-256 of the previous
+// payload of the chain exactly as it was handed to the sink (64 zeros for the
+// first). Checkpoints are events of their own (event=audit_checkpoint, part
+// of the chain) with audit.sig, the base64 Ed25519 signature of
+//
+//	krakend-trace-audit/v1 chain=<audit.chain> seq=<audit.seq> prev=<audit.prev>
+//
+// and audit.key_id, the first 8 bytes of the SHA-256 of the public key in hex.
+// A verifier hashes each payload, checks it against the next audit.prev and
+// checks the signatures; a gap in audit.seq or a mismatch shows a lost or
+// altered event, including events dropped after encoding (quotas, a full
+// queue, failed sends). Payloads of a backend are encoded one at a time.
+//
+// Sinks that store a document of their own (stdout, sqlite, file, parquet,
+// elasticsearch, clickhouse, unix in ndjson mode) and routes with another
+// payload_format do not keep the hashed payload, so the option is rejected
+// with them. The timed checkpoints stop with the backend's context.
+
+// Audit is a backend's hash chain.
+type Audit struct {
+	key      ed25519.PrivateKey
+	keyID    string
+	chain    string
+	every    int
+	interval time.Duration
+
+	once  sync.Once
+	stop  chan struct{} // closed by Stop
+	halt  sync.Once
+	mu    sync.Mutex
+	seq   uint64
+	head  [sha256.Size]byte
+	since int // events since the last checkpoint
+}
+
+// ParseAudit reads the audit block and loads the signing key.
+func ParseAudit(v map[string]interface{}) (*Audit, error) {
+	path, _ := v["key_file"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("key_file missing")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T is not an Ed25519 key", path, k)
+	}
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	a := &Audit{key: key, keyID: hex.EncodeToString(sum[:8]), chain: RandomID(), every: 1000,
+		stop: make(chan struct{})}
+	if n, ok := v["checkpoint_every"].(float64); ok {
+		if a.every = int(n); a.every < 1 {
+			return nil, fmt.Errorf("checkpoint_every must be at least 1")
+		}
+	}
+	if n, ok := v["checkpoint_interval_s"].(float64); ok && n > 0 {
+		a.interval = time.Duration(n) * time.Second
+	}
+	return a, nil
+}
+
+// encode encodes ev as the next link of the chain.
+func (a *Audit) encode(c *Config, ev *Event) ([]byte, error) {
+	a.once.Do(func() {
+		if a.interval > 0 {
+			go func() {
+				t := time.NewTicker(a.interval)
+				defer t.Stop()
+				for {
+					select {
+					case <-t.C:
+						a.checkpoint(c)
+					case <-a.stop:
+						return
+					}
+				}
+			}()
+		}
+	})
+	a.mu.Lock()
+	payload, err := a.linkLocked(c, ev)
+	due := err == nil && a.since >= a.every
+	a.mu.Unlock()
+	if due {
+		go a.checkpoint(c)
+	}
+	return payload, err
+}
+
+// Stop ends the timed checkpoints of a; the backend is going away. A nil
+// Audit is a no-op.
+func (a *Audit) Stop() {
+	if a != nil {
+		a.halt.Do(func() { close(a.stop) })
+	}
+}
+
+// linkLocked stamps ev with the chain fields, encodes it and advances the
+// chain; the caller holds mu.
+func (a *Audit) linkLocked(c *Config, ev *Event) ([]byte, error) {
+	seq, prev := strconv.FormatUint(a.seq+1, 10), hex.EncodeToString(a.head[:])
+	ev.Meta.Set("audit.chain", a.chain)
+	ev.Meta.Set("audit.seq", seq)
+	ev.Meta.Set("audit.prev", prev)
+	if ev.Meta.Get("event") == "audit_checkpoint" {
+		msg := "krakend-trace-audit/v1 chain=" + a.chain + " seq=" + seq + " prev=" + prev
+		ev.Meta.Set("audit.sig", base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, []byte(msg))))
+		ev.Meta.Set("audit.key_id", a.keyID)
+	}
+	payload, err := c.Format.Encode(ev)
+	if err != nil {
+		return nil, err
+	}
+	a.seq++
+	a.head = sha256.Sum256(payload)
+	a.since++
+	return payload, nil
+}
+
+// checkpoint sends a signed checkpoint when events came in since the last.
+func (a *Audit) checkpoint(c *Config) {
+	defer Recover("audit checkpoint", nil)
+	u := &url.URL{Scheme: "http", Host: "krakend-trace.invalid", Path: "/__audit_checkpoint"}
+	ev := &Event{At: time.Now(), Method: http.MethodGet, URL: u, ReqHeader: http.Header{},
+		RespHeader: http.Header{}, Status: http.StatusOK, Meta: url.Values{}}
+	ev.Meta.Set("event", "audit_checkpoint")
+	ev.Meta.Set("instance_id", instanceID)
+	ev.Meta.Set("seq", strconv.FormatUint(eventSeq.Add(1), 10))
+	ev.Meta.Set("status", "200")
+	if c.Endpoint != "" {
+		ev.Meta.Set("endpoint", c.Endpoint)
+	}
+
+	a.mu.Lock()
+	if a.since == 0 {
+		a.mu.Unlock()
+		return
+	}
+	payload, err := a.linkLocked(c, ev)
+	a.since = 0
+	a.mu.Unlock()
+	if err != nil {
+		Log("audit checkpoint:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	dispatch(ctx, c, ev, payload)
+}
@@ -0,0 +1,143 @@
+package capture
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeKey(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	return path
+}
+
+func TestAuditChainLinksAndSigns(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	a, err := ParseAudit(map[string]interface{}{"key_file": writeKey(t, priv), "checkpoint_every": float64(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{Format: PayloadFormat{Encode: func(ev *Event) ([]byte, error) {
+		return []byte(ev.Meta.Encode()), nil
+	}}}
+
+	prev := strings.Repeat("0", 64)
+	for i, event := range []string{"", "", "audit_checkpoint", ""} {
+		ev := &Event{Meta: url.Values{}}
+		if event != "" {
+			ev.Meta.Set("event", event)
+		}
+		a.mu.Lock()
+		payload, err := a.linkLocked(c, ev)
+		a.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Meta.Get("audit.chain") != a.chain || ev.Meta.Get("audit.seq") != string(rune('1'+i)) ||
+			ev.Meta.Get("audit.prev") != prev {
+			t.Fatalf("link %d: %v, want prev %s", i, ev.Meta, prev)
+		}
+		if event == "audit_checkpoint" {
+			sig, _ := base64.StdEncoding.DecodeString(ev.Meta.Get("audit.sig"))
+			msg := "krakend-trace-audit/v1 chain=" + a.chain + " seq=3 prev=" + prev
+			if !ed25519.Verify(pub, []byte(msg), sig) {
+				t.Errorf("checkpoint signature does not verify over %q", msg)
+			}
+			sum := sha256.Sum256(pub)
+			if ev.Meta.Get("audit.key_id") != hex.EncodeToString(sum[:8]) {
+				t.Errorf("key_id = %s", ev.Meta.Get("audit.key_id"))
+			}
+		} else if ev.Meta.Has("audit.sig") {
+			t.Errorf("link %d is signed", i)
+		}
+		sum := sha256.Sum256(payload)
+		prev = hex.EncodeToString(sum[:])
+	}
+
+	// a payload that fails to encode does not advance the chain
+	c.Format.Encode = func(*Event) ([]byte, error) { return nil, errors.New("no") }
+	if _, err := a.encode(c, &Event{Meta: url.Values{}}); err == nil || a.seq != 4 || a.since != 4 {
+		t.Errorf("failed encode: err %v, seq %d, since %d", err, a.seq, a.since)
+	}
+	if b, _ := ParseAudit(map[string]interface{}{"key_file": writeKey(t, priv)}); b.chain == a.chain {
+		t.Error("two chains share an id")
+	}
+}
+
+func TestAuditStopEndsCheckpoints(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	a, err := ParseAudit(map[string]interface{}{"key_file": writeKey(t, priv), "checkpoint_interval_s": float64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.interval = 10 * time.Millisecond
+	var checkpoints atomic.Int32
+	c := &Config{Format: PayloadFormat{Encode: func(ev *Event) ([]byte, error) {
+		if ev.Meta.Get("event") == "audit_checkpoint" {
+			checkpoints.Add(1)
+			return nil, errors.New("not sent")
+		}
+		return []byte(ev.Meta.Encode()), nil
+	}}}
+	if _, err := a.encode(c, &Event{Meta: url.Values{}}); err != nil { // starts the ticker
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); checkpoints.Load() == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no timed checkpoint")
+		}
+	}
+	a.Stop()
+	a.Stop()                          // a second reload is harmless
+	time.Sleep(20 * time.Millisecond) // a tick already under way
+	n := checkpoints.Load()
+	a.mu.Lock()
+	a.since = 1
+	a.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if got := checkpoints.Load(); got != n {
+		t.Errorf("%d checkpoints after Stop", got-n)
+	}
+	(*Audit)(nil).Stop()
+}
+
+func TestParseAuditErrors(t *testing.T) {
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	notPEM := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(notPEM, []byte("secret"), 0o600)
+	for _, tc := range []struct {
+		v    map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{}, "key_file missing"},
+		{map[string]interface{}{"key_file": filepath.Join(t.TempDir(), "none.pem")}, "no such file"},
+		{map[string]interface{}{"key_file": notPEM}, "no PEM block"},
+		{map[string]interface{}{"key_file": writeKey(t, ec)}, "is not an Ed25519 key"},
+		{map[string]interface{}{"key_file": writeKey(t, other), "checkpoint_every": float64(0)}, "at least 1"},
+	} {
+		if _, err := ParseAudit(tc.v); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: err = %v, want %q", tc.v, err, tc.want)
+		}
+	}
+}
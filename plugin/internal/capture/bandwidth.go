@@ -0,0 +1,66 @@
+package capture
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* ───────── bytes in and out ───────── */
+
+// Every event carries request_size and response_size, the body bytes that
+// actually streamed from the client and to it, whatever max_capture_kb kept.
+// The admin server adds them up per endpoint (the endpoint label, or the
+// path when there is none) for bandwidth attribution:
+//
+//	GET /debug/bandwidth
+//	{"since": "2026-…", "endpoints": {"/orders": {"requests": 120, "bytes_in": 48213, "bytes_out": 1093825}}}
+//
+// At most maxBandwidthKeys paths are kept apart; the rest count as "other".
+
+const maxBandwidthKeys = 1000
+
+type bandwidthStat struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+var (
+	bandwidthMu    sync.Mutex
+	bandwidth      = map[string]*bandwidthStat{}
+	bandwidthSince = time.Now().UTC()
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/bandwidth", serveBandwidth)
+}
+
+// countBytes adds the body sizes of ev to the totals.
+func countBytes(ev *Event, in, out int64) {
+	key := ev.Meta.Get("endpoint")
+	if key == "" && ev.URL != nil {
+		key = ev.URL.Path
+	}
+	bandwidthMu.Lock()
+	defer bandwidthMu.Unlock()
+	st, ok := bandwidth[key]
+	if !ok {
+		if len(bandwidth) >= maxBandwidthKeys {
+			key = "other"
+		}
+		if st = bandwidth[key]; st == nil {
+			st = &bandwidthStat{}
+			bandwidth[key] = st
+		}
+	}
+	st.Requests++
+	st.BytesIn += in
+	st.BytesOut += out
+}
+
+func serveBandwidth(w http.ResponseWriter, _ *http.Request) {
+	bandwidthMu.Lock()
+	defer bandwidthMu.Unlock()
+	WriteJSON(w, map[string]interface{}{"since": bandwidthSince, "endpoints": bandwidth})
+}
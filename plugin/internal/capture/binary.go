@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+/* ───────── binary bodies ───────── */
+
+// Binary bodies would corrupt the text payloads (and the JSON documents
+// sinks build), so right before encoding a body that is not UTF-8 text, holds
+// control characters, or has a binary content type (images, audio, video,
+// fonts, archives, PDF, octet-stream) is replaced by its base64 encoding and
+// request_body_encoding / response_body_encoding=base64 is added to the event.
+// Expressions, transforms and WASM modules still see the raw bytes.
+//
+//	"binary_bodies": "base64"   // default, raw with payload_format msgpack, cbor or proto
+//	"binary_bodies": "raw"      // sends the bytes unchanged
+
+// ParseBinaryBodies reads binary_bodies and reports whether to encode them.
+func ParseBinaryBodies(v string) (bool, error) {
+	switch v {
+	case "", "base64":
+		return true, nil
+	case "raw":
+		return false, nil
+	}
+	return false, fmt.Errorf("binary_bodies must be base64 or raw, not %q", v)
+}
+
+func encodeBinaryBodies(ev *Event) {
+	if isBinary(ev.ReqHeader, ev.ReqBody) {
+		ev.ReqBody = base64Body(ev.ReqBody)
+		ev.Meta.Set("request_body_encoding", "base64")
+	}
+	if isBinary(ev.RespHeader, ev.RespBody) {
+		ev.RespBody = base64Body(ev.RespBody)
+		ev.Meta.Set("response_body_encoding", "base64")
+	}
+}
+
+func base64Body(b []byte) []byte {
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(out, b)
+	return out
+}
+
+var binaryTypes = []string{
+	"image/", "audio/", "video/", "font/",
+	"application/octet-stream", "application/pdf", "application/zip",
+	"application/gzip", "application/x-gzip", "application/x-tar", "application/wasm",
+}
+
+func isBinary(h http.Header, body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt != "" && mt != "image/svg+xml" {
+		for _, t := range binaryTypes {
+			if strings.HasPrefix(mt, t) {
+				return true
+			}
+		}
+	}
+	// a rune cut by max_capture_kb does not make a text body binary
+	for i := len(body) - 1; i >= 0 && i >= len(body)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(body[i]) {
+			if !utf8.FullRune(body[i:]) {
+				body = body[:i]
+			}
+			break
+		}
+	}
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		if r == utf8.RuneError && size == 1 || r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0x7f {
+			return true
+		}
+		body = body[size:]
+	}
+	return false
+}
@@ -0,0 +1,606 @@
+package capture
+
+import _ "embed"
+
+/* ───────── brotli decoder ───────── */
+
+// A decoder for RFC 7932 streams, written out here because the standard
+// library has none and KrakenD links no brotli package the plugin could
+// share. It decodes a whole captured body at once, so it keeps the output in
+// one slice instead of a ring buffer, and stops at a size limit.
+
+//go:embed brotli.dict
+var brotliDict string
+
+// brotliDictBits is NDBITS: log2 of the number of dictionary words per length.
+var brotliDictBits = [25]uint{0, 0, 0, 0, 10, 10, 11, 11, 10, 10, 10, 10, 10, 9, 9, 8, 7, 7, 8, 7, 7, 6, 6, 5, 5}
+
+var brotliDictOffset = func() (off [25]int) {
+	for l := 4; l < 24; l++ {
+		off[l+1] = off[l] + l<<brotliDictBits[l]
+	}
+	return off
+}()
+
+type brotliError string
+
+func (e brotliError) Error() string { return "brotli: " + string(e) }
+
+const (
+	errBrotliEOF   = brotliError("unexpected end of stream")
+	errBrotliLimit = brotliError("output limit") // not an error to callers
+)
+
+// unbrotli decodes src, up to limit bytes of output. A stream cut short
+// returns what decoded before the cut with the error.
+func unbrotli(src []byte, limit int) (out []byte, err error) {
+	d := &brotliDecoder{br: bitReader{src: src}, limit: limit, dist: [4]int{16, 15, 11, 4}}
+	defer func() {
+		if v := recover(); v != nil {
+			e, ok := v.(brotliError)
+			if !ok {
+				panic(v)
+			}
+			if out = d.out; e != errBrotliLimit {
+				err = e
+			}
+		}
+	}()
+	d.run()
+	return d.out, nil
+}
+
+type bitReader struct {
+	src []byte
+	off int
+	val uint64
+	n   uint
+}
+
+func (br *bitReader) bits(n uint) int {
+	for br.n < n {
+		if br.off == len(br.src) {
+			panic(errBrotliEOF)
+		}
+		br.val |= uint64(br.src[br.off]) << br.n
+		br.off++
+		br.n += 8
+	}
+	v := int(br.val & (1<<n - 1))
+	br.val >>= n
+	br.n -= n
+	return v
+}
+
+// align skips to the next byte boundary; the padding must be zero.
+func (br *bitReader) align() {
+	if br.bits(br.n%8) != 0 {
+		panic(brotliError("non-zero padding"))
+	}
+}
+
+// prefixCode is a canonical prefix code, decoded a bit at a time.
+type prefixCode struct {
+	count  [16]int // codes per length
+	symbol []int   // symbols in code order
+	single int     // the symbol of a code without bits, -1 for none
+}
+
+// newPrefixCode builds the code for the lengths; complete codes use all
+// the code space, as the format requires of every code with two or more
+// symbols.
+func newPrefixCode(lengths []int) *prefixCode {
+	h := &prefixCode{single: -1}
+	var offs [16]int
+	n := 0
+	for s, l := range lengths {
+		if l != 0 {
+			h.count[l]++
+			h.single, n = s, n+1
+		}
+	}
+	if n == 1 {
+		return h
+	}
+	h.single = -1
+	left := 1
+	for l := 1; l < 16; l++ {
+		if left = left<<1 - h.count[l]; left < 0 {
+			panic(brotliError("over-subscribed prefix code"))
+		}
+		offs[l] = offs[l-1] + h.count[l-1]
+	}
+	if left != 0 {
+		panic(brotliError("incomplete prefix code"))
+	}
+	h.symbol = make([]int, n)
+	for s, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = s
+			offs[l]++
+		}
+	}
+	return h
+}
+
+func (br *bitReader) decode(h *prefixCode) int {
+	if h.single >= 0 {
+		return h.single
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l < 16; l++ {
+		code |= br.bits(1)
+		n := h.count[l]
+		if code-n < first {
+			return h.symbol[index+code-first]
+		}
+		index, first, code = index+n, (first+n)<<1, code<<1
+	}
+	panic(brotliError("invalid code"))
+}
+
+var codeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// readPrefixCode reads a simple or complex prefix code over alphabet
+// symbols (section 3.4 and 3.5).
+func (br *bitReader) readPrefixCode(alphabet int) *prefixCode {
+	lengths := make([]int, alphabet)
+	hskip := br.bits(2)
+	if hskip == 1 {
+		nbits := uint(0)
+		for (alphabet-1)>>nbits != 0 {
+			nbits++
+		}
+		nsym := br.bits(2) + 1
+		syms := make([]int, nsym)
+		for i := range syms {
+			if syms[i] = br.bits(nbits); syms[i] >= alphabet {
+				panic(brotliError("symbol out of range"))
+			}
+			for _, s := range syms[:i] {
+				if s == syms[i] {
+					panic(brotliError("duplicate symbol"))
+				}
+			}
+		}
+		if nsym == 1 {
+			return &prefixCode{single: syms[0]}
+		}
+		shape := [][]int{nil, nil, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}}[nsym]
+		if nsym == 4 && br.bits(1) == 1 {
+			shape = []int{1, 2, 3, 3}
+		}
+		for i, s := range syms {
+			lengths[s] = shape[i]
+		}
+		return newPrefixCode(lengths)
+	}
+
+	var clens [18]int
+	space, num := 32, 0
+	for i := hskip; i < 18; i++ {
+		var l int
+		switch br.bits(2) {
+		case 0:
+			l = 0
+		case 1:
+			l = 4
+		case 2:
+			l = 3
+		default:
+			switch {
+			case br.bits(1) == 0:
+				l = 2
+			case br.bits(1) == 0:
+				l = 1
+			default:
+				l = 5
+			}
+		}
+		clens[codeLengthOrder[i]] = l
+		if l != 0 {
+			num++
+			if space -= 32 >> l; space <= 0 {
+				break
+			}
+		}
+	}
+	if num != 1 && space != 0 {
+		panic(brotliError("invalid code length code"))
+	}
+	clcode := newPrefixCode(clens[:])
+
+	prev, repeat, repeatLen := 8, 0, 0
+	space = 1 << 15
+	for s := 0; s < alphabet && space > 0; {
+		l := br.decode(clcode)
+		if l < 16 {
+			repeat = 0
+			lengths[s] = l
+			s++
+			if l != 0 {
+				prev = l
+				space -= 1 << 15 >> l
+			}
+			continue
+		}
+		extra, newLen := uint(2), prev
+		if l == 17 {
+			extra, newLen = 3, 0
+		}
+		if repeatLen != newLen {
+			repeat, repeatLen = 0, newLen
+		}
+		old := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extra
+		}
+		repeat += br.bits(extra) + 3
+		delta := repeat - old
+		if s+delta > alphabet {
+			panic(brotliError("code lengths overflow the alphabet"))
+		}
+		for ; delta > 0; delta-- {
+			lengths[s] = newLen
+			s++
+		}
+		if newLen != 0 {
+			space -= (repeat - old) << (15 - newLen)
+		}
+	}
+	if space != 0 {
+		panic(brotliError("invalid code lengths"))
+	}
+	return newPrefixCode(lengths)
+}
+
+// readVarLen reads the 1-256 count of block types and trees.
+func (br *bitReader) readVarLen() int {
+	if br.bits(1) == 0 {
+		return 1
+	}
+	n := uint(br.bits(3))
+	return 1<<n + br.bits(n) + 1
+}
+
+var blockLengthBase = [26]int{1, 5, 9, 13, 17, 25, 33, 41, 49, 65, 81, 97, 113, 145, 177, 209,
+	241, 305, 369, 497, 753, 1265, 2289, 4337, 8433, 16625}
+var blockLengthExtra = [26]uint{2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 7, 8, 9, 10, 11, 12, 13, 24}
+
+var insertBase = [24]int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578,
+	1090, 2114, 6210, 22594}
+var insertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+var copyBase = [24]int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198,
+	326, 582, 1094, 2118}
+var copyExtra = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+
+// insert and copy length code offsets per 64-symbol cell of the
+// command alphabet (section 5).
+var cellInsert = [11]int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}
+var cellCopy = [11]int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}
+
+// blockSwitch is the state of one of the three block categories.
+type blockSwitch struct {
+	types     int
+	typeCode  *prefixCode
+	lenCode   *prefixCode
+	cur, prev int
+	left      int // commands, literals or distances left in the block
+}
+
+func (br *bitReader) readBlockSwitch() blockSwitch {
+	b := blockSwitch{types: br.readVarLen(), prev: 1, left: 1 << 24}
+	if b.types >= 2 {
+		b.typeCode = br.readPrefixCode(b.types + 2)
+		b.lenCode = br.readPrefixCode(26)
+		b.left = br.readBlockLength(b.lenCode)
+	}
+	return b
+}
+
+func (br *bitReader) readBlockLength(h *prefixCode) int {
+	c := br.decode(h)
+	return blockLengthBase[c] + br.bits(blockLengthExtra[c])
+}
+
+// next moves to the next block when the current one is used up.
+func (b *blockSwitch) next(br *bitReader) {
+	if b.left == 0 {
+		t := br.decode(b.typeCode)
+		switch t {
+		case 0:
+			t = b.prev
+		case 1:
+			t = b.cur + 1
+		default:
+			t -= 2
+		}
+		if t >= b.types {
+			t -= b.types
+		}
+		b.prev, b.cur = b.cur, t
+		b.left = br.readBlockLength(b.lenCode)
+	}
+	b.left--
+}
+
+func (br *bitReader) readContextMap(size, trees int) []int {
+	cmap := make([]int, size)
+	if trees < 2 {
+		return cmap
+	}
+	rleMax := 0
+	if br.bits(1) == 1 {
+		rleMax = br.bits(4) + 1
+	}
+	code := br.readPrefixCode(trees + rleMax)
+	for i := 0; i < size; {
+		switch s := br.decode(code); {
+		case s == 0:
+			i++
+		case s <= rleMax:
+			if i += 1<<s + br.bits(uint(s)); i > size {
+				panic(brotliError("context map overflow"))
+			}
+		default:
+			cmap[i] = s - rleMax
+			i++
+		}
+	}
+	if br.bits(1) == 1 { // inverse move-to-front
+		var mtf [256]int
+		for i := range mtf {
+			mtf[i] = i
+		}
+		for i, idx := range cmap {
+			v := mtf[idx]
+			cmap[i] = v
+			copy(mtf[1:idx+1], mtf[:idx])
+			mtf[0] = v
+		}
+	}
+	for _, t := range cmap {
+		if t >= trees {
+			panic(brotliError("context map refers to a missing tree"))
+		}
+	}
+	return cmap
+}
+
+type brotliDecoder struct {
+	br     bitReader
+	out    []byte
+	limit  int
+	window int
+	dist   [4]int // last distances, dist[3] the most recent
+}
+
+func (d *brotliDecoder) emit(b ...byte) {
+	if len(d.out)+len(b) > d.limit {
+		d.out = append(d.out, b[:d.limit-len(d.out)]...)
+		panic(errBrotliLimit)
+	}
+	d.out = append(d.out, b...)
+}
+
+func (d *brotliDecoder) run() {
+	br := &d.br
+	wbits := 16
+	if br.bits(1) == 1 {
+		if n := br.bits(3); n != 0 {
+			wbits = 17 + n
+		} else if n = br.bits(3); n == 1 {
+			panic(brotliError("large windows are not supported"))
+		} else if n != 0 {
+			wbits = 8 + n
+		} else {
+			wbits = 17
+		}
+	}
+	d.window = 1<<wbits - 16
+	for {
+		last := br.bits(1) == 1
+		if last && br.bits(1) == 1 {
+			return
+		}
+		nibbles := br.bits(2) + 4
+		if nibbles == 7 { // metadata, skipped
+			if br.bits(1) != 0 {
+				panic(brotliError("reserved bit set"))
+			}
+			skip := 0
+			if n := br.bits(2); n > 0 {
+				skip = br.bits(uint(8*n)) + 1
+			}
+			br.align()
+			for ; skip > 0; skip-- {
+				br.bits(8)
+			}
+			continue
+		}
+		mlen := br.bits(uint(4*nibbles)) + 1
+		if !last && br.bits(1) == 1 { // uncompressed
+			br.align()
+			for ; mlen > 0; mlen-- {
+				d.emit(byte(br.bits(8)))
+			}
+			continue
+		}
+		d.metaBlock(mlen)
+		if last {
+			return
+		}
+	}
+}
+
+func (d *brotliDecoder) metaBlock(mlen int) {
+	br := &d.br
+	lit, cmd, dst := br.readBlockSwitch(), br.readBlockSwitch(), br.readBlockSwitch()
+	postfix := uint(br.bits(2))
+	direct := br.bits(4) << postfix
+	modes := make([]int, lit.types)
+	for i := range modes {
+		modes[i] = br.bits(2)
+	}
+	litTrees := br.readVarLen()
+	litMap := br.readContextMap(64*lit.types, litTrees)
+	distTrees := br.readVarLen()
+	distMap := br.readContextMap(4*dst.types, distTrees)
+	litCodes := make([]*prefixCode, litTrees)
+	for i := range litCodes {
+		litCodes[i] = br.readPrefixCode(256)
+	}
+	cmdCodes := make([]*prefixCode, cmd.types)
+	for i := range cmdCodes {
+		cmdCodes[i] = br.readPrefixCode(704)
+	}
+	distCodes := make([]*prefixCode, distTrees)
+	for i := range distCodes {
+		distCodes[i] = br.readPrefixCode(16 + direct + 48<<postfix)
+	}
+
+	end := len(d.out) + mlen
+	for len(d.out) < end {
+		cmd.next(br)
+		c := br.decode(cmdCodes[cmd.cur])
+		cell := c >> 6
+		ic, cc := cellInsert[cell]+c>>3&7, cellCopy[cell]+c&7
+		ilen := insertBase[ic] + br.bits(insertExtra[ic])
+		clen := copyBase[cc] + br.bits(copyExtra[cc])
+		if len(d.out)+ilen > end {
+			panic(brotliError("insert beyond the meta-block"))
+		}
+		for ; ilen > 0; ilen-- {
+			lit.next(br)
+			var p1, p2 byte
+			if n := len(d.out); n > 1 {
+				p1, p2 = d.out[n-1], d.out[n-2]
+			} else if n == 1 {
+				p1 = d.out[0]
+			}
+			var ctx int
+			switch modes[lit.cur] {
+			case 0:
+				ctx = int(p1 & 0x3f)
+			case 1:
+				ctx = int(p1 >> 2)
+			case 2:
+				ctx = int(lut0[p1] | lut1[p2])
+			default:
+				ctx = int(lut2[p1]<<3 | lut2[p2])
+			}
+			d.emit(byte(br.decode(litCodes[litMap[64*lit.cur+ctx]])))
+		}
+		if len(d.out) == end {
+			return
+		}
+
+		code := 0
+		if cell >= 2 {
+			dst.next(br)
+			cid := 3
+			if clen <= 4 {
+				cid = clen - 2
+			}
+			code = br.decode(distCodes[distMap[4*dst.cur+cid]])
+		}
+		dist := d.distance(code, postfix, direct)
+		maxDist := min(d.window, len(d.out))
+		if dist > maxDist {
+			d.dictWord(dist-maxDist-1, clen, end)
+			continue
+		}
+		if code != 0 {
+			d.dist = [4]int{d.dist[1], d.dist[2], d.dist[3], dist}
+		}
+		if len(d.out)+clen > end {
+			panic(brotliError("copy beyond the meta-block"))
+		}
+		for from := len(d.out) - dist; clen > 0; clen-- {
+			d.emit(d.out[from])
+			from++
+		}
+	}
+}
+
+// distance resolves a distance code (section 4).
+func (d *brotliDecoder) distance(code int, postfix uint, direct int) int {
+	var dist int
+	switch {
+	case code < 4:
+		dist = d.dist[3-code]
+	case code < 16:
+		delta := [12]int{-1, 1, -2, 2, -3, 3, -1, 1, -2, 2, -3, 3}[code-4]
+		if code < 10 {
+			dist = d.dist[3] + delta
+		} else {
+			dist = d.dist[2] + delta
+		}
+	case code < 16+direct:
+		dist = code - 15
+	default:
+		c := code - direct - 16
+		nbits := uint(1 + c>>(postfix+1))
+		hcode, lcode := c>>postfix, c&(1<<postfix-1)
+		offset := (2+hcode&1)<<nbits - 4
+		dist = (offset+d.br.bits(nbits))<<postfix + lcode + direct + 1
+	}
+	if dist <= 0 {
+		panic(brotliError("invalid distance"))
+	}
+	return dist
+}
+
+// dictWord writes a transformed word of the static dictionary.
+func (d *brotliDecoder) dictWord(id, length, end int) {
+	if length < 4 || length > 24 {
+		panic(brotliError("invalid dictionary reference"))
+	}
+	nbits := brotliDictBits[length]
+	t := id >> nbits
+	if t >= len(brotliTransforms) {
+		panic(brotliError("invalid transform"))
+	}
+	off := brotliDictOffset[length] + (id&(1<<nbits-1))*length
+	tr := brotliTransforms[t]
+	word := []byte(brotliDict[off : off+length])
+	switch {
+	case tr.kind <= 9:
+		word = word[:max(len(word)-tr.kind, 0)]
+	case tr.kind >= 12:
+		word = word[min(tr.kind-11, len(word)):]
+	}
+	if tr.kind == 10 && len(word) > 0 {
+		upperFirst(word)
+	}
+	for w := word; tr.kind == 11 && len(w) > 0; {
+		w = w[upperFirst(w):]
+	}
+	b := append(append([]byte(tr.prefix), word...), tr.suffix...)
+	if len(d.out)+len(b) > end {
+		panic(brotliError("word beyond the meta-block"))
+	}
+	d.emit(b...)
+}
+
+// upperFirst upper-cases the character starting p the way the format does
+// and returns its length.
+func upperFirst(p []byte) int {
+	switch {
+	case p[0] < 0xc0:
+		if p[0] >= 'a' && p[0] <= 'z' {
+			p[0] ^= 32
+		}
+		return 1
+	case p[0] < 0xe0:
+		if len(p) > 1 {
+			p[1] ^= 32
+		}
+		return min(2, len(p))
+	default:
+		if len(p) > 2 {
+			p[2] ^= 5
+		}
+		return min(3, len(p))
+	}
+}
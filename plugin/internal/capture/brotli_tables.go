@@ -0,0 +1,107 @@
+package capture
+
+/* ───────── brotli tables ───────── */
+
+// The RFC 7932 tables the brotli decoder needs besides the dictionary
+// (brotli.dict): the word transforms of appendix B and the context lookup
+// of section 7.1.
+
+// brotliTransforms are prefix, kind and suffix of the 121 word transforms;
+// kind 0 is the identity, 1-9 omit that many last bytes, 10 upper-cases the
+// first character, 11 all, 12-20 omit 1-9 first bytes.
+var brotliTransforms = [121]struct {
+	prefix string
+	kind   int
+	suffix string
+}{
+	{"", 0, ""}, {"", 0, " "}, {" ", 0, " "}, {"", 12, ""},
+	{"", 10, " "}, {"", 0, " the "}, {" ", 0, ""}, {"s ", 0, " "},
+	{"", 0, " of "}, {"", 10, ""}, {"", 0, " and "}, {"", 13, ""},
+	{"", 1, ""}, {", ", 0, " "}, {"", 0, ", "}, {" ", 10, " "},
+	{"", 0, " in "}, {"", 0, " to "}, {"e ", 0, " "}, {"", 0, "\""},
+	{"", 0, "."}, {"", 0, "\">"}, {"", 0, "\n"}, {"", 3, ""},
+	{"", 0, "]"}, {"", 0, " for "}, {"", 14, ""}, {"", 2, ""},
+	{"", 0, " a "}, {"", 0, " that "}, {" ", 10, ""}, {"", 0, ". "},
+	{".", 0, ""}, {" ", 0, ", "}, {"", 15, ""}, {"", 0, " with "},
+	{"", 0, "'"}, {"", 0, " from "}, {"", 0, " by "}, {"", 16, ""},
+	{"", 17, ""}, {" the ", 0, ""}, {"", 4, ""}, {"", 0, ". The "},
+	{"", 11, ""}, {"", 0, " on "}, {"", 0, " as "}, {"", 0, " is "},
+	{"", 7, ""}, {"", 1, "ing "}, {"", 0, "\n\t"}, {"", 0, ":"},
+	{" ", 0, ". "}, {"", 0, "ed "}, {"", 20, ""}, {"", 18, ""},
+	{"", 6, ""}, {"", 0, "("}, {"", 10, ", "}, {"", 8, ""},
+	{"", 0, " at "}, {"", 0, "ly "}, {" the ", 0, " of "}, {"", 5, ""},
+	{"", 9, ""}, {" ", 10, ", "}, {"", 10, "\""}, {".", 0, "("},
+	{"", 11, " "}, {"", 10, "\">"}, {"", 0, "=\""}, {" ", 0, "."},
+	{".com/", 0, ""}, {" the ", 0, " of the "}, {"", 10, "'"}, {"", 0, ". This "},
+	{"", 0, ","}, {".", 0, " "}, {"", 10, "("}, {"", 10, "."},
+	{"", 0, " not "}, {" ", 0, "=\""}, {"", 0, "er "}, {" ", 11, " "},
+	{"", 0, "al "}, {" ", 11, ""}, {"", 0, "='"}, {"", 11, "\""},
+	{"", 10, ". "}, {" ", 0, "("}, {"", 0, "ful "}, {" ", 10, ". "},
+	{"", 0, "ive "}, {"", 0, "less "}, {"", 11, "'"}, {"", 0, "est "},
+	{" ", 10, "."}, {"", 11, "\">"}, {" ", 0, "='"}, {"", 10, ","},
+	{"", 0, "ize "}, {"", 11, "."}, {"\u00a0", 0, ""}, {" ", 0, ","},
+	{"", 10, "=\""}, {"", 11, "=\""}, {"", 0, "ous "}, {"", 11, ", "},
+	{"", 10, "='"}, {" ", 10, ","}, {" ", 11, "=\""}, {" ", 11, ", "},
+	{"", 11, ","}, {"", 11, "("}, {"", 11, ". "}, {" ", 11, "."},
+	{"", 11, "='"}, {" ", 11, ". "}, {" ", 10, "=\""}, {" ", 11, "='"},
+	{" ", 10, "='"},
+}
+
+// UTF8 context mode: lut0[p1] | lut1[p2].
+var lut0 = [256]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 4, 0, 0, 4, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	8, 12, 16, 12, 12, 20, 12, 16, 24, 28, 12, 12, 32, 12, 36, 12,
+	44, 44, 44, 44, 44, 44, 44, 44, 44, 44, 32, 32, 24, 40, 28, 12,
+	12, 48, 52, 52, 52, 48, 52, 52, 52, 48, 52, 52, 52, 52, 52, 48,
+	52, 52, 52, 52, 52, 48, 52, 52, 52, 52, 52, 24, 12, 28, 12, 12,
+	12, 56, 60, 60, 60, 56, 60, 60, 60, 56, 60, 60, 60, 60, 60, 56,
+	60, 60, 60, 60, 60, 56, 60, 60, 60, 60, 60, 24, 12, 28, 12, 0,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+}
+
+var lut1 = [256]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1,
+	1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1,
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 1, 1, 1, 1, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+}
+
+// Signed context mode: lut2[p1]<<3 | lut2[p2].
+var lut2 = [256]uint8{
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 7,
+}
@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// bitWriter packs fields LSB first, the way RFC 7932 section 2 reads them.
+type bitWriter struct {
+	buf  []byte
+	nbit uint
+}
+
+func (w *bitWriter) put(v uint64, n uint) {
+	for i := uint(0); i < n; i++ {
+		if w.nbit%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&1) << (w.nbit % 8)
+		w.nbit++
+	}
+}
+
+func (w *bitWriter) raw(b []byte) {
+	w.nbit = uint(len(w.buf)) * 8
+	w.buf = append(w.buf, b...)
+	w.nbit += uint(len(b)) * 8
+}
+
+// storedStream is a WBITS 16 stream of one uncompressed meta-block per
+// chunk, closed by an empty last meta-block (section 9.2).
+func storedStream(chunks ...string) []byte {
+	var w bitWriter
+	w.put(0, 1) // WBITS 16
+	for _, c := range chunks {
+		w.put(0, 1)                 // ISLAST
+		w.put(0, 2)                 // MNIBBLES 4
+		w.put(uint64(len(c)-1), 16) // MLEN-1
+		w.put(1, 1)                 // ISUNCOMPRESSED
+		w.raw([]byte(c))
+	}
+	w.put(1, 1) // ISLAST
+	w.put(1, 1) // ISLASTEMPTY
+	return w.buf
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// windowText repeats its lines further back than a 1008 byte window, so the
+// encoder has to reach every match either inside the window or through the
+// dictionary.
+func windowText() string {
+	var b strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "line %d: the quick brown fox jumps over the lazy dog\n", i*7919%1000)
+	}
+	return b.String()
+}
+
+// The compressed vectors come from the reference encoder at quality 11.
+var brotliVectors = []struct {
+	name string
+	in   []byte
+	want string
+}{
+	{"empty", []byte{0x06}, ""},
+	{"empty wbits 22", []byte{0x3b}, ""},
+	{"empty wbits 10", []byte{0xa1, 0x01}, ""},
+	{"uncompressed", storedStream("hello, world"), "hello, world"},
+	{"uncompressed blocks", storedStream("abc", strings.Repeat("x", 300), "z"), "abc" + strings.Repeat("x", 300) + "z"},
+	{"dictionary and transforms",
+		unhex("1b5800308d94ee9a91a4a62a439b93206169e09003876f25144556b001c73ce826eb5b201357bcff8664ce7d51ea69d4307cda0506"),
+		`Hello World. The Example is a Transformation of the Language, <div class="content"></div>`},
+	{"wbits 10 window",
+		unhex("a1404300e54cb07142bdbbe1b9c98c554105def2f7f40639c3d353616f0da2309797027682d8e11b944090253af06198db181e1d5f448246b3616ceaf938725e46e79b51d6147d7fdfdb22afd3516dbad6aa3e5dbe59dd530f597351439d774a57aec35bc847fc4e7b6bd5e407f201bfe62e9de4686b8aef71adcee46e72826f73d57507bafc9c10f89cbed59ebfc93c009c06"),
+		windowText()},
+}
+
+func TestUnbrotliVectors(t *testing.T) {
+	for _, tc := range brotliVectors {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := unbrotli(tc.in, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tc.want {
+				t.Errorf("got %q, want %q", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnbrotliLimit(t *testing.T) {
+	for _, tc := range brotliVectors {
+		if len(tc.want) < 10 {
+			continue
+		}
+		out, err := unbrotli(tc.in, 10)
+		if err != nil || string(out) != tc.want[:10] {
+			t.Errorf("%s: limit 10 = %q, %v; want %q", tc.name, out, err, tc.want[:10])
+		}
+	}
+}
+
+func TestUnbrotliRejects(t *testing.T) {
+	stored := storedStream("hello")
+	padded := append([]byte(nil), stored...)
+	padded[2] |= 0x80 // bits 21-23 pad the header to the raw bytes
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"nothing", nil, "unexpected end"},
+		{"large window", []byte{0x11, 0x00}, "large windows"},
+		{"truncated", stored[:len(stored)-1], "unexpected end"},
+		{"truncated raw bytes", stored[:6], "unexpected end"},
+		{"non-zero padding", padded, "non-zero padding"},
+		{"truncated compressed", brotliVectors[5].in[:20], "unexpected end"},
+	} {
+		_, err := unbrotli(tc.in, 1<<20)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func FuzzUnbrotli(f *testing.F) {
+	for _, tc := range brotliVectors {
+		f.Add(tc.in)
+	}
+	const limit = 1 << 16
+	f.Fuzz(func(t *testing.T, in []byte) {
+		out, _ := unbrotli(in, limit)
+		if len(out) > limit {
+			t.Fatalf("%d bytes out, limit %d", len(out), limit)
+		}
+		if again, _ := unbrotli(in, limit); !bytes.Equal(out, again) {
+			t.Fatal("two runs over the same input disagree")
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package capture
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── memory budget ───────── */
+
+// max_pending_mb bounds the memory the tracing path holds for events not
+// delivered yet, so a slow or unreachable sink cannot run the gateway out
+// of memory:
+//
+//	"max_pending_mb": 64
+//
+// Counted are the captured bodies of an event (and the request copy kept
+// for shadow) from capture until the event is sent, dropped or given up,
+// its encoded payload while it waits in the queue or for the sink, and the
+// repeats dedupe holds back. The count is one per process, shared by every
+// backend; once it reaches the budget of a backend, that backend captures
+// new events without bodies (meta capture=metadata_only) until deliveries
+// bring it back under, or applies its overflow policy (overflow.go). Events
+// already captured keep their bodies. Hitting the budget is logged at most
+// once a minute; /debug/stats shows pending_bytes. Without the setting there
+// is no budget.
+
+var (
+	pendingBytes atomic.Int64
+	budgetWarned atomic.Int64 // unix nanoseconds
+)
+
+// hold counts n more bytes held for ev.
+func hold(ev *Event, n int) {
+	ev.held += int64(n)
+	pendingBytes.Add(int64(n))
+}
+
+// release gives back the bytes held for ev, once it is done with.
+func release(ev *Event) {
+	pendingBytes.Add(-ev.held)
+	ev.held = 0
+}
+
+// overBudget reports whether the events of the process hold the budget of
+// c or more.
+func overBudget(c *Config) bool {
+	if c.MaxPending <= 0 {
+		return false
+	}
+	n := pendingBytes.Load()
+	if n < c.MaxPending {
+		return false
+	}
+	now, last := time.Now().UnixNano(), budgetWarned.Load()
+	if now-last >= int64(time.Minute) && budgetWarned.CompareAndSwap(last, now) {
+		policy := c.Overflow.Policy()
+		if policy == "" {
+			policy = "metadata"
+		}
+		logger.Warning(tag, "pending events hold", n, "bytes, over the max_pending_mb of",
+			c.Endpoint+": overflow policy", policy)
+	}
+	return true
+}
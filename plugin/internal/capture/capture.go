@@ -0,0 +1,758 @@
+// Package capture is the core of the trace plugin: the HTTP handler that
+// proxies a request while capturing it, the event the tracking coroutine
+// builds from it, the body pipeline (GraphQL / XML / protobuf awareness,
+// normalization, extraction, capture_if, transforms, Starlark, WASM), the
+// payload formats and the localhost admin server. Sinks plug in through the
+// Sink interface; package config builds a Config from the plugin's
+// extra_config block.
+//
+// SPDX-License-Identifier: Apache-2.0
+package capture
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Tag prefixes log lines and configuration errors.
+	Tag = "[krakend-trace-plugin]"
+	tag = Tag
+
+	headerReqID = "X-Request-Id" // correlation header
+)
+
+/* ─────────────────── configuration ─────────────────── */
+
+// Config is one backend's capture setup, built by package config.
+type Config struct {
+	URL            *url.URL
+	Timeout        time.Duration
+	DrainTimeout   time.Duration
+	MaxCapture     int
+	MaxPending     int64
+	Overflow       *Overflow
+	CaptureTail    int // bytes kept from the end of clipped bodies, 0 for none
+	Verbose        bool
+	Labels         map[string]string
+	TagHeaders     map[string]string // canonical header name → event field
+	Endpoint       string
+	Backend        string
+	TrustedProxies TrustedNets
+	Sink           Sink
+	Format         PayloadFormat
+	GraphQL        *GraphQL
+	XML            *XML
+	Protobuf       *Protobuf
+	NormalizeJSON  JSONNormalize
+	Base64Bodies   bool // base64-encode binary bodies before encoding
+	Charsets       bool // transcode text bodies to UTF-8
+	Decompress     bool // decode compressed bodies
+	Extract        []ExtractField
+	CaptureIf      *Expr
+	Transform      []TransformRule
+	Starlark       *StarlarkTransform
+	WASM           *WASMTransform
+	Shadow         *Shadow
+	AdminPort      int // localhost admin server, 0 for none
+	RecentEvents   int // events kept for /debug/traces
+	SelfTest       SelfTestMode
+	DryRun         bool // log payloads instead of sending them
+	Tenant         *Tenant
+	TenantLimits   *TenantLimits
+	Queue          *Queue // nil: every request sends on its own
+	SplitPhases    bool   // also send an event when the request arrives
+	Consent        *Consent
+	Classification []string // data classes stamped on every event, e.g. pii
+	RetentionDays  int      // retention hint for the store, 0 for none
+	Tokenize       *Tokenizer
+	AnonymizeIP    *IPMask
+	Audit          *Audit       // hash chain over the encoded payloads
+	Upstream       *http.Client // upstream_tls, nil for http.DefaultClient
+	SyncDelivery   bool         // handler waits for the send
+	Dedupe         *Dedupe      // holds back repeated events
+	Cookies        *Cookies     // nil: Cookie headers kept as they are
+	TLSMeta        *TLSMeta     // inbound TLS fields, nil for none
+	Headers        *HeaderLists // captured headers, nil for all
+	Health         *HealthCheck // sink probing, nil for none
+	Sampling       *Sampling    // share of requests captured, nil for all
+	Flag           *FeatureFlag // feature_flag gate, nil for none
+	Stats          *PipelineStats
+
+	Effective  map[string]interface{} // resolved block, secrets masked, for /debug/config
+	ctl        *control               // admin counters, set by NewHandler
+	unregister func()                 // takes ctl out of the admin view
+}
+
+// Sink delivers one encoded event. Every request runs its own coroutine, so
+// implementations must be safe for concurrent use.
+type Sink interface {
+	Send(ctx context.Context, ev *Event, payload []byte) error
+}
+
+/* ─────────────────── event ─────────────────── */
+
+// Event is what the handler hands over to the tracking coroutine; the
+// response body follows separately once streaming has finished.
+type Event struct {
+	At         time.Time // request received
+	Method     string
+	URL        *url.URL
+	ReqHeader  http.Header
+	ReqBody    []byte
+	RespHeader http.Header
+	RespBody   []byte // set by the coroutine once streaming is done
+	Status     int
+	Elapsed    time.Duration // until the response was fully streamed
+	Upstream   time.Duration // until the backend's response headers arrived
+	Meta       url.Values
+
+	fullBody []byte          // unclipped request body, only kept for shadow
+	held     int64           // bytes counted against max_pending_mb, see budget.go
+	ctx      context.Context // request context without its cancellation
+}
+
+// detached is the parent context of the sends for ev: the request context
+// with its values (trace ids, auth) but without its cancellation and
+// deadline, since the event is sent after the handler returned.
+func (ev *Event) detached() context.Context {
+	if ev.ctx == nil {
+		return context.Background()
+	}
+	return ev.ctx
+}
+
+/* ─────────────────── globals ─────────────────── */
+
+var (
+	logger = &pluginLogger{} // see log.go
+
+	instanceID = RandomID()  // stable for the process lifetime
+	eventSeq   atomic.Uint64 // shared by every backend of this instance
+)
+
+// InstanceID identifies this gateway process in every event.
+func InstanceID() string { return instanceID }
+
+// SetLogger installs the logger KrakenD injects; the lines logged before
+// are replayed into it.
+func SetLogger(l Logger) {
+	if l != nil {
+		logger.set(l)
+	}
+}
+
+/* ───────── helpers for optional DEBUG ───────── */
+
+func vdbg(c *Config, v ...interface{}) {
+	if c.Verbose {
+		logger.Debug(append([]interface{}{tag}, v...)...)
+	}
+}
+
+// Log writes a debug line whether or not verbose is set.
+func Log(v ...interface{}) {
+	logger.Debug(append([]interface{}{tag}, v...)...)
+}
+
+/* ───────── tiny object pools ───────── */
+
+var bufPool = sync.Pool{New: func() any { return &bytes.Buffer{} }}
+
+/* ───────── proxy handler ───────── */
+
+// NewHandler returns the http-client handler for c.
+func NewHandler(c *Config) http.Handler {
+	logger.Info(tag, "config →", c.URL, "timeout:", c.Timeout,
+		"max_cap:", c.MaxCapture, "verbose:", c.Verbose)
+	if c.Sampling == nil { // the admin server may set a rate later
+		c.Sampling = newSampling()
+	}
+	c.ctl, c.unregister = register(c)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		degraded := c.Health.degraded()
+		sampled, metadataOnly := c.Sampling.sample()
+		if captureOff.Load() || c.ctl.draining.Load() || degraded && c.Health.bypass || !sampled ||
+			!c.Flag.enabled(c, req) {
+			passThrough(c, w, req)
+			return
+		}
+		drop, lean := c.Overflow.admit(c)
+		if drop {
+			vdbg(c, "overflow, request not captured")
+			countDropped(c)
+			passThrough(c, w, req)
+			return
+		}
+		start := time.Now()
+		c.ctl.requests.Add(1)
+		metadataOnly = metadataOnly || degraded || lean
+		max, tail := c.MaxCapture, c.CaptureTail
+		if metadataOnly {
+			max, tail = 0, 0
+		}
+
+		// capture request body (clipped)
+		reqBody, fullBody, reqSkipped := captureBody(&req.Body, max, tail)
+		vdbg(c, "reqB:", len(reqBody))
+
+		// channel passes captured resp body to coroutine
+		respCh := make(chan []byte, 1)
+
+		ev := NewEvent(c, req, reqBody)
+		ev.At = start
+		ev.Meta.Set("request_size", strconv.Itoa(len(fullBody)))
+		if reqSkipped > 0 {
+			ev.Meta.Set("request_body_skipped", strconv.FormatInt(reqSkipped, 10))
+		}
+		if metadataOnly {
+			ev.Meta.Set("capture", "metadata_only")
+		}
+		if rate, _ := c.Sampling.current(); rate < 1 {
+			ev.Meta.Set("sample_rate", strconv.FormatFloat(rate, 'g', -1, 64))
+		}
+		if c.Shadow != nil {
+			ev.fullBody = fullBody
+		}
+		hold(ev, len(reqBody)+len(ev.fullBody))
+
+		if c.SplitPhases {
+			rev := requestPhase(ev)
+			go func() {
+				defer recoverEvent(c, rev, "request phase")
+				process(c, rev)
+			}()
+		}
+
+		// coroutine: build payload & POST (non-blocking unless sync)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer recoverEvent(c, ev, "tracking")
+			trackingCoroutine(c, ev, respCh)
+		}()
+		if c.SyncDelivery || c.Queue != nil && c.Overflow.blockFor(c) > 0 {
+			defer awaitDelivery(c, done, req.URL.Path)
+		}
+
+		// call upstream
+		out, target := traceUpstream(req)
+		resp, err := c.upstream().Do(out)
+		ev.Upstream = time.Since(start)
+		target.record(ev)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			upstreamFailed(ev, err, []byte(err.Error()+"\n"), start)
+			countBytes(ev, int64(len(fullBody)), int64(len(ev.RespBody)))
+			respCh <- ev.RespBody
+			close(respCh)
+			Log(tag, req.URL.Path, "upstream error:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		// propagate headers & status
+		for k, vs := range resp.Header {
+			for _, h := range vs {
+				w.Header().Add(k, h)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		ev.Status = resp.StatusCode
+		ev.RespHeader = resp.Header
+		ev.Meta.Set("status", strconv.Itoa(resp.StatusCode))
+
+		// stream response to client & capture slice
+		respBody, size, skipped := streamAndCapture(w, resp.Body, max, tail)
+		ev.Elapsed = time.Since(start)
+		responseMeta(ev, size, skipped)
+		timingMeta(ev)
+		countBytes(ev, int64(len(fullBody)), size)
+		hold(ev, len(respBody))
+		respCh <- respBody
+		close(respCh)
+
+		Log(tag, req.URL.Path, "status:", resp.StatusCode, "elapsed:", time.Since(start))
+	})
+}
+
+// ReservedField reports whether name is a field the plugin sets itself, which
+// tag_headers may not overwrite: the identity and routing fields, those set
+// only in some cases (tenant, consent, the error and sampling fields), and
+// the label., tls., cloud. and audit. families.
+func ReservedField(name string) bool {
+	switch name {
+	case "instance_id", "seq", "endpoint", "backend", "client_ip", "phase", "status", "event", "capture",
+		"tenant", "consent", "classification", "retention_days", "retain_until",
+		"error", "error_class", "request_body_skipped", "response_body_skipped", "sample_rate":
+		return true
+	}
+	for _, p := range []string{"label.", "tls.", "cloud.", "audit."} {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEvent starts the event for req: the captured request body plus the
+// fields known before the upstream call (instance_id, seq, labels, endpoint,
+// backend, request_trailer.* and the other requestMeta fields, client_ip,
+// tag_headers, tenant, consent, classification, retention_days /
+// retain_until, tls.*, cloud.*).
+func NewEvent(c *Config, req *http.Request, reqBody []byte) *Event {
+	ev := &Event{At: time.Now(), Method: req.Method, URL: req.URL, ReqHeader: req.Header.Clone(),
+		ReqBody: reqBody, Meta: url.Values{}, ctx: context.WithoutCancel(req.Context())}
+	ev.Meta.Set("instance_id", instanceID)
+	ev.Meta.Set("seq", strconv.FormatUint(eventSeq.Add(1), 10))
+	requestMeta(ev, req)
+	for k, v := range c.Labels {
+		ev.Meta.Set("label."+k, v)
+	}
+	if c.Endpoint != "" {
+		ev.Meta.Set("endpoint", c.Endpoint)
+	}
+	if c.Backend != "" {
+		ev.Meta.Set("backend", c.Backend)
+	} else {
+		ev.Meta.Set("backend", req.URL.Host)
+	}
+	if ip := clientIP(req, c.TrustedProxies); ip != "" {
+		if c.AnonymizeIP != nil {
+			ip = c.AnonymizeIP.host(ip)
+		}
+		ev.Meta.Set("client_ip", ip)
+	}
+	if c.AnonymizeIP != nil {
+		c.AnonymizeIP.headers(ev.ReqHeader)
+	}
+	for h, f := range c.TagHeaders { // after anonymize_ip, so a tagged X-Forwarded-For is masked too
+		if v := ev.ReqHeader.Get(h); v != "" {
+			ev.Meta.Set(f, v)
+		}
+	}
+	if c.Tenant != nil {
+		if t := c.Tenant.of(req); t != "" {
+			ev.Meta.Set("tenant", t)
+		}
+	}
+	if c.Consent != nil {
+		ev.Meta.Set("consent", c.Consent.of(req))
+	}
+	if len(c.Classification) > 0 {
+		ev.Meta.Set("classification", strings.Join(c.Classification, ","))
+	}
+	if c.RetentionDays > 0 {
+		ev.Meta.Set("retention_days", strconv.Itoa(c.RetentionDays))
+		ev.Meta.Set("retain_until", ev.At.UTC().AddDate(0, 0, c.RetentionDays).Format(time.DateOnly))
+	}
+	if c.TLSMeta != nil {
+		c.TLSMeta.apply(ev, req)
+	}
+	addCloudMeta(ev.Meta)
+	return ev
+}
+
+/* ───────── coroutine sender ───────── */
+
+func trackingCoroutine(c *Config, ev *Event, respCh <-chan []byte) {
+	ev.RespBody = <-respCh // waits only for capture to finish
+
+	if c.Shadow != nil && c.Shadow.methods[ev.Method] && ev.Meta.Get("error_class") == "" {
+		go c.Shadow.mirror(c, c.Shadow.copyOf(ev))
+	}
+	process(c, ev)
+}
+
+// process runs the capture pipeline on ev and sends it; shadow diff events
+// come through here as well.
+func process(c *Config, ev *Event) {
+	// detached transform & send with per-event timeout
+	ctx, cancel := context.WithTimeout(ev.detached(), c.Timeout)
+	defer cancel()
+
+	handed := false // to dispatch or the dedupe window, which release ev
+	defer func() {
+		if !handed {
+			release(ev)
+		}
+	}()
+
+	tenant := ev.Meta.Get("tenant")
+	if c.TenantLimits != nil && !c.TenantLimits.allow(tenant) {
+		vdbg(c, "tenant", tenant, "over its rate limit, event dropped")
+		countDropped(c)
+		return
+	}
+	if !rewrite(ctx, c, ev) {
+		return
+	}
+	if c.Dedupe != nil && c.Dedupe.repeat(c, ev) {
+		vdbg(c, "duplicate event held back")
+		handed = true
+		return
+	}
+	stripWhenFull(c, ev)
+	payload, err := encode(c, ev)
+	if err != nil {
+		vdbg(c, "encode failed:", err)
+		return
+	}
+	if c.TenantLimits != nil && !c.TenantLimits.take(tenant, len(payload)) {
+		countDropped(c)
+		return
+	}
+	handed = true
+	dispatch(ctx, c, ev, payload)
+}
+
+// dispatch logs (dry_run), queues or sends an encoded event.
+func dispatch(ctx context.Context, c *Config, ev *Event, payload []byte) {
+	hold(ev, len(payload))
+	switch {
+	case c.DryRun:
+		defer release(ev)
+		logDryRun(c, payload)
+		if c.RecentEvents > 0 {
+			recordRecent(ev, nil)
+		}
+	case c.Queue != nil:
+		c.Queue.push(c, ev, payload) // the queue releases ev
+	default:
+		defer release(ev)
+		deliver(ctx, c, ev, payload)
+	}
+}
+
+// deliver sends one encoded event.
+func deliver(ctx context.Context, c *Config, ev *Event, payload []byte) error {
+	if c.ctl != nil {
+		c.ctl.inflight.Add(1)
+	}
+	start := time.Now()
+	err := c.Sink.Send(ctx, ev, payload)
+	if c.ctl != nil {
+		c.ctl.inflight.Add(-1)
+		c.ctl.observe(time.Since(start))
+		if err != nil {
+			c.ctl.failed.Add(1)
+		} else {
+			c.ctl.sent.Add(1)
+		}
+	}
+	if err != nil {
+		noteSendError(c, ev, err)
+	}
+	if err != nil && c.SyncDelivery {
+		logger.Warning(tag, "sync delivery failed:", err)
+	} else if err != nil {
+		vdbg(c, "send failed:", err)
+	} else {
+		vdbg(c, "send ok (", len(payload), "B)")
+	}
+	if c.RecentEvents > 0 {
+		recordRecent(ev, err)
+	}
+	return err
+}
+
+// Simulate runs the pipeline on a complete event (response fields set)
+// without sending it, and returns the payload or false when the event is
+// dropped. ev is rewritten as the sink would see it.
+func Simulate(c *Config, ev *Event) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(ev.detached(), c.Timeout)
+	defer cancel()
+	return pipeline(ctx, c, ev)
+}
+
+// pipeline rewrites ev and encodes it; false means the event is dropped.
+func pipeline(ctx context.Context, c *Config, ev *Event) ([]byte, bool) {
+	if !rewrite(ctx, c, ev) {
+		return nil, false
+	}
+	payload, err := encode(c, ev)
+	if err != nil {
+		vdbg(c, "encode failed:", err)
+		return nil, false
+	}
+	return payload, true
+}
+
+// rewrite runs the parsers, filters and transforms on ev; false means the
+// event is dropped.
+func rewrite(ctx context.Context, c *Config, ev *Event) bool {
+	if c.Decompress {
+		decodeBodies(c, ev)
+	}
+	if c.Charsets {
+		transcodeBodies(ev)
+	}
+	if c.Cookies != nil {
+		c.Cookies.apply(ev)
+	}
+	if c.Consent != nil {
+		applyConsent(ev)
+	}
+	if c.GraphQL != nil {
+		applyGraphQL(c.GraphQL, ev)
+	}
+	if c.XML != nil {
+		applyXML(c.XML, ev)
+	}
+	if c.Protobuf != nil {
+		applyProtobuf(c.Protobuf, ev)
+	}
+	if c.NormalizeJSON != 0 {
+		applyNormalizeJSON(c.NormalizeJSON, ev)
+	}
+	if len(c.Extract) > 0 {
+		applyExtract(c.Extract, ev)
+	}
+	if c.CaptureIf != nil {
+		// a failing expression (e.g. a missing map key) keeps the event
+		if ok, err := c.CaptureIf.test(ev.vars()); err != nil {
+			vdbg(c, "capture_if:", err)
+		} else if !ok {
+			return false
+		}
+	}
+	if !applyTransform(c, ev) {
+		return false
+	}
+	if c.Starlark != nil {
+		keep, err := c.Starlark.apply(ctx, ev)
+		if err != nil {
+			vdbg(c, "starlark:", err)
+		}
+		if !keep {
+			return false
+		}
+	}
+	if c.Tokenize != nil {
+		keep, err := c.Tokenize.apply(ctx, ev)
+		if err != nil {
+			vdbg(c, err)
+		}
+		if !keep {
+			return false
+		}
+	}
+
+	if c.WASM != nil {
+		keep, err := c.WASM.apply(ctx, ev)
+		if err != nil {
+			vdbg(c, "wasm:", err)
+		}
+		if !keep {
+			return false
+		}
+	}
+
+	if c.Base64Bodies {
+		encodeBinaryBodies(ev)
+	}
+	if c.Headers != nil {
+		c.Headers.apply(ev)
+	}
+	return true
+}
+
+// encode encodes ev in the payload format, or as the next audit link.
+func encode(c *Config, ev *Event) ([]byte, error) {
+	if c.Audit != nil {
+		return c.Audit.encode(c, ev)
+	}
+	return c.Format.Encode(ev)
+}
+
+/* ───────── helpers ───────── */
+
+// RandomID returns 16 random hex digits (the time, if the system has no
+// randomness).
+func RandomID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// captureBody buffers the request body for the upstream call and returns it
+// clipped to max (plus the last tail bytes, see headTail) as well as whole,
+// and the number of bytes the clipped copy leaves out.
+func captureBody(rc *io.ReadCloser, max, tail int) (clipped, all []byte, skipped int64) {
+	if rc == nil || *rc == nil {
+		return nil, nil, 0
+	}
+	all, _ = io.ReadAll(*rc)
+	(*rc).Close()
+	*rc = io.NopCloser(bytes.NewReader(all))
+	if len(all) <= max+tail {
+		return all, all, 0
+	}
+	skipped = int64(len(all) - max - tail)
+	if tail == 0 {
+		return bytes.Clone(all[:max]), all, skipped // not pinning all for the event's life
+	}
+	return headTail(all[:max], all[len(all)-tail:], skipped), all, skipped
+}
+
+// streamAndCapture copies the whole response to the client and keeps its
+// first max and last tail bytes; it returns them (the slice is owned by the
+// coroutine afterwards), the size and the bytes left out.
+func streamAndCapture(dst io.Writer, src io.Reader, max, tail int) ([]byte, int64, int64) {
+	if max <= 0 {
+		n, _ := io.Copy(dst, src)
+		return nil, n, n
+	}
+
+	cw := &capWriter{max: max, tail: tail}
+	io.Copy(dst, io.TeeReader(src, cw))
+	return cw.body()
+}
+
+// capWriter keeps the first max and the last tail bytes and silently
+// discards the rest.
+type capWriter struct {
+	buf  []byte
+	max  int
+	tail int
+	end  []byte // up to 2*tail bytes after buf
+	n    int64  // bytes seen
+}
+
+func (w *capWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	w.n += int64(written)
+	if n := w.max - len(w.buf); n > 0 {
+		k := min(n, len(p))
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+	}
+	if w.tail > 0 && len(p) > 0 {
+		if len(p) >= w.tail {
+			w.end = append(w.end[:0], p[len(p)-w.tail:]...)
+		} else {
+			if len(w.end)+len(p) > 2*w.tail {
+				w.end = append(w.end[:0], w.end[len(w.end)-w.tail:]...)
+			}
+			w.end = append(w.end, p...)
+		}
+	}
+	return written, nil
+}
+
+func (w *capWriter) body() ([]byte, int64, int64) {
+	kept := len(w.buf) + min(len(w.end), w.tail)
+	skipped := w.n - int64(kept)
+	if skipped == 0 {
+		return append(w.buf, w.end...), w.n, 0
+	}
+	if w.tail == 0 {
+		return w.buf, w.n, skipped
+	}
+	return headTail(w.buf, w.end[len(w.end)-w.tail:], skipped), w.n, skipped
+}
+
+// headTail joins the start and the end of a clipped body around a marker.
+func headTail(head, tail []byte, skipped int64) []byte {
+	marker := "\n[… " + strconv.FormatInt(skipped, 10) + " bytes skipped …]\n"
+	out := make([]byte, 0, len(head)+len(marker)+len(tail))
+	return append(append(append(out, head...), marker...), tail...)
+}
+
+// requestMeta records how the client sent the request, for clients that
+// behave differently through the gateway: request_transfer_encoding
+// (chunked), the declared request_trailers and their values as
+// request_trailer.<name> (complete once the body has been read, which the
+// capture does before the upstream call), and the expect and upgrade
+// headers. With Expect: 100-continue the gateway answers 100 itself when the
+// plugin reads the body, before the backend has seen the request.
+func requestMeta(ev *Event, req *http.Request) {
+	if len(req.TransferEncoding) > 0 {
+		ev.Meta.Set("request_transfer_encoding", strings.Join(req.TransferEncoding, ","))
+	}
+	if len(req.Trailer) > 0 {
+		names := make([]string, 0, len(req.Trailer))
+		for k, vs := range req.Trailer {
+			names = append(names, k)
+			if len(vs) > 0 {
+				ev.Meta.Set("request_trailer."+k, strings.Join(vs, ", "))
+			}
+		}
+		sort.Strings(names)
+		ev.Meta.Set("request_trailers", strings.Join(names, ","))
+	}
+	for _, h := range []string{"Expect", "Upgrade"} {
+		if v := req.Header.Get(h); v != "" {
+			ev.Meta.Set(strings.ToLower(h), strings.ToLower(v))
+		}
+	}
+}
+
+// responseMeta records what the response section holds, so an empty body is
+// not mistaken for a failed capture: response_size (bytes streamed to the
+// client), response_body (none for HEAD, 1xx, 204 and 304 responses, which
+// have no body, empty, clipped or full) and response_content_type; skipped
+// is what the capture left out (response_body_skipped).
+func responseMeta(ev *Event, size, skipped int64) {
+	ev.Meta.Set("response_size", strconv.FormatInt(size, 10))
+	switch {
+	case ev.Method == http.MethodHead || ev.Status/100 == 1 ||
+		ev.Status == http.StatusNoContent || ev.Status == http.StatusNotModified:
+		ev.Meta.Set("response_body", "none")
+	case size == 0:
+		ev.Meta.Set("response_body", "empty")
+	case skipped > 0:
+		ev.Meta.Set("response_body", "clipped")
+		ev.Meta.Set("response_body_skipped", strconv.FormatInt(skipped, 10))
+	default:
+		ev.Meta.Set("response_body", "full")
+	}
+	if ct := ev.RespHeader.Get("Content-Type"); ct != "" {
+		ev.Meta.Set("response_content_type", ct)
+	}
+}
+
+// rfc3339Millis is RFC 3339 with millisecond precision.
+const rfc3339Millis = "2006-01-02T15:04:05.000Z07:00"
+
+// timingMeta stamps received_at and completed_at (UTC, RFC 3339 with
+// milliseconds) and the durations duration_ms (until the response was
+// streamed) and upstream_ms (until the backend answered). Durations come
+// from the monotonic clock, and completed_at is received_at plus
+// duration_ms, so a clock step during the request cannot skew them.
+func timingMeta(ev *Event) {
+	ev.Meta.Set("received_at", ev.At.UTC().Format(rfc3339Millis))
+	ev.Meta.Set("completed_at", ev.At.Add(ev.Elapsed).UTC().Format(rfc3339Millis))
+	ev.Meta.Set("duration_ms", millis(ev.Elapsed))
+	ev.Meta.Set("upstream_ms", millis(ev.Upstream))
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64)
+}
+
+/* ───────── KrakenD logger interface ───────── */
+
+// Logger is the logger KrakenD hands the plugin.
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warning(v ...interface{})
+	Error(v ...interface{})
+	Critical(v ...interface{})
+	Fatal(v ...interface{})
+}
@@ -0,0 +1,282 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+/* ───────── charset normalization ───────── */
+
+// Text bodies in another charset than UTF-8 would reach the collector as
+// mojibake, so before the parsers run they are transcoded to UTF-8. The
+// charset comes from the Content-Type parameter, the encoding of an XML
+// declaration, or a UTF-16 byte order mark:
+//
+//	"charsets": "utf-8"   // default; "keep" leaves the bodies as captured
+//
+// Supported are ISO-8859-1, US-ASCII and windows-1252 (read as windows-1252,
+// like browsers do), ISO-8859-15, ISO-8859-2, windows-1250, windows-1251,
+// KOI8-R, Shift_JIS (with the Windows extensions), EUC-JP and UTF-16. The
+// transcoded body gets charset=utf-8 in its captured Content-Type, and an
+// XML declaration encoding="UTF-8"; request_charset / response_charset keep
+// the original one. Bodies in another charset (GBK, Big5, EUC-KR …) keep
+// their bytes and get request_charset_unsupported /
+// response_charset_unsupported instead, so binary_bodies sends them as base64.
+
+// ParseCharsets reads charsets and reports whether to transcode.
+func ParseCharsets(v string) (bool, error) {
+	switch v {
+	case "", "utf-8":
+		return true, nil
+	case "keep":
+		return false, nil
+	}
+	return false, fmt.Errorf("charsets must be utf-8 or keep, not %q", v)
+}
+
+var charsetNames = map[string]string{
+	"iso-8859-1": "iso-8859-1", "iso8859-1": "iso-8859-1", "iso_8859-1": "iso-8859-1", "latin1": "iso-8859-1",
+	"l1": "iso-8859-1", "us-ascii": "us-ascii", "ascii": "us-ascii",
+	"windows-1252": "windows-1252", "cp1252": "windows-1252", "x-cp1252": "windows-1252",
+	"iso-8859-15": "iso-8859-15", "iso8859-15": "iso-8859-15", "latin9": "iso-8859-15", "latin-9": "iso-8859-15",
+	"iso-8859-2": "iso-8859-2", "iso8859-2": "iso-8859-2", "latin2": "iso-8859-2", "l2": "iso-8859-2",
+	"windows-1250": "windows-1250", "cp1250": "windows-1250", "x-cp1250": "windows-1250",
+	"windows-1251": "windows-1251", "cp1251": "windows-1251", "x-cp1251": "windows-1251",
+	"koi8-r": "koi8-r", "koi8r": "koi8-r", "koi8": "koi8-r",
+	"shift_jis": "shift_jis", "shift-jis": "shift_jis", "sjis": "shift_jis", "x-sjis": "shift_jis",
+	"ms_kanji": "shift_jis", "windows-31j": "shift_jis", "cp932": "shift_jis",
+	"euc-jp": "euc-jp", "eucjp": "euc-jp", "x-euc-jp": "euc-jp",
+	"utf-16": "utf-16", "utf-16le": "utf-16le", "utf-16be": "utf-16be",
+}
+
+var singleByte = map[string]*string{
+	"iso-8859-1": &windows1252, "us-ascii": &windows1252, "windows-1252": &windows1252,
+	"iso-8859-15": &iso885915, "iso-8859-2": &iso88592, "windows-1250": &windows1250,
+	"windows-1251": &windows1251, "koi8-r": &koi8r,
+}
+
+var xmlEncoding = regexp.MustCompile(`^(<\?xml[^>]*?encoding\s*=\s*["'])([^"']*)(["'])`)
+
+// transcodeBodies converts the text bodies of ev to UTF-8.
+func transcodeBodies(ev *Event) {
+	for _, side := range []struct {
+		body  *[]byte
+		h     *http.Header
+		field string
+	}{{&ev.ReqBody, &ev.ReqHeader, "request"}, {&ev.RespBody, &ev.RespHeader, "response"}} {
+		cs, ok := transcode(side.body, side.h, ev.Meta.Get(side.field+"_body_skipped"))
+		switch {
+		case ok:
+			ev.Meta.Set(side.field+"_charset", cs)
+		case cs != "":
+			ev.Meta.Set(side.field+"_charset_unsupported", cs)
+		}
+	}
+}
+
+// transcode converts *body to UTF-8 and reports its original charset; the two
+// halves of a head-and-tail capture are converted on their own. An
+// unsupported charset leaves *body as is and returns its label with false.
+func transcode(body *[]byte, h *http.Header, skipped string) (string, bool) {
+	b := *body
+	if len(b) == 0 {
+		return "", false
+	}
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	label := strings.ToLower(strings.TrimSpace(params["charset"]))
+	switch {
+	case err != nil && h.Get("Content-Type") != "":
+		return "", false
+	case label != "":
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}), bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		label = "utf-16"
+	default:
+		if m := xmlEncoding.FindSubmatch(b); m != nil {
+			label = strings.ToLower(string(m[2]))
+		}
+	}
+	if label == "" || label == "utf-8" || label == "utf8" {
+		return "", false
+	}
+	cs, ok := charsetNames[label]
+	if !ok {
+		return label, false
+	}
+	if cs != "utf-16" && cs != "utf-16le" && cs != "utf-16be" && isASCII(b) {
+		return "", false // the same bytes in UTF-8
+	}
+	parts := [][]byte{b}
+	var marker []byte
+	if n, err := strconv.ParseInt(skipped, 10, 64); err == nil {
+		marker = headTail(nil, nil, n)
+		if head, tail, ok := bytes.Cut(b, marker); ok {
+			parts = [][]byte{head, tail}
+		}
+	}
+	for i, p := range parts {
+		parts[i] = decodeCharset(cs, p)
+	}
+	out := bytes.Join(parts, marker)
+	*body = xmlEncoding.ReplaceAll(out, []byte("${1}UTF-8${3}"))
+	if mt != "" {
+		params["charset"] = "utf-8"
+		*h = h.Clone() // shared with shadow
+		h.Set("Content-Type", mime.FormatMediaType(mt, params))
+	}
+	return cs, true
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeCharset converts b from cs to UTF-8. Bytes without a character
+// become U+FFFD; a character cut by max_capture_kb at the end is dropped.
+func decodeCharset(cs string, b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/2)
+	switch cs {
+	case "shift_jis":
+		jis := jisRows()
+		for i := 0; i < len(b); i++ {
+			c := b[i]
+			switch {
+			case c <= 0x80:
+				out = utf8.AppendRune(out, rune(c))
+			case c >= 0xa1 && c <= 0xdf: // half-width katakana
+				out = utf8.AppendRune(out, 0xff61+rune(c-0xa1))
+			case c >= 0x81 && c <= 0x9f || c >= 0xe0 && c <= 0xfc:
+				if i+1 == len(b) {
+					return out
+				}
+				i++
+				t := b[i]
+				row := int(c-0x81) * 2
+				if c >= 0xe0 {
+					row = int(c-0xc1) * 2
+				}
+				cell := -1
+				switch {
+				case t >= 0x40 && t <= 0x7e:
+					cell = int(t - 0x40)
+				case t >= 0x80 && t <= 0x9e:
+					cell = int(t - 0x41)
+				case t >= 0x9f && t <= 0xfc:
+					row, cell = row+1, int(t-0x9f)
+				}
+				if cell < 0 || row >= len(jis) {
+					if t < 0x80 {
+						i-- // an ASCII byte stands for itself
+					}
+					out = utf8.AppendRune(out, utf8.RuneError)
+					continue
+				}
+				out = utf8.AppendRune(out, jis[row][cell])
+			default:
+				out = utf8.AppendRune(out, utf8.RuneError)
+			}
+		}
+	case "euc-jp":
+		jis := jisRows()
+		for i := 0; i < len(b); i++ {
+			c := b[i]
+			switch {
+			case c < 0x80:
+				out = append(out, c)
+			case c == 0x8e && i+1 < len(b): // half-width katakana
+				i++
+				if t := b[i]; t >= 0xa1 && t <= 0xdf {
+					out = utf8.AppendRune(out, 0xff61+rune(t-0xa1))
+				} else {
+					out = utf8.AppendRune(out, utf8.RuneError)
+				}
+			case c == 0x8f && i+2 < len(b): // JIS X 0212, not in the table
+				i += 2
+				out = utf8.AppendRune(out, utf8.RuneError)
+			case c >= 0xa1 && c <= 0xfe:
+				if i+1 == len(b) {
+					return out
+				}
+				i++
+				if t := b[i]; t >= 0xa1 && t <= 0xfe {
+					out = utf8.AppendRune(out, jis[c-0xa1][t-0xa1])
+				} else {
+					out = utf8.AppendRune(out, utf8.RuneError)
+				}
+			case c == 0x8e || c == 0x8f:
+				return out
+			default:
+				out = utf8.AppendRune(out, utf8.RuneError)
+			}
+		}
+	case "utf-16", "utf-16le", "utf-16be":
+		be := cs == "utf-16be"
+		switch {
+		case bytes.HasPrefix(b, []byte{0xff, 0xfe}) && cs != "utf-16be":
+			b = b[2:]
+		case bytes.HasPrefix(b, []byte{0xfe, 0xff}) && cs != "utf-16le":
+			b, be = b[2:], true
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if be {
+				units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+			} else {
+				units[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+			}
+		}
+		if n := len(units); n > 0 && utf16.IsSurrogate(rune(units[n-1])) && units[n-1] < 0xdc00 {
+			units = units[:n-1]
+		}
+		for _, r := range utf16.Decode(units) {
+			out = utf8.AppendRune(out, r)
+		}
+	default:
+		table := singleByteRunes(cs)
+		for _, c := range b {
+			if c < 0x80 {
+				out = append(out, c)
+			} else {
+				out = utf8.AppendRune(out, table[c-0x80])
+			}
+		}
+	}
+	return out
+}
+
+var (
+	singleByteMu    sync.Mutex
+	singleByteCache = map[string]*[128]rune{}
+)
+
+func singleByteRunes(cs string) *[128]rune {
+	singleByteMu.Lock()
+	defer singleByteMu.Unlock()
+	t, ok := singleByteCache[cs]
+	if !ok {
+		t = &[128]rune{}
+		copy(t[:], []rune(*singleByte[cs]))
+		singleByteCache[cs] = t
+	}
+	return t
+}
+
+var jisRows = sync.OnceValue(func() [][]rune {
+	rows := make([][]rune, len(jis0208))
+	for i, s := range jis0208 {
+		rows[i] = []rune(s)
+	}
+	return rows
+})
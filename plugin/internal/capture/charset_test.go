@@ -0,0 +1,84 @@
+package capture
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDecodeCharset(t *testing.T) {
+	for _, tc := range []struct{ cs, in, want string }{
+		{"iso-8859-1", "caf\xe9", "café"},
+		{"windows-1252", "\x80 \x93x\x94", "€ “x”"},
+		{"iso-8859-15", "\xa4 \xbd", "€ œ"},
+		{"iso-8859-2", "\xb1\xea", "ąę"},
+		{"windows-1250", "\x9a\x9e", "šž"},
+		{"windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"shift_jis", "\x93\xfa\x96\x7b \xb1\xb2", "日本 ｱｲ"},
+		{"shift_jis", "a\x93", "a"},       // lead byte cut at the end
+		{"shift_jis", "\x93\x20x", "� x"}, // ASCII trail byte kept
+		{"euc-jp", "\xc6\xfc\xcb\xdc \x8e\xb1", "日本 ｱ"},
+		{"euc-jp", "\xc6\xfc\xcb", "日"},
+		{"euc-jp", "\x8f\xb0\xa1!", "�!"}, // JIS X 0212
+		{"utf-16", "\xff\xfeh\x00\xe9\x00", "hé"},
+		{"utf-16", "\xfe\xff\x00h\x00\xe9", "hé"},
+		{"utf-16le", "=\xd8\x00\xde", "😀"},
+		{"utf-16be", "\xd8=\xde\x00", "😀"},
+		{"utf-16be", "\x00a\xd8=", "a"}, // high surrogate cut at the end
+	} {
+		if got := string(decodeCharset(tc.cs, []byte(tc.in))); got != tc.want {
+			t.Errorf("%s %q = %q, want %q", tc.cs, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	marker := string(headTail(nil, nil, 100))
+	for _, tc := range []struct {
+		name, ct, in, skipped string
+		body, ctOut, cs       string
+		ok                    bool
+	}{
+		{"content type", "text/plain; charset=Latin1", "caf\xe9", "",
+			"café", "text/plain; charset=utf-8", "iso-8859-1", true},
+		{"xml declaration", "", "<?xml version='1.0' encoding='ISO-8859-15'?><a>\xa4</a>", "",
+			"<?xml version='1.0' encoding='UTF-8'?><a>€</a>", "", "iso-8859-15", true},
+		{"byte order mark", "application/json", "\xff\xfe{\x00}\x00", "",
+			"{}", "application/json; charset=utf-8", "utf-16", true},
+		{"head and tail", "text/plain; charset=cp1252", "\x80" + marker + "\x80", "100",
+			"€" + marker + "€", "text/plain; charset=utf-8", "windows-1252", true},
+		{"ascii is already utf-8", "text/plain; charset=iso-8859-1", "plain", "",
+			"plain", "text/plain; charset=iso-8859-1", "", false},
+		{"utf-8", "text/plain; charset=UTF-8", "caf\xc3\xa9", "",
+			"caf\xc3\xa9", "text/plain; charset=UTF-8", "", false},
+		{"unsupported", "text/plain; charset=Big5", "\xa4\xa4", "",
+			"\xa4\xa4", "text/plain; charset=Big5", "big5", false},
+		{"unparsable content type", "text/plain; charset", "caf\xe9", "",
+			"caf\xe9", "text/plain; charset", "", false},
+	} {
+		h := http.Header{}
+		if tc.ct != "" {
+			h.Set("Content-Type", tc.ct)
+		}
+		shared := h
+		body := []byte(tc.in)
+		cs, ok := transcode(&body, &h, tc.skipped)
+		if string(body) != tc.body || h.Get("Content-Type") != tc.ctOut || cs != tc.cs || ok != tc.ok {
+			t.Errorf("%s: got %q, %q, %q, %v", tc.name, body, h.Get("Content-Type"), cs, ok)
+		}
+		if shared.Get("Content-Type") != tc.ct {
+			t.Errorf("%s: the shared header was changed to %q", tc.name, shared.Get("Content-Type"))
+		}
+	}
+}
+
+func TestParseCharsets(t *testing.T) {
+	for v, want := range map[string]bool{"": true, "utf-8": true, "keep": false} {
+		if got, err := ParseCharsets(v); err != nil || got != want {
+			t.Errorf("ParseCharsets(%q) = %v, %v", v, got, err)
+		}
+	}
+	if _, err := ParseCharsets("latin1"); err == nil {
+		t.Error("ParseCharsets(latin1) accepted")
+	}
+}
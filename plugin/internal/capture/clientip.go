@@ -0,0 +1,216 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/* ───────── client IP extraction ───────── */
+
+// The caller's address is resolved from the forwarding chain: every hop listed
+// in Forwarded / X-Forwarded-For plus the direct peer (RemoteAddr, when set).
+// Walking from the nearest hop outwards, addresses inside trusted_proxies are
+// skipped and the first untrusted one is the client. X-Real-IP is only honoured
+// when there is no forwarding chain at all.
+//
+// KrakenD has to forward the headers to the backend (input_headers) for the
+// plugin to see them. PROXY protocol is resolved before HTTP, so for listeners
+// that speak it RemoteAddr already holds the original peer.
+
+// TrustedNets are the proxies skipped when resolving the client address.
+type TrustedNets []netip.Prefix
+
+// ParseTrustedProxies reads trusted_proxies: CIDRs or single addresses.
+func ParseTrustedProxies(v []interface{}) (TrustedNets, error) {
+	var nets TrustedNets
+	for _, e := range v {
+		s, _ := e.(string)
+		if !strings.Contains(s, "/") {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, p.Masked())
+	}
+	return nets, nil
+}
+
+func (t TrustedNets) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range t {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(req *http.Request, trusted TrustedNets) string {
+	chain := forwardedChain(req.Header)
+	if peer, ok := parseHost(req.RemoteAddr); ok {
+		chain = append(chain, peer)
+	}
+	if len(chain) == 0 {
+		if a, ok := parseHost(req.Header.Get("X-Real-Ip")); ok {
+			return a.String()
+		}
+		return ""
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !trusted.contains(chain[i]) {
+			return chain[i].String()
+		}
+	}
+	// every hop is trusted: the outermost one is the best we have
+	return chain[0].String()
+}
+
+// forwardedChain returns hops ordered client-first, preferring the standard
+// Forwarded header over X-Forwarded-For. Unparseable entries (obfuscated
+// identifiers, "unknown") are dropped.
+func forwardedChain(h http.Header) []netip.Addr {
+	var chain []netip.Addr
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		for _, line := range fwd {
+			for _, elem := range strings.Split(line, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(k, "for") {
+						continue
+					}
+					if a, ok := parseHost(strings.Trim(v, `"`)); ok {
+						chain = append(chain, a)
+					}
+				}
+			}
+		}
+		return chain
+	}
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(line, ",") {
+			if a, ok := parseHost(strings.TrimSpace(s)); ok {
+				chain = append(chain, a)
+			}
+		}
+	}
+	return chain
+}
+
+// parseHost accepts bare IPs, host:port and bracketed IPv6 with or without port.
+func parseHost(s string) (netip.Addr, bool) {
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		s = h
+	}
+	a, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+/* ───────── IP anonymization ───────── */
+
+// anonymize_ip zeroes the host part of client_ip and of the addresses in the
+// captured Forwarded, X-Forwarded-For and X-Real-IP headers before anything
+// else sees them:
+//
+//	"anonymize_ip": true                               // IPv4 /24, IPv6 /48
+//	"anonymize_ip": {"ipv4_prefix": 16, "ipv6_prefix": 32}
+//
+// Only the captured copy changes; the backend gets the original headers.
+
+// IPMask holds the prefix lengths kept by anonymize_ip.
+type IPMask struct{ v4, v6 int }
+
+// ParseIPMask reads anonymize_ip; nil means addresses are kept.
+func ParseIPMask(v interface{}) (*IPMask, error) {
+	m := &IPMask{v4: 24, v6: 48}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		for key, dst := range map[string]*int{"ipv4_prefix": &m.v4, "ipv6_prefix": &m.v6} {
+			n, ok := v[key].(float64)
+			if !ok {
+				continue
+			}
+			limit := 32
+			if key == "ipv6_prefix" {
+				limit = 128
+			}
+			if *dst = int(n); *dst < 0 || *dst > limit {
+				return nil, fmt.Errorf("%s must be between 0 and %d", key, limit)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("must be true or an object")
+	}
+	return m, nil
+}
+
+func (m *IPMask) addr(a netip.Addr) netip.Addr {
+	bits := m.v6
+	if a = a.Unmap(); a.Is4() {
+		bits = m.v4
+	}
+	p, _ := a.Prefix(bits)
+	return p.Addr()
+}
+
+// host masks the address in s (bare, host:port or bracketed), keeping
+// anything that is not an address.
+func (m *IPMask) host(s string) string {
+	a, ok := parseHost(s)
+	if !ok {
+		return s
+	}
+	return m.addr(a).String()
+}
+
+// headers masks the forwarding headers of h in place.
+func (m *IPMask) headers(h http.Header) {
+	list := func(line, sep string, f func(string) string) string {
+		parts := strings.Split(line, sep)
+		for i, p := range parts {
+			parts[i] = f(strings.TrimSpace(p))
+		}
+		return strings.Join(parts, sep+" ")
+	}
+	for i, line := range h.Values("X-Forwarded-For") {
+		h["X-Forwarded-For"][i] = list(line, ",", m.host)
+	}
+	if v := h.Get("X-Real-Ip"); v != "" {
+		h.Set("X-Real-Ip", m.host(v))
+	}
+	for i, line := range h.Values("Forwarded") {
+		h["Forwarded"][i] = list(line, ",", func(elem string) string {
+			pairs := strings.Split(elem, ";")
+			for j, pair := range pairs {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					if a, ok := parseHost(strings.Trim(v, `"`)); ok {
+						pairs[j] = k + `="` + m.addr(a).String() + `"`
+					}
+				}
+			}
+			return strings.Join(pairs, ";")
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package capture
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]interface{}{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, remote string
+		header       http.Header
+		want         string
+	}{
+		{"peer only", "203.0.113.5:4711", nil, "203.0.113.5"},
+		{"untrusted peer wins over the headers", "198.51.100.1:80",
+			http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "198.51.100.1"},
+		{"trusted hops are skipped", "10.0.0.2:80",
+			http.Header{"X-Forwarded-For": {"203.0.113.5, 198.51.100.9, 192.0.2.7"}}, "198.51.100.9"},
+		{"several header lines", "10.0.0.2:80",
+			http.Header{"X-Forwarded-For": {"203.0.113.5", "10.1.1.1"}}, "203.0.113.5"},
+		{"spoofed leftmost entry is ignored", "10.0.0.2:80",
+			http.Header{"X-Forwarded-For": {"1.1.1.1, 203.0.113.5"}}, "203.0.113.5"},
+		{"forwarded beats x-forwarded-for", "10.0.0.2:80",
+			http.Header{"Forwarded": {`for=203.0.113.5;proto=https, for="[2001:db8::1]:443"`},
+				"X-Forwarded-For": {"198.51.100.9"}}, "203.0.113.5"},
+		{"obfuscated hops are dropped", "10.0.0.2:80",
+			http.Header{"Forwarded": {"for=_hidden, for=unknown"}}, "10.0.0.2"},
+		{"all trusted: the outermost", "10.0.0.2:80",
+			http.Header{"X-Forwarded-For": {"10.9.9.9"}}, "10.9.9.9"},
+		{"mapped ipv4", "[::ffff:10.0.0.2]:80",
+			http.Header{"X-Forwarded-For": {"::ffff:203.0.113.5"}}, "203.0.113.5"},
+		{"x-real-ip without a chain", "",
+			http.Header{"X-Real-Ip": {"203.0.113.5"}}, "203.0.113.5"},
+		{"x-real-ip ignored with a chain", "10.0.0.2:80",
+			http.Header{"X-Real-Ip": {"203.0.113.5"}}, "10.0.0.2"},
+		{"nothing", "", nil, ""},
+	} {
+		req := &http.Request{RemoteAddr: tc.remote, Header: tc.header}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		if got := clientIP(req, trusted); got != tc.want {
+			t.Errorf("%s: client_ip = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := ParseTrustedProxies([]interface{}{"10.1.2.3/8", "::1"})
+	if err != nil || len(nets) != 2 || nets[0].String() != "10.0.0.0/8" || nets[1].String() != "::1/128" {
+		t.Errorf("got %v, %v", nets, err)
+	}
+	for _, v := range []interface{}{"10.0.0.0/33", "proxy.internal", 10} {
+		if _, err := ParseTrustedProxies([]interface{}{v}); err == nil {
+			t.Errorf("%v accepted", v)
+		}
+	}
+}
+
+func TestIPMask(t *testing.T) {
+	m, err := ParseIPMask(map[string]interface{}{"ipv4_prefix": float64(16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"203.0.113.5":          "203.0.0.0",
+		"203.0.113.5:8443":     "203.0.0.0",
+		"[2001:db8:1:2::7]:80": "2001:db8:1::",
+		"::ffff:203.0.113.5":   "203.0.0.0",
+		"_hidden":              "_hidden",
+	} {
+		if got := m.host(in); got != want {
+			t.Errorf("host(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	h := http.Header{
+		"X-Forwarded-For": {"203.0.113.5,198.51.100.9", "10.1.2.3"},
+		"X-Real-Ip":       {"198.51.100.9"},
+		"Forwarded":       {`for=203.0.113.5;proto=https, for="[2001:db8:1:2::7]:443";by=_gw`},
+	}
+	m.headers(h)
+	if got := strings.Join(h.Values("X-Forwarded-For"), " | "); got != "203.0.0.0, 198.51.0.0 | 10.1.0.0" {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+	if got := h.Get("X-Real-Ip"); got != "198.51.0.0" {
+		t.Errorf("X-Real-Ip = %q", got)
+	}
+	if got := h.Get("Forwarded"); got != `for="203.0.0.0";proto=https, for="2001:db8:1::";by=_gw` {
+		t.Errorf("Forwarded = %q", got)
+	}
+}
+
+func TestParseIPMask(t *testing.T) {
+	for _, v := range []interface{}{nil, false} {
+		if m, err := ParseIPMask(v); m != nil || err != nil {
+			t.Errorf("ParseIPMask(%v) = %v, %v; want nil", v, m, err)
+		}
+	}
+	if m, err := ParseIPMask(true); err != nil || *m != (IPMask{v4: 24, v6: 48}) {
+		t.Errorf("ParseIPMask(true) = %v, %v", m, err)
+	}
+	for _, v := range []interface{}{
+		map[string]interface{}{"ipv4_prefix": float64(33)},
+		map[string]interface{}{"ipv6_prefix": float64(-1)},
+		"yes",
+	} {
+		if _, err := ParseIPMask(v); err == nil {
+			t.Errorf("ParseIPMask(%v) accepted", v)
+		}
+	}
+}
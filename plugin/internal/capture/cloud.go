@@ -0,0 +1,172 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── cloud instance metadata ───────── */
+
+// The identity is looked up once per process, in the background, and shared
+// by every backend: events emitted before the lookup finishes simply carry no
+// cloud.* keys.
+
+const cloudProbeTimeout = 500 * time.Millisecond
+
+type cloudIdentity struct {
+	provider   string
+	instanceID string
+	region     string
+	zone       string
+}
+
+var (
+	cloudOnce  sync.Once
+	cloudIdent atomic.Pointer[cloudIdentity]
+)
+
+var cloudProbes = map[string]func(context.Context) (*cloudIdentity, error){
+	"aws":   probeAWS,
+	"gcp":   probeGCP,
+	"azure": probeAzure,
+}
+
+// LoadCloudIdentity starts the one-off metadata lookup for provider.
+func LoadCloudIdentity(provider string) {
+	provider = strings.ToLower(provider)
+	if provider == "" || provider == "off" {
+		return
+	}
+	cloudOnce.Do(func() {
+		go func() {
+			defer Recover("cloud_metadata", nil)
+			order := []string{"aws", "gcp", "azure"}
+			if provider != "auto" {
+				order = []string{provider}
+			}
+			for _, p := range order {
+				probe, ok := cloudProbes[p]
+				if !ok {
+					Log("cloud_metadata: unknown provider", p)
+					return
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), cloudProbeTimeout)
+				id, err := probe(ctx)
+				cancel()
+				if err == nil && id.instanceID != "" {
+					cloudIdent.Store(id)
+					Log("cloud identity:", id.provider, id.instanceID, id.region, id.zone)
+					return
+				}
+			}
+			Log("cloud_metadata: no metadata service answered")
+		}()
+	})
+}
+
+func addCloudMeta(meta url.Values) {
+	id := cloudIdent.Load()
+	if id == nil {
+		return
+	}
+	meta.Set("cloud.provider", id.provider)
+	meta.Set("cloud.instance_id", id.instanceID)
+	meta.Set("cloud.region", id.region)
+	meta.Set("cloud.availability_zone", id.zone)
+}
+
+/* ───────── providers ───────── */
+
+// probeAWS uses IMDSv2 (session token first, then the identity document).
+func probeAWS(ctx context.Context) (*cloudIdentity, error) {
+	token, err := MetadataGet(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := MetadataGet(ctx, http.MethodGet, "http://169.254.169.254/latest/dynamic/instance-identity/document",
+		map[string]string{"X-aws-ec2-metadata-token": string(token)})
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		InstanceID       string `json:"instanceId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+	}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	return &cloudIdentity{"aws", v.InstanceID, v.Region, v.AvailabilityZone}, nil
+}
+
+func probeGCP(ctx context.Context) (*cloudIdentity, error) {
+	hdr := map[string]string{"Metadata-Flavor": "Google"}
+	base := "http://metadata.google.internal/computeMetadata/v1/instance/"
+	id, err := MetadataGet(ctx, http.MethodGet, base+"id", hdr)
+	if err != nil {
+		return nil, err
+	}
+	zone, err := MetadataGet(ctx, http.MethodGet, base+"zone", hdr)
+	if err != nil {
+		return nil, err
+	}
+	// zone comes back as projects/<num>/zones/<region>-<x>
+	z := string(zone)
+	z = z[strings.LastIndexByte(z, '/')+1:]
+	region := z
+	if i := strings.LastIndexByte(z, '-'); i > 0 {
+		region = z[:i]
+	}
+	return &cloudIdentity{"gcp", string(id), region, z}, nil
+}
+
+func probeAzure(ctx context.Context) (*cloudIdentity, error) {
+	doc, err := MetadataGet(ctx, http.MethodGet, "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01",
+		map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		VMID     string `json:"vmId"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	return &cloudIdentity{"azure", v.VMID, v.Location, v.Zone}, nil
+}
+
+// MetadataGet queries an instance metadata endpoint (also used by sinks for
+// workload credentials).
+func MetadataGet(ctx context.Context, method, u string, hdr map[string]string) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		r.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata %s: %s", u, resp.Status)
+	}
+	return b, nil
+}
@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/* ───────── consent gating ───────── */
+
+// consent reads the user's consent from the request and captures metadata
+// only (no request / response bodies) when it is not granted:
+//
+//	"consent": {
+//	  "header":  "X-Tracking-Consent",   // checked first…
+//	  "cookie":  "tracking_consent",     // …then the cookie…
+//	  "claim":   "consent.analytics",    // …then the bearer JWT claim
+//	  "granted": ["true", "yes", "1"]    // optional, default: true, yes, 1, granted
+//	}
+//
+// The first signal present decides; values compare case-insensitively. The
+// decision is stored as the event field consent: "granted", "denied" (a
+// signal without a granted value) or "absent". Bodies are removed before
+// anything else in the pipeline runs, so extract_fields, capture_if and
+// transforms never see them.
+
+// Consent decides whether bodies may be captured.
+type Consent struct {
+	header, cookie string
+	claim          []string
+	granted        map[string]bool
+}
+
+// ParseConsent reads the consent block.
+func ParseConsent(v map[string]interface{}) (*Consent, error) {
+	c := &Consent{granted: map[string]bool{"true": true, "yes": true, "1": true, "granted": true}}
+	if h, ok := v["header"].(string); ok && h != "" {
+		c.header = http.CanonicalHeaderKey(h)
+	}
+	c.cookie, _ = v["cookie"].(string)
+	if s, ok := v["claim"].(string); ok && s != "" {
+		c.claim = strings.Split(s, ".")
+	}
+	if c.header == "" && c.cookie == "" && c.claim == nil {
+		return nil, fmt.Errorf("needs a header, cookie or claim")
+	}
+	if list, ok := v["granted"].([]interface{}); ok {
+		c.granted = make(map[string]bool, len(list))
+		for _, g := range list {
+			c.granted[strings.ToLower(fmt.Sprint(g))] = true
+		}
+	}
+	return c, nil
+}
+
+// of returns the consent decision for req.
+func (c *Consent) of(req *http.Request) string {
+	v, ok := "", false
+	if c.header != "" {
+		v = req.Header.Get(c.header)
+		ok = v != ""
+	}
+	if !ok && c.cookie != "" {
+		if ck, err := req.Cookie(c.cookie); err == nil {
+			v, ok = ck.Value, true
+		}
+	}
+	if !ok && c.claim != nil {
+		v = bearerClaim(req.Header, c.claim)
+		ok = v != ""
+	}
+	switch {
+	case !ok:
+		return "absent"
+	case c.granted[strings.ToLower(strings.TrimSpace(v))]:
+		return "granted"
+	}
+	return "denied"
+}
+
+// applyConsent drops the bodies of events without consent.
+func applyConsent(ev *Event) {
+	if ev.Meta.Get("consent") != "granted" {
+		ev.ReqBody, ev.RespBody = nil, nil
+	}
+}
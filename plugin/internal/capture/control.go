@@ -0,0 +1,184 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── runtime control ───────── */
+
+// The admin server also lets an operator look at and steer the running
+// plugin without a restart:
+//
+//	GET  /debug/stats                  per backend: requests captured, events sent,
+//	                                   failed and dropped, sends in flight, events queued
+//	GET  /debug/config                 per backend: the effective configuration
+//	                                   (profiles applied, secrets masked)
+//	GET  /debug/capture                {"enabled": true}
+//	POST /debug/capture?enabled=false  stop capturing; true resumes
+//	POST /debug/queue/flush            deliver every queued event now, answering
+//	                                   once they are sent: {"flushed": 120, "failed": 0}
+//
+// While capture is off the handler only proxies: no event is built and
+// nothing is sent, for every backend of the process. The switch is not
+// persisted, a restart captures again. Counters start with the process.
+
+// control is the admin view of one backend, registered by NewHandler.
+type control struct {
+	c                               *Config
+	requests, sent, failed, dropped atomic.Int64
+	inflight                        atomic.Int64 // sends waiting for the sink
+	draining                        atomic.Bool  // torn down, see drain.go
+
+	latMu   sync.Mutex
+	latency []time.Duration // send times since the last pipeline_stats event
+	seen    int
+}
+
+var (
+	controlMu  sync.Mutex
+	controls   []*control
+	captureOff atomic.Bool
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/stats", serveStats)
+	adminMux.HandleFunc("GET /debug/config", serveConfig)
+	adminMux.HandleFunc("GET /debug/capture", serveCapture)
+	adminMux.HandleFunc("POST /debug/capture", serveCapture)
+	adminMux.HandleFunc("POST /debug/queue/flush", serveFlush)
+}
+
+// register adds the backend of c to the admin view; unregister takes it out
+// again once the backend is torn down, and may be called more than once.
+func register(c *Config) (ctl *control, unregister func()) {
+	ctl = &control{c: c}
+	controlMu.Lock()
+	controls = append(controls, ctl)
+	controlMu.Unlock()
+	return ctl, func() {
+		controlMu.Lock()
+		defer controlMu.Unlock()
+		if i := slices.Index(controls, ctl); i >= 0 {
+			controls = slices.Delete(controls, i, i+1)
+		}
+	}
+}
+
+// registered returns the backends sorted by endpoint and backend.
+func registered() []*control {
+	controlMu.Lock()
+	out := append([]*control(nil), controls...)
+	controlMu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i].c, out[j].c
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		return a.Backend < b.Backend
+	})
+	return out
+}
+
+// countDropped counts an event given up on (queue full, tenant limits).
+func countDropped(c *Config) {
+	if c.ctl != nil {
+		c.ctl.dropped.Add(1)
+	}
+}
+
+func (ctl *control) describe() map[string]interface{} {
+	d := map[string]interface{}{"endpoint": ctl.c.Endpoint, "backend": ctl.c.Backend}
+	if ctl.c.URL != nil {
+		d["sink"] = ctl.c.URL.Redacted()
+	}
+	return d
+}
+
+func serveStats(w http.ResponseWriter, _ *http.Request) {
+	WriteJSON(w, statsView())
+}
+
+func statsView() map[string]interface{} {
+	out := []map[string]interface{}{}
+	for _, ctl := range registered() {
+		d := ctl.describe()
+		d["requests"] = ctl.requests.Load()
+		d["sent"] = ctl.sent.Load()
+		d["failed"] = ctl.failed.Load()
+		d["dropped"] = ctl.dropped.Load()
+		d["in_flight"] = ctl.inflight.Load()
+		if ctl.c.Queue != nil {
+			d["queued"] = ctl.c.Queue.length()
+		}
+		if ctl.c.Health != nil {
+			d["sink_health"] = ctl.c.Health.state()
+		}
+		if p := ctl.c.Overflow.Policy(); p != "" {
+			d["overflow"] = p
+		}
+		d["sample_rate"], d["capture_mode"] = ctl.c.Sampling.current()
+		out = append(out, d)
+	}
+	return map[string]interface{}{"capture": !captureOff.Load(), "pending_bytes": pendingBytes.Load(),
+		"backends": out}
+}
+
+func serveConfig(w http.ResponseWriter, _ *http.Request) {
+	out := []map[string]interface{}{}
+	for _, ctl := range registered() {
+		d := ctl.describe()
+		d["config"] = ctl.c.Effective
+		out = append(out, d)
+	}
+	WriteJSON(w, out)
+}
+
+func serveCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if captureOff.Swap(!on) != !on {
+			logger.Warning(tag, "capture enabled through the admin server:", on)
+		}
+	}
+	WriteJSON(w, map[string]bool{"enabled": !captureOff.Load()})
+}
+
+func serveFlush(w http.ResponseWriter, _ *http.Request) {
+	sent, lost := 0, 0
+	for _, ctl := range registered() {
+		if ctl.c.Queue != nil {
+			s, l := ctl.c.Queue.flush(context.Background(), ctl.c)
+			sent, lost = sent+s, lost+l
+		}
+	}
+	WriteJSON(w, map[string]int{"flushed": sent, "failed": lost})
+}
+
+// passThrough proxies req while capture is off.
+func passThrough(c *Config, w http.ResponseWriter, req *http.Request) {
+	resp, err := c.upstream().Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		for _, h := range vs {
+			w.Header().Add(k, h)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,25 @@
+package capture
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTeardownUnregisters(t *testing.T) {
+	c := &Config{Endpoint: "/gone"}
+	c.ctl, c.unregister = register(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	DrainOnDone(ctx, c)
+	if !slices.Contains(registered(), c.ctl) {
+		t.Fatal("backend not registered")
+	}
+	cancel()
+	for deadline := time.Now().Add(time.Second); slices.Contains(registered(), c.ctl); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("backend still registered after teardown")
+		}
+	}
+	c.unregister() // a second call is harmless
+}
@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/* ───────── cookies ───────── */
+
+// cookies breaks the Cookie and Set-Cookie headers out into one event field
+// per cookie, and takes the raw headers out of the captured copy:
+//
+//	"cookies": true                                   // every cookie
+//	"cookies": {
+//	  "allow": ["theme", "ab_*", "session_id"],       // default ["*"]
+//	  "mask":  ["cart_*"]                             // besides the built-in list
+//	}
+//
+// Request cookies become cookie.<name>, response cookies set_cookie.<name>
+// with their attributes (set_cookie.sid = "masked:…; Path=/; HttpOnly").
+// Cookies outside allow are left out. Session and credential cookies are
+// masked whether or not mask lists them: names matching *sess*, *sid,
+// *auth*, *token*, *jwt*, *csrf*, *xsrf*, remember*, __host-* or __secure-*
+// (case-insensitive). A masked value is "masked:" and 12 hex digits of its
+// SHA-256, so requests of one session can still be told apart from others.
+// Patterns are globs. Only the captured copy changes; the backend and the
+// client get the original headers.
+
+var builtinCookieMasks = []string{"*sess*", "*sid", "*auth*", "*token*", "*jwt*", "*csrf*",
+	"*xsrf*", "remember*", "__host-*", "__secure-*"}
+
+// Cookies is the cookies block.
+type Cookies struct {
+	allow, mask []string // lower-case globs
+}
+
+// ParseCookies reads cookies; nil means the headers are kept as they are.
+func ParseCookies(v interface{}) (*Cookies, error) {
+	c := &Cookies{allow: []string{"*"}, mask: builtinCookieMasks}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		if list, ok := v["allow"].([]interface{}); ok {
+			c.allow = nil
+			for _, p := range list {
+				g, err := cookieGlob("allow", p)
+				if err != nil {
+					return nil, err
+				}
+				c.allow = append(c.allow, g)
+			}
+		}
+		if list, ok := v["mask"].([]interface{}); ok {
+			c.mask = append([]string(nil), builtinCookieMasks...)
+			for _, p := range list {
+				g, err := cookieGlob("mask", p)
+				if err != nil {
+					return nil, err
+				}
+				c.mask = append(c.mask, g)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("must be true or an object")
+	}
+	return c, nil
+}
+
+func cookieGlob(key string, v interface{}) (string, error) {
+	s, _ := v.(string)
+	s = strings.ToLower(s)
+	if _, err := path.Match(s, ""); err != nil || s == "" {
+		return "", fmt.Errorf("%s: invalid pattern %q", key, v)
+	}
+	return s, nil
+}
+
+func matchAny(globs []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply moves the cookies of ev into its fields.
+func (c *Cookies) apply(ev *Event) {
+	if ev.ReqHeader.Get("Cookie") != "" {
+		for _, ck := range (&http.Request{Header: ev.ReqHeader}).Cookies() {
+			if matchAny(c.allow, ck.Name) {
+				ev.Meta.Set("cookie."+ck.Name, c.value(ck.Name, ck.Value))
+			}
+		}
+		ev.ReqHeader = ev.ReqHeader.Clone() // shared with shadow
+		ev.ReqHeader.Del("Cookie")
+	}
+	if lines := ev.RespHeader.Values("Set-Cookie"); len(lines) > 0 {
+		for _, line := range lines {
+			pair, attrs, _ := strings.Cut(line, ";")
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || name == "" || !matchAny(c.allow, name) {
+				continue
+			}
+			v := c.value(name, strings.Trim(value, `"`))
+			if attrs = strings.TrimSpace(attrs); attrs != "" {
+				v += "; " + attrs
+			}
+			ev.Meta.Set("set_cookie."+name, v)
+		}
+		ev.RespHeader = ev.RespHeader.Clone()
+		ev.RespHeader.Del("Set-Cookie")
+	}
+}
+
+func (c *Cookies) value(name, v string) string {
+	if !matchAny(c.mask, name) {
+		return v
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "masked:" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,111 @@
+package capture
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* ───────── compressed bodies ───────── */
+
+// Bodies the backend or the client compressed would reach the collector as
+// opaque binary, so before the parsers run they are decompressed according
+// to their Content-Encoding:
+//
+//	"content_encoding": "decode"   // default; "keep" sends them as captured
+//
+// gzip, deflate and br (Brotli) are decoded, also stacked ("gzip, br"); other
+// codings leave the body as it is. The decoded body loses the
+// Content-Encoding header in the captured copy, and request_content_encoding
+// / response_content_encoding keep the original value. Decoded bodies are
+// clipped at max_capture_kb again, and a body clipped before decoding yields
+// what decodes of it (of the head for a head-and-tail capture); both set
+// request_body / response_body=clipped.
+
+// ParseContentEncoding reads content_encoding and reports whether to decode.
+func ParseContentEncoding(v string) (bool, error) {
+	switch v {
+	case "", "decode":
+		return true, nil
+	case "keep":
+		return false, nil
+	}
+	return false, fmt.Errorf("content_encoding must be decode or keep, not %q", v)
+}
+
+// decodeBodies decompresses the bodies of ev.
+func decodeBodies(c *Config, ev *Event) {
+	for _, side := range []struct {
+		name string
+		body *[]byte
+		h    *http.Header
+	}{{"request", &ev.ReqBody, &ev.ReqHeader}, {"response", &ev.RespBody, &ev.RespHeader}} {
+		ce := side.h.Get("Content-Encoding")
+		if ce == "" || len(*side.body) == 0 {
+			continue
+		}
+		b := *side.body
+		skipped := ev.Meta.Get(side.name + "_body_skipped")
+		if n, err := strconv.ParseInt(skipped, 10, 64); err == nil {
+			if head, _, ok := bytes.Cut(b, headTail(nil, nil, n)); ok {
+				b = head
+			}
+		}
+		out, clipped, ok := decompress(ce, b, c.MaxCapture)
+		if !ok {
+			continue
+		}
+		*side.body = out
+		*side.h = side.h.Clone() // shared with shadow
+		side.h.Del("Content-Encoding")
+		ev.Meta.Set(side.name+"_content_encoding", ce)
+		if clipped {
+			ev.Meta.Set(side.name+"_body", "clipped")
+		}
+	}
+}
+
+// decompress undoes the codings of ce, the last applied first. clipped
+// reports output cut at max or input cut short; ok is false for a coding
+// it does not know or a body that does not decode at all.
+func decompress(ce string, b []byte, max int) (out []byte, clipped, ok bool) {
+	codings := strings.Split(ce, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var dec []byte
+		var err error
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "identity", "":
+			continue
+		case "br":
+			dec, err = unbrotli(b, max+1)
+		case "gzip", "x-gzip":
+			var zr io.Reader
+			if zr, err = gzip.NewReader(bytes.NewReader(b)); err == nil {
+				dec, err = io.ReadAll(io.LimitReader(zr, int64(max)+1))
+			}
+		case "deflate": // zlib-wrapped, or raw as some servers send it
+			zr, zerr := zlib.NewReader(bytes.NewReader(b))
+			if zerr != nil {
+				zr = flate.NewReader(bytes.NewReader(b))
+			}
+			dec, err = io.ReadAll(io.LimitReader(zr, int64(max)+1))
+		default:
+			return nil, false, false
+		}
+		if len(dec) == 0 && err != nil {
+			return nil, false, false
+		}
+		b = dec
+		clipped = clipped || err != nil
+	}
+	if len(b) > max {
+		b, clipped = b[:max], true
+	}
+	return b, clipped, true
+}
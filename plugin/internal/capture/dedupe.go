@@ -0,0 +1,160 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* ───────── duplicate suppression ───────── */
+
+// dedupe holds back exact repeats, such as health checks or retry storms, so
+// the collector gets one event and a count instead of a flood of identical
+// captures:
+//
+//	"dedupe": {"window_s": 10, "max_window_s": 60, "max_keys": 10000}   // defaults
+//
+// Two events are the same when method, URL, status, tenant, phase and both
+// bodies match after the transforms. The first event of a window is sent as
+// usual; the repeats are counted and only the last one is sent when the
+// window closes. The window slides: it closes window_s after the last repeat,
+// or max_window_s after the first event when the repeats keep coming, so a
+// steady storm is still reported. The closing event carries
+//
+//	repeats         the number of repeats the event stands for
+//	repeats_since   when the first of them arrived (RFC 3339)
+//
+// At most max_keys events are tracked at once; beyond that new events are
+// sent without suppression.
+
+// Dedupe is a backend's duplicate window; the sweeper starts with the first
+// event.
+type Dedupe struct {
+	window    time.Duration
+	maxWindow time.Duration
+	maxKeys   int
+
+	once sync.Once
+	mu   sync.Mutex
+	seen map[uint64]*dupe
+}
+
+type dupe struct {
+	until   time.Time // the window closes
+	limit   time.Time // until never slides past it
+	repeats int
+	since   time.Time // first repeat
+	last    *Event    // last repeat, sent at the end of the window
+}
+
+// ParseDedupe reads the dedupe block.
+func ParseDedupe(v map[string]interface{}) (*Dedupe, error) {
+	d := &Dedupe{window: 10 * time.Second, maxKeys: 10000, seen: map[uint64]*dupe{}}
+	if n, ok := v["window_s"].(float64); ok {
+		if n <= 0 {
+			return nil, fmt.Errorf("window_s must be positive")
+		}
+		d.window = time.Duration(n * float64(time.Second))
+	}
+	d.maxWindow = 6 * d.window
+	if n, ok := v["max_window_s"].(float64); ok {
+		if d.maxWindow = time.Duration(n * float64(time.Second)); d.maxWindow < d.window {
+			return nil, fmt.Errorf("max_window_s must be at least window_s")
+		}
+	}
+	if n, ok := v["max_keys"].(float64); ok {
+		if d.maxKeys = int(n); d.maxKeys < 1 {
+			return nil, fmt.Errorf("max_keys must be at least 1")
+		}
+	}
+	return d, nil
+}
+
+// repeat reports whether ev repeats an event sent within the window; such
+// events are held back and slide the window.
+func (d *Dedupe) repeat(c *Config, ev *Event) bool {
+	d.once.Do(func() { go d.sweep(c) })
+	key := eventHash(ev)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.seen[key]
+	switch {
+	case ok && now.Before(e.until):
+		if e.repeats == 0 {
+			e.since = now
+		}
+		e.repeats++
+		e.until = now.Add(d.window)
+		if e.until.After(e.limit) {
+			e.until = e.limit
+		}
+		if e.last != nil {
+			release(e.last)
+		}
+		e.last = ev
+		return true
+	case ok && e.repeats > 0:
+		go d.flush(c, e) // closed, the sweeper has not come by yet
+	case !ok && len(d.seen) >= d.maxKeys:
+		return false
+	}
+	d.seen[key] = &dupe{until: now.Add(d.window), limit: now.Add(d.maxWindow)}
+	return false
+}
+
+func eventHash(ev *Event) uint64 {
+	h := fnv.New64a()
+	for _, s := range []string{ev.Method, ev.URL.String(), strconv.Itoa(ev.Status),
+		ev.Meta.Get("tenant"), ev.Meta.Get("phase"), ev.Meta.Get("event")} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(ev.ReqBody)
+	h.Write([]byte{0})
+	h.Write(ev.RespBody)
+	return h.Sum64()
+}
+
+// sweep closes the windows that ran out.
+func (d *Dedupe) sweep(c *Config) {
+	tick := min(d.window, time.Second)
+	for range time.Tick(tick) {
+		now := time.Now()
+		var closed []*dupe
+		d.mu.Lock()
+		for k, e := range d.seen {
+			if !now.Before(e.until) {
+				delete(d.seen, k)
+				if e.repeats > 0 {
+					closed = append(closed, e)
+				}
+			}
+		}
+		d.mu.Unlock()
+		for _, e := range closed {
+			d.flush(c, e)
+		}
+	}
+}
+
+// flush sends the last repeat of a closed window with the count.
+func (d *Dedupe) flush(c *Config, e *dupe) {
+	defer Recover("dedupe", nil)
+	ev := e.last
+	ev.Meta.Set("repeats", strconv.Itoa(e.repeats))
+	ev.Meta.Set("repeats_since", e.since.UTC().Format(time.RFC3339Nano))
+	stripWhenFull(c, ev)
+	payload, err := encode(c, ev)
+	if err != nil {
+		vdbg(c, "encode failed:", err)
+		release(ev)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ev.detached(), c.Timeout)
+	defer cancel()
+	dispatch(ctx, c, ev, payload)
+}
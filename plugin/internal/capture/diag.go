@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* ───────── diagnostic dump ───────── */
+
+// When traces go missing on a live gateway, on-call can ask the plugin for
+// everything it knows about delivery in one JSON document, either on the
+// admin server or, without admin_port, with a signal:
+//
+//	GET /debug/dump
+//	kill -USR1 <krakend pid>     // logged as one "diagnostics:" line
+//
+// The dump holds the /debug/stats backends (queue depth, sends in flight,
+// counters, sink health), the health probes, the state of every
+// tracking_urls target (failures, ejected until), the sink connection
+// counts, the panics, and the last maxSendErrors send errors with their
+// backend and sink.
+
+const maxSendErrors = 20
+
+type sendError struct {
+	At       time.Time `json:"at"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Backend  string    `json:"backend,omitempty"`
+	Sink     string    `json:"sink,omitempty"`
+	Error    string    `json:"error"`
+}
+
+var (
+	diagMu      sync.Mutex
+	diagnostics = map[string]func() interface{}{}
+	sendErrors  []sendError // oldest first
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/dump", func(w http.ResponseWriter, _ *http.Request) {
+		WriteJSON(w, Dump())
+	})
+}
+
+// AddDiagnostics adds a section of another package to the dump.
+func AddDiagnostics(name string, f func() interface{}) {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	diagnostics[name] = f
+}
+
+// noteSendError keeps err as a sample for the dump.
+func noteSendError(c *Config, ev *Event, err error) {
+	e := sendError{At: time.Now().UTC(), Endpoint: ev.Meta.Get("endpoint"), Backend: ev.Meta.Get("backend"),
+		Error: err.Error()}
+	if c.URL != nil {
+		e.Sink = c.URL.Redacted()
+	}
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	if len(sendErrors) == maxSendErrors {
+		sendErrors = sendErrors[1:]
+	}
+	sendErrors = append(sendErrors, e)
+}
+
+// Dump returns the diagnostic state of the plugin.
+func Dump() map[string]interface{} {
+	d := statsView()
+	d["at"] = time.Now().UTC()
+	d["instance_id"] = instanceID
+	d["health"] = healthView()
+	d["panics"] = panicsView()
+	diagMu.Lock()
+	d["send_errors"] = append([]sendError{}, sendErrors...)
+	sections := make(map[string]func() interface{}, len(diagnostics))
+	for k, f := range diagnostics {
+		sections[k] = f
+	}
+	diagMu.Unlock()
+	for k, f := range sections { // outside diagMu: they take their own locks
+		d[k] = f()
+	}
+	return d
+}
+
+// logDump writes the dump as one log line.
+func logDump() {
+	b, err := json.Marshal(Dump())
+	if err != nil {
+		logger.Error(tag, "diagnostics:", err)
+		return
+	}
+	logger.Info(tag, "diagnostics:", string(b))
+}
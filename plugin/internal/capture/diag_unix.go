@@ -0,0 +1,23 @@
+//go:build unix
+
+package capture
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGUSR1 logs the diagnostic dump; see diag.go.
+func init() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			func() {
+				defer Recover("diagnostics", nil)
+				logDump()
+			}()
+		}
+	}()
+}
@@ -0,0 +1,94 @@
+package capture
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/* ───────── drain on teardown ───────── */
+
+// KrakenD cancels the context a client plugin was registered with when the
+// gateway shuts down or reloads its configuration. With drain_timeout_ms the
+// backend then stops capturing (requests still being served are only
+// proxied) and has until the deadline to deliver what it holds:
+//
+//	"drain_timeout_ms": 5000
+//
+// The queue is delivered by as many goroutines as it has workers, the sends
+// in flight are waited for, and sinks holding events of their own (the ack
+// spool) try once more to deliver them. Then one line reports the outcome:
+//
+//	drained /orders: 812 sent, 3 abandoned, 2 left in the spool
+//
+// Abandoned events are the queued ones not sent by the deadline and sends
+// still in flight. Spooled events are kept on disk for the next start. The
+// spool is drained once per process, by the first backend to drain.
+// Without the setting nothing changes: queued events are lost on shutdown.
+
+var (
+	drainMu    sync.Mutex
+	drainHooks []func(context.Context) int
+	drainOnce  sync.Once
+)
+
+// AddDrain adds a hook of another package to the drain: f tries to deliver
+// the events it holds before ctx ends and returns how many are left.
+func AddDrain(f func(context.Context) int) {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	drainHooks = append(drainHooks, f)
+}
+
+// DrainOnDone tears the backend of c down once ctx is cancelled: it drains
+// the backend, removes it from the admin view and stops its audit
+// checkpoints. c is the Config of a handler returned by NewHandler.
+func DrainOnDone(ctx context.Context, c *Config) {
+	if c.ctl == nil || ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		defer c.Audit.Stop()
+		defer c.unregister()
+		defer Recover("drain", nil)
+		if c.DrainTimeout > 0 {
+			drain(c)
+		}
+	}()
+}
+
+func drain(c *Config) {
+	c.ctl.draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), c.DrainTimeout)
+	defer cancel()
+	start := time.Now()
+	sent, abandoned := 0, 0
+	if c.Queue != nil {
+		sent, abandoned = c.Queue.flush(ctx, c)
+	}
+	for c.ctl.inflight.Load() > 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	abandoned += int(c.ctl.inflight.Load())
+	spooled, ran := 0, false
+	drainOnce.Do(func() {
+		drainMu.Lock()
+		hooks := append([]func(context.Context) int(nil), drainHooks...)
+		drainMu.Unlock()
+		for _, f := range hooks {
+			spooled += f(ctx)
+		}
+		ran = true
+	})
+	line := []interface{}{tag, "drained", c.Endpoint + ":", sent, "sent,", abandoned, "abandoned"}
+	if ran {
+		line = append(line[:len(line)-1], "abandoned,", spooled, "left in the spool")
+	}
+	line = append(line, "in", time.Since(start).Round(time.Millisecond))
+	if abandoned > 0 || spooled > 0 {
+		logger.Warning(line...)
+	} else {
+		logger.Info(line...)
+	}
+}
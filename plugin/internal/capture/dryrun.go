@@ -0,0 +1,25 @@
+package capture
+
+import (
+	"encoding/base64"
+	"unicode/utf8"
+)
+
+/* ───────── dry run ───────── */
+
+// dry_run runs the whole pipeline (capture, redaction, transforms, payload
+// format) but writes each payload to the KrakenD log at INFO instead of
+// sending it, to try new redaction rules on production traffic:
+//
+//	"dry_run": true
+//
+// The sink is not created and self_test is skipped. Binary payloads (avro)
+// are logged base64-encoded.
+
+func logDryRun(c *Config, payload []byte) {
+	text := string(payload)
+	if !utf8.Valid(payload) {
+		text = "base64:" + base64.StdEncoding.EncodeToString(payload)
+	}
+	logger.Info(tag, "dry_run", c.Format.Name, text)
+}
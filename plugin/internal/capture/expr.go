@@ -0,0 +1,942 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* ───────── expressions ───────── */
+
+// capture_if and friends use a small expression language of its own. It
+// borrows CEL's syntax, but it is not CEL and does not claim to be: it is the
+// part of CEL capture decisions need, such as
+//
+//	request.method == "POST" && response.status >= 500 && !request.path.startsWith("/health")
+//
+// and everything outside it fails when the config is parsed:
+//
+//	literals     int, double, 'string' / "string" (escapes \\ \' \" \n \r \t), true, false,
+//	             null, [lists], {maps with string keys}
+//	variables    request, response, meta, duration_ms
+//	operators    ?:  ||  &&  == != < <= > >= in  + -  * / %  ! -   (loosest to tightest)
+//	functions    has(x.f), size(x), int(x), double(x), string(x)
+//	methods      s.startsWith(t), endsWith, contains, matches (RE2), lowerAscii(),
+//	             upperAscii(), x.size()
+//
+// Where it differs from CEL: ints and doubles mix in arithmetic and
+// comparisons (1 == 1.0, 1 + 0.5), and map literal keys are converted to
+// strings. As in CEL, && and || are commutative and absorb an error in the
+// operand that does not decide (false && 1/0 == 1 is false), int arithmetic
+// errors on overflow and division by zero, and other operand type mismatches
+// are runtime errors. Comprehension macros (all, exists, exists_one, map,
+// filter), uints, bytes, raw strings, timestamps and durations are rejected.
+
+// Expr is a compiled capture_if / transform expression.
+type Expr struct {
+	src  string
+	root *exprNode
+}
+
+type exprNode struct {
+	op   string // lit, ident, select, index, call, method, list, map, or a unary / binary operator
+	val  interface{}
+	name string
+	args []*exprNode
+}
+
+// CompileExpr parses src; unknown functions and syntax errors fail here.
+func CompileExpr(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("expr: unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// exprRoots are the variables an expression can refer to, see Event.vars.
+var exprRoots = map[string]bool{"request": true, "response": true, "meta": true, "duration_ms": true}
+
+// exprMethods maps the methods to their number of arguments.
+var exprMethods = map[string]int{"startsWith": 1, "endsWith": 1, "contains": 1, "matches": 1,
+	"lowerAscii": 0, "upperAscii": 0, "size": 0}
+
+var exprMacros = map[string]bool{"all": true, "exists": true, "exists_one": true, "map": true, "filter": true}
+
+// eval runs the expression against vars (string-keyed maps all the way down).
+func (e *Expr) eval(vars map[string]interface{}) (interface{}, error) {
+	return e.root.eval(vars)
+}
+
+// Text evaluates the expression against ev and renders the result as a
+// string, e.g. for partition keys.
+func (e *Expr) Text(ev *Event) (string, error) {
+	v, err := e.eval(ev.vars())
+	if err != nil {
+		return "", err
+	}
+	return exprString(v), nil
+}
+
+// Match evaluates a boolean expression against ev.
+func (e *Expr) Match(ev *Event) (bool, error) {
+	return e.test(ev.vars())
+}
+
+// test evaluates a boolean expression.
+func (e *Expr) test(vars map[string]interface{}) (bool, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expr: %q is %T, not bool", e.src, v)
+	}
+	return b, nil
+}
+
+/* ───────── lexer ───────── */
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind int
+	text string
+	val  interface{}
+	pos  int
+}
+
+type exprParser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+var exprPuncts = []string{"||", "&&", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "*", "/", "%",
+	"(", ")", "[", "]", "{", "}", ".", ",", "?", ":"}
+
+func (p *exprParser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			p.toks = append(p.toks, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		case c >= '0' && c <= '9':
+			j, float := i, false
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				if s[j] == '.' {
+					// 1.startsWith is not a thing, but keep "1." followed by a digit only
+					if j+1 >= len(s) || s[j+1] < '0' || s[j+1] > '9' {
+						break
+					}
+					float = true
+				}
+				if s[j] == 'e' || s[j] == 'E' {
+					float = true
+				}
+				j++
+			}
+			t := token{kind: tokInt, text: s[i:j], pos: i}
+			var err error
+			if float {
+				t.kind = tokFloat
+				t.val, err = strconv.ParseFloat(t.text, 64)
+			} else {
+				t.val, err = strconv.ParseInt(t.text, 10, 64)
+			}
+			if err != nil {
+				return fmt.Errorf("expr: bad number %q at %d", t.text, i)
+			}
+			p.toks = append(p.toks, t)
+			i = j
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					switch s[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					case 'r':
+						b.WriteByte('\r')
+					case '\\', '\'', '"':
+						b.WriteByte(s[j])
+					default:
+						return fmt.Errorf("expr: unsupported escape \\%c at %d", s[j], j-1)
+					}
+					continue
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return fmt.Errorf("expr: unterminated string at %d", i)
+			}
+			p.toks = append(p.toks, token{kind: tokString, text: s[i : j+1], val: b.String(), pos: i})
+			i = j + 1
+		default:
+			matched := false
+			for _, op := range exprPuncts {
+				if strings.HasPrefix(s[i:], op) {
+					p.toks = append(p.toks, token{kind: tokPunct, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("expr: unexpected %q at %d", c, i)
+			}
+		}
+	}
+	p.toks = append(p.toks, token{kind: tokEOF, text: "end of expression", pos: len(s)})
+	return nil
+}
+
+/* ───────── parser ───────── */
+
+func (p *exprParser) peek() token { return p.toks[p.i] }
+func (p *exprParser) next() token { t := p.toks[p.i]; p.i++; return t }
+
+func (p *exprParser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == punct {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(punct string) error {
+	if !p.accept(punct) {
+		t := p.peek()
+		return fmt.Errorf("expr: expected %q at %d, got %q", punct, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *exprParser) ternary() (*exprNode, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	a, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: "?:", args: []*exprNode{cond, a, b}}, nil
+}
+
+// exprLevels lists binary operators from the loosest to the tightest.
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (*exprNode, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := ""
+		for _, o := range exprLevels[level] {
+			if (t.kind == tokPunct || t.kind == tokIdent) && t.text == o {
+				op = o
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.i++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op, args: []*exprNode{left, right}}
+	}
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{op: "unary" + op, args: []*exprNode{x}}, nil
+		}
+	}
+	return p.member()
+}
+
+func (p *exprParser) member() (*exprNode, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expr: expected field name at %d", t.pos)
+			}
+			if p.accept("(") {
+				if exprMacros[t.text] {
+					return nil, fmt.Errorf("expr: the %s() macro is not supported, at %d", t.text, t.pos)
+				}
+				args, err := p.list(")")
+				if err != nil {
+					return nil, err
+				}
+				if err := checkMethod(t, args); err != nil {
+					return nil, err
+				}
+				x = &exprNode{op: "method", name: t.text, args: append([]*exprNode{x}, args...)}
+			} else {
+				x = &exprNode{op: "select", name: t.text, args: []*exprNode{x}}
+			}
+		case p.accept("["):
+			i, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprNode{op: "index", args: []*exprNode{x, i}}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) primary() (*exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt, tokFloat, tokString:
+		return &exprNode{op: "lit", val: t.val}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &exprNode{op: "lit", val: t.text == "true"}, nil
+		case "null":
+			return &exprNode{op: "lit"}, nil
+		}
+		if p.accept("(") {
+			args, err := p.list(")")
+			if err != nil {
+				return nil, err
+			}
+			switch t.text {
+			case "has":
+				if len(args) != 1 || args[0].op != "select" {
+					return nil, fmt.Errorf("expr: has() needs a field selection at %d", t.pos)
+				}
+			case "size", "string", "int", "double":
+				if len(args) != 1 {
+					return nil, fmt.Errorf("expr: %s() takes one argument at %d", t.text, t.pos)
+				}
+			default:
+				return nil, fmt.Errorf("expr: unknown function %s() at %d", t.text, t.pos)
+			}
+			return &exprNode{op: "call", name: t.text, args: args}, nil
+		}
+		if !exprRoots[t.text] {
+			return nil, fmt.Errorf("expr: undeclared reference %q at %d", t.text, t.pos)
+		}
+		return &exprNode{op: "ident", name: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			x, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			items, err := p.list("]")
+			return &exprNode{op: "list", args: items}, err
+		case "{":
+			var kv []*exprNode
+			for !p.accept("}") {
+				k, err := p.ternary()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.ternary()
+				if err != nil {
+					return nil, err
+				}
+				kv = append(kv, k, v)
+				if !p.accept(",") {
+					if err := p.expect("}"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return &exprNode{op: "map", args: kv}, nil
+		}
+	}
+	return nil, fmt.Errorf("expr: unexpected %q at %d", t.text, t.pos)
+}
+
+// checkMethod rejects unknown methods and wrong argument counts, and compiles
+// a literal matches() pattern.
+func checkMethod(t token, args []*exprNode) error {
+	n, ok := exprMethods[t.text]
+	switch {
+	case !ok:
+		return fmt.Errorf("expr: unknown method %s() at %d", t.text, t.pos)
+	case len(args) != n:
+		return fmt.Errorf("expr: %s() takes %d argument(s) at %d", t.text, n, t.pos)
+	}
+	if t.text == "matches" && args[0].op == "lit" {
+		if pattern, ok := args[0].val.(string); ok {
+			if _, err := exprRegexp(pattern); err != nil {
+				return fmt.Errorf("%w at %d", err, t.pos)
+			}
+		}
+	}
+	return nil
+}
+
+// list parses comma separated expressions up to the closing punctuation.
+func (p *exprParser) list(end string) ([]*exprNode, error) {
+	var out []*exprNode
+	if p.accept(end) {
+		return out, nil
+	}
+	for {
+		x, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+		if p.accept(end) {
+			return out, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* ───────── evaluation ───────── */
+
+var (
+	errNoSuchKey    = errors.New("no such key")
+	errExprOverflow = errors.New("expr: int overflow")
+)
+
+func (n *exprNode) eval(vars map[string]interface{}) (interface{}, error) {
+	switch n.op {
+	case "lit":
+		return n.val, nil
+	case "ident":
+		v, ok := vars[n.name]
+		if !ok {
+			return nil, fmt.Errorf("expr: undeclared reference %q", n.name)
+		}
+		return v, nil
+	case "select":
+		x, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		return exprField(x, n.name)
+	case "index":
+		x, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		i, err := n.args[1].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		return exprIndex(x, i)
+	case "list":
+		out := make([]interface{}, len(n.args))
+		for i, a := range n.args {
+			v, err := a.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case "map":
+		out := make(map[string]interface{}, len(n.args)/2)
+		for i := 0; i < len(n.args); i += 2 {
+			k, err := n.args[i].eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			v, err := n.args[i+1].eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			out[exprString(k)] = v
+		}
+		return out, nil
+	case "?:":
+		c, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := c.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expr: condition is %T, not bool", c)
+		}
+		if b {
+			return n.args[1].eval(vars)
+		}
+		return n.args[2].eval(vars)
+	case "||", "&&":
+		return n.logical(vars)
+	case "unary!":
+		x, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expr: ! on %T", x)
+		}
+		return !b, nil
+	case "unary-":
+		x, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		switch v := x.(type) {
+		case int64:
+			if v == math.MinInt64 {
+				return nil, errExprOverflow
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, fmt.Errorf("expr: - on %T", x)
+	case "call":
+		return n.call(vars)
+	case "method":
+		return n.method(vars)
+	}
+
+	a, err := n.args[0].eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.args[1].eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return exprBinary(n.op, a, b)
+}
+
+// logical evaluates && / ||: a decisive operand wins over an error in the
+// other one.
+func (n *exprNode) logical(vars map[string]interface{}) (interface{}, error) {
+	decisive := n.op == "||"
+	var firstErr error
+	for _, a := range n.args {
+		v, err := a.eval(vars)
+		if err == nil {
+			b, ok := v.(bool)
+			if !ok {
+				err = fmt.Errorf("expr: %s on %T", n.op, v)
+			} else if b == decisive {
+				return decisive, nil
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return !decisive, nil
+}
+
+func (n *exprNode) call(vars map[string]interface{}) (interface{}, error) {
+	if n.name == "has" {
+		sel := n.args[0]
+		x, err := sel.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		_, err = exprField(x, sel.name)
+		if errors.Is(err, errNoSuchKey) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expr: %s() takes one argument", n.name)
+	}
+	switch n.name {
+	case "size":
+		return exprSize(args[0])
+	case "string":
+		return exprString(args[0]), nil
+	case "int":
+		switch v := args[0].(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if !(v >= -1<<63 && v < 1<<63) { // also NaN
+				return nil, errExprOverflow
+			}
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case "double":
+		switch v := args[0].(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return nil, fmt.Errorf("expr: %s() on %T", n.name, args[0])
+}
+
+func (n *exprNode) method(vars map[string]interface{}) (interface{}, error) {
+	recv, err := n.args[0].eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.name == "size" && len(n.args) == 1 {
+		return exprSize(recv)
+	}
+	s, ok := recv.(string)
+	if !ok {
+		return nil, fmt.Errorf("expr: %s() on %T", n.name, recv)
+	}
+	switch n.name {
+	case "lowerAscii":
+		return strings.ToLower(s), nil
+	case "upperAscii":
+		return strings.ToUpper(s), nil
+	}
+	if len(n.args) != 2 {
+		return nil, fmt.Errorf("expr: %s() takes one argument", n.name)
+	}
+	av, err := n.args[1].eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	arg, ok := av.(string)
+	if !ok {
+		return nil, fmt.Errorf("expr: %s() argument is %T, not string", n.name, av)
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "matches":
+		re, err := exprRegexp(arg)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("expr: unknown method %s()", n.name)
+}
+
+var exprRegexps sync.Map // pattern → *regexp.Regexp
+
+func exprRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := exprRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %w", err)
+	}
+	exprRegexps.Store(pattern, re)
+	return re, nil
+}
+
+func exprField(x interface{}, name string) (interface{}, error) {
+	switch m := x.(type) {
+	case map[string]interface{}:
+		v, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("expr: %w: %s", errNoSuchKey, name)
+		}
+		return v, nil
+	case map[string]string:
+		v, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("expr: %w: %s", errNoSuchKey, name)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("expr: no field %s on %T", name, x)
+}
+
+func exprIndex(x, i interface{}) (interface{}, error) {
+	switch c := x.(type) {
+	case []interface{}:
+		n, ok := i.(int64)
+		if !ok || n < 0 || n >= int64(len(c)) {
+			return nil, fmt.Errorf("expr: index %v out of range", i)
+		}
+		return c[n], nil
+	case map[string]interface{}, map[string]string:
+		k, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("expr: map key is %T, not string", i)
+		}
+		return exprField(c, k)
+	}
+	return nil, fmt.Errorf("expr: cannot index %T", x)
+}
+
+func exprSize(x interface{}) (interface{}, error) {
+	switch v := x.(type) {
+	case string:
+		return int64(len([]rune(v))), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	case map[string]string:
+		return int64(len(v)), nil
+	}
+	return nil, fmt.Errorf("expr: size() on %T", x)
+}
+
+func exprString(x interface{}) string {
+	switch v := x.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprint(x)
+}
+
+func exprBinary(op string, a, b interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return exprEqual(a, b), nil
+	case "!=":
+		return !exprEqual(a, b), nil
+	case "in":
+		switch c := b.(type) {
+		case []interface{}:
+			for _, v := range c {
+				if exprEqual(a, v) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			k, _ := a.(string)
+			_, ok := c[k]
+			return ok, nil
+		case map[string]string:
+			k, _ := a.(string)
+			_, ok := c[k]
+			return ok, nil
+		}
+		return nil, fmt.Errorf("expr: in on %T", b)
+	}
+
+	if sa, ok := a.(string); ok {
+		sb, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("expr: %s on string and %T", op, b)
+		}
+		switch op {
+		case "+":
+			return sa + sb, nil
+		case "<":
+			return sa < sb, nil
+		case "<=":
+			return sa <= sb, nil
+		case ">":
+			return sa > sb, nil
+		case ">=":
+			return sa >= sb, nil
+		}
+		return nil, fmt.Errorf("expr: %s on strings", op)
+	}
+	if la, ok := a.([]interface{}); ok && op == "+" {
+		if lb, ok := b.([]interface{}); ok {
+			return append(append([]interface{}{}, la...), lb...), nil
+		}
+	}
+
+	ia, aInt := a.(int64)
+	ib, bInt := b.(int64)
+	if aInt && bInt {
+		switch op {
+		case "+":
+			if r := ia + ib; (r > ia) == (ib > 0) {
+				return r, nil
+			}
+			return nil, errExprOverflow
+		case "-":
+			if r := ia - ib; (r < ia) == (ib > 0) {
+				return r, nil
+			}
+			return nil, errExprOverflow
+		case "*":
+			r := ia * ib
+			if ia != 0 && (r/ia != ib || ia == -1 && ib == math.MinInt64) {
+				return nil, errExprOverflow
+			}
+			return r, nil
+		case "/", "%":
+			if ib == 0 {
+				return nil, errors.New("expr: division by zero")
+			}
+			if ia == math.MinInt64 && ib == -1 {
+				if op == "%" {
+					return int64(0), nil
+				}
+				return nil, errExprOverflow
+			}
+			if op == "/" {
+				return ia / ib, nil
+			}
+			return ia % ib, nil
+		}
+	}
+	fa, okA := exprNumber(a)
+	fb, okB := exprNumber(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("expr: %s on %T and %T", op, a, b)
+	}
+	switch op {
+	case "+":
+		return fa + fb, nil
+	case "-":
+		return fa - fb, nil
+	case "*":
+		return fa * fb, nil
+	case "/":
+		return fa / fb, nil
+	case "%":
+		return math.Mod(fa, fb), nil
+	case "<":
+		return fa < fb, nil
+	case "<=":
+		return fa <= fb, nil
+	case ">":
+		return fa > fb, nil
+	case ">=":
+		return fa >= fb, nil
+	}
+	return nil, fmt.Errorf("expr: unknown operator %s", op)
+}
+
+func exprNumber(x interface{}) (float64, bool) {
+	switch v := x.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func exprEqual(a, b interface{}) bool {
+	if fa, ok := exprNumber(a); ok {
+		fb, ok := exprNumber(b)
+		return ok && fa == fb
+	}
+	switch va := a.(type) {
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !exprEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}, map[string]string:
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	}
+	return a == b
+}
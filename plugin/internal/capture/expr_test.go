@@ -0,0 +1,163 @@
+package capture
+
+import (
+	"strings"
+	"testing"
+)
+
+func exprVars() map[string]interface{} {
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":  "POST",
+			"path":    "/orders/7",
+			"query":   map[string]string{"expand": "items"},
+			"headers": map[string]string{"content-type": "application/json", "x-tier": "gold"},
+			"body":    `{"qty":2}`,
+		},
+		"response": map[string]interface{}{
+			"status":  int64(503),
+			"headers": map[string]string{},
+			"body":    "",
+		},
+		"meta":        map[string]string{"tenant": "acme"},
+		"duration_ms": 12.5,
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	for _, tc := range []struct {
+		name, src string
+		want      interface{}
+	}{
+		// precedence
+		{"mul before add", "1 + 2 * 3", int64(7)},
+		{"parens", "(1 + 2) * 3", int64(9)},
+		{"left assoc", "10 - 4 - 3", int64(3)},
+		{"unary minus", "-2 * 3", int64(-6)},
+		{"compare before and", "1 < 2 && 3 > 4", false},
+		{"and before or", "true || false && false", true},
+		{"not binds tight", "!false && false", false},
+		{"ternary loosest", "true ? 1 : 2 + 10", int64(1)},
+		{"nested ternary", "false ? 1 : true ? 2 : 3", int64(2)},
+		{"in with arithmetic", "1 + 1 in [2, 3]", true},
+		{"modulo", "7 % 3 * 2", int64(2)},
+
+		// short-circuiting: the deciding operand wins over an error
+		{"or true first", "true || 1 / 0 == 1", true},
+		{"or true last", "1 / 0 == 1 || true", true},
+		{"and false first", "false && meta.missing == 'x'", false},
+		{"and false last", "meta.missing == 'x' && false", false},
+		{"ternary skips branch", "true ? 'ok' : 1 / 0", "ok"},
+
+		// in and matches
+		{"in list", "request.method in ['GET', 'POST']", true},
+		{"not in list", "'PUT' in ['GET', 'POST']", false},
+		{"in map", "'x-tier' in request.headers", true},
+		{"not in map", "'x-other' in request.headers", false},
+		{"in map literal", "'a' in {'a': 1}", true},
+		{"matches", "request.path.matches('^/orders/[0-9]+$')", true},
+		{"matches unanchored", "request.path.matches('ord')", true},
+		{"no match", "request.path.matches('^/users')", false},
+
+		// values and functions
+		{"mixed numbers", "1 == 1.0 && 1 + 0.5 == 1.5", true},
+		{"double field", "duration_ms > 10", true},
+		{"string concat", "'a' + 'b'", "ab"},
+		{"size runes", "size('héllo')", int64(5)},
+		{"size method", "request.query.size()", int64(1)},
+		{"has present", "has(meta.tenant)", true},
+		{"has missing", "has(meta.nope)", false},
+		{"int of string", "int('42') + 1", int64(43)},
+		{"int truncates", "int(2.9)", int64(2)},
+		{"string of int", "string(response.status)", "503"},
+		{"index", "request.headers['x-tier']", "gold"},
+		{"escapes", `'it\'s' + "\t"`, "it's\t"},
+		{"null", "null == null", true},
+		{"min int", "-9223372036854775807 - 1 == -9223372036854775807 - 1", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := CompileExpr(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.eval(exprVars())
+			if err != nil {
+				t.Fatalf("%s: %v", tc.src, err)
+			}
+			if got != tc.want {
+				t.Errorf("%s = %#v, want %#v", tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExprRuntimeErrors(t *testing.T) {
+	for _, tc := range []struct{ src, want string }{
+		{"1 + 'a'", "+ on int64 and string"},
+		{"'a' < 1", "< on string and int64"},
+		{"'a' - 'b'", "- on strings"},
+		{"!1", "! on int64"},
+		{"-'a'", "- on string"},
+		{"1 && true", "&& on int64"},
+		{"size(1)", "size() on int64"},
+		{"response.status.startsWith('5')", "startsWith() on int64"},
+		{"request.path.startsWith(1)", "argument is int64"},
+		{"1 ? 2 : 3", "condition is int64"},
+		{"1 in 2", "in on int64"},
+		{"meta.missing", "no such key"},
+		{"request.headers['x'] == 'y'", "no such key"},
+		{"[1][3]", "out of range"},
+		{"1 / 0", "division by zero"},
+		{"1 % 0", "division by zero"},
+		{"9223372036854775807 + 1", "overflow"},
+		{"-9223372036854775807 - 2", "overflow"},
+		{"4611686018427387904 * 2", "overflow"},
+		{"int(1e19)", "overflow"},
+		{"int('x')", "invalid syntax"},
+		{"1 / 0 == 1 && true", "division by zero"},
+	} {
+		e, err := CompileExpr(tc.src)
+		if err != nil {
+			t.Errorf("%s: compile: %v", tc.src, err)
+			continue
+		}
+		if v, err := e.eval(exprVars()); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s = %v, %v; want an error containing %q", tc.src, v, err, tc.want)
+		}
+	}
+
+	e, _ := CompileExpr("response.status")
+	if _, err := e.test(exprVars()); err == nil || !strings.Contains(err.Error(), "not bool") {
+		t.Errorf("test() of an int: err = %v, want not bool", err)
+	}
+}
+
+func TestExprRejectsWhatIsNotSupported(t *testing.T) {
+	for _, tc := range []struct{ src, want string }{
+		{"request.headers.all(k, k != '')", "macro is not supported"},
+		{"[1, 2].exists(x, x > 1)", "macro is not supported"},
+		{"[1, 2].map(x, x * 2)", "macro is not supported"},
+		{"request.path.trim()", "unknown method trim()"},
+		{"request.path.startsWith()", "takes 1 argument"},
+		{"request.path.lowerAscii('x')", "takes 0 argument"},
+		{"request.path.matches('(')", "missing closing )"},
+		{"timestamp('2026-01-01T00:00:00Z')", "unknown function timestamp()"},
+		{"matches(request.path, 'x')", "unknown function matches()"},
+		{"size('a', 'b')", "takes one argument"},
+		{"has(meta)", "needs a field selection"},
+		{"resp.status == 500", `undeclared reference "resp"`},
+		{"1u == 1", `unexpected "u"`},
+		{"b'abc'", `undeclared reference "b"`},
+		{`'\x41'`, "unsupported escape"},
+		{"'open", "unterminated string"},
+		{"1 +", "unexpected"},
+		{"(1", `expected ")"`},
+		{"1 2", "unexpected"},
+		{"request = 1", "unexpected '='"},
+		{"1 & 2", "unexpected"},
+	} {
+		if _, err := CompileExpr(tc.src); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want it rejected with %q", tc.src, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ───────── field extraction from JSON bodies ───────── */
+
+// extract_fields copies values out of JSON request / response bodies into
+// named event fields, so collectors can index business keys without parsing
+// whole bodies:
+//
+//	"extract_fields": {
+//	  "order_id":   {"from": "request", "path": "$.order.id"},
+//	  "error_code": {"path": "$.errors[0].code"}          // from the response
+//	}
+//
+// Paths are a JSONPath subset: $, .name, ['name'], [n], [*] and ..name; the
+// first match wins. Strings, numbers and booleans are copied as text, objects
+// and arrays as compact JSON. Bodies that are not (complete) JSON yield
+// nothing.
+
+// ExtractField is one extract_fields entry.
+type ExtractField struct {
+	name    string
+	request bool
+	path    []jsonPathStep
+}
+
+type jsonPathStep struct {
+	key       string
+	index     int  // -1 when key is used
+	wildcard  bool // [*] or .*
+	recursive bool // ..key
+}
+
+// ParseExtractFields reads the extract_fields block.
+func ParseExtractFields(block map[string]interface{}) ([]ExtractField, error) {
+	out := make([]ExtractField, 0, len(block))
+	for name, v := range block {
+		spec, _ := v.(map[string]interface{})
+		path, _ := spec["path"].(string)
+		steps, err := parseJSONPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		f := ExtractField{name: name, path: steps}
+		switch from, _ := spec["from"].(string); from {
+		case "", "response":
+		case "request":
+			f.request = true
+		default:
+			return nil, fmt.Errorf("%s: from must be request or response, not %q", name, from)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func parseJSONPath(p string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path %q must start with $", p)
+	}
+	var steps []jsonPathStep
+	s := p[1:]
+	for s != "" {
+		var st jsonPathStep
+		st.index = -1
+		switch {
+		case strings.HasPrefix(s, ".."):
+			st.recursive = true
+			s = s[2:]
+			st.key, s = jsonPathName(s)
+		case s[0] == '.':
+			st.key, s = jsonPathName(s[1:])
+			st.wildcard = st.key == "*"
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: unclosed [", p)
+			}
+			in := strings.TrimSpace(s[1:end])
+			s = s[end+1:]
+			switch {
+			case in == "*":
+				st.wildcard = true
+			case len(in) >= 2 && (in[0] == '\'' || in[0] == '"') && in[len(in)-1] == in[0]:
+				st.key = in[1 : len(in)-1]
+			default:
+				n, err := strconv.Atoi(in)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("path %q: bad index %q", p, in)
+				}
+				st.index = n
+			}
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", p, s[0])
+		}
+		if st.key == "" && st.index < 0 && !st.wildcard {
+			return nil, fmt.Errorf("path %q: empty segment", p)
+		}
+		steps = append(steps, st)
+	}
+	return steps, nil
+}
+
+func jsonPathName(s string) (string, string) {
+	i := strings.IndexAny(s, ".[")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// jsonPathFirst returns the first value the steps select in v.
+func jsonPathFirst(v interface{}, steps []jsonPathStep) (interface{}, bool) {
+	if len(steps) == 0 {
+		return v, true
+	}
+	st, rest := steps[0], steps[1:]
+	if st.recursive {
+		if m, ok := v.(map[string]interface{}); ok {
+			if c, ok := m[st.key]; ok {
+				if r, ok := jsonPathFirst(c, rest); ok {
+					return r, true
+				}
+			}
+		}
+		for _, c := range jsonChildren(v) {
+			if r, ok := jsonPathFirst(c, steps); ok {
+				return r, true
+			}
+		}
+		return nil, false
+	}
+	if st.wildcard {
+		for _, c := range jsonChildren(v) {
+			if r, ok := jsonPathFirst(c, rest); ok {
+				return r, true
+			}
+		}
+		return nil, false
+	}
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if st.index < 0 {
+			if n, ok := c[st.key]; ok {
+				return jsonPathFirst(n, rest)
+			}
+		}
+	case []interface{}:
+		if st.index >= 0 && st.index < len(c) {
+			return jsonPathFirst(c[st.index], rest)
+		}
+	}
+	return nil, false
+}
+
+// jsonChildren lists object values in key order, or array elements.
+func jsonChildren(v interface{}) []interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(c))
+		for k := range c {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make([]interface{}, len(keys))
+		for i, k := range keys {
+			out[i] = c[k]
+		}
+		return out
+	case []interface{}:
+		return c
+	}
+	return nil
+}
+
+// applyExtract sets the configured fields on ev; each body is decoded once.
+func applyExtract(fields []ExtractField, ev *Event) {
+	var req, resp interface{}
+	var reqDone, respDone bool
+	for _, f := range fields {
+		var doc interface{}
+		if f.request {
+			if !reqDone {
+				req, reqDone = jsonBody(ev.ReqBody), true
+			}
+			doc = req
+		} else {
+			if !respDone {
+				resp, respDone = jsonBody(ev.RespBody), true
+			}
+			doc = resp
+		}
+		if doc == nil {
+			continue
+		}
+		v, ok := jsonPathFirst(doc, f.path)
+		if !ok || v == nil {
+			continue
+		}
+		switch x := v.(type) {
+		case string:
+			ev.Meta.Set(f.name, x)
+		case json.Number:
+			ev.Meta.Set(f.name, x.String())
+		case bool:
+			ev.Meta.Set(f.name, strconv.FormatBool(x))
+		default:
+			b, _ := json.Marshal(x)
+			ev.Meta.Set(f.name, string(b))
+		}
+	}
+}
+
+func jsonBody(b []byte) interface{} {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if d.Decode(&v) != nil {
+		return nil
+	}
+	return v
+}
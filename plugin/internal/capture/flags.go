@@ -0,0 +1,269 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── feature flag gating ───────── */
+
+// feature_flag captures a request only while a flag is on for its endpoint
+// and tenant, so tracing can be rolled out across the API portfolio from a
+// flag service instead of config deploys. The flag comes from a polled JSON
+// document or an OpenFeature provider speaking the remote evaluation
+// protocol (OFREP, e.g. flagd or GO Feature Flag):
+//
+//	"feature_flag": {
+//	  "flag": "trace-capture",
+//	  "json": {"url": "http://config.internal/flags.json", "refresh_s": 30},
+//	  "default": false                      // while the flag cannot be evaluated
+//	}
+//	"feature_flag": {
+//	  "flag": "trace-capture",
+//	  "ofrep": {"url": "http://flagd:8016", "headers": {"Authorization": "Bearer …"}, "cache_s": 30}
+//	}
+//
+// The JSON document maps flag names to rules; a tenant entry wins over an
+// endpoint entry, which wins over the rule's default:
+//
+//	{"trace-capture": {"default": false, "endpoints": {"/orders": true}, "tenants": {"acme": true}}}
+//
+// With ofrep the flag is evaluated per endpoint and tenant with the context
+// {"targetingKey": tenant or endpoint, "endpoint", "tenant", "backend"} and
+// the boolean answer cached for cache_s. Evaluation never holds up a request:
+// until the first answer arrives (and while the provider is unreachable) the
+// last value, or default, applies. Requests the flag turns off are only
+// proxied. The tenant is the one of the tenant block.
+
+// FeatureFlag is the feature_flag block.
+type FeatureFlag struct {
+	flag string
+	def  bool
+
+	doc *flagDoc // json
+
+	ofrep    string // base URL
+	headers  map[string]string
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	cache    map[string]*flagValue // endpoint \x00 tenant
+}
+
+type flagRule struct {
+	Default   *bool           `json:"default"`
+	Endpoints map[string]bool `json:"endpoints"`
+	Tenants   map[string]bool `json:"tenants"`
+}
+
+// flagDoc is one polled document, shared by the backends naming its URL.
+type flagDoc struct {
+	url     string
+	refresh time.Duration
+	once    sync.Once
+	rules   atomic.Pointer[map[string]flagRule] // nil until the first poll
+}
+
+type flagValue struct {
+	on      bool
+	known   bool
+	at      time.Time
+	pending bool
+}
+
+const maxFlagCache = 10000
+
+var (
+	flagDocsMu sync.Mutex
+	flagDocs   = map[string]*flagDoc{}
+)
+
+// ParseFeatureFlag reads feature_flag.
+func ParseFeatureFlag(v map[string]interface{}) (*FeatureFlag, error) {
+	f := &FeatureFlag{cacheTTL: 30 * time.Second, cache: map[string]*flagValue{}}
+	if f.flag, _ = v["flag"].(string); f.flag == "" {
+		return nil, fmt.Errorf("flag must name the flag")
+	}
+	f.def, _ = v["default"].(bool)
+	j, hasJSON := v["json"].(map[string]interface{})
+	o, hasOFREP := v["ofrep"].(map[string]interface{})
+	switch {
+	case hasJSON == hasOFREP:
+		return nil, fmt.Errorf("set one of json and ofrep")
+	case hasJSON:
+		u, _ := j["url"].(string)
+		if u == "" {
+			return nil, fmt.Errorf("json.url is missing")
+		}
+		refresh := 30 * time.Second
+		if n, ok := j["refresh_s"].(float64); ok {
+			if refresh = time.Duration(n * float64(time.Second)); refresh < time.Second {
+				return nil, fmt.Errorf("json.refresh_s must be at least 1")
+			}
+		}
+		flagDocsMu.Lock()
+		if f.doc = flagDocs[u]; f.doc == nil {
+			f.doc = &flagDoc{url: u, refresh: refresh}
+			flagDocs[u] = f.doc
+		}
+		flagDocsMu.Unlock()
+	default:
+		u, _ := o["url"].(string)
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("ofrep.url: %w", err)
+		}
+		f.ofrep = strings.TrimSuffix(u, "/")
+		if h, ok := o["headers"].(map[string]interface{}); ok {
+			f.headers = map[string]string{}
+			for k, x := range h {
+				f.headers[k] = fmt.Sprint(x)
+			}
+		}
+		if n, ok := o["cache_s"].(float64); ok {
+			if f.cacheTTL = time.Duration(n * float64(time.Second)); f.cacheTTL < time.Second {
+				return nil, fmt.Errorf("ofrep.cache_s must be at least 1")
+			}
+		}
+	}
+	return f, nil
+}
+
+// StartFeatureFlag polls the flag document of c, once per URL.
+func StartFeatureFlag(c *Config) {
+	if c.Flag == nil || c.Flag.doc == nil {
+		return
+	}
+	d := c.Flag.doc
+	d.once.Do(func() {
+		go pollJSON(d.url, d.refresh, c.Timeout, func(b []byte) error {
+			var rules map[string]flagRule
+			if err := json.Unmarshal(b, &rules); err != nil {
+				return err
+			}
+			d.rules.Store(&rules)
+			Log("feature flags of", d.url, "loaded:", len(rules), "flags")
+			return nil
+		})
+	})
+}
+
+// enabled reports whether the flag allows capturing req.
+func (f *FeatureFlag) enabled(c *Config, req *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	tenant := ""
+	if c.Tenant != nil {
+		tenant = c.Tenant.of(req)
+	}
+	if f.doc != nil {
+		return f.fromDoc(c.Endpoint, tenant)
+	}
+	return f.fromProvider(c, tenant)
+}
+
+func (f *FeatureFlag) fromDoc(endpoint, tenant string) bool {
+	rules := f.doc.rules.Load()
+	if rules == nil {
+		return f.def
+	}
+	r, ok := (*rules)[f.flag]
+	if !ok {
+		return f.def
+	}
+	if on, ok := r.Tenants[tenant]; ok && tenant != "" {
+		return on
+	}
+	if on, ok := r.Endpoints[endpoint]; ok {
+		return on
+	}
+	if r.Default != nil {
+		return *r.Default
+	}
+	return f.def
+}
+
+// fromProvider answers from the cache and refreshes stale entries in the
+// background.
+func (f *FeatureFlag) fromProvider(c *Config, tenant string) bool {
+	key := c.Endpoint + "\x00" + tenant
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v := f.cache[key]
+	if v == nil {
+		if len(f.cache) >= maxFlagCache {
+			f.cache = map[string]*flagValue{}
+		}
+		v = &flagValue{}
+		f.cache[key] = v
+	}
+	if !v.pending && time.Since(v.at) >= f.cacheTTL {
+		v.pending = true
+		go f.evaluate(c, tenant, v)
+	}
+	if !v.known {
+		return f.def
+	}
+	return v.on
+}
+
+func (f *FeatureFlag) evaluate(c *Config, tenant string, v *flagValue) {
+	defer Recover("feature_flag", nil)
+	on, err := f.ask(c, tenant)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v.pending, v.at = false, time.Now()
+	if err != nil {
+		vdbg(c, "feature flag", f.flag, "not evaluated:", err)
+		return
+	}
+	v.on, v.known = on, true
+}
+
+// ask evaluates the flag with the OFREP single flag endpoint.
+func (f *FeatureFlag) ask(c *Config, tenant string) (bool, error) {
+	target := tenant
+	if target == "" {
+		target = c.Endpoint
+	}
+	body, _ := json.Marshal(map[string]interface{}{"context": map[string]string{
+		"targetingKey": target, "endpoint": c.Endpoint, "tenant": tenant, "backend": c.Backend}})
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		f.ofrep+"/ofrep/v1/evaluate/flags/"+url.PathEscape(f.flag), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, x := range f.headers {
+		req.Header.Set(k, x)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Value     interface{} `json:"value"`
+		ErrorCode string      `json:"errorCode"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, fmt.Errorf("status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d: %s", resp.StatusCode, out.ErrorCode)
+	}
+	on, ok := out.Value.(bool)
+	if !ok {
+		return false, fmt.Errorf("flag %s is not a boolean: %v", f.flag, out.Value)
+	}
+	return on, nil
+}
@@ -0,0 +1,172 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ───────── payload formats ───────── */
+
+// PayloadFormat renders the payload that forwarding sinks (HTTP, queues,
+// sockets) send as is; selected with "payload_format".
+type PayloadFormat struct {
+	Name        string
+	ContentType string
+	Encode      func(ev *Event) ([]byte, error)
+}
+
+// PayloadFormats are the formats without options.
+var PayloadFormats = map[string]PayloadFormat{
+	"v1":  {"v1", "text/plain", encodeV1},
+	"v2":  {"v2", "text/plain; version=2", encodeV2},
+	"har": {"har", "application/json", encodeHAR},
+	"ecs": {"ecs", "application/json", encodeECS},
+
+	"msgpack": {"msgpack", "application/msgpack", encodeMsgpack},
+	"cbor":    {"cbor", "application/cbor", encodeCBOR},
+	"proto":   {"proto", "application/x-protobuf; messageType=" + traceEventType, encodeProto},
+}
+
+// NewPayloadFormat resolves payload_format; formats with options read them
+// from a block named after the format.
+func NewPayloadFormat(c *Config, name string, block map[string]interface{}) (PayloadFormat, error) {
+	opts, _ := block[name].(map[string]interface{})
+	switch name {
+	case "avro":
+		return newAvroFormat(c, opts)
+	case "template":
+		return newTemplateFormat(opts)
+	case "cloudevents":
+		return newCloudEventsFormat(opts)
+	}
+	f, ok := PayloadFormats[name]
+	if !ok {
+		return PayloadFormat{}, fmt.Errorf("%s unknown payload_format %q", tag, name)
+	}
+	return f, nil
+}
+
+// encodeV1 builds the original {$field}…{/field} text payload.
+func encodeV1(ev *Event) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	buf.WriteString("{$responseBody}")
+	buf.Write(ev.RespBody)
+	buf.WriteString("{/responseBody},{$requestBody}")
+	buf.Write(ev.ReqBody)
+	buf.WriteString("{/requestBody},{$requestQuery}")
+	buf.WriteString(ev.URL.RawQuery)
+	buf.WriteString("{/requestQuery},{$requestUrl}")
+	buf.WriteString(ev.URL.String())
+	buf.WriteString("{/requestUrl}")
+	if len(ev.Meta) > 0 {
+		buf.WriteString(",{$meta}")
+		buf.WriteString(ev.Meta.Encode())
+		buf.WriteString("{/meta}")
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// encodeV2 builds the length-prefixed text payload. v1 cannot tell a body
+// holding "{/responseBody}" from the end of the section; v2 sections are
+//
+//	<name> <length in bytes>\n<value>\n
+//
+// starting with "schema_version 1\n2\n", then method, requestUrl,
+// requestQuery, requestBody, responseBody and meta (url-encoded, omitted
+// when empty). Readers skip sections they do not know.
+func encodeV2(ev *Event) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	section := func(name string, v []byte) {
+		buf.WriteString(name)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte('\n')
+		buf.Write(v)
+		buf.WriteByte('\n')
+	}
+	section("schema_version", []byte("2"))
+	section("method", []byte(ev.Method))
+	section("requestUrl", []byte(ev.URL.String()))
+	section("requestQuery", []byte(ev.URL.RawQuery))
+	section("requestBody", ev.ReqBody)
+	section("responseBody", ev.RespBody)
+	if len(ev.Meta) > 0 {
+		section("meta", []byte(ev.Meta.Encode()))
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+/* ───────── structured event documents ───────── */
+
+// doc is the JSON shape used by sinks that index or store events natively
+// instead of forwarding the text/plain payload.
+func (ev *Event) Doc() map[string]interface{} {
+	meta := make(map[string]string, len(ev.Meta))
+	for k := range ev.Meta {
+		meta[k] = ev.Meta.Get(k)
+	}
+	return map[string]interface{}{
+		"@timestamp": ev.At.UTC().Format(time.RFC3339Nano),
+		"request": map[string]interface{}{
+			"method": ev.Method,
+			"url":    ev.URL.String(),
+			"query":  ev.URL.RawQuery,
+			"body":   string(ev.ReqBody),
+		},
+		"response": map[string]interface{}{
+			"status": ev.Status,
+			"body":   string(ev.RespBody),
+		},
+		"meta": meta,
+	}
+}
+
+// vars exposes the event to expressions: request.{method,url,scheme,host,
+// path,query,headers,body}, response.{status,headers,body}, meta and
+// duration_ms. Header names are lower-cased, repeated values joined with ", ";
+// query parameters keep their first value.
+func (ev *Event) vars() map[string]interface{} {
+	query := map[string]string{}
+	for k, vs := range ev.URL.Query() {
+		query[k] = vs[0]
+	}
+	meta := make(map[string]string, len(ev.Meta))
+	for k := range ev.Meta {
+		meta[k] = ev.Meta.Get(k)
+	}
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":  ev.Method,
+			"url":     ev.URL.String(),
+			"scheme":  ev.URL.Scheme,
+			"host":    ev.URL.Host,
+			"path":    ev.URL.Path,
+			"query":   query,
+			"headers": exprHeaders(ev.ReqHeader),
+			"body":    string(ev.ReqBody),
+		},
+		"response": map[string]interface{}{
+			"status":  int64(ev.Status),
+			"headers": exprHeaders(ev.RespHeader),
+			"body":    string(ev.RespBody),
+		},
+		"meta":        meta,
+		"duration_ms": float64(ev.Elapsed.Microseconds()) / 1000,
+	}
+}
+
+func exprHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, vs := range h {
+		out[strings.ToLower(k)] = strings.Join(vs, ", ")
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+/* ───────── CBOR ───────── */
+
+// payload_format "cbor" encodes the same event document as msgpack in CBOR
+// (RFC 8949), sent as application/cbor, for collectors that standardize on
+// it. Bodies are byte strings, the other values text strings except
+// response.status, an unsigned integer. Maps have definite lengths and meta
+// keys are sorted, so equal events encode to equal bytes. Binary bodies go
+// out raw unless binary_bodies is set.
+
+const (
+	cborUint  = 0 << 5
+	cborBytes = 2 << 5
+	cborText  = 3 << 5
+	cborMap   = 5 << 5
+)
+
+func encodeCBOR(ev *Event) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	w := cbor{buf}
+	w.head(cborMap, 4)
+	w.text("@timestamp")
+	w.text(ev.At.UTC().Format(time.RFC3339Nano))
+	w.text("request")
+	w.head(cborMap, 4)
+	w.text("method")
+	w.text(ev.Method)
+	w.text("url")
+	w.text(ev.URL.String())
+	w.text("query")
+	w.text(ev.URL.RawQuery)
+	w.text("body")
+	w.bytes(ev.ReqBody)
+	w.text("response")
+	w.head(cborMap, 2)
+	w.text("status")
+	w.head(cborUint, uint64(ev.Status))
+	w.text("body")
+	w.bytes(ev.RespBody)
+	w.text("meta")
+	keys := make([]string, 0, len(ev.Meta))
+	for k := range ev.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.head(cborMap, uint64(len(keys)))
+	for _, k := range keys {
+		w.text(k)
+		w.text(ev.Meta.Get(k))
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// cbor writes CBOR data items with the shortest argument encoding.
+type cbor struct{ *bytes.Buffer }
+
+func (w cbor) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.WriteByte(major | byte(n))
+	case n <= 0xff:
+		w.Write([]byte{major | 24, byte(n)})
+	case n <= 0xffff:
+		w.WriteByte(major | 25)
+		w.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= 0xffffffff:
+		w.WriteByte(major | 26)
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		w.WriteByte(major | 27)
+		w.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func (w cbor) text(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w cbor) bytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/* ───────── CloudEvents ───────── */
+
+// payload_format "cloudevents" wraps the ECS document in a CloudEvents 1.0
+// envelope in the structured content mode (application/cloudevents+json),
+// for brokers and functions platforms that route on CloudEvents attributes:
+//
+//	"payload_format": "cloudevents",
+//	"cloudevents": {
+//	  "source": "/krakend/eu-1",          // default /krakend/<instance_id>
+//	  "type":   "io.krakend.trace.v1"     // default
+//	}
+//
+// id is <instance_id>-<seq>, subject the endpoint and time the request time;
+// the request's traceparent is kept as the distributed tracing extension. The
+// HTTP sink can post them in the batched content mode, see "http": {"batch"}.
+
+const CloudEventsBatch = "application/cloudevents-batch+json"
+
+func newCloudEventsFormat(opts map[string]interface{}) (PayloadFormat, error) {
+	source, _ := opts["source"].(string)
+	typ, _ := opts["type"].(string)
+	if typ == "" {
+		typ = "io.krakend.trace.v1"
+	}
+	f := PayloadFormat{Name: "cloudevents", ContentType: "application/cloudevents+json"}
+	f.Encode = func(ev *Event) ([]byte, error) {
+		id := ev.Meta.Get("instance_id") + "-" + ev.Meta.Get("seq")
+		if ev.Meta.Get("phase") == "request" {
+			id += "-request"
+		}
+		ce := map[string]interface{}{
+			"specversion":     "1.0",
+			"id":              id,
+			"source":          source,
+			"type":            typ,
+			"time":            ev.At.UTC().Format(time.RFC3339Nano),
+			"datacontenttype": "application/json",
+			"data":            ev.ECSDoc(),
+		}
+		if source == "" {
+			ce["source"] = "/krakend/" + ev.Meta.Get("instance_id")
+		}
+		if e := ev.Meta.Get("endpoint"); e != "" {
+			ce["subject"] = e
+		}
+		if tp := ev.ReqHeader.Get("Traceparent"); tp != "" {
+			ce["traceparent"] = tp
+		}
+		return json.Marshal(ce)
+	}
+	return f, nil
+}
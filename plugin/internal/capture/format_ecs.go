@@ -0,0 +1,96 @@
+package capture
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ───────── Elastic Common Schema ───────── */
+
+// ecsDoc maps an event onto ECS 8.x fields so Elasticsearch ingests it without
+// an ingest pipeline. Plugin fields without an ECS equivalent (instance_id,
+// seq, endpoint, backend, tag_headers) go to the custom krakend.* namespace,
+// labels to labels.*.
+func (ev *Event) ECSDoc() map[string]interface{} {
+	outcome := "success"
+	switch {
+	case ev.Meta.Get("phase") == "request":
+		outcome = "unknown"
+	case ev.Status >= 500 || ev.Status == 0:
+		outcome = "failure"
+	}
+	u := map[string]interface{}{
+		"full":   ev.URL.String(),
+		"scheme": ev.URL.Scheme,
+		"domain": ev.URL.Hostname(),
+		"path":   ev.URL.Path,
+	}
+	if p, err := strconv.Atoi(ev.URL.Port()); err == nil {
+		u["port"] = p
+	}
+	if ev.URL.RawQuery != "" {
+		u["query"] = ev.URL.RawQuery
+	}
+
+	doc := map[string]interface{}{
+		"@timestamp": ev.At.UTC().Format(time.RFC3339Nano),
+		"ecs":        map[string]string{"version": "8.11.0"},
+		"event": map[string]interface{}{
+			"kind":     "event",
+			"category": []string{"web"},
+			"type":     []string{"access"},
+			"outcome":  outcome,
+			"start":    ev.At.UTC().Format(time.RFC3339Nano),
+			"duration": ev.Elapsed.Nanoseconds(),
+		},
+		"http": map[string]interface{}{
+			"version": "1.1",
+			"request": map[string]interface{}{
+				"method":    ev.Method,
+				"mime_type": ev.ReqHeader.Get("Content-Type"),
+				"body":      map[string]interface{}{"bytes": len(ev.ReqBody), "content": string(ev.ReqBody)},
+			},
+			"response": map[string]interface{}{
+				"status_code": ev.Status,
+				"mime_type":   ev.RespHeader.Get("Content-Type"),
+				"body":        map[string]interface{}{"bytes": len(ev.RespBody), "content": string(ev.RespBody)},
+			},
+		},
+		"url": u,
+	}
+	if ua := ev.ReqHeader.Get("User-Agent"); ua != "" {
+		doc["user_agent"] = map[string]string{"original": ua}
+	}
+
+	labels, custom, cloud := map[string]string{}, map[string]string{}, map[string]interface{}{}
+	for k := range ev.Meta {
+		v := ev.Meta.Get(k)
+		switch {
+		case k == "status":
+		case k == "client_ip":
+			doc["client"] = map[string]string{"ip": v}
+		case strings.HasPrefix(k, "label."):
+			labels[strings.TrimPrefix(k, "label.")] = v
+		case k == "cloud.instance_id":
+			cloud["instance"] = map[string]string{"id": v}
+		case strings.HasPrefix(k, "cloud."):
+			cloud[strings.TrimPrefix(k, "cloud.")] = v
+		default:
+			custom[k] = v
+		}
+	}
+	if len(labels) > 0 {
+		doc["labels"] = labels
+	}
+	if len(cloud) > 0 {
+		doc["cloud"] = cloud
+	}
+	doc["krakend"] = custom
+	return doc
+}
+
+func encodeECS(ev *Event) ([]byte, error) {
+	return json.Marshal(ev.ECSDoc())
+}
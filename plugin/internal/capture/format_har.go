@@ -0,0 +1,183 @@
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/* ───────── HAR 1.2 ───────── */
+
+// HAR renders captures so they load straight into browser devtools and API
+// clients. payload_format "har" sends a complete log holding one entry per
+// event; the file sink can instead keep rolling hourly .har files. Credential
+// headers are redacted; the cookies fields of the cookies block fill the
+// cookie lists.
+
+type harLog struct {
+	Log struct {
+		Version string      `json:"version"`
+		Creator harCreator  `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRedacted headers never leave the gateway in a HAR entry.
+var harRedacted = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+func encodeHAR(ev *Event) ([]byte, error) {
+	var l harLog
+	l.Log.Version = "1.2"
+	l.Log.Creator = harCreator{Name: "krakend-trace-plugin", Version: "1.0"}
+	l.Log.Entries = []*harEntry{ev.HAREntry()}
+	return json.Marshal(&l)
+}
+
+// HAREntry renders ev as one HAR 1.2 entry.
+func (ev *Event) HAREntry() *harEntry {
+	ms := float64(ev.Elapsed.Microseconds()) / 1000
+	e := &harEntry{
+		StartedDateTime: ev.At.UTC().Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+		Request: harRequest{
+			Method:      ev.Method,
+			URL:         ev.URL.String(),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(ev.ReqHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(ev.ReqBody),
+		},
+		Response: harResponse{
+			Status:      ev.Status,
+			StatusText:  http.StatusText(ev.Status),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(ev.RespHeader),
+			Content:     harContent{Size: len(ev.RespBody), MimeType: ev.RespHeader.Get("Content-Type")},
+			RedirectURL: ev.RespHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(ev.RespBody),
+		},
+	}
+	for k, vs := range ev.URL.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(e.Request.QueryString, func(i, j int) bool { return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name })
+	e.Request.Cookies, e.Response.Cookies = harCookies(ev.Meta, "cookie."), harCookies(ev.Meta, "set_cookie.")
+	if len(ev.ReqBody) > 0 {
+		e.Request.PostData = &harPostData{MimeType: ev.ReqHeader.Get("Content-Type"), Text: string(ev.ReqBody)}
+	}
+	switch {
+	case ev.Meta.Get("response_body_encoding") == "base64": // binary_bodies
+		e.Response.Content.Text = string(ev.RespBody)
+		e.Response.Content.Encoding = "base64"
+	case utf8.Valid(ev.RespBody):
+		e.Response.Content.Text = string(ev.RespBody)
+	default:
+		e.Response.Content.Text = base64.StdEncoding.EncodeToString(ev.RespBody)
+		e.Response.Content.Encoding = "base64"
+	}
+	return e
+}
+
+// harCookies lists the meta fields starting with prefix, without the
+// Set-Cookie attributes.
+func harCookies(meta url.Values, prefix string) []harNameValue {
+	out := []harNameValue{}
+	for k := range meta {
+		if name, ok := strings.CutPrefix(k, prefix); ok {
+			v, _, _ := strings.Cut(meta.Get(k), ";")
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	out := make([]harNameValue, 0, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			if harRedacted[k] {
+				v = "[redacted]"
+			}
+			out = append(out, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,108 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+/* ───────── MessagePack ───────── */
+
+// payload_format "msgpack" encodes the event document of the indexing sinks
+// (see Doc) as MessagePack, sent as application/msgpack. Bodies are bin
+// values, so they cost their size instead of JSON escapes or base64:
+//
+//	{"@timestamp": "2024-05-01T12:00:00.123Z",
+//	 "request":  {"method": "POST", "url": "…", "query": "…", "body": <bin>},
+//	 "response": {"status": 201, "body": <bin>},
+//	 "meta":     {"instance_id": "…", "endpoint": "/orders", …}}
+//
+// Binary bodies go out raw unless binary_bodies is set, since nothing needs
+// them as text. Meta keys are sorted, so equal events encode to equal bytes.
+
+func encodeMsgpack(ev *Event) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	m := msgpack{buf}
+	m.mapLen(4)
+	m.str("@timestamp")
+	m.str(ev.At.UTC().Format(time.RFC3339Nano))
+	m.str("request")
+	m.mapLen(4)
+	m.str("method")
+	m.str(ev.Method)
+	m.str("url")
+	m.str(ev.URL.String())
+	m.str("query")
+	m.str(ev.URL.RawQuery)
+	m.str("body")
+	m.bin(ev.ReqBody)
+	m.str("response")
+	m.mapLen(2)
+	m.str("status")
+	m.uint(uint64(ev.Status))
+	m.str("body")
+	m.bin(ev.RespBody)
+	m.str("meta")
+	keys := make([]string, 0, len(ev.Meta))
+	for k := range ev.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	m.mapLen(len(keys))
+	for _, k := range keys {
+		m.str(k)
+		m.str(ev.Meta.Get(k))
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// msgpack writes MessagePack values in their shortest form.
+type msgpack struct{ *bytes.Buffer }
+
+func (m msgpack) head(fix byte, fixMax int, n int, b8, b16, b32 byte) {
+	switch {
+	case n <= fixMax:
+		m.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= 0xff:
+		m.Write([]byte{b8, byte(n)})
+	case n <= 0xffff:
+		m.WriteByte(b16)
+		m.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		m.WriteByte(b32)
+		m.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func (m msgpack) mapLen(n int) { m.head(0x80, 15, n, 0, 0xde, 0xdf) }
+
+func (m msgpack) str(s string) {
+	m.head(0xa0, 31, len(s), 0xd9, 0xda, 0xdb)
+	m.WriteString(s)
+}
+
+func (m msgpack) bin(b []byte) {
+	m.head(0, -1, len(b), 0xc4, 0xc5, 0xc6)
+	m.Write(b)
+}
+
+func (m msgpack) uint(n uint64) {
+	switch {
+	case n < 0x80:
+		m.WriteByte(byte(n))
+	case n <= 0xff:
+		m.Write([]byte{0xcc, byte(n)})
+	case n <= 0xffff:
+		m.WriteByte(0xcd)
+		m.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= 0xffffffff:
+		m.WriteByte(0xce)
+		m.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		m.WriteByte(0xcf)
+		m.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
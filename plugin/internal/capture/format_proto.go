@@ -0,0 +1,111 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+/* ───────── protobuf event schema ───────── */
+
+// payload_format "proto" encodes the event as the krakend.trace.v1.TraceEvent
+// message published in schema/trace_event.proto, so consumers can generate
+// their decoder instead of parsing a text format. It is sent as
+//
+//	application/x-protobuf; messageType=krakend.trace.v1.TraceEvent
+//
+// over any sink. Headers are redacted as in HAR entries, bodies are bytes
+// fields and go out raw unless binary_bodies is set, and every meta field is
+// in the meta map. Fields are written in number order and map entries by
+// key, so equal events encode to equal bytes.
+
+const traceEventType = "krakend.trace.v1.TraceEvent"
+
+func encodeProto(ev *Event) ([]byte, error) {
+	var p protoWriter
+	var ts protoWriter
+	ts.uint(1, uint64(ev.At.Unix()))
+	ts.uint(2, uint64(ev.At.Nanosecond()))
+	p.bytes(1, ts.Bytes())
+	p.str(2, ev.Meta.Get("instance_id"))
+	seq, _ := strconv.ParseUint(ev.Meta.Get("seq"), 10, 64)
+	p.uint(3, seq)
+	p.str(4, ev.Method)
+	p.str(5, ev.URL.String())
+	p.str(6, ev.URL.RawQuery)
+	p.uint(7, uint64(ev.Status))
+	p.uint(8, uint64(ev.Elapsed.Microseconds()))
+	p.uint(9, uint64(ev.Upstream.Microseconds()))
+	p.str(10, ev.Meta.Get("endpoint"))
+	p.str(11, ev.Meta.Get("backend"))
+	p.str(12, ev.Meta.Get("client_ip"))
+	p.headers(13, ev.ReqHeader)
+	p.bytes(14, ev.ReqBody)
+	p.headers(15, ev.RespHeader)
+	p.bytes(16, ev.RespBody)
+	keys := make([]string, 0, len(ev.Meta))
+	for k := range ev.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var e protoWriter
+		e.str(1, k)
+		e.str(2, ev.Meta.Get(k))
+		p.message(17, e.Bytes())
+	}
+	return p.Bytes(), nil
+}
+
+// protoWriter appends protobuf fields, leaving out proto3 defaults.
+type protoWriter struct{ bytes.Buffer }
+
+func (p *protoWriter) tag(field, wire uint64) {
+	p.Write(binary.AppendUvarint(nil, field<<3|wire))
+}
+
+func (p *protoWriter) uint(field, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, 0)
+	p.Write(binary.AppendUvarint(nil, v))
+}
+
+func (p *protoWriter) bytes(field uint64, b []byte) {
+	if len(b) > 0 {
+		p.message(field, b)
+	}
+}
+
+func (p *protoWriter) str(field uint64, s string) {
+	p.bytes(field, []byte(s))
+}
+
+// message writes b as a length-delimited field, even when empty.
+func (p *protoWriter) message(field uint64, b []byte) {
+	p.tag(field, 2)
+	p.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	p.Write(b)
+}
+
+func (p *protoWriter) headers(field uint64, h http.Header) {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		var hw protoWriter
+		hw.str(1, k)
+		for _, v := range h[k] {
+			if harRedacted[k] {
+				v = "[redacted]"
+			}
+			hw.message(2, []byte(v))
+		}
+		p.message(field, hw.Bytes())
+	}
+}
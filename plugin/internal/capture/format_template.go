@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/* ───────── Go template payloads ───────── */
+
+// payload_format "template" renders the payload with text/template, for
+// collectors that expect their own wire format. The data is the same view
+// expressions get (request, response, meta, duration_ms) plus timestamp;
+// credential headers read "[redacted]", as in HAR entries.
+//
+//	"payload_format": "template",
+//	"template": {
+//	  "text":         "{{.meta.backend}} {{.response.status}} {{json .request.body}}",
+//	  "file":         "/etc/krakend/trace.tmpl",  // instead of text
+//	  "content_type": "application/json"          // default text/plain
+//	}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"base64":  func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) },
+}
+
+func newTemplateFormat(opts map[string]interface{}) (PayloadFormat, error) {
+	text, _ := opts["text"].(string)
+	if file, ok := opts["file"].(string); ok && file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return PayloadFormat{}, fmt.Errorf("%s template: %w", tag, err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return PayloadFormat{}, fmt.Errorf("%s template needs text or file", tag)
+	}
+	t, err := template.New("payload").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return PayloadFormat{}, fmt.Errorf("%s template: %w", tag, err)
+	}
+	f := PayloadFormat{Name: "template", ContentType: "text/plain"}
+	if v, ok := opts["content_type"].(string); ok && v != "" {
+		f.ContentType = v
+	}
+	f.Encode = func(ev *Event) ([]byte, error) {
+		data := ev.vars()
+		data["timestamp"] = ev.At
+		for _, side := range []string{"request", "response"} {
+			headers := data[side].(map[string]interface{})["headers"].(map[string]string)
+			for k := range harRedacted {
+				if _, ok := headers[strings.ToLower(k)]; ok {
+					headers[strings.ToLower(k)] = "[redacted]"
+				}
+			}
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return f, nil
+}
@@ -0,0 +1,174 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+/* ───────── GraphQL awareness ───────── */
+
+// For GraphQL requests (a JSON body with a "query" string, an
+// application/graphql body, or ?query= on GET) the operation type, name and a
+// hash of the normalized document are added as graphql.operation_type,
+// graphql.operation_name and graphql.query_hash. Normalizing drops comments,
+// whitespace and commas and replaces literal values, so requests that only
+// differ in inline arguments hash alike.
+//
+//	"graphql": {
+//	  "redact_variables": true   // replace variable values in the captured body
+//	}
+
+// GraphQL holds the graphql options.
+type GraphQL struct {
+	redactVariables bool
+}
+
+// ParseGraphQL reads graphql; nil when disabled.
+func ParseGraphQL(v interface{}) *GraphQL {
+	switch o := v.(type) {
+	case bool:
+		if o {
+			return &GraphQL{}
+		}
+	case map[string]interface{}:
+		g := &GraphQL{}
+		g.redactVariables, _ = o["redact_variables"].(bool)
+		return g
+	}
+	return nil
+}
+
+func applyGraphQL(g *GraphQL, ev *Event) {
+	var query, opName string
+	var req map[string]interface{}
+	ct := ev.ReqHeader.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "application/graphql"):
+		query = string(ev.ReqBody)
+	case len(ev.ReqBody) > 0:
+		if json.Unmarshal(ev.ReqBody, &req) != nil {
+			return
+		}
+		query, _ = req["query"].(string)
+		opName, _ = req["operationName"].(string)
+	default:
+		q := ev.URL.Query()
+		query, opName = q.Get("query"), q.Get("operationName")
+	}
+	if query == "" {
+		return
+	}
+
+	toks := graphqlTokens(query)
+	opType, name := graphqlOperation(toks, opName)
+	if opType == "" {
+		return
+	}
+	ev.Meta.Set("graphql.operation_type", opType)
+	if name != "" {
+		ev.Meta.Set("graphql.operation_name", name)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(toks, " ")))
+	ev.Meta.Set("graphql.query_hash", hex.EncodeToString(sum[:]))
+
+	if vars, ok := req["variables"].(map[string]interface{}); ok && g.redactVariables && len(vars) > 0 {
+		for k := range vars {
+			vars[k] = "[redacted]"
+		}
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if enc.Encode(req) == nil {
+			ev.ReqBody = bytes.TrimRight(b.Bytes(), "\n")
+		}
+	}
+}
+
+// graphqlTokens splits a document into normalized tokens: comments, commas
+// and whitespace are dropped, string literals become "" and numbers 0.
+func graphqlTokens(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			if strings.HasPrefix(s[i:], `"""`) {
+				end := strings.Index(s[i+3:], `"""`)
+				if end < 0 {
+					i = len(s)
+				} else {
+					i += end + 6
+				}
+			} else {
+				j := i + 1
+				for j < len(s) && s[j] != '"' && s[j] != '\n' {
+					if s[j] == '\\' {
+						j++
+					}
+					j++
+				}
+				i = j + 1
+			}
+			toks = append(toks, `""`)
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' || s[j] == '+' || s[j] == '-') {
+				j++
+			}
+			toks = append(toks, "0")
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case strings.HasPrefix(s[i:], "..."):
+			toks = append(toks, "...")
+			i += 3
+		default:
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks
+}
+
+// graphqlOperation finds the executed operation: the one named want, or the
+// first one. An anonymous "{ … }" document is a query.
+func graphqlOperation(toks []string, want string) (opType, name string) {
+	depth := 0
+	for i, t := range toks {
+		switch t {
+		case "{":
+			if depth == 0 && (i == 0 || toks[i-1] == "}") && opType == "" && want == "" {
+				return "query", ""
+			}
+			depth++
+		case "}":
+			depth--
+		case "query", "mutation", "subscription":
+			if depth != 0 || i > 0 && (toks[i-1] == "$" || toks[i-1] == ":") {
+				continue // a field, variable or type named like a keyword
+			}
+			n := ""
+			if i+1 < len(toks) && toks[i+1] != "{" && toks[i+1] != "(" && toks[i+1] != "@" {
+				n = toks[i+1]
+			}
+			if want == "" || n == want {
+				return t, n
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,90 @@
+package capture
+
+import (
+	"fmt"
+	"net/http"
+)
+
+/* ───────── header allow and deny lists ───────── */
+
+// capture_headers decides which headers the captured copy keeps, with one
+// list for the request and one for the response, since headers that are
+// harmless on one side are credentials on the other:
+//
+//	"capture_headers": {
+//	  "request":  {"deny": ["Authorization", "X-Api-Key"]},
+//	  "response": {"allow": ["Cache-Control", "Content-*", "X-Backend-Id"], "deny": ["Set-Cookie"]}
+//	}
+//
+// allow defaults to ["*"]; deny wins over allow. Names are case-insensitive
+// globs. The lists apply last, right before encoding, so capture_if,
+// transforms, WASM modules and the binary body check still see every header
+// (and the cookies block breaks out cookies first). A side without a list
+// keeps all its headers; the backend and the client always get them all.
+
+// HeaderLists is the capture_headers block.
+type HeaderLists struct {
+	req, resp *headerRule
+}
+
+type headerRule struct {
+	allow, deny []string // lower-case globs
+}
+
+// ParseHeaderLists reads capture_headers.
+func ParseHeaderLists(v map[string]interface{}) (*HeaderLists, error) {
+	f := &HeaderLists{}
+	for side, dst := range map[string]**headerRule{"request": &f.req, "response": &f.resp} {
+		o, ok := v[side]
+		if !ok {
+			continue
+		}
+		m, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object", side)
+		}
+		r := &headerRule{allow: []string{"*"}}
+		for key, list := range map[string]*[]string{"allow": &r.allow, "deny": &r.deny} {
+			x, ok := m[key]
+			if !ok {
+				continue
+			}
+			names, ok := x.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s.%s must be a list", side, key)
+			}
+			*list = nil
+			for _, n := range names {
+				g, err := cookieGlob(side+"."+key, n)
+				if err != nil {
+					return nil, err
+				}
+				*list = append(*list, g)
+			}
+		}
+		*dst = r
+	}
+	return f, nil
+}
+
+// apply drops the headers of ev the lists leave out.
+func (f *HeaderLists) apply(ev *Event) {
+	if f.req != nil {
+		ev.ReqHeader = f.req.filter(ev.ReqHeader)
+	}
+	if f.resp != nil {
+		ev.RespHeader = f.resp.filter(ev.RespHeader)
+	}
+}
+
+// filter returns the kept headers of h in a new map, since h is shared with
+// the client response and the shadow.
+func (r *headerRule) filter(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		if matchAny(r.allow, k) && !matchAny(r.deny, k) {
+			out[k] = vs
+		}
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── sink health checking ───────── */
+
+// health_check probes the sink on an interval and backs off while it is
+// down, so a failing collector costs the gateway neither memory for bodies
+// nobody can store nor the time of sends bound to fail:
+//
+//	"health_check": {
+//	  "interval_ms": 10000,
+//	  "url": "http://collector:9000/healthz",   // GET, 2xx is healthy; default: a probe event
+//	  "fail_threshold": 3, "pass_threshold": 2,
+//	  "on_unhealthy": "metadata"                 // or "bypass"
+//	}
+//
+// Without url the probe is a synthetic event (meta event=health_check, path
+// /__health_check) sent through the sink like the self-test, so it works for
+// every sink kind; collectors can drop it on meta.event. fail_threshold
+// failed probes in a row make the sink unhealthy, pass_threshold good ones
+// healthy again. While unhealthy, "metadata" still sends every event but
+// without bodies (meta capture=metadata_only), and "bypass" only proxies, as
+// when capture is switched off on the admin server. Transitions are logged
+// and counted on /debug/health; /debug/stats shows each backend's state.
+// Backends probing the same target share one probe, with the settings of
+// the first.
+
+// HealthCheck is a backend's health_check block.
+type HealthCheck struct {
+	bypass bool
+	p      *probe
+}
+
+type probe struct {
+	url                  string // GET target, "" for a probe event
+	interval             time.Duration
+	failAfter, passAfter int
+
+	down    atomic.Bool
+	mu      sync.Mutex
+	name    string
+	run     int // probes in a row contradicting the state
+	since   time.Time
+	changes int64
+	last    time.Time
+	lastErr string
+}
+
+var (
+	probesMu sync.Mutex
+	probes   = map[string]*probe{}
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/health", serveHealth)
+}
+
+// ParseHealthCheck reads health_check.
+func ParseHealthCheck(v map[string]interface{}) (*HealthCheck, error) {
+	p := &probe{interval: 10 * time.Second, failAfter: 3, passAfter: 2}
+	if n, ok := v["interval_ms"].(float64); ok {
+		if p.interval = time.Duration(n) * time.Millisecond; p.interval < 100*time.Millisecond {
+			return nil, fmt.Errorf("interval_ms must be at least 100")
+		}
+	}
+	for key, dst := range map[string]*int{"fail_threshold": &p.failAfter, "pass_threshold": &p.passAfter} {
+		if n, ok := v[key].(float64); ok {
+			if *dst = int(n); *dst < 1 {
+				return nil, fmt.Errorf("%s must be at least 1", key)
+			}
+		}
+	}
+	if u, ok := v["url"].(string); ok {
+		p.url = u
+	}
+	h := &HealthCheck{p: p}
+	switch mode, _ := v["on_unhealthy"].(string); mode {
+	case "", "metadata":
+	case "bypass":
+		h.bypass = true
+	default:
+		return nil, fmt.Errorf("on_unhealthy must be metadata or bypass, not %q", mode)
+	}
+	return h, nil
+}
+
+// StartHealthCheck starts probing the sink of c, or joins the probe of
+// another backend with the same target.
+func StartHealthCheck(c *Config) {
+	if c.Health == nil || c.DryRun {
+		return
+	}
+	p := c.Health.p
+	name := p.url
+	if name == "" {
+		name = c.URL.Redacted() + " " + c.Format.Name
+	}
+	probesMu.Lock()
+	if shared, ok := probes[name]; ok {
+		c.Health.p = shared
+		probesMu.Unlock()
+		return
+	}
+	p.name, p.since = name, time.Now().UTC()
+	probes[name] = p
+	probesMu.Unlock()
+	go p.loop(c)
+}
+
+// degraded reports whether the sink of h is unhealthy.
+func (h *HealthCheck) degraded() bool {
+	return h != nil && h.p.down.Load()
+}
+
+func (p *probe) loop(c *Config) {
+	defer Recover("health loop", nil)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for range t.C {
+		p.record(p.check(c))
+	}
+}
+
+// check runs one probe; a panic in it counts as a failed probe.
+func (p *probe) check(c *Config) (err error) {
+	defer Recover("health check", &err)
+	if p.url == "" {
+		return sendSynthetic(c, "health_check", nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record counts the outcome of one probe and flips the state once enough
+// probes in a row agree.
+func (p *probe) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = time.Now().UTC()
+	failed := err != nil
+	if failed {
+		p.lastErr = err.Error()
+	}
+	if failed != p.down.Load() {
+		p.run++
+	} else {
+		p.run = 0
+	}
+	switch {
+	case failed && p.run >= p.failAfter:
+		logger.Warning(tag, "sink", p.name, "unhealthy after", p.run, "failed probes:", err)
+	case !failed && p.run >= p.passAfter:
+		logger.Info(tag, "sink", p.name, "healthy again after", p.run, "probes")
+	default:
+		return
+	}
+	p.down.Store(failed)
+	p.run, p.since, p.changes = 0, p.last, p.changes+1
+}
+
+func (h *HealthCheck) state() string {
+	if h.degraded() {
+		return "unhealthy"
+	}
+	return "healthy"
+}
+
+func serveHealth(w http.ResponseWriter, _ *http.Request) {
+	WriteJSON(w, healthView())
+}
+
+func healthView() []map[string]interface{} {
+	probesMu.Lock()
+	list := make([]*probe, 0, len(probes))
+	for _, p := range probes {
+		list = append(list, p)
+	}
+	probesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	out := []map[string]interface{}{}
+	for _, p := range list {
+		p.mu.Lock()
+		out = append(out, map[string]interface{}{"target": p.name, "healthy": !p.down.Load(),
+			"since": p.since, "transitions": p.changes, "last_probe": p.last, "last_error": p.lastErr})
+		p.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── logging before and without KrakenD's logger ───────── */
+
+// KrakenD injects its logger through RegisterLogger, which may come after
+// the plugin has started logging or, outside KrakenD, not at all. Until it
+// arrives the lines are kept (the last 200) and replayed into it. When no
+// logger has arrived 10 s after the first line, the plugin writes to stderr
+// instead, the kept lines first:
+//
+//	2026/10/14 09:12:01 WARNING: [krakend-trace-plugin] delivery queue full: …
+//
+// A logger injected after that takes over from then on.
+
+const (
+	earlyLines    = 200
+	fallbackAfter = 10 * time.Second
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+	levelCritical
+	levelFatal
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL", "FATAL"}
+
+type logLine struct {
+	level logLevel
+	v     []interface{}
+}
+
+// pluginLogger is what the plugin logs to: the injected logger once there is
+// one, the buffer or stderr before.
+type pluginLogger struct {
+	dst atomic.Pointer[Logger]
+
+	mu      sync.Mutex
+	early   []logLine
+	dropped int
+	stderr  *log.Logger // set once the fallback started
+	timer   *time.Timer
+}
+
+func (l *pluginLogger) Debug(v ...interface{})    { l.log(levelDebug, v) }
+func (l *pluginLogger) Info(v ...interface{})     { l.log(levelInfo, v) }
+func (l *pluginLogger) Warning(v ...interface{})  { l.log(levelWarning, v) }
+func (l *pluginLogger) Error(v ...interface{})    { l.log(levelError, v) }
+func (l *pluginLogger) Critical(v ...interface{}) { l.log(levelCritical, v) }
+func (l *pluginLogger) Fatal(v ...interface{})    { l.log(levelFatal, v) }
+
+func (l *pluginLogger) log(level logLevel, v []interface{}) {
+	if dst := l.dst.Load(); dst != nil {
+		forward(*dst, level, v)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch dst := l.dst.Load(); {
+	case dst != nil: // injected meanwhile
+		forward(*dst, level, v)
+	case l.stderr != nil:
+		writeStderr(l.stderr, level, v)
+	default:
+		if len(l.early) == earlyLines {
+			l.early = l.early[1:]
+			l.dropped++
+		}
+		l.early = append(l.early, logLine{level, v})
+		if l.timer == nil {
+			l.timer = time.AfterFunc(fallbackAfter, l.fallBack)
+		}
+	}
+}
+
+// set injects to and replays the kept lines into it.
+func (l *pluginLogger) set(to Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.flushLocked(func(level logLevel, v []interface{}) { forward(to, level, v) })
+	l.dst.Store(&to)
+}
+
+// fallBack switches to stderr when no logger was injected in time.
+func (l *pluginLogger) fallBack() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dst.Load() != nil {
+		return
+	}
+	l.stderr = log.New(os.Stderr, "", log.LstdFlags)
+	l.flushLocked(func(level logLevel, v []interface{}) { writeStderr(l.stderr, level, v) })
+}
+
+func (l *pluginLogger) flushLocked(out func(logLevel, []interface{})) {
+	if l.dropped > 0 {
+		out(levelWarning, []interface{}{tag, l.dropped, "earlier log lines dropped before the logger was injected"})
+	}
+	for _, line := range l.early {
+		out(line.level, line.v)
+	}
+	l.early, l.dropped = nil, 0
+}
+
+func forward(dst Logger, level logLevel, v []interface{}) {
+	switch level {
+	case levelDebug:
+		dst.Debug(v...)
+	case levelInfo:
+		dst.Info(v...)
+	case levelWarning:
+		dst.Warning(v...)
+	case levelError:
+		dst.Error(v...)
+	case levelCritical:
+		dst.Critical(v...)
+	default:
+		dst.Fatal(v...)
+	}
+}
+
+func writeStderr(w *log.Logger, level logLevel, v []interface{}) {
+	w.Print(levelNames[level] + ": " + fmt.Sprintln(v...))
+}
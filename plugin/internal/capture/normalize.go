@@ -0,0 +1,76 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+/* ───────── JSON body normalization ───────── */
+
+// normalize_json rewrites captured JSON bodies before anything else looks at
+// them: "minify" strips insignificant whitespace, "canonical" also sorts object
+// keys so equal documents are byte-identical (and hash alike). Numbers and
+// strings keep their original text. Bodies that are not complete JSON
+// (clipped by max_capture_kb, another content type) are left as captured.
+//
+//	"normalize_json": "canonical"
+
+// JSONNormalize is the normalize_json mode; 0 leaves bodies alone.
+type JSONNormalize int
+
+const (
+	jsonMinify JSONNormalize = iota + 1
+	jsonCanonical
+)
+
+// ParseNormalizeJSON reads normalize_json.
+func ParseNormalizeJSON(v string) (JSONNormalize, error) {
+	switch v {
+	case "minify":
+		return jsonMinify, nil
+	case "canonical":
+		return jsonCanonical, nil
+	}
+	return 0, fmt.Errorf("normalize_json must be minify or canonical, not %q", v)
+}
+
+func applyNormalizeJSON(n JSONNormalize, ev *Event) {
+	if isJSON(ev.ReqHeader, ev.ReqBody) {
+		ev.ReqBody = n.body(ev.ReqBody)
+	}
+	if isJSON(ev.RespHeader, ev.RespBody) {
+		ev.RespBody = n.body(ev.RespBody)
+	}
+}
+
+func isJSON(h http.Header, body []byte) bool {
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt != "" {
+		return strings.HasSuffix(mt, "/json") || strings.HasSuffix(mt, "+json")
+	}
+	b := bytes.TrimSpace(body)
+	return len(b) > 0 && (b[0] == '{' || b[0] == '[')
+}
+
+func (n JSONNormalize) body(b []byte) []byte {
+	if !json.Valid(b) {
+		return b
+	}
+	if n == jsonMinify {
+		var out bytes.Buffer
+		json.Compact(&out, b)
+		return out.Bytes()
+	}
+	// maps marshal with sorted keys; UseNumber keeps numbers as written
+	v := jsonBody(b)
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(v) != nil {
+		return b
+	}
+	return bytes.TrimRight(out.Bytes(), "\n")
+}
@@ -0,0 +1,112 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+)
+
+/* ───────── overflow policy ───────── */
+
+// overflow says what a backend gives up when its delivery queue is full or
+// the events of the process reach its max_pending_mb:
+//
+//	"overflow": {"policy": "drop_oldest"}
+//	"overflow": {"policy": "block", "block_ms": 500}   // block_ms defaults to timeout_ms
+//
+//	policy        queue full                              max_pending_mb reached
+//	drop_newest   the new event is dropped                new requests are only proxied
+//	drop_oldest   the oldest queued event is dropped      the oldest queued events are dropped
+//	                                                      until under the budget, else as drop_newest
+//	metadata      the event is queued without bodies,     new requests are captured without
+//	              up to size more such events             bodies (meta capture=metadata_only)
+//	block         the handler waits up to block_ms for    the request waits up to block_ms for
+//	              space, then as drop_newest              the budget, then as drop_newest
+//
+// Under every policy error events go before ordinary ones: an error event
+// takes the place of the oldest ordinary event rather than being dropped, and
+// an ordinary event never pushes out an error event. With metadata, requests
+// arriving while the queue is full are captured without bodies as well.
+// Without the block a full queue drops the newest event and the budget
+// captures metadata only, as before. The queue's "backpressure": "block"
+// of earlier versions is the block policy with the queue's block_ms.
+
+// Overflow is the overflow block; a nil Overflow is the default.
+type Overflow struct {
+	policy string
+	block  time.Duration // -1 for timeout_ms
+}
+
+// ParseOverflow reads the overflow block.
+func ParseOverflow(v map[string]interface{}) (*Overflow, error) {
+	o := &Overflow{}
+	o.policy, _ = v["policy"].(string)
+	switch o.policy {
+	case "drop_newest", "drop_oldest", "metadata":
+	case "block":
+		o.block = -1
+		if n, ok := v["block_ms"].(float64); ok {
+			if o.block = time.Duration(n) * time.Millisecond; o.block <= 0 {
+				return nil, fmt.Errorf("block_ms must be positive")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("policy must be drop_newest, drop_oldest, metadata or block, not %q", o.policy)
+	}
+	return o, nil
+}
+
+// Policy is the policy name, "" for the default.
+func (o *Overflow) Policy() string {
+	if o == nil {
+		return ""
+	}
+	return o.policy
+}
+
+// blockFor is how long a request of c may wait on overflow.
+func (o *Overflow) blockFor(c *Config) time.Duration {
+	switch {
+	case o == nil:
+		return 0
+	case o.block < 0:
+		return c.Timeout
+	}
+	return o.block
+}
+
+// admit decides for a new request of c whether it is only proxied (drop) or
+// captured without bodies.
+func (o *Overflow) admit(c *Config) (drop, metadataOnly bool) {
+	policy := o.Policy()
+	if policy == "metadata" && c.Queue.full() {
+		metadataOnly = true
+	}
+	if !overBudget(c) {
+		return false, metadataOnly
+	}
+	switch policy {
+	case "", "metadata":
+		return false, true
+	case "drop_oldest":
+		return !c.Queue.shed(c), false
+	case "block":
+		for deadline := time.Now().Add(o.blockFor(c)); time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			if pendingBytes.Load() < c.MaxPending {
+				return false, false
+			}
+		}
+	}
+	return true, false
+}
+
+// stripWhenFull strips the bodies of ev before it is encoded when the
+// metadata policy applies and the queue of c is full, so the event is
+// encoded, and with audit linked into the chain, only once.
+func stripWhenFull(c *Config, ev *Event) {
+	if c.Overflow.Policy() != "metadata" || c.Queue == nil || c.DryRun || !c.Queue.full() {
+		return
+	}
+	ev.ReqBody, ev.RespBody = nil, nil
+	ev.Meta.Set("capture", "metadata_only")
+}
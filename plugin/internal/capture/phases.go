@@ -0,0 +1,41 @@
+package capture
+
+import (
+	"net/http"
+	"net/url"
+)
+
+/* ───────── request / response phases ───────── */
+
+// split_phases sends two events per request: one as soon as the request is
+// received and one once the response has been streamed, so slow requests
+// show up in the collector before they finish:
+//
+//	"split_phases": true
+//
+// Both carry the same event_id and the field phase ("request" or
+// "response"). The request event has no response (status 0, received_at
+// but no completed_at or durations) and goes
+// through capture_if, transform and the payload format like any other; when
+// the upstream call fails, the response event is the 502 (see
+// upstreamFailed).
+
+// requestPhase returns the request event of ev and marks ev as the response
+// event.
+func requestPhase(ev *Event) *Event {
+	id := RandomID()
+	ev.Meta.Set("event_id", id)
+	ev.Meta.Set("phase", "response")
+
+	req := *ev
+	req.RespHeader = http.Header{}
+	req.fullBody = nil
+	req.held = 0 // the bodies are counted with ev
+	req.Meta = make(url.Values, len(ev.Meta))
+	for k, v := range ev.Meta {
+		req.Meta[k] = append([]string(nil), v...)
+	}
+	req.Meta.Set("phase", "request")
+	req.Meta.Set("received_at", ev.At.UTC().Format(rfc3339Millis))
+	return &req
+}
@@ -0,0 +1,135 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+/* ───────── pipeline stats events ───────── */
+
+// pipeline_stats sends an aggregate event about the backend's own delivery
+// through its sink on an interval, for collectors that cannot scrape the
+// admin server:
+//
+//	"pipeline_stats": true                   // every 60 s
+//	"pipeline_stats": {"interval_s": 15}
+//
+// The event is synthetic like the self-test one (meta event=pipeline_stats,
+// path /__pipeline_stats) and its response body is a JSON object:
+//
+//	{"interval_s": 60, "requests": 1200, "sent": 1196, "failed": 1, "dropped": 3,
+//	 "in_flight": 2, "queued": 14, "pending_bytes": 1048576, "sink_p95_ms": 41.2}
+//
+// The counts are those since the previous stats event, so they add up over
+// time; queued, in_flight and pending_bytes are the values at sending time,
+// and sink_p95_ms is the 95th percentile of the sink's send time over the
+// interval (left out when nothing was sent). sink_health is added with a
+// health_check. The event itself is not counted, and a failed stats send is
+// not retried: its counts are lost. Dry runs send no stats.
+
+// PipelineStats is the pipeline_stats block.
+type PipelineStats struct {
+	every time.Duration
+	last  map[string]int64
+}
+
+const maxLatencySamples = 4096
+
+// ParsePipelineStats reads pipeline_stats (a bool or a block).
+func ParsePipelineStats(v interface{}) (*PipelineStats, error) {
+	s := &PipelineStats{every: time.Minute}
+	switch v := v.(type) {
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		if n, ok := v["interval_s"].(float64); ok {
+			if s.every = time.Duration(n * float64(time.Second)); s.every < time.Second {
+				return nil, fmt.Errorf("interval_s must be at least 1")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("must be true, false or a block, not %v", v)
+	}
+	return s, nil
+}
+
+// StartPipelineStats sends the stats events of c.
+func StartPipelineStats(c *Config) {
+	if c.Stats == nil || c.DryRun {
+		return
+	}
+	go func() {
+		t := time.NewTicker(c.Stats.every)
+		defer t.Stop()
+		for range t.C {
+			c.Stats.tick(c)
+		}
+	}()
+}
+
+// tick sends one stats event; a panic loses that event, not the later ones.
+func (s *PipelineStats) tick(c *Config) {
+	defer Recover("pipeline stats", nil)
+	if c.ctl == nil { // no handler yet
+		return
+	}
+	body, _ := json.Marshal(s.snapshot(c.ctl))
+	if err := sendSynthetic(c, "pipeline_stats", body); err != nil {
+		vdbg(c, "pipeline stats not sent:", err)
+	}
+}
+
+func (s *PipelineStats) snapshot(ctl *control) map[string]interface{} {
+	counts := map[string]int64{"requests": ctl.requests.Load(), "sent": ctl.sent.Load(),
+		"failed": ctl.failed.Load(), "dropped": ctl.dropped.Load()}
+	out := map[string]interface{}{"interval_s": s.every.Seconds(), "in_flight": ctl.inflight.Load(),
+		"pending_bytes": pendingBytes.Load()}
+	for k, n := range counts {
+		out[k] = n - s.last[k]
+	}
+	s.last = counts
+	if ctl.c.Queue != nil {
+		out["queued"] = ctl.c.Queue.length()
+	}
+	if ctl.c.Health != nil {
+		out["sink_health"] = ctl.c.Health.state()
+	}
+	if p95, ok := ctl.p95(); ok {
+		out["sink_p95_ms"] = float64(p95.Microseconds()) / 1000
+	}
+	return out
+}
+
+// observe records the time of one send for the stats event; past
+// maxLatencySamples a random sample is replaced.
+func (ctl *control) observe(d time.Duration) {
+	if ctl.c.Stats == nil {
+		return
+	}
+	ctl.latMu.Lock()
+	defer ctl.latMu.Unlock()
+	ctl.seen++
+	if len(ctl.latency) < maxLatencySamples {
+		ctl.latency = append(ctl.latency, d)
+	} else if i := rand.IntN(ctl.seen); i < maxLatencySamples {
+		ctl.latency[i] = d
+	}
+}
+
+// p95 takes the recorded send times and returns their 95th percentile.
+func (ctl *control) p95() (time.Duration, bool) {
+	ctl.latMu.Lock()
+	l := ctl.latency
+	ctl.latency, ctl.seen = nil, 0
+	ctl.latMu.Unlock()
+	if len(l) == 0 {
+		return 0, false
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return l[(len(l)*95+99)/100-1], true
+}
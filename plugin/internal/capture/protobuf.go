@@ -0,0 +1,530 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* ───────── protobuf body decoding ───────── */
+
+// Protobuf request / response bodies are decoded to JSON (protojson style:
+// camelCase names, 64-bit integers as strings, enums by name, bytes as
+// base64) from a compiled FileDescriptorSet, so captures are readable instead
+// of opaque binary. Message types are set per backend; gRPC bodies are
+// unframed first (the first message of the stream is decoded).
+//
+//	"protobuf": {
+//	  "descriptor_set": "/etc/krakend/api.pb",   // protoc --include_imports -o api.pb …
+//	  "request_type":   "acme.v1.CreateOrderRequest",
+//	  "response_type":  "acme.v1.Order"
+//	}
+//
+// Bodies that do not decode (clipped, wrong type, compressed gRPC frames) are
+// kept as captured.
+
+// Protobuf holds the message types bodies are decoded as.
+type Protobuf struct {
+	req, resp *protoMessage
+}
+
+type protoMessage struct {
+	name     string
+	fields   map[uint64]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string // JSON name
+	number   uint64
+	repeated bool
+	kind     uint64 // FieldDescriptorProto.Type
+	typeName string
+	message  *protoMessage
+	enum     map[int64]string
+}
+
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMsg      = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+var protoSets sync.Map // descriptor_set path → map[string]*protoMessage
+
+// ParseProtobuf reads the protobuf block and loads its descriptor set.
+func ParseProtobuf(opts map[string]interface{}) (*Protobuf, error) {
+	path, _ := opts["descriptor_set"].(string)
+	if path == "" {
+		return nil, errors.New("descriptor_set is required")
+	}
+	msgs, err := loadDescriptorSet(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &Protobuf{}
+	for key, dst := range map[string]**protoMessage{"request_type": &o.req, "response_type": &o.resp} {
+		name, _ := opts[key].(string)
+		if name == "" {
+			continue
+		}
+		m, ok := msgs[strings.TrimPrefix(name, ".")]
+		if !ok {
+			return nil, fmt.Errorf("%s: no message %s in %s", key, name, path)
+		}
+		*dst = m
+	}
+	return o, nil
+}
+
+func applyProtobuf(o *Protobuf, ev *Event) {
+	if o.req != nil {
+		if b, ok := o.decodeBody(o.req, ev.ReqHeader.Get("Content-Type"), ev.ReqBody); ok {
+			ev.ReqBody = b
+			ev.Meta.Set("protobuf.request_type", o.req.name)
+		}
+	}
+	if o.resp != nil {
+		if b, ok := o.decodeBody(o.resp, ev.RespHeader.Get("Content-Type"), ev.RespBody); ok {
+			ev.RespBody = b
+			ev.Meta.Set("protobuf.response_type", o.resp.name)
+		}
+	}
+}
+
+func (o *Protobuf) decodeBody(m *protoMessage, ct string, body []byte) ([]byte, bool) {
+	if len(body) == 0 || strings.Contains(ct, "json") {
+		return nil, false
+	}
+	if strings.HasPrefix(ct, "application/grpc") {
+		// 1 byte compressed flag, 4 bytes length, message
+		if len(body) < 5 || body[0] != 0 {
+			return nil, false
+		}
+		n := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(n) {
+			return nil, false
+		}
+		body = body[5 : 5+n]
+	}
+	v, err := m.decode(body)
+	if err != nil {
+		return nil, false
+	}
+	out, err := json.Marshal(v)
+	return out, err == nil
+}
+
+/* ───────── wire format ───────── */
+
+type protoReader struct {
+	b []byte
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errors.New("protobuf: bad varint")
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *protoReader) fixed(n int) (uint64, error) {
+	if len(r.b) < n {
+		return 0, errors.New("protobuf: truncated")
+	}
+	var v uint64
+	if n == 4 {
+		v = uint64(binary.LittleEndian.Uint32(r.b))
+	} else {
+		v = binary.LittleEndian.Uint64(r.b)
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.b)) < n {
+		return nil, errors.New("protobuf: truncated")
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// next reads one field: its number, wire type and raw value (varint or
+// fixed value in v, length-delimited payload in b).
+func (r *protoReader) next() (num uint64, wt int, v uint64, b []byte, err error) {
+	key, err := r.varint()
+	if err != nil {
+		return
+	}
+	num, wt = key>>3, int(key&7)
+	switch wt {
+	case 0:
+		v, err = r.varint()
+	case 1:
+		v, err = r.fixed(8)
+	case 2:
+		b, err = r.bytes()
+	case 5:
+		v, err = r.fixed(4)
+	default:
+		err = fmt.Errorf("protobuf: unsupported wire type %d", wt)
+	}
+	return
+}
+
+func (m *protoMessage) decode(b []byte) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, wt, v, raw, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		f := m.fields[num]
+		if f == nil {
+			continue // unknown field
+		}
+		var vals []interface{}
+		if wt == 2 && f.kind != protoString && f.kind != protoBytes && f.kind != protoMsg {
+			// packed repeated scalars
+			pr := &protoReader{b: raw}
+			for len(pr.b) > 0 {
+				var x uint64
+				switch f.kind {
+				case protoDouble, protoFixed64, protoSfixed64:
+					x, err = pr.fixed(8)
+				case protoFloat, protoFixed32, protoSfixed32:
+					x, err = pr.fixed(4)
+				default:
+					x, err = pr.varint()
+				}
+				if err != nil {
+					return nil, err
+				}
+				vals = append(vals, f.scalar(x))
+			}
+		} else {
+			val, err := f.value(v, raw)
+			if err != nil {
+				return nil, err
+			}
+			vals = []interface{}{val}
+		}
+
+		switch {
+		case f.message != nil && f.message.mapEntry:
+			mm, _ := out[f.name].(map[string]interface{})
+			if mm == nil {
+				mm = map[string]interface{}{}
+				out[f.name] = mm
+			}
+			k, v := f.message.fields[1], f.message.fields[2]
+			if e, ok := vals[0].(map[string]interface{}); ok && k != nil && v != nil {
+				mm[fmt.Sprint(e[k.name])] = e[v.name]
+			}
+		case f.repeated:
+			l, _ := out[f.name].([]interface{})
+			out[f.name] = append(l, vals...)
+		default:
+			out[f.name] = vals[len(vals)-1]
+		}
+	}
+	return out, nil
+}
+
+func (f *protoField) value(v uint64, raw []byte) (interface{}, error) {
+	switch f.kind {
+	case protoString:
+		return string(raw), nil
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(raw), nil
+	case protoMsg:
+		if f.message == nil {
+			return nil, fmt.Errorf("protobuf: unresolved type %s", f.typeName)
+		}
+		return f.message.decode(raw)
+	case protoGroup:
+		return nil, errors.New("protobuf: groups are not supported")
+	}
+	return f.scalar(v), nil
+}
+
+func (f *protoField) scalar(v uint64) interface{} {
+	switch f.kind {
+	case protoDouble:
+		return protoFloatJSON(math.Float64frombits(v))
+	case protoFloat:
+		return protoFloatJSON(float64(math.Float32frombits(uint32(v))))
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(v), 10)
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(v, 10)
+	case protoSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10)
+	case protoInt32, protoSfixed32:
+		return int32(v)
+	case protoSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1)
+	case protoUint32, protoFixed32:
+		return uint32(v)
+	case protoBool:
+		return v != 0
+	case protoEnum:
+		if name, ok := f.enum[int64(int32(v))]; ok {
+			return name
+		}
+		return int32(v)
+	}
+	return v
+}
+
+// protoFloatJSON keeps NaN and infinities representable, as protojson does.
+func protoFloatJSON(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+/* ───────── descriptor sets ───────── */
+
+func loadDescriptorSet(path string) (map[string]*protoMessage, error) {
+	if v, ok := protoSets.Load(path); ok {
+		return v.(map[string]*protoMessage), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	msgs := map[string]*protoMessage{}
+	enums := map[string]map[int64]string{}
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, _, _, file, err := r.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if num == 1 { // FileDescriptorSet.file
+			if err := readFileDescriptor(file, msgs, enums); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	for _, m := range msgs {
+		for _, f := range m.fields {
+			name := strings.TrimPrefix(f.typeName, ".")
+			switch f.kind {
+			case protoMsg:
+				f.message = msgs[name]
+			case protoEnum:
+				f.enum = enums[name]
+			}
+		}
+	}
+	protoSets.Store(path, msgs)
+	return msgs, nil
+}
+
+func readFileDescriptor(b []byte, msgs map[string]*protoMessage, enums map[string]map[int64]string) error {
+	var pkg string
+	var types, enumTypes [][]byte
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, _, _, raw, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 2:
+			pkg = string(raw)
+		case 4:
+			types = append(types, raw)
+		case 5:
+			enumTypes = append(enumTypes, raw)
+		}
+	}
+	prefix := ""
+	if pkg != "" {
+		prefix = pkg + "."
+	}
+	for _, e := range enumTypes {
+		if err := readEnum(e, prefix, enums); err != nil {
+			return err
+		}
+	}
+	for _, t := range types {
+		if err := readMessage(t, prefix, msgs, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMessage(b []byte, prefix string, msgs map[string]*protoMessage, enums map[string]map[int64]string) error {
+	m := &protoMessage{fields: map[uint64]*protoField{}}
+	var nested, nestedEnums [][]byte
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, _, _, raw, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			m.name = prefix + string(raw)
+		case 2:
+			f, err := readField(raw)
+			if err != nil {
+				return err
+			}
+			m.fields[f.number] = f
+		case 3:
+			nested = append(nested, raw)
+		case 4:
+			nestedEnums = append(nestedEnums, raw)
+		case 7: // MessageOptions
+			or := &protoReader{b: raw}
+			for len(or.b) > 0 {
+				n, _, v, _, err := or.next()
+				if err != nil {
+					return err
+				}
+				if n == 7 {
+					m.mapEntry = v != 0
+				}
+			}
+		}
+	}
+	msgs[m.name] = m
+	for _, e := range nestedEnums {
+		if err := readEnum(e, m.name+".", enums); err != nil {
+			return err
+		}
+	}
+	for _, t := range nested {
+		if err := readMessage(t, m.name+".", msgs, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readField(b []byte) (*protoField, error) {
+	f := &protoField{}
+	var name string
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, _, v, raw, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch num {
+		case 1:
+			name = string(raw)
+		case 3:
+			f.number = v
+		case 4:
+			f.repeated = v == 3 // LABEL_REPEATED
+		case 5:
+			f.kind = v
+		case 6:
+			f.typeName = string(raw)
+		case 10:
+			f.name = string(raw)
+		}
+	}
+	if f.name == "" {
+		f.name = protoJSONName(name)
+	}
+	return f, nil
+}
+
+func readEnum(b []byte, prefix string, enums map[string]map[int64]string) error {
+	var name string
+	values := map[int64]string{}
+	r := &protoReader{b: b}
+	for len(r.b) > 0 {
+		num, _, _, raw, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			name = string(raw)
+		case 2:
+			var vname string
+			var vnum int64
+			vr := &protoReader{b: raw}
+			for len(vr.b) > 0 {
+				n, _, v, vraw, err := vr.next()
+				if err != nil {
+					return err
+				}
+				switch n {
+				case 1:
+					vname = string(vraw)
+				case 2:
+					vnum = int64(int32(v))
+				}
+			}
+			values[vnum] = vname
+		}
+	}
+	enums[prefix+name] = values
+	return nil
+}
+
+// protoJSONName converts snake_case like protoc does for json_name.
+func protoJSONName(s string) string {
+	var b bytes.Buffer
+	up := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' {
+			up = true
+			continue
+		}
+		if up && c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		up = false
+		b.WriteByte(c)
+	}
+	return b.String()
+}
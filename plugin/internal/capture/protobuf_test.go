@@ -0,0 +1,181 @@
+package capture
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pbField(name string, number, label, kind uint64, typeName string) []byte {
+	var f protoWriter
+	f.str(1, name)
+	f.uint(3, number)
+	f.uint(4, label)
+	f.uint(5, kind)
+	f.str(6, typeName)
+	return f.Bytes()
+}
+
+// writeDescriptorSet writes what protoc -o produces for
+//
+//	package acme.v1;
+//	enum Status { PENDING = 0; SHIPPED = 1; }
+//	message Item { string sku = 1; }
+//	message Order {
+//	  string order_id = 1; int64 total_cents = 2; repeated int32 qty = 3;
+//	  Status status = 4; map<string, string> labels = 5; Item item = 6;
+//	  bytes blob = 7; sint32 delta = 8; double ratio = 9;
+//	}
+func writeDescriptorSet(t *testing.T) string {
+	t.Helper()
+	var status protoWriter
+	status.str(1, "Status")
+	for i, v := range []string{"PENDING", "SHIPPED"} {
+		var ev protoWriter
+		ev.str(1, v)
+		ev.uint(2, uint64(i))
+		status.message(2, ev.Bytes())
+	}
+
+	var item protoWriter
+	item.str(1, "Item")
+	item.message(2, pbField("sku", 1, 1, protoString, ""))
+
+	var entry, entryOpts protoWriter
+	entry.str(1, "LabelsEntry")
+	entry.message(2, pbField("key", 1, 1, protoString, ""))
+	entry.message(2, pbField("value", 2, 1, protoString, ""))
+	entryOpts.uint(7, 1) // map_entry
+	entry.message(7, entryOpts.Bytes())
+
+	var order protoWriter
+	order.str(1, "Order")
+	for _, f := range [][]byte{
+		pbField("order_id", 1, 1, protoString, ""),
+		pbField("total_cents", 2, 1, protoInt64, ""),
+		pbField("qty", 3, 3, protoInt32, ""),
+		pbField("status", 4, 1, protoEnum, ".acme.v1.Status"),
+		pbField("labels", 5, 3, protoMsg, ".acme.v1.Order.LabelsEntry"),
+		pbField("item", 6, 1, protoMsg, ".acme.v1.Item"),
+		pbField("blob", 7, 1, protoBytes, ""),
+		pbField("delta", 8, 1, protoSint32, ""),
+		pbField("ratio", 9, 1, protoDouble, ""),
+	} {
+		order.message(2, f)
+	}
+	order.message(3, entry.Bytes())
+
+	var file, set protoWriter
+	file.str(1, "acme/v1/order.proto")
+	file.str(2, "acme.v1")
+	file.message(4, item.Bytes())
+	file.message(4, order.Bytes())
+	file.message(5, status.Bytes())
+	set.message(1, file.Bytes())
+
+	path := filepath.Join(t.TempDir(), "api.pb")
+	if err := os.WriteFile(path, set.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func orderMessage() []byte {
+	var m, it, lbl, qty protoWriter
+	m.str(1, "o-7")
+	m.uint(2, 1234)
+	for _, q := range []uint64{1, 2, 3} {
+		qty.Write(binary.AppendUvarint(nil, q))
+	}
+	m.message(3, qty.Bytes()) // packed
+	m.uint(4, 1)
+	lbl.str(1, "env")
+	lbl.str(2, "prod")
+	m.message(5, lbl.Bytes())
+	it.str(1, "A-1")
+	m.message(6, it.Bytes())
+	m.bytes(7, []byte{1, 2})
+	m.uint(8, 5) // zigzag -3
+	m.tag(9, 1)
+	m.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(0.5)))
+	m.uint(99, 7) // unknown, skipped
+	return m.Bytes()
+}
+
+const orderJSON = `{"blob":"AQI=","delta":-3,"item":{"sku":"A-1"},"labels":{"env":"prod"},` +
+	`"orderId":"o-7","qty":[1,2,3],"ratio":0.5,"status":"SHIPPED","totalCents":"1234"}`
+
+func TestProtobufDecodesWithTheDescriptorSet(t *testing.T) {
+	o, err := ParseProtobuf(map[string]interface{}{
+		"descriptor_set": writeDescriptorSet(t),
+		"request_type":   "acme.v1.Order",
+		"response_type":  ".acme.v1.Item",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := orderMessage()
+	framed := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	framed = append(framed, msg...)
+
+	for _, tc := range []struct {
+		name, ct string
+		body     []byte
+		want     string
+	}{
+		{"plain", "application/x-protobuf", msg, orderJSON},
+		{"grpc frame", "application/grpc", framed, orderJSON},
+		{"grpc stream keeps the first message", "application/grpc+proto", append(framed, framed...), orderJSON},
+		{"json is left alone", "application/json", []byte(`{"a":1}`), ""},
+		{"compressed frame", "application/grpc", append([]byte{1}, framed[1:]...), ""},
+		{"short frame", "application/grpc", framed[:len(framed)-1], ""},
+		{"clipped message", "application/x-protobuf", msg[:len(msg)-5], ""},
+	} {
+		out, ok := o.decodeBody(o.req, tc.ct, tc.body)
+		if string(out) != tc.want || ok != (tc.want != "") {
+			t.Errorf("%s: got %s, %v; want %s", tc.name, out, ok, tc.want)
+		}
+	}
+
+	ev := &Event{Meta: url.Values{}, ReqHeader: http.Header{"Content-Type": {"application/x-protobuf"}}, ReqBody: msg,
+		RespHeader: http.Header{"Content-Type": {"application/x-protobuf"}}, RespBody: []byte{0x0a, 0x03, 'B', '-', '2'}}
+	applyProtobuf(o, ev)
+	if string(ev.ReqBody) != orderJSON || ev.Meta.Get("protobuf.request_type") != "acme.v1.Order" {
+		t.Errorf("request: %s, %q", ev.ReqBody, ev.Meta.Get("protobuf.request_type"))
+	}
+	if string(ev.RespBody) != `{"sku":"B-2"}` || ev.Meta.Get("protobuf.response_type") != "acme.v1.Item" {
+		t.Errorf("response: %s, %q", ev.RespBody, ev.Meta.Get("protobuf.response_type"))
+	}
+}
+
+func TestParseProtobufErrors(t *testing.T) {
+	path := writeDescriptorSet(t)
+	bad := filepath.Join(t.TempDir(), "bad.pb")
+	os.WriteFile(bad, []byte{0x0a, 0x05, 0x01}, 0o644)
+	for _, tc := range []struct {
+		opts map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{}, "descriptor_set is required"},
+		{map[string]interface{}{"descriptor_set": filepath.Join(t.TempDir(), "none.pb")}, "no such file"},
+		{map[string]interface{}{"descriptor_set": bad}, "bad.pb"},
+		{map[string]interface{}{"descriptor_set": path, "request_type": "acme.v1.Cart"}, "request_type: no message acme.v1.Cart"},
+	} {
+		if _, err := ParseProtobuf(tc.opts); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: err = %v, want %q", tc.opts, err, tc.want)
+		}
+	}
+}
+
+func TestProtoJSONName(t *testing.T) {
+	for in, want := range map[string]string{"order_id": "orderId", "total": "total", "a_b_c": "aBC", "x__y": "xY", "v_1": "v1"} {
+		if got := protoJSONName(in); got != want {
+			t.Errorf("protoJSONName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── delivery queue ───────── */
+
+// queue puts a bound on the sends in flight: encoded events wait in a queue
+// of size events and a fixed pool of workers delivers them, instead of one
+// send per request.
+//
+//	"queue": {"size": 10000, "workers": 8}
+//
+// The queue has two tiers. Error events (5xx responses, events without a
+// status) are always delivered before the others. When the queue is full, a
+// new error event pushes out the oldest ordinary event and a new ordinary
+// event is dropped, so backpressure costs the least useful captures first;
+// overflow (overflow.go) picks another policy. Drops are logged at most once
+// a minute. Without the block every request sends on its own, as before.
+//
+// With the block policy the handler waits for space before returning, so the
+// client sees the end of the response after the wait, as with delivery_mode
+// sync.
+
+// Queue is a backend's delivery queue; workers start with the first event.
+type Queue struct {
+	size, workers int
+
+	once      sync.Once
+	mu        sync.Mutex
+	ready     *sync.Cond
+	space     *sync.Cond // signalled when an event leaves the queue
+	high, low []queued
+
+	droppedHigh, droppedLow int64 // since the last warning
+	warned                  time.Time
+}
+
+type queued struct {
+	ev      *Event
+	payload []byte
+}
+
+// ParseQueue reads the queue block.
+func ParseQueue(v map[string]interface{}) (*Queue, error) {
+	q := &Queue{size: 10000, workers: 8}
+	if n, ok := v["size"].(float64); ok {
+		if q.size = int(n); q.size < 1 {
+			return nil, fmt.Errorf("size must be at least 1")
+		}
+	}
+	if n, ok := v["workers"].(float64); ok {
+		if q.workers = int(n); q.workers < 1 {
+			return nil, fmt.Errorf("workers must be at least 1")
+		}
+	}
+	q.ready = sync.NewCond(&q.mu)
+	q.space = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// urgent reports whether ev belongs in the error tier; request phase events
+// (split_phases) have no status yet.
+func urgent(ev *Event) bool {
+	if ev.Status == 0 {
+		return ev.Meta.Get("phase") != "request"
+	}
+	return ev.Status >= 500
+}
+
+func (q *Queue) push(c *Config, ev *Event, payload []byte) {
+	q.once.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go q.work(c)
+		}
+	})
+	policy, limit := c.Overflow.Policy(), q.size
+	if policy == "metadata" && ev.Meta.Get("capture") == "metadata_only" {
+		limit += q.size
+	}
+	it := queued{ev: ev, payload: payload}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if wait := c.Overflow.blockFor(c); wait > 0 && len(q.high)+len(q.low) >= limit {
+		q.waitLocked(wait, limit)
+	}
+	if len(q.high)+len(q.low) >= limit {
+		switch {
+		case len(q.low) > 0 && (urgent(ev) || policy == "drop_oldest"):
+			q.dropLocked(c, &q.low, &q.droppedLow)
+		case len(q.high) > 0 && urgent(ev):
+			q.dropLocked(c, &q.high, &q.droppedHigh)
+		default:
+			q.droppedLow++
+			release(ev)
+			countDropped(c)
+			q.warnLocked()
+			vdbg(c, "queue full, event dropped")
+			return
+		}
+		vdbg(c, "queue full, oldest event dropped")
+	}
+	if urgent(ev) {
+		q.high = append(q.high, it)
+	} else {
+		q.low = append(q.low, it)
+	}
+	q.ready.Signal()
+}
+
+// dropLocked drops the oldest event of tier; the caller holds mu.
+func (q *Queue) dropLocked(c *Config, tier *[]queued, dropped *int64) {
+	release((*tier)[0].ev)
+	*tier = (*tier)[1:]
+	*dropped++
+	countDropped(c)
+	q.warnLocked()
+}
+
+// shed drops the oldest queued events, ordinary ones first, until the
+// pending events are under the budget of c, and reports whether they are.
+func (q *Queue) shed(c *Config) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for pendingBytes.Load() >= c.MaxPending {
+		switch {
+		case len(q.low) > 0:
+			q.dropLocked(c, &q.low, &q.droppedLow)
+		case len(q.high) > 0:
+			q.dropLocked(c, &q.high, &q.droppedHigh)
+		default:
+			return false
+		}
+	}
+	q.space.Broadcast()
+	return true
+}
+
+// waitLocked waits up to d for the queue to hold fewer than limit events;
+// the caller holds mu.
+func (q *Queue) waitLocked(d time.Duration, limit int) {
+	deadline := time.Now().Add(d)
+	t := time.AfterFunc(d, func() {
+		q.mu.Lock()
+		q.space.Broadcast()
+		q.mu.Unlock()
+	})
+	defer t.Stop()
+	for len(q.high)+len(q.low) >= limit && time.Now().Before(deadline) {
+		q.space.Wait()
+	}
+}
+
+// warnLocked logs the drops once a minute; the caller holds mu.
+func (q *Queue) warnLocked() {
+	if time.Since(q.warned) < time.Minute {
+		return
+	}
+	logger.Warning(tag, "delivery queue full: dropped", q.droppedHigh, "error and",
+		q.droppedLow, "other events")
+	q.droppedHigh, q.droppedLow, q.warned = 0, 0, time.Now()
+}
+
+// full reports whether q holds size events or more; a nil queue never is.
+func (q *Queue) full() bool {
+	return q != nil && q.length() >= q.size
+}
+
+func (q *Queue) length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.high) + len(q.low)
+}
+
+// flush takes every queued event, error events first, and delivers them on
+// as many goroutines as the queue has workers; events still waiting when
+// ctx ends are given up. It returns once all are done, with the number sent
+// and the number failed or given up.
+func (q *Queue) flush(ctx context.Context, c *Config) (sent, lost int) {
+	q.mu.Lock()
+	items := append(q.high, q.low...)
+	q.high, q.low = nil, nil
+	q.space.Broadcast()
+	q.mu.Unlock()
+	ch := make(chan queued)
+	var ok atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < min(q.workers, len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range ch {
+				if ctx.Err() != nil {
+					release(it.ev)
+				} else if q.deliver(ctx, c, it) == nil {
+					ok.Add(1)
+				}
+			}
+		}()
+	}
+	for _, it := range items {
+		ch <- it
+	}
+	close(ch)
+	wg.Wait()
+	return int(ok.Load()), len(items) - int(ok.Load())
+}
+
+func (q *Queue) pop() queued {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.high) == 0 && len(q.low) == 0 {
+		q.ready.Wait()
+	}
+	var it queued
+	if len(q.high) > 0 {
+		it, q.high = q.high[0], q.high[1:]
+	} else {
+		it, q.low = q.low[0], q.low[1:]
+	}
+	q.space.Signal()
+	return it
+}
+
+func (q *Queue) work(c *Config) {
+	for {
+		q.deliver(context.Background(), c, q.pop())
+	}
+}
+
+// deliver sends one queued event, at the latest by the deadline of bound; a
+// panic costs the event, not the worker.
+func (q *Queue) deliver(bound context.Context, c *Config, it queued) error {
+	defer recoverEvent(c, it.ev, "queue worker")
+	defer release(it.ev)
+	ctx, cancel := context.WithTimeout(it.ev.detached(), c.Timeout)
+	defer cancel()
+	if dl, ok := bound.Deadline(); ok {
+		var stop context.CancelFunc
+		ctx, stop = context.WithDeadline(ctx, dl)
+		defer stop()
+	}
+	return deliver(ctx, c, it.ev, it.payload)
+}
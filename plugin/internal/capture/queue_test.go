@@ -0,0 +1,137 @@
+package capture
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleQueue is a queue whose workers never start, so the tests see what
+// push leaves in it.
+func idleQueue(t *testing.T, size int) *Queue {
+	t.Helper()
+	q, err := ParseQueue(map[string]interface{}{"size": float64(size)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.once.Do(func() {})
+	q.warned = time.Now()
+	return q
+}
+
+func queueEvent(name string, status int) *Event {
+	return &Event{Status: status, Meta: url.Values{"seq": {name}}}
+}
+
+// contents lists the queue in delivery order, error tier first.
+func (q *Queue) contents() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var names []string
+	for _, it := range append(append([]queued(nil), q.high...), q.low...) {
+		names = append(names, it.ev.Meta.Get("seq"))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestQueueTiers(t *testing.T) {
+	q := idleQueue(t, 3)
+	c := &Config{}
+	for _, step := range []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{"a", 200, "a"},
+		{"b", 404, "a b"},
+		{"X", 503, "X a b"},
+		{"c", 200, "X a b"}, // full: the new ordinary event is dropped
+		{"Y", 500, "X Y b"}, // an error event pushes out the oldest ordinary one
+		{"Z", 0, "X Y Z"},   // no status counts as an error
+		{"W", 502, "Y Z W"}, // only errors left: the oldest goes
+	} {
+		q.push(c, queueEvent(step.name, step.status), nil)
+		if got := q.contents(); got != step.want {
+			t.Fatalf("after %s: %q, want %q", step.name, got, step.want)
+		}
+	}
+	if it := q.pop(); it.ev.Meta.Get("seq") != "Y" || q.length() != 2 {
+		t.Errorf("pop = %s, length %d", it.ev.Meta.Get("seq"), q.length())
+	}
+}
+
+func TestQueueOverflowPolicies(t *testing.T) {
+	oldest, _ := ParseOverflow(map[string]interface{}{"policy": "drop_oldest"})
+	q := idleQueue(t, 2)
+	for _, n := range []string{"a", "b", "c"} {
+		q.push(&Config{Overflow: oldest}, queueEvent(n, 200), nil)
+	}
+	if got := q.contents(); got != "b c" {
+		t.Errorf("drop_oldest: %q, want b c", got)
+	}
+
+	meta, _ := ParseOverflow(map[string]interface{}{"policy": "metadata"})
+	q = idleQueue(t, 1)
+	stripped := queueEvent("b", 200)
+	stripped.Meta.Set("capture", "metadata_only")
+	for _, ev := range []*Event{queueEvent("a", 200), stripped, queueEvent("c", 200)} {
+		q.push(&Config{Overflow: meta}, ev, nil)
+	}
+	if got := q.contents(); got != "a b" {
+		t.Errorf("metadata: %q, want a b", got)
+	}
+
+	block, _ := ParseOverflow(map[string]interface{}{"policy": "block", "block_ms": float64(50)})
+	c := &Config{Overflow: block}
+	q = idleQueue(t, 1)
+	q.push(c, queueEvent("a", 200), nil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.pop()
+	}()
+	q.push(c, queueEvent("b", 200), nil)
+	if got := q.contents(); got != "b" {
+		t.Errorf("block with space freed: %q, want b", got)
+	}
+	start := time.Now()
+	q.push(c, queueEvent("c", 200), nil)
+	if got, waited := q.contents(), time.Since(start); got != "b" || waited < 50*time.Millisecond {
+		t.Errorf("block without space: %q after %s, want b after 50ms", got, waited)
+	}
+}
+
+func TestUrgent(t *testing.T) {
+	request := queueEvent("r", 0)
+	request.Meta.Set("phase", "request")
+	for _, tc := range []struct {
+		ev   *Event
+		want bool
+	}{
+		{queueEvent("a", 200), false},
+		{queueEvent("b", 499), false},
+		{queueEvent("c", 500), true},
+		{queueEvent("d", 0), true},
+		{request, false},
+	} {
+		if got := urgent(tc.ev); got != tc.want {
+			t.Errorf("urgent(status %d, phase %q) = %v", tc.ev.Status, tc.ev.Meta.Get("phase"), got)
+		}
+	}
+}
+
+func TestParseQueue(t *testing.T) {
+	q, err := ParseQueue(map[string]interface{}{})
+	if err != nil || q.size != 10000 || q.workers != 8 {
+		t.Errorf("defaults: %+v, %v", q, err)
+	}
+	var none *Queue
+	if none.full() {
+		t.Error("a nil queue is full")
+	}
+	for _, v := range []map[string]interface{}{{"size": float64(0)}, {"workers": float64(-1)}} {
+		if _, err := ParseQueue(v); err == nil {
+			t.Errorf("%v accepted", v)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package capture
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* ───────── per-tenant limits ───────── */
+
+// tenant.limits caps what each tenant may put into the tracking pipeline: a
+// token bucket on the event rate and daily (UTC) quotas on events and payload
+// volume, with per-tenant overrides:
+//
+//	"tenant": {
+//	  "header": "X-Tenant-Id",
+//	  "limits": {
+//	    "events_per_sec": 20, "burst": 40,
+//	    "daily_events": 500000, "daily_mb": 2048,
+//	    "per_tenant": {"acme": {"events_per_sec": 100, "daily_mb": 10240}}
+//	  }
+//	}
+//
+// Each backend has its own budget. Events without a tenant share the ""
+// budget. Rate limiting happens before the pipeline runs, quotas once the
+// payload size is known; dropped events are counted per tenant and listed per
+// backend on the admin server under /debug/tenants.
+
+type limit struct {
+	rate   float64 // events per second, 0 = unlimited
+	burst  float64
+	events int64 // per day, 0 = unlimited
+	bytes  int64
+}
+
+type tenantUsage struct {
+	tokens float64
+	last   time.Time
+
+	day                       string
+	events, bytes             int64
+	droppedRate, droppedQuota int64  // since start
+	warned                    string // day the quota warning was logged
+}
+
+// TenantLimits is the limiter of one backend.
+type TenantLimits struct {
+	def       limit
+	perTenant map[string]limit
+
+	mu    sync.Mutex
+	usage map[string]*tenantUsage
+}
+
+func init() {
+	adminMux.HandleFunc("GET /debug/tenants", func(w http.ResponseWriter, _ *http.Request) {
+		out := []map[string]interface{}{}
+		for _, ctl := range registered() {
+			if ctl.c.TenantLimits != nil {
+				d := ctl.describe()
+				d["tenants"] = ctl.c.TenantLimits.snapshot()
+				out = append(out, d)
+			}
+		}
+		WriteJSON(w, map[string]interface{}{"backends": out})
+	})
+}
+
+// ParseTenantLimits reads tenant.limits.
+func ParseTenantLimits(v map[string]interface{}) (*TenantLimits, error) {
+	def, err := parseLimit(v)
+	if err != nil {
+		return nil, err
+	}
+	l := &TenantLimits{def: def, perTenant: map[string]limit{}, usage: map[string]*tenantUsage{}}
+	per, _ := v["per_tenant"].(map[string]interface{})
+	for tenant, o := range per {
+		m, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("per_tenant %q must be an object", tenant)
+		}
+		// overrides inherit what they do not set
+		merged := map[string]interface{}{}
+		for k, x := range v {
+			merged[k] = x
+		}
+		for k, x := range m {
+			merged[k] = x
+		}
+		if l.perTenant[tenant], err = parseLimit(merged); err != nil {
+			return nil, fmt.Errorf("per_tenant %q: %w", tenant, err)
+		}
+	}
+	return l, nil
+}
+
+func parseLimit(v map[string]interface{}) (limit, error) {
+	var l limit
+	num := func(k string) (float64, error) {
+		x, _ := v[k].(float64)
+		if x < 0 {
+			return 0, fmt.Errorf("%s must not be negative", k)
+		}
+		return x, nil
+	}
+	var err error
+	var mb, events float64
+	if l.rate, err = num("events_per_sec"); err != nil {
+		return l, err
+	}
+	if l.burst, err = num("burst"); err != nil {
+		return l, err
+	}
+	if events, err = num("daily_events"); err != nil {
+		return l, err
+	}
+	if mb, err = num("daily_mb"); err != nil {
+		return l, err
+	}
+	l.events, l.bytes = int64(events), int64(mb*(1<<20))
+	if l.burst < l.rate {
+		l.burst = max(l.rate, 1)
+	}
+	return l, nil
+}
+
+func (l *TenantLimits) limitOf(tenant string) limit {
+	if o, ok := l.perTenant[tenant]; ok {
+		return o
+	}
+	return l.def
+}
+
+// usageOf returns tenant's usage, rolled over at UTC midnight; the caller
+// holds mu.
+func (l *TenantLimits) usageOf(tenant string, now time.Time) *tenantUsage {
+	u := l.usage[tenant]
+	if u == nil {
+		u = &tenantUsage{tokens: l.limitOf(tenant).burst, last: now}
+		l.usage[tenant] = u
+	}
+	if day := now.UTC().Format(time.DateOnly); u.day != day {
+		u.day, u.events, u.bytes = day, 0, 0
+	}
+	return u
+}
+
+// allow takes a token from tenant's bucket.
+func (l *TenantLimits) allow(tenant string) bool {
+	lim := l.limitOf(tenant)
+	if lim.rate == 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usageOf(tenant, now)
+	u.tokens = min(lim.burst, u.tokens+now.Sub(u.last).Seconds()*lim.rate)
+	u.last = now
+	if u.tokens < 1 {
+		u.droppedRate++
+		return false
+	}
+	u.tokens--
+	return true
+}
+
+// take books one event of size bytes against tenant's daily quotas.
+func (l *TenantLimits) take(tenant string, size int) bool {
+	lim := l.limitOf(tenant)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usageOf(tenant, time.Now())
+	if (lim.events > 0 && u.events >= lim.events) || (lim.bytes > 0 && u.bytes+int64(size) > lim.bytes) {
+		if u.warned != u.day {
+			logger.Warning(tag, "tenant", fmt.Sprintf("%q", tenant), "reached its daily quota, events are dropped")
+		}
+		u.warned = u.day
+		u.droppedQuota++
+		return false
+	}
+	u.events++
+	u.bytes += int64(size)
+	return true
+}
+
+func (l *TenantLimits) snapshot() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]interface{}, len(l.usage))
+	for t, u := range l.usage {
+		out[t] = map[string]interface{}{
+			"day": u.day, "events_today": u.events, "bytes_today": u.bytes,
+			"dropped_rate": u.droppedRate, "dropped_quota": u.droppedQuota,
+		}
+	}
+	return out
+}
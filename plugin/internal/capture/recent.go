@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+/* ───────── recent events ───────── */
+
+// recent_events keeps the last N events of a backend, as the sink received
+// them (after redaction and transforms), in a process-wide ring buffer served
+// on the admin server:
+//
+//	"admin_port": 9091, "recent_events": 200
+//
+//	curl 'localhost:9091/debug/traces?request_id=4f1c…&limit=20'
+//
+// Backends share the buffer, which holds the largest recent_events any of
+// them asks for; events are listed newest first.
+
+type recentEvent struct {
+	doc       map[string]interface{}
+	requestID string
+	sinkErr   string
+}
+
+type ring struct {
+	mu    sync.Mutex
+	buf   []recentEvent
+	next  int // slot of the next event
+	total uint64
+}
+
+var recent ring
+
+// KeepRecent makes the ring buffer hold at least n events.
+func KeepRecent(n int) {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	if n <= len(recent.buf) {
+		return
+	}
+	old := recent.newest(len(recent.buf))
+	recent.buf = make([]recentEvent, n)
+	// oldest first, so the newest end up just before next
+	for i := len(old) - 1; i >= 0; i-- {
+		recent.buf[len(old)-1-i] = old[i]
+	}
+	recent.next = len(old) % n
+}
+
+func (r *ring) add(e recentEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) == 0 {
+		return
+	}
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+	r.total++
+}
+
+// newest returns up to n events, newest first; the caller holds mu.
+func (r *ring) newest(n int) []recentEvent {
+	out := make([]recentEvent, 0, min(n, len(r.buf)))
+	for i := 1; i <= len(r.buf) && len(out) < n; i++ {
+		e := r.buf[(r.next-i+len(r.buf))%len(r.buf)]
+		if e.doc == nil {
+			break
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// recordRecent stores ev once the sink has answered.
+func recordRecent(ev *Event, err error) {
+	e := recentEvent{doc: ev.Doc(), requestID: RequestID(ev)}
+	if err != nil {
+		e.sinkErr = err.Error()
+	}
+	recent.add(e)
+}
+
+// RequestID is the correlation id of ev: a request_id field (see
+// tag_headers) or the X-Request-Id header of the request or response.
+func RequestID(ev *Event) string {
+	if id := ev.Meta.Get("request_id"); id != "" {
+		return id
+	}
+	if id := ev.ReqHeader.Get(headerReqID); id != "" {
+		return id
+	}
+	return ev.RespHeader.Get(headerReqID)
+}
+
+// serveRecent lists the buffer; ?request_id= filters, ?limit= caps the list.
+func serveRecent(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("request_id")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	recent.mu.Lock()
+	all := recent.newest(len(recent.buf))
+	size, total := len(recent.buf), recent.total
+	recent.mu.Unlock()
+
+	events := []map[string]interface{}{}
+	for _, e := range all {
+		if len(events) == limit {
+			break
+		}
+		if id != "" && e.requestID != id {
+			continue
+		}
+		doc := make(map[string]interface{}, len(e.doc)+2)
+		for k, v := range e.doc {
+			doc[k] = v
+		}
+		if e.requestID != "" {
+			doc["request_id"] = e.requestID
+		}
+		if e.sinkErr != "" {
+			doc["sink_error"] = e.sinkErr
+		}
+		events = append(events, doc)
+	}
+	WriteJSON(w, map[string]interface{}{"size": size, "recorded": total, "events": events})
+}
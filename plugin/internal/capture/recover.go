@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/* ───────── panic recovery ───────── */
+
+// A panic in a plugin goroutine kills the whole gateway, so every goroutine
+// the plugin starts recovers: the panic is logged as an error with its stack
+// and counted, and when it happened while an event was being captured or
+// sent, a small error event takes its place:
+//
+//	error_class  panic
+//	error        the panic value
+//	panic_in     tracking | request phase | queue worker
+//
+// It keeps the identity of the event (instance_id, seq, endpoint, backend,
+// tenant, status, the URL without its query) but no headers or bodies, since
+// those may be what broke the pipeline; it skips the pipeline and is encoded
+// and sent directly. The admin server counts the panics per place:
+//
+//	GET /debug/panics
+//	{"tracking": {"count": 2, "last": "runtime error: index out of range", "at": "2026-…"}}
+
+type panicStat struct {
+	Count int64     `json:"count"`
+	Last  string    `json:"last"`
+	At    time.Time `json:"at"`
+}
+
+var (
+	panicsMu sync.Mutex
+	panics   = map[string]*panicStat{}
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/panics", servePanics)
+}
+
+// Recover, deferred at the top of a goroutine, stops a panic there from
+// crashing the process; with err set, the panic becomes that error.
+func Recover(where string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	perr := notePanic(where, v)
+	if err != nil {
+		*err = perr
+	}
+}
+
+// recoverEvent is Recover for the goroutines that own ev: the panic is
+// reported as an error event.
+func recoverEvent(c *Config, ev *Event, where string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	notePanic(where, v)
+	reportPanic(c, ev, where, v)
+}
+
+func notePanic(where string, v interface{}) error {
+	err := fmt.Errorf("panic in %s: %v", where, v)
+	panicsMu.Lock()
+	st, ok := panics[where]
+	if !ok {
+		st = &panicStat{}
+		panics[where] = st
+	}
+	st.Count++
+	st.Last, st.At = fmt.Sprint(v), time.Now().UTC()
+	panicsMu.Unlock()
+	logger.Error(tag, err, "\n"+string(debug.Stack()))
+	return err
+}
+
+// reportPanic sends the error event replacing ev.
+func reportPanic(c *Config, ev *Event, where string, v interface{}) {
+	defer Recover(where+" (panic event)", nil)
+	pe := &Event{At: ev.At, Method: ev.Method, URL: &url.URL{}, ReqHeader: http.Header{},
+		RespHeader: http.Header{}, Status: ev.Status, Elapsed: ev.Elapsed, Meta: url.Values{}, ctx: ev.ctx}
+	if ev.URL != nil {
+		pe.URL = &url.URL{Scheme: ev.URL.Scheme, Host: ev.URL.Host, Path: ev.URL.Path}
+	}
+	for _, k := range []string{"instance_id", "seq", "phase", "endpoint", "backend", "tenant", "status"} {
+		if x := ev.Meta.Get(k); x != "" {
+			pe.Meta.Set(k, x)
+		}
+	}
+	pe.Meta.Set("error_class", "panic")
+	pe.Meta.Set("error", fmt.Sprint(v))
+	pe.Meta.Set("panic_in", where)
+	payload, err := encode(c, pe)
+	if err != nil {
+		vdbg(c, "panic event: encode failed:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(pe.detached(), c.Timeout)
+	defer cancel()
+	deliver(ctx, c, pe, payload)
+}
+
+func servePanics(w http.ResponseWriter, _ *http.Request) {
+	WriteJSON(w, panicsView())
+}
+
+func panicsView() map[string]panicStat {
+	panicsMu.Lock()
+	defer panicsMu.Unlock()
+	out := make(map[string]panicStat, len(panics))
+	for k, st := range panics {
+		out[k] = *st
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/* ───────── sampling ───────── */
+
+// sampling captures a share of the requests, and may keep only their
+// metadata; both can change while the gateway runs:
+//
+//	"sampling": {
+//	  "rate": 0.05,            // share of requests captured, default 1
+//	  "mode": "full",          // or "metadata": events without bodies
+//	  "remote": {"url": "http://config.internal/trace-sampling.json", "refresh_s": 30}
+//	}
+//
+// Requests left out are only proxied. Sampled events carry sample_rate when
+// it is below 1, so counts can be scaled up. On the admin server
+//
+//	GET  /debug/sampling
+//	POST /debug/sampling?rate=1&mode=full            every backend
+//	POST /debug/sampling?rate=0.1&endpoint=/orders   the backends of one endpoint
+//
+// set the rate, the mode or both (a missing parameter keeps its value), e.g.
+// to capture everything during an incident and back down afterwards. remote is polled
+// for {"rate": 0.05, "mode": "metadata"} and applied whenever the document
+// changes, so an admin change holds until the next remote edit. Changes are
+// logged and not persisted: a restart goes back to the block.
+
+// Sampling is a backend's current rate and mode; a nil Sampling captures
+// every request in full.
+type Sampling struct {
+	rate     atomic.Uint64 // math.Float64bits
+	metadata atomic.Bool
+
+	url     string
+	refresh time.Duration
+}
+
+type samplingDoc struct {
+	Rate *float64 `json:"rate"`
+	Mode *string  `json:"mode"`
+}
+
+func init() {
+	adminMux.HandleFunc("GET /debug/sampling", serveSampling)
+	adminMux.HandleFunc("POST /debug/sampling", serveSampling)
+}
+
+// ParseSampling reads the sampling block.
+func ParseSampling(v map[string]interface{}) (*Sampling, error) {
+	s := newSampling()
+	doc := samplingDoc{}
+	if r, ok := v["rate"].(float64); ok {
+		doc.Rate = &r
+	}
+	if m, ok := v["mode"].(string); ok {
+		doc.Mode = &m
+	}
+	if err := s.set(doc); err != nil {
+		return nil, err
+	}
+	if r, ok := v["remote"].(map[string]interface{}); ok {
+		if s.url, _ = r["url"].(string); s.url == "" {
+			return nil, fmt.Errorf("remote needs a url")
+		}
+		s.refresh = 30 * time.Second
+		if n, ok := r["refresh_s"].(float64); ok {
+			if s.refresh = time.Duration(n * float64(time.Second)); s.refresh < time.Second {
+				return nil, fmt.Errorf("remote.refresh_s must be at least 1")
+			}
+		}
+	}
+	return s, nil
+}
+
+func newSampling() *Sampling {
+	s := &Sampling{}
+	s.rate.Store(math.Float64bits(1))
+	return s
+}
+
+// set applies the fields doc has, or neither when one is invalid.
+func (s *Sampling) set(doc samplingDoc) error {
+	if doc.Rate != nil && (*doc.Rate < 0 || *doc.Rate > 1) {
+		return fmt.Errorf("rate must be between 0 and 1, not %v", *doc.Rate)
+	}
+	metadata := s.metadata.Load()
+	if doc.Mode != nil {
+		switch *doc.Mode {
+		case "full":
+			metadata = false
+		case "metadata":
+			metadata = true
+		default:
+			return fmt.Errorf("mode must be full or metadata, not %q", *doc.Mode)
+		}
+	}
+	if doc.Rate != nil {
+		s.rate.Store(math.Float64bits(*doc.Rate))
+	}
+	s.metadata.Store(metadata)
+	return nil
+}
+
+func (s *Sampling) current() (float64, string) {
+	if s == nil {
+		return 1, "full"
+	}
+	mode := "full"
+	if s.metadata.Load() {
+		mode = "metadata"
+	}
+	return math.Float64frombits(s.rate.Load()), mode
+}
+
+// sample decides for one request: whether to capture it, and whether
+// without bodies.
+func (s *Sampling) sample() (keep, metadataOnly bool) {
+	if s == nil {
+		return true, false
+	}
+	rate := math.Float64frombits(s.rate.Load())
+	return rate >= 1 || rand.Float64() < rate, s.metadata.Load()
+}
+
+// StartSampling polls the remote sampling document of c, if any.
+func StartSampling(c *Config) {
+	if c.Sampling == nil || c.Sampling.url == "" {
+		return
+	}
+	go pollJSON(c.Sampling.url, c.Sampling.refresh, c.Timeout, func(b []byte) error {
+		var doc samplingDoc
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+		if err := c.Sampling.set(doc); err != nil {
+			return err
+		}
+		rate, mode := c.Sampling.current()
+		logger.Info(tag, "sampling of", c.Endpoint, "set remotely: rate", rate, "mode", mode)
+		return nil
+	})
+}
+
+// pollJSON fetches url every interval and calls apply with the body when it
+// changed since the last successful apply; failures are logged and retried
+// on the next round.
+func pollJSON(url string, every, timeout time.Duration, apply func([]byte) error) {
+	defer Recover("poll "+url, nil)
+	var last []byte
+	for {
+		b, err := fetch(url, timeout)
+		if err == nil && !bytes.Equal(b, last) {
+			if err = apply(b); err == nil {
+				last = b
+			}
+		}
+		if err != nil {
+			logger.Warning(tag, "remote", url+":", err)
+		}
+		time.Sleep(every)
+	}
+}
+
+func fetch(url string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func serveSampling(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	endpoint, only := q.Get("endpoint"), q.Has("endpoint")
+	if r.Method == http.MethodPost {
+		doc := samplingDoc{}
+		if q.Has("rate") {
+			rate, err := strconv.ParseFloat(q.Get("rate"), 64)
+			if err != nil {
+				http.Error(w, "rate must be a number", http.StatusBadRequest)
+				return
+			}
+			doc.Rate = &rate
+		}
+		if q.Has("mode") {
+			mode := q.Get("mode")
+			doc.Mode = &mode
+		}
+		if err := newSampling().set(doc); err != nil { // validate before touching any backend
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, ctl := range registered() {
+			if !only || ctl.c.Endpoint == endpoint {
+				ctl.c.Sampling.set(doc)
+			}
+		}
+		logger.Warning(tag, "sampling changed through the admin server:", r.URL.RawQuery)
+	}
+	out := []map[string]interface{}{}
+	for _, ctl := range registered() {
+		if only && ctl.c.Endpoint != endpoint {
+			continue
+		}
+		d := ctl.describe()
+		d["rate"], d["mode"] = ctl.c.Sampling.current()
+		out = append(out, d)
+	}
+	WriteJSON(w, out)
+}
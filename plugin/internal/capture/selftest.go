@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* ───────── startup self-test ───────── */
+
+// self_test sends one synthetic event (meta event=self_test) through the
+// payload format and the sink when the configuration is loaded, so a wrong
+// URL, credential, certificate or format shows up at boot instead of as
+// silently missing traces:
+//
+//	"self_test": true       // in the background, the result is logged
+//	"self_test": "strict"   // synchronously, a failure stops KrakenD
+//
+// Backends sharing tracking_url and payload_format are tested once. Results
+// are listed on the admin server under /debug/self-test. capture_if and
+// transforms do not apply to the synthetic event; collectors can drop it on
+// meta.event.
+
+// SelfTestMode is the self_test setting; 0 disables it.
+type SelfTestMode int
+
+const (
+	SelfTestBackground SelfTestMode = iota + 1
+	SelfTestStrict
+)
+
+// ParseSelfTest reads self_test (a bool or "strict").
+func ParseSelfTest(v interface{}) (SelfTestMode, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		if v {
+			return SelfTestBackground, nil
+		}
+		return 0, nil
+	case string:
+		switch v {
+		case "strict":
+			return SelfTestStrict, nil
+		case "", "off":
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("self_test must be true, false or \"strict\", not %v", v)
+}
+
+type selfTestResult struct {
+	Target    string    `json:"target"`
+	Format    string    `json:"payload_format"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	At        time.Time `json:"at"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+}
+
+var (
+	selfTestMu      sync.Mutex
+	selfTestResults = map[string]*selfTestResult{}
+)
+
+func init() {
+	adminMux.HandleFunc("GET /debug/self-test", func(w http.ResponseWriter, _ *http.Request) {
+		selfTestMu.Lock()
+		out := make([]selfTestResult, 0, len(selfTestResults))
+		for _, r := range selfTestResults {
+			if r != nil { // nil while running
+				out = append(out, *r)
+			}
+		}
+		selfTestMu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+		WriteJSON(w, out)
+	})
+}
+
+// SelfTest runs the self-test for c according to c.SelfTest; only a strict
+// test returns its error.
+func SelfTest(c *Config) error {
+	if c.SelfTest == 0 || c.DryRun {
+		return nil
+	}
+	key := c.URL.Redacted() + " " + c.Format.Name
+	selfTestMu.Lock()
+	_, done := selfTestResults[key]
+	if !done {
+		selfTestResults[key] = nil
+	}
+	selfTestMu.Unlock()
+	if done {
+		return nil
+	}
+	if c.SelfTest == SelfTestStrict {
+		return runSelfTest(c, key)
+	}
+	go runSelfTest(c, key)
+	return nil
+}
+
+func runSelfTest(c *Config, key string) error {
+	start := time.Now()
+	err := sendSynthetic(c, "self_test", nil)
+	r := &selfTestResult{Target: c.URL.Redacted(), Format: c.Format.Name, OK: err == nil,
+		At: start.UTC(), ElapsedMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	selfTestMu.Lock()
+	selfTestResults[key] = r
+	selfTestMu.Unlock()
+
+	switch {
+	case err != nil:
+		logger.Error(tag, "self-test failed for", r.Target, "("+r.Format+"):", err)
+	default:
+		logger.Info(tag, "self-test ok for", r.Target, "("+r.Format+") in", time.Since(start))
+	}
+	if err != nil {
+		return fmt.Errorf("%s self-test for %s: %w", tag, r.Target, err)
+	}
+	return nil
+}
+
+// sendSynthetic sends the synthetic event with meta event=name and body as
+// the response body, {"ok":true} when nil.
+func sendSynthetic(c *Config, name string, body []byte) (err error) {
+	defer Recover(name, &err)
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	u := &url.URL{Scheme: "http", Host: "krakend-trace.invalid", Path: "/__" + name}
+	ev := &Event{At: time.Now(), Method: http.MethodGet, URL: u, ReqHeader: http.Header{},
+		RespHeader: http.Header{"Content-Type": {"application/json"}}, RespBody: body,
+		Status: http.StatusOK, Meta: url.Values{}}
+	if body == nil {
+		ev.RespBody = []byte(`{"ok":true}`)
+	}
+	ev.Meta.Set("event", name)
+	ev.Meta.Set("instance_id", instanceID)
+	ev.Meta.Set("seq", strconv.FormatUint(eventSeq.Add(1), 10))
+	ev.Meta.Set("status", "200")
+	for k, v := range c.Labels {
+		ev.Meta.Set("label."+k, v)
+	}
+	if c.Endpoint != "" {
+		ev.Meta.Set("endpoint", c.Endpoint)
+	}
+	if c.Backend != "" {
+		ev.Meta.Set("backend", c.Backend)
+	}
+
+	payload, err := c.Format.Encode(ev)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return c.Sink.Send(ctx, ev, payload)
+}
@@ -0,0 +1,201 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ───────── shadow traffic ───────── */
+
+// shadow mirrors requests to a secondary backend once the primary response
+// has been streamed, and emits a diff event comparing both responses. The
+// shadow response never reaches the client. Diff events carry
+// event=shadow_diff, the shadow response as response body and status, and
+// shadow.* fields (status_match, primary_status, headers_diff, body_match,
+// body_diff_at, elapsed_ms, error); they go through capture_if, transform and
+// the sink like any capture. JSON bodies are compared canonically, others
+// byte for byte, both clipped to max_capture_kb.
+//
+//	"shadow": {
+//	  "url":              "http://orders-v2.internal:8080",
+//	  "methods":          ["GET", "HEAD"],   // default; only idempotent requests
+//	  "timeout_ms":       2000,              // default timeout_ms
+//	  "ignore_headers":   ["X-Served-By"],   // beyond Date, Server, Content-Length…
+//	  "only_mismatches":  true               // skip diff events when all matches
+//	}
+
+// Shadow is the mirroring setup of one backend.
+type Shadow struct {
+	base           *url.URL
+	methods        map[string]bool
+	timeout        time.Duration
+	ignore         map[string]bool
+	onlyMismatches bool
+}
+
+// shadowIgnored headers differ between any two backends.
+var shadowIgnored = []string{"Date", "Server", "Content-Length", "Connection", "Keep-Alive",
+	"Transfer-Encoding", "X-Request-Id", "Etag", "Last-Modified", "Age", "Expires"}
+
+// NewShadow reads the shadow block.
+func NewShadow(c *Config, opts map[string]interface{}) (*Shadow, error) {
+	raw, _ := opts["url"].(string)
+	u, err := url.Parse(raw)
+	if raw == "" || err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s shadow needs an absolute url", tag)
+	}
+	s := &Shadow{base: u, methods: map[string]bool{"GET": true, "HEAD": true}, timeout: c.Timeout, ignore: map[string]bool{}}
+	if ms, ok := opts["methods"].([]interface{}); ok {
+		s.methods = map[string]bool{}
+		for _, m := range ms {
+			if v, ok := m.(string); ok {
+				s.methods[strings.ToUpper(v)] = true
+			}
+		}
+	}
+	if v, ok := opts["timeout_ms"].(float64); ok && v > 0 {
+		s.timeout = time.Duration(v) * time.Millisecond
+	}
+	for _, h := range shadowIgnored {
+		s.ignore[h] = true
+	}
+	if hs, ok := opts["ignore_headers"].([]interface{}); ok {
+		for _, h := range hs {
+			if v, ok := h.(string); ok {
+				s.ignore[http.CanonicalHeaderKey(v)] = true
+			}
+		}
+	}
+	s.onlyMismatches, _ = opts["only_mismatches"].(bool)
+	return s, nil
+}
+
+// shadowCopy is what the mirror needs from the primary exchange, copied
+// before the capture pipeline rewrites the event.
+type shadowCopy struct {
+	method     string
+	url        *url.URL
+	reqHeader  http.Header
+	reqBody    []byte // unclipped
+	status     int
+	respHeader http.Header
+	respBody   []byte
+	elapsed    time.Duration
+	meta       url.Values
+	ctx        context.Context
+}
+
+func (s *Shadow) copyOf(ev *Event) *shadowCopy {
+	meta := make(url.Values, len(ev.Meta))
+	for k, v := range ev.Meta {
+		meta[k] = append([]string(nil), v...)
+	}
+	return &shadowCopy{method: ev.Method, url: ev.URL, reqHeader: ev.ReqHeader,
+		reqBody: ev.fullBody, status: ev.Status, respHeader: ev.RespHeader,
+		respBody: bytes.Clone(ev.RespBody), elapsed: ev.Elapsed, meta: meta, ctx: ev.ctx}
+}
+
+// mirror replays p against the shadow backend and hands the diff event to
+// the capture pipeline.
+func (s *Shadow) mirror(c *Config, p *shadowCopy) {
+	defer Recover("shadow", nil)
+	ev := &Event{At: time.Now(), Method: p.method, URL: p.url, ReqHeader: p.reqHeader,
+		ReqBody: p.reqBody, RespHeader: http.Header{}, Meta: p.meta, ctx: p.ctx}
+	ctx, cancel := context.WithTimeout(ev.detached(), s.timeout)
+	defer cancel()
+
+	u := *s.base
+	u.Path = strings.TrimSuffix(s.base.Path, "/") + p.url.Path
+	u.RawQuery = p.url.RawQuery
+
+	if len(ev.ReqBody) > c.MaxCapture {
+		ev.ReqBody = ev.ReqBody[:c.MaxCapture]
+	}
+	ev.Meta.Set("event", "shadow_diff")
+	ev.Meta.Set("shadow.url", u.String())
+	ev.Meta.Set("shadow.primary_status", strconv.Itoa(p.status))
+	ev.Meta.Set("shadow.primary_elapsed_ms", strconv.FormatInt(p.elapsed.Milliseconds(), 10))
+
+	req, err := http.NewRequestWithContext(ctx, p.method, u.String(), bytes.NewReader(p.reqBody))
+	if err == nil {
+		req.Header = p.reqHeader.Clone()
+		var resp *http.Response
+		start := time.Now()
+		if resp, err = c.upstream().Do(req); err == nil {
+			ev.Status, ev.RespHeader = resp.StatusCode, resp.Header
+			ev.RespBody, _, _ = streamAndCapture(io.Discard, resp.Body, c.MaxCapture, c.CaptureTail)
+			resp.Body.Close()
+			ev.Elapsed = time.Since(start)
+		}
+	}
+	if err != nil {
+		ev.Meta.Set("shadow.error", err.Error())
+		vdbg(c, "shadow:", err)
+	} else {
+		ev.Meta.Set("status", strconv.Itoa(ev.Status))
+		ev.Meta.Set("shadow.elapsed_ms", strconv.FormatInt(ev.Elapsed.Milliseconds(), 10))
+	}
+
+	match := err == nil
+	match = s.diffStatus(ev, p) && match
+	match = s.diffHeaders(ev, p) && match
+	match = s.diffBodies(ev, p) && match
+	if match && s.onlyMismatches {
+		return
+	}
+	process(c, ev)
+}
+
+func (s *Shadow) diffStatus(ev *Event, p *shadowCopy) bool {
+	ok := ev.Status == p.status
+	ev.Meta.Set("shadow.status_match", strconv.FormatBool(ok))
+	return ok
+}
+
+// diffHeaders lists the headers whose values differ, sorted.
+func (s *Shadow) diffHeaders(ev *Event, p *shadowCopy) bool {
+	var diff []string
+	seen := map[string]bool{}
+	for _, h := range []http.Header{p.respHeader, ev.RespHeader} {
+		for k := range h {
+			if seen[k] || s.ignore[k] {
+				continue
+			}
+			seen[k] = true
+			if strings.Join(p.respHeader.Values(k), ", ") != strings.Join(ev.RespHeader.Values(k), ", ") {
+				diff = append(diff, k)
+			}
+		}
+	}
+	sort.Strings(diff)
+	if len(diff) > 0 {
+		ev.Meta.Set("shadow.headers_diff", strings.Join(diff, ","))
+	}
+	return len(diff) == 0
+}
+
+func (s *Shadow) diffBodies(ev *Event, p *shadowCopy) bool {
+	a, b := p.respBody, ev.RespBody
+	if isJSON(p.respHeader, a) && isJSON(ev.RespHeader, b) {
+		a, b = jsonCanonical.body(a), jsonCanonical.body(b)
+	}
+	ok := bytes.Equal(a, b)
+	ev.Meta.Set("shadow.body_match", strconv.FormatBool(ok))
+	if !ok {
+		at := 0
+		for at < len(a) && at < len(b) && a[at] == b[at] {
+			at++
+		}
+		ev.Meta.Set("shadow.body_diff_at", strconv.Itoa(at))
+		ev.Meta.Set("shadow.primary_body_bytes", strconv.Itoa(len(p.respBody)))
+	}
+	return ok
+}
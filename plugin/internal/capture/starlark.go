@@ -0,0 +1,194 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+/* ───────── Starlark transform ───────── */
+
+// A Starlark script (go.starlark.net, pure Go) gets every event after the
+// transform rules. Its transform function receives the event as a dict, the
+// view expressions get (request, response, meta, duration_ms), and may change
+// it in place or return a new one; meta replaces the event fields and
+// request.body / response.body the bodies. Returning False drops the event.
+//
+//	"starlark": {
+//	  "script":    "/etc/krakend/transform.star",
+//	  "source":    "def transform(event): ...",  // instead of script
+//	  "max_steps": 1000000
+//	}
+//
+// The json module is predeclared; print goes to the plugin log.
+
+// StarlarkTransform is a loaded script.
+type StarlarkTransform struct {
+	fn       starlark.Callable
+	maxSteps uint64
+}
+
+var starlarkOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true, Recursion: true}
+
+// NewStarlarkTransform loads the script named in the starlark block.
+func NewStarlarkTransform(opts map[string]interface{}) (*StarlarkTransform, error) {
+	name, src := "transform.star", ""
+	if v, ok := opts["source"].(string); ok {
+		src = v
+	}
+	if path, ok := opts["script"].(string); ok && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s starlark: %w", tag, err)
+		}
+		name, src = path, string(b)
+	}
+	if src == "" {
+		return nil, fmt.Errorf("%s starlark needs a script or source", tag)
+	}
+	s := &StarlarkTransform{maxSteps: 1000000}
+	if v, ok := opts["max_steps"].(float64); ok && v > 0 {
+		s.maxSteps = uint64(v)
+	}
+
+	thread := s.thread()
+	globals, err := starlark.ExecFileOptions(starlarkOptions, thread, name, src,
+		starlark.StringDict{"json": json.Module})
+	if err != nil {
+		return nil, fmt.Errorf("%s starlark %s: %w", tag, name, err)
+	}
+	fn, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s starlark %s does not define transform", tag, name)
+	}
+	globals.Freeze() // shared by every call
+	s.fn = fn
+	return s, nil
+}
+
+func (s *StarlarkTransform) thread() *starlark.Thread {
+	t := &starlark.Thread{Name: "transform", Print: func(_ *starlark.Thread, msg string) { Log("starlark:", msg) }}
+	t.SetMaxExecutionSteps(s.maxSteps)
+	return t
+}
+
+// apply runs the script on ev and reports whether the event is kept. An
+// error (or the event deadline) keeps the event unchanged.
+func (s *StarlarkTransform) apply(ctx context.Context, ev *Event) (bool, error) {
+	thread := s.thread()
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+	defer stop()
+
+	in := toStarlark(ev.vars()).(*starlark.Dict)
+	r, err := starlark.Call(thread, s.fn, starlark.Tuple{in}, nil)
+	if err != nil {
+		return true, err
+	}
+	switch r := r.(type) {
+	case starlark.Bool:
+		if !r {
+			return false, nil
+		}
+	case starlark.NoneType: // changed in place
+	case *starlark.Dict:
+		in = r
+	default:
+		return true, fmt.Errorf("transform returned %s, want the event, None or False", r.Type())
+	}
+
+	// read everything before changing the event, so a bad value leaves it as it was
+	meta, err := dictPath(in, "meta")
+	if err != nil {
+		return true, err
+	}
+	reqBody, err := dictPath(in, "request", "body")
+	if err != nil {
+		return true, err
+	}
+	respBody, err := dictPath(in, "response", "body")
+	if err != nil {
+		return true, err
+	}
+	if m, ok := meta.(*starlark.Dict); ok {
+		for k := range ev.Meta {
+			delete(ev.Meta, k)
+		}
+		for _, kv := range m.Items() {
+			ev.Meta.Set(starlarkString(kv[0]), starlarkString(kv[1]))
+		}
+	} else if meta != nil {
+		return true, fmt.Errorf("meta is a %s, want a dict", meta.Type())
+	}
+	if reqBody != nil {
+		ev.ReqBody = []byte(starlarkString(reqBody))
+	}
+	if respBody != nil {
+		ev.RespBody = []byte(starlarkString(respBody))
+	}
+	return true, nil
+}
+
+// dictPath follows keys through nested dicts; a missing key is nil.
+func dictPath(d *starlark.Dict, keys ...string) (starlark.Value, error) {
+	var v starlark.Value = d
+	for _, k := range keys {
+		m, ok := v.(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("%s is a %s, want a dict", k, v.Type())
+		}
+		if v, ok, _ = m.Get(starlark.String(k)); !ok {
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+// starlarkString is a string value itself, anything else its Starlark representation.
+func starlarkString(v starlark.Value) string {
+	if s, ok := starlark.AsString(v); ok {
+		return s
+	}
+	return v.String()
+}
+
+func toStarlark(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		d := starlark.NewDict(len(v))
+		for _, k := range sortedKeys(v) {
+			d.SetKey(starlark.String(k), toStarlark(v[k]))
+		}
+		return d
+	case map[string]string:
+		d := starlark.NewDict(len(v))
+		for _, k := range sortedKeys(v) {
+			d.SetKey(starlark.String(k), starlark.String(v[k]))
+		}
+		return d
+	case string:
+		return starlark.String(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case float64:
+		return starlark.Float(v)
+	case bool:
+		return starlark.Bool(v)
+	case nil:
+		return starlark.None
+	}
+	return starlark.String(fmt.Sprint(v))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,33 @@
+package capture
+
+import (
+	"time"
+)
+
+/* ───────── synchronous delivery ───────── */
+
+// delivery_mode "sync" makes the handler wait for the sink to take the event
+// before it returns, for low-volume endpoints (audit) where a lost capture is
+// not acceptable:
+//
+//	"delivery_mode": "sync"    // default "async"
+//
+// The response has been streamed by then, but KrakenD completes it only once
+// the handler returns, so the client sees the end of the response after the
+// send. The wait is bounded by timeout_ms; failed sends are logged as
+// warnings. The request event of split_phases is still sent in the
+// background, and a delivery queue cannot be combined with sync.
+
+// awaitDelivery waits for the tracking coroutine of a request: until the
+// send with delivery_mode sync, until the event is queued with the overflow
+// policy block.
+func awaitDelivery(c *Config, done <-chan struct{}, path string) {
+	wait := c.Timeout + c.Overflow.blockFor(c)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		logger.Warning(tag, path, "delivery wait timed out after", wait)
+	}
+}
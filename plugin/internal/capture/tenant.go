@@ -0,0 +1,100 @@
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/* ───────── tenant ───────── */
+
+// tenant names where the tenant of a request is read from; it is stored as
+// the event field "tenant", which sinks route on (see package sink):
+//
+//	"tenant": {
+//	  "header": "X-Tenant-Id",   // checked first
+//	  "claim":  "org.id",        // dotted path into the bearer JWT payload
+//	  "routes": { … }            // read by package sink
+//	}
+//
+// The JWT is only decoded, not verified: validate it in KrakenD
+// (auth/validator) before it reaches the backend.
+
+// Tenant extracts the tenant id of a request.
+type Tenant struct {
+	header string
+	claim  []string
+}
+
+// ParseTenant reads the header and claim of the tenant block.
+func ParseTenant(v map[string]interface{}) (*Tenant, error) {
+	t := &Tenant{}
+	if h, ok := v["header"].(string); ok && h != "" {
+		t.header = http.CanonicalHeaderKey(h)
+	}
+	if c, ok := v["claim"].(string); ok && c != "" {
+		t.claim = strings.Split(c, ".")
+	}
+	if t.header == "" && t.claim == nil {
+		return nil, fmt.Errorf("needs a header or a claim")
+	}
+	return t, nil
+}
+
+func (t *Tenant) of(req *http.Request) string {
+	if t.header != "" {
+		if v := req.Header.Get(t.header); v != "" {
+			return v
+		}
+	}
+	if t.claim == nil {
+		return ""
+	}
+	return bearerClaim(req.Header, t.claim)
+}
+
+// Claim returns the claim at the dotted path in the (unverified) bearer JWT
+// of h, or "".
+func Claim(h http.Header, path string) string {
+	return bearerClaim(h, strings.Split(path, "."))
+}
+
+func bearerClaim(h http.Header, path []string) string {
+	token, ok := strings.CutPrefix(h.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return jwtClaim(token, path)
+}
+
+// jwtClaim returns the claim at path in the payload of a compact JWT, or "".
+func jwtClaim(token string, path []string) string {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var v interface{}
+	if json.Unmarshal(raw, &v) != nil {
+		return ""
+	}
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[p]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package capture
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+/* ───────── outbound TLS ───────── */
+
+// sink_tls and upstream_tls set up TLS for the connections to the sink and
+// to the backend:
+//
+//	"sink_tls": {
+//	  "ca_file":              "/etc/ssl/private-ca.pem",  // trusted besides the system roots
+//	  "min_version":          "1.2",                      // 1.0 … 1.3, default 1.2
+//	  "cipher_suites":        ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+//	  "server_name":          "collector.internal",       // SNI and name checked
+//	  "insecure_skip_verify": false
+//	}
+//
+// Cipher suites are the Go names of the secure TLS 1.2 suites; TLS 1.3
+// suites are not configurable. insecure_skip_verify is logged as a warning
+// whenever a block sets it.
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13,
+}
+
+// ParseTLS reads a TLS block; name is the key, for the messages.
+func ParseTLS(name string, v map[string]interface{}) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if path, _ := v["ca_file"].(string); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", path)
+		}
+		cfg.RootCAs = pool
+	}
+	if s, ok := v["min_version"].(string); ok {
+		if cfg.MinVersion, ok = tlsVersions[s]; !ok {
+			return nil, fmt.Errorf("min_version must be 1.0, 1.1, 1.2 or 1.3, not %q", s)
+		}
+	}
+	if list, ok := v["cipher_suites"].([]interface{}); ok {
+		ids := map[string]uint16{}
+		for _, cs := range tls.CipherSuites() {
+			ids[cs.Name] = cs.ID
+		}
+		for _, x := range list {
+			s, _ := x.(string)
+			id, ok := ids[s]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", s)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	cfg.ServerName, _ = v["server_name"].(string)
+	if skip, _ := v["insecure_skip_verify"].(bool); skip {
+		cfg.InsecureSkipVerify = true
+		logger.Warning(tag, name+": insecure_skip_verify is set, certificates are not verified")
+	}
+	return cfg, nil
+}
+
+func (c *Config) upstream() *http.Client {
+	if c.Upstream != nil {
+		return c.Upstream
+	}
+	return http.DefaultClient
+}
+
+// HTTPClient returns a client whose connections use cfg; nil gives the
+// default client.
+func HTTPClient(cfg *tls.Config) *http.Client {
+	if cfg == nil {
+		return http.DefaultClient
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return &http.Client{Transport: t}
+}
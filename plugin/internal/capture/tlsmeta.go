@@ -0,0 +1,138 @@
+package capture
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* ───────── inbound TLS metadata ───────── */
+
+// tls_meta records how the client connected:
+//
+//	tls.version         1.2 | 1.3 …
+//	tls.cipher          TLS_AES_128_GCM_SHA256
+//	tls.alpn            h2
+//	tls.client_subject  CN=svc-a,O=Example (mutual TLS only)
+//
+// The plugin sees the request KrakenD sends to the backend, which carries no
+// connection state, so the values usually come from the headers of the proxy
+// or the KrakenD server plugin that terminated TLS (forwarded with
+// input_headers):
+//
+//	"tls_meta": true                             // X-Forwarded-Client-Cert only
+//	"tls_meta": {
+//	  "version_header":     "X-Tls-Version",     // e.g. TLSv1.3 or 1.3
+//	  "cipher_header":      "X-Tls-Cipher",
+//	  "alpn_header":        "X-Tls-Alpn",
+//	  "client_cert_header": "X-Forwarded-Client-Cert"   // the default
+//	}
+//
+// The client certificate header is either Envoy's X-Forwarded-Client-Cert
+// (the Subject of its first element, the original client) or a URL-encoded
+// PEM certificate as nginx' $ssl_client_escaped_cert sends it. When the
+// handler runs in a server that terminates TLS itself (outside KrakenD), the
+// connection state is used directly and the headers are ignored.
+
+// TLSMeta names the headers tls_meta reads.
+type TLSMeta struct {
+	version, cipher, alpn, clientCert string
+}
+
+// ParseTLSMeta reads tls_meta; nil means no tls.* fields.
+func ParseTLSMeta(v interface{}) (*TLSMeta, error) {
+	m := &TLSMeta{clientCert: "X-Forwarded-Client-Cert"}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		for key, dst := range map[string]*string{"version_header": &m.version, "cipher_header": &m.cipher,
+			"alpn_header": &m.alpn, "client_cert_header": &m.clientCert} {
+			if s, ok := v[key].(string); ok {
+				*dst = s
+			}
+		}
+	default:
+		return nil, fmt.Errorf("must be true or an object")
+	}
+	return m, nil
+}
+
+// apply sets the tls.* fields of ev from req.
+func (m *TLSMeta) apply(ev *Event, req *http.Request) {
+	set := func(k, v string) {
+		if v != "" {
+			ev.Meta.Set("tls."+k, v)
+		}
+	}
+	if st := req.TLS; st != nil {
+		set("version", strings.TrimPrefix(tls.VersionName(st.Version), "TLS "))
+		set("cipher", tls.CipherSuiteName(st.CipherSuite))
+		set("alpn", st.NegotiatedProtocol)
+		if len(st.PeerCertificates) > 0 {
+			set("client_subject", st.PeerCertificates[0].Subject.String())
+		}
+		return
+	}
+	if m.version != "" {
+		v := strings.TrimSpace(req.Header.Get(m.version))
+		set("version", strings.TrimPrefix(strings.TrimPrefix(v, "TLSv"), "TLS "))
+	}
+	if m.cipher != "" {
+		set("cipher", req.Header.Get(m.cipher))
+	}
+	if m.alpn != "" {
+		set("alpn", req.Header.Get(m.alpn))
+	}
+	if m.clientCert != "" {
+		set("client_subject", certSubject(req.Header.Get(m.clientCert)))
+	}
+}
+
+// certSubject reads the subject out of an XFCC or URL-encoded PEM value.
+func certSubject(v string) string {
+	if v == "" {
+		return ""
+	}
+	if s, err := url.PathUnescape(v); err == nil && strings.HasPrefix(s, "-----BEGIN") {
+		if b, _ := pem.Decode([]byte(s)); b != nil {
+			if cert, err := x509.ParseCertificate(b.Bytes); err == nil {
+				return cert.Subject.String()
+			}
+		}
+		return ""
+	}
+	first := splitQuoted(v, ',')[0]
+	for _, kv := range splitQuoted(first, ';') {
+		if k, val, ok := strings.Cut(kv, "="); ok && strings.EqualFold(k, "Subject") {
+			return strings.Trim(val, `"`)
+		}
+	}
+	return ""
+}
+
+// splitQuoted splits an XFCC value at the seps outside quotes.
+func splitQuoted(s string, sep byte) []string {
+	var out []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				out = append(out, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(out, s[start:])
+}
@@ -0,0 +1,367 @@
+package capture
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* ───────── tokenization ───────── */
+
+// tokenize replaces sensitive values with tokens from an external
+// tokenization service, so the tracking store only keeps references that
+// authorized systems can resolve:
+//
+//	"tokenize": {
+//	  "url":         "https://tokens.internal/v1/tokenize",
+//	  "headers":     {"Authorization": "Bearer …"},   // optional
+//	  "request":     ["$.card.number"],               // JSON body paths
+//	  "response":    ["$..iban"],
+//	  "fields":      ["email"],                       // event fields
+//	  "timeout_ms":  500,                             // optional, per call
+//	  "cache_size":  10000, "cache_ttl_s": 3600,      // optional
+//	  "on_error":    "redact"                         // or "drop"
+//	}
+//
+// The service gets POST {"values": [...]} with the values of an event that
+// are not cached and answers {"tokens": [...]} in the same order. Paths use
+// the extract_fields subset and every match is replaced; numbers and booleans
+// are sent as text and come back as string tokens. Bodies are re-encoded
+// (compact, keys sorted). When the service fails, the values are replaced by
+// "[untokenized]" or, with on_error "drop", the event is dropped. A body with
+// paths that is not a JSON document (not JSON, clipped by max_capture_kb, or
+// cut by capture_tail_kb) cannot be searched and is handled the same way: it
+// becomes "[untokenized]" as a whole, or the event is dropped. The cache is
+// keyed by a SHA-256 of the value, so plain values are not kept.
+
+// Tokenizer is a configured tokenization service with its cache.
+type Tokenizer struct {
+	url               string
+	headers           map[string]string
+	request, response [][]jsonPathStep
+	fields            []string
+	timeout           time.Duration
+	drop              bool
+
+	cacheSize int
+	ttl       time.Duration
+	mu        sync.Mutex
+	lru       *list.List // of *tokenEntry, most recent first
+	cache     map[[32]byte]*list.Element
+}
+
+type tokenEntry struct {
+	key     [32]byte
+	token   string
+	expires time.Time
+}
+
+const untokenized = "[untokenized]"
+
+// ParseTokenize reads the tokenize block.
+func ParseTokenize(v map[string]interface{}) (*Tokenizer, error) {
+	t := &Tokenizer{timeout: 500 * time.Millisecond, cacheSize: 10000, ttl: time.Hour,
+		lru: list.New(), cache: map[[32]byte]*list.Element{}}
+	t.url, _ = v["url"].(string)
+	if t.url == "" {
+		return nil, fmt.Errorf("url missing")
+	}
+	if h, ok := v["headers"].(map[string]interface{}); ok {
+		t.headers = make(map[string]string, len(h))
+		for k, x := range h {
+			t.headers[k] = fmt.Sprint(x)
+		}
+	}
+	for key, dst := range map[string]*[][]jsonPathStep{"request": &t.request, "response": &t.response} {
+		list, _ := v[key].([]interface{})
+		for _, p := range list {
+			s, _ := p.(string)
+			steps, err := parseJSONPath(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = append(*dst, steps)
+		}
+	}
+	if list, ok := v["fields"].([]interface{}); ok {
+		for _, f := range list {
+			t.fields = append(t.fields, fmt.Sprint(f))
+		}
+	}
+	if len(t.request)+len(t.response)+len(t.fields) == 0 {
+		return nil, fmt.Errorf("nothing to tokenize: set request, response or fields")
+	}
+	if n, ok := v["timeout_ms"].(float64); ok && n > 0 {
+		t.timeout = time.Duration(n) * time.Millisecond
+	}
+	if n, ok := v["cache_size"].(float64); ok && n >= 0 {
+		t.cacheSize = int(n)
+	}
+	if n, ok := v["cache_ttl_s"].(float64); ok && n > 0 {
+		t.ttl = time.Duration(n) * time.Second
+	}
+	switch mode, _ := v["on_error"].(string); mode {
+	case "", "redact":
+	case "drop":
+		t.drop = true
+	default:
+		return nil, fmt.Errorf("on_error must be redact or drop, not %q", mode)
+	}
+	return t, nil
+}
+
+// apply tokenizes ev in place; false means drop the event.
+func (t *Tokenizer) apply(ctx context.Context, ev *Event) (bool, error) {
+	// collect the slots to fill, then resolve them in one call
+	var slots []*tokenSlot
+	req, reqOK := t.collect(ev.ReqBody, t.request, &slots)
+	resp, respOK := t.collect(ev.RespBody, t.response, &slots)
+	var bodyErr error
+	if !reqOK || !respOK {
+		if t.drop {
+			return false, fmt.Errorf("tokenize: body is not a JSON document, event dropped")
+		}
+		bodyErr = fmt.Errorf("tokenize: body is not a JSON document, redacted")
+		if !reqOK {
+			ev.ReqBody = []byte(untokenized)
+		}
+		if !respOK {
+			ev.RespBody = []byte(untokenized)
+		}
+	}
+	for _, f := range t.fields {
+		if _, ok := ev.Meta[f]; ok {
+			slots = append(slots, &tokenSlot{value: ev.Meta.Get(f), set: func(s string) { ev.Meta.Set(f, s) }})
+		}
+	}
+	if len(slots) == 0 {
+		return true, bodyErr
+	}
+	err := t.resolve(ctx, slots)
+	if err != nil && t.drop {
+		return false, err
+	}
+	for _, s := range slots {
+		if s.token == "" {
+			s.token = untokenized
+		}
+		s.set(s.token)
+	}
+	if req != nil {
+		ev.ReqBody = encodeJSON(req)
+	}
+	if resp != nil {
+		ev.RespBody = encodeJSON(resp)
+	}
+	if err == nil {
+		err = bodyErr
+	}
+	return true, err
+}
+
+type tokenSlot struct {
+	value, token string
+	set          func(string)
+}
+
+// collect decodes body and adds a slot for every scalar the paths select; it
+// returns the decoded document, or nil when nothing matched, and false when
+// the body is not a complete JSON document.
+func (t *Tokenizer) collect(body []byte, paths [][]jsonPathStep, slots *[]*tokenSlot) (interface{}, bool) {
+	if len(paths) == 0 || len(body) == 0 {
+		return nil, true
+	}
+	doc, ok := jsonDocument(body)
+	if !ok {
+		return nil, false
+	}
+	n := len(*slots)
+	root := &doc
+	for _, p := range paths {
+		jsonPathEach(doc, func(x interface{}) { *root = x }, p, func(v interface{}, set func(interface{})) {
+			switch x := v.(type) {
+			case string, json.Number, bool:
+				*slots = append(*slots, &tokenSlot{value: fmt.Sprint(x), set: func(s string) { set(s) }})
+			}
+		})
+	}
+	if len(*slots) == n {
+		return nil, true
+	}
+	return root, true
+}
+
+// jsonDocument decodes b when it is exactly one JSON value; trailing data
+// would otherwise reach the sink unsearched.
+func jsonDocument(b []byte) (interface{}, bool) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if d.Decode(&v) != nil {
+		return nil, false
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, false
+	}
+	return v, true
+}
+
+// jsonPathEach calls fn with every value the steps select in v and a
+// setter replacing it; set replaces v itself.
+func jsonPathEach(v interface{}, set func(interface{}), steps []jsonPathStep, fn func(interface{}, func(interface{}))) {
+	if len(steps) == 0 {
+		fn(v, set)
+		return
+	}
+	st, rest := steps[0], steps[1:]
+	children := func(f func(interface{}, func(interface{}))) {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			for k, x := range c {
+				f(x, func(n interface{}) { c[k] = n })
+			}
+		case []interface{}:
+			for i, x := range c {
+				f(x, func(n interface{}) { c[i] = n })
+			}
+		}
+	}
+	switch {
+	case st.recursive:
+		if m, ok := v.(map[string]interface{}); ok {
+			if x, ok := m[st.key]; ok {
+				jsonPathEach(x, func(n interface{}) { m[st.key] = n }, rest, fn)
+			}
+		}
+		children(func(x interface{}, set func(interface{})) { jsonPathEach(x, set, steps, fn) })
+	case st.wildcard:
+		children(func(x interface{}, set func(interface{})) { jsonPathEach(x, set, rest, fn) })
+	default:
+		switch c := v.(type) {
+		case map[string]interface{}:
+			if x, ok := c[st.key]; ok && st.index < 0 {
+				jsonPathEach(x, func(n interface{}) { c[st.key] = n }, rest, fn)
+			}
+		case []interface{}:
+			if st.index >= 0 && st.index < len(c) {
+				jsonPathEach(c[st.index], func(n interface{}) { c[st.index] = n }, rest, fn)
+			}
+		}
+	}
+}
+
+func encodeJSON(doc interface{}) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(doc)
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+// resolve fills the tokens of slots from the cache and one service call.
+func (t *Tokenizer) resolve(ctx context.Context, slots []*tokenSlot) error {
+	var values []string
+	pending := map[string][]*tokenSlot{}
+	for _, s := range slots {
+		if tok, ok := t.cached(s.value); ok {
+			s.token = tok
+			continue
+		}
+		if _, ok := pending[s.value]; !ok {
+			values = append(values, s.value)
+		}
+		pending[s.value] = append(pending[s.value], s)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	tokens, err := t.call(ctx, values)
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		t.store(v, tokens[i])
+		for _, s := range pending[v] {
+			s.token = tokens[i]
+		}
+	}
+	return nil
+}
+
+func (t *Tokenizer) call(ctx context.Context, values []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	body, _ := json.Marshal(map[string][]string{"values": values})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tokenize: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("tokenize: %s", resp.Status)
+	}
+	var out struct {
+		Tokens []string `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("tokenize: %w", err)
+	}
+	if len(out.Tokens) != len(values) {
+		return nil, fmt.Errorf("tokenize: %d tokens for %d values", len(out.Tokens), len(values))
+	}
+	return out.Tokens, nil
+}
+
+func (t *Tokenizer) cached(value string) (string, bool) {
+	if t.cacheSize == 0 {
+		return "", false
+	}
+	key := sha256.Sum256([]byte(value))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.cache[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*tokenEntry)
+	if time.Now().After(e.expires) {
+		t.lru.Remove(el)
+		delete(t.cache, key)
+		return "", false
+	}
+	t.lru.MoveToFront(el)
+	return e.token, true
+}
+
+func (t *Tokenizer) store(value, token string) {
+	if t.cacheSize == 0 {
+		return
+	}
+	key := sha256.Sum256([]byte(value))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.cache[key]; ok {
+		t.lru.Remove(el)
+	}
+	t.cache[key] = t.lru.PushFront(&tokenEntry{key: key, token: token, expires: time.Now().Add(t.ttl)})
+	for t.lru.Len() > t.cacheSize {
+		old := t.lru.Back()
+		t.lru.Remove(old)
+		delete(t.cache, old.Value.(*tokenEntry).key)
+	}
+}
@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"fmt"
+	"regexp"
+)
+
+/* ───────── transform hook ───────── */
+
+// transform rules run in order on every captured event before it is encoded.
+// Each rule may carry an "if" expression and then drops the event, sets or
+// removes event fields, or rewrites bodies with a regular expression:
+//
+//	"transform": [
+//	  {"if": "request.path.startsWith('/internal')", "drop": true},
+//	  {"set": {"tier": "'x-tier' in request.headers ? request.headers['x-tier'] : 'free'"}},
+//	  {"unset": ["client_ip"]},
+//	  {"redact": {"pattern": "\"password\":\"[^\"]*\"", "with": "\"password\":\"***\""}}
+//	]
+//
+// Conditions and set values use the capture_if expression language. Logic
+// the rules cannot express goes in a starlark script (starlark.go).
+
+// TransformRule is one compiled transform rule.
+type TransformRule struct {
+	cond   *Expr
+	drop   bool
+	set    map[string]*Expr
+	unset  []string
+	redact *regexp.Regexp
+	with   []byte
+	bodies []string // request.body / response.body
+}
+
+// ParseTransform compiles the transform rules.
+func ParseTransform(rules []interface{}) ([]TransformRule, error) {
+	out := make([]TransformRule, 0, len(rules))
+	for i, r := range rules {
+		m, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rule %d is not an object", i)
+		}
+		var t TransformRule
+		var err error
+		if v, ok := m["if"].(string); ok && v != "" {
+			if t.cond, err = CompileExpr(v); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+		t.drop, _ = m["drop"].(bool)
+		if v, ok := m["set"].(map[string]interface{}); ok {
+			t.set = make(map[string]*Expr, len(v))
+			for k, src := range v {
+				s, _ := src.(string)
+				if t.set[k], err = CompileExpr(s); err != nil {
+					return nil, fmt.Errorf("rule %d set %s: %w", i, k, err)
+				}
+			}
+		}
+		if v, ok := m["unset"].([]interface{}); ok {
+			for _, k := range v {
+				t.unset = append(t.unset, fmt.Sprint(k))
+			}
+		}
+		if v, ok := m["redact"].(map[string]interface{}); ok {
+			p, _ := v["pattern"].(string)
+			if t.redact, err = regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("rule %d redact: %w", i, err)
+			}
+			w, _ := v["with"].(string)
+			t.with = []byte(w)
+			t.bodies = []string{"request.body", "response.body"}
+			if in, ok := v["in"].([]interface{}); ok {
+				t.bodies = t.bodies[:0]
+				for _, b := range in {
+					if b != "request.body" && b != "response.body" {
+						return nil, fmt.Errorf("rule %d redact: cannot redact %v", i, b)
+					}
+					t.bodies = append(t.bodies, b.(string))
+				}
+			}
+		}
+		if !t.drop && t.set == nil && t.unset == nil && t.redact == nil {
+			return nil, fmt.Errorf("rule %d does nothing", i)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// applyTransform runs the rules and reports whether the event is kept. A
+// condition that fails to evaluate skips its rule.
+func applyTransform(c *Config, ev *Event) bool {
+	for _, t := range c.Transform {
+		if t.cond != nil {
+			ok, err := t.cond.test(ev.vars())
+			if err != nil {
+				vdbg(c, "transform:", err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		if t.drop {
+			return false
+		}
+		if len(t.set) > 0 {
+			vars := ev.vars()
+			for k, e := range t.set {
+				v, err := e.eval(vars)
+				if err != nil {
+					vdbg(c, "transform set", k+":", err)
+					continue
+				}
+				ev.Meta.Set(k, exprString(v))
+			}
+		}
+		for _, k := range t.unset {
+			ev.Meta.Del(k)
+		}
+		if t.redact != nil {
+			for _, b := range t.bodies {
+				switch b {
+				case "request.body":
+					ev.ReqBody = t.redact.ReplaceAll(ev.ReqBody, t.with)
+				case "response.body":
+					ev.RespBody = t.redact.ReplaceAll(ev.RespBody, t.with)
+				}
+			}
+		}
+	}
+	return true
+}
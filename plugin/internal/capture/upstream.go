@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* ───────── upstream errors ───────── */
+
+// When the backend call fails the client gets a 502 with the error text, and
+// the event records the same: status 502, the error text as response body,
+// and the meta fields
+//
+//	error        the error message
+//	error_class  timeout | canceled | connection_refused | connection_reset |
+//	             dns | tls | other
+//
+// so the failed requests are tracked like any other (and count as error
+// events for the delivery queue).
+
+// upstreamFailed completes ev for a failed backend call; body is what the
+// client received.
+func upstreamFailed(ev *Event, err error, body []byte, start time.Time) {
+	ev.Status = http.StatusBadGateway
+	ev.RespHeader = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	ev.RespBody = body
+	ev.Elapsed = time.Since(start)
+	ev.Meta.Set("status", strconv.Itoa(http.StatusBadGateway))
+	responseMeta(ev, int64(len(body)), 0)
+	timingMeta(ev)
+	ev.Meta.Set("error", err.Error())
+	ev.Meta.Set("error_class", errorClass(err))
+}
+
+func errorClass(err error) string {
+	var (
+		dns  *net.DNSError
+		nerr net.Error
+		cert *tls.CertificateVerificationError
+		rec  tls.RecordHeaderError
+		ua   x509.UnknownAuthorityError
+		host x509.HostnameError
+		inv  x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection_reset"
+	case errors.As(err, &dns):
+		return "dns"
+	case errors.As(err, &cert), errors.As(err, &rec), errors.As(err, &ua), errors.As(err, &host), errors.As(err, &inv):
+		return "tls"
+	}
+	return "other"
+}
+
+/* ───────── upstream target ───────── */
+
+// Every event names the backend instance that served it, so captures can be
+// attributed to one instance when only some of them fail:
+//
+//	upstream.ip           10.0.3.17 (the connected, or last dialed, address)
+//	upstream.port         8080
+//	upstream.attempts     connections the transport asked for; above 1 when
+//	                      it retried on a reused connection that broke
+//	upstream.conn_reused  true | false
+
+// upstreamTrace collects the connection details of one backend call; the
+// callbacks may run on the transport's goroutines.
+type upstreamTrace struct {
+	mu       sync.Mutex
+	attempts int
+	addr     string
+	reused   bool
+}
+
+// traceUpstream returns req set up to record into the trace.
+func traceUpstream(req *http.Request) (*http.Request, *upstreamTrace) {
+	t := &upstreamTrace{}
+	ct := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			t.attempts++
+			t.mu.Unlock()
+		},
+		ConnectStart: func(_, addr string) {
+			t.mu.Lock()
+			t.addr = addr
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.addr, t.reused = info.Conn.RemoteAddr().String(), info.Reused
+			t.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct)), t
+}
+
+// record sets the upstream.* fields of ev.
+func (t *upstreamTrace) record(ev *Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if host, port, err := net.SplitHostPort(t.addr); err == nil {
+		ev.Meta.Set("upstream.ip", host)
+		ev.Meta.Set("upstream.port", port)
+	}
+	ev.Meta.Set("upstream.attempts", strconv.Itoa(t.attempts))
+	ev.Meta.Set("upstream.conn_reused", strconv.FormatBool(t.reused))
+}
@@ -0,0 +1,193 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+/* ───────── WASM transform ───────── */
+
+// A compiled WebAssembly module (run by wazero, pure Go) gets every event
+// after the transform rules and returns it changed, or drops it. ABI:
+//
+//	memory                                exported linear memory
+//	alloc(len i32) -> ptr i32             buffer for the input document
+//	transform(ptr i32, len i32) -> i64    0 drops the event, otherwise
+//	                                      (out_ptr << 32 | out_len)
+//	dealloc(ptr i32, len i32)             optional, called for both buffers
+//
+// The input is the JSON view expressions get (request, response, meta,
+// duration_ms). The output may carry meta (replaces the event fields),
+// request.body and response.body; anything else is ignored. WASI is available
+// to modules built for wasip1 as reactors (_initialize).
+//
+//	"wasm": {
+//	  "module":        "/etc/krakend/transform.wasm",
+//	  "max_instances": 4
+//	}
+
+// WASMTransform is a compiled module and its instance pool.
+type WASMTransform struct {
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+
+	idle  chan api.Module
+	slots chan struct{} // bounds live instances to max_instances
+}
+
+// NewWASMTransform compiles the module named in the wasm block.
+func NewWASMTransform(opts map[string]interface{}) (*WASMTransform, error) {
+	path, _ := opts["module"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("%s wasm needs a module", tag)
+	}
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s wasm: %w", tag, err)
+	}
+	n := 4
+	if v, ok := opts["max_instances"].(float64); ok && v > 0 {
+		n = int(v)
+	}
+
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	compiled, err := rt.CompileModule(ctx, bin)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("%s wasm %s: %w", tag, path, err)
+	}
+	exports := compiled.ExportedFunctions()
+	for _, fn := range []string{"alloc", "transform"} {
+		if _, ok := exports[fn]; !ok {
+			rt.Close(ctx)
+			return nil, fmt.Errorf("%s wasm %s does not export %s", tag, path, fn)
+		}
+	}
+	return &WASMTransform{
+		rt:       rt,
+		compiled: compiled,
+		idle:     make(chan api.Module, n),
+		slots:    make(chan struct{}, n),
+	}, nil
+}
+
+// apply runs the module on ev and reports whether the event is kept.
+func (w *WASMTransform) apply(ctx context.Context, ev *Event) (bool, error) {
+	in, err := json.Marshal(ev.vars())
+	if err != nil {
+		return true, err
+	}
+	m, err := w.get(ctx)
+	if err != nil {
+		return true, err
+	}
+	out, keep, err := w.call(ctx, m, in)
+	w.put(m, err)
+	if err != nil || !keep {
+		return keep, err
+	}
+
+	var res struct {
+		Meta    map[string]string `json:"meta"`
+		Request struct {
+			Body *string `json:"body"`
+		} `json:"request"`
+		Response struct {
+			Body *string `json:"body"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return true, fmt.Errorf("wasm: bad output: %w", err)
+	}
+	if res.Meta != nil {
+		for k := range ev.Meta {
+			delete(ev.Meta, k)
+		}
+		for k, v := range res.Meta {
+			ev.Meta.Set(k, v)
+		}
+	}
+	if res.Request.Body != nil {
+		ev.ReqBody = []byte(*res.Request.Body)
+	}
+	if res.Response.Body != nil {
+		ev.RespBody = []byte(*res.Response.Body)
+	}
+	return true, nil
+}
+
+func (w *WASMTransform) call(ctx context.Context, m api.Module, in []byte) ([]byte, bool, error) {
+	r, err := m.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, true, err
+	}
+	ptr := uint32(r[0])
+	if !m.Memory().Write(ptr, in) {
+		return nil, true, fmt.Errorf("wasm: alloc returned %d, out of memory bounds", ptr)
+	}
+	r, err = m.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, true, err
+	}
+	dealloc := m.ExportedFunction("dealloc")
+	if dealloc != nil {
+		dealloc.Call(ctx, uint64(ptr), uint64(len(in)))
+	}
+	if r[0] == 0 {
+		return nil, false, nil
+	}
+	optr, olen := uint32(r[0]>>32), uint32(r[0])
+	b, ok := m.Memory().Read(optr, olen)
+	if !ok {
+		return nil, true, fmt.Errorf("wasm: output %d+%d out of memory bounds", optr, olen)
+	}
+	out := append([]byte(nil), b...)
+	if dealloc != nil {
+		dealloc.Call(ctx, uint64(optr), uint64(olen))
+	}
+	return out, true, nil
+}
+
+// get hands out an idle instance or starts one while below max_instances.
+// Instances are single-threaded, so each call has one to itself.
+func (w *WASMTransform) get(ctx context.Context) (api.Module, error) {
+	select {
+	case m := <-w.idle:
+		return m, nil
+	default:
+	}
+	select {
+	case m := <-w.idle:
+		return m, nil
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// a background context: the instance outlives this event
+	m, err := w.rt.InstantiateModule(context.Background(), w.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		<-w.slots
+		return nil, err
+	}
+	return m, nil
+}
+
+// put returns an instance to the pool; an instance that failed (trap,
+// deadline) may be corrupt or closed and is dropped.
+func (w *WASMTransform) put(m api.Module, err error) {
+	if err != nil {
+		m.Close(context.Background())
+		<-w.slots
+		return
+	}
+	w.idle <- m
+}
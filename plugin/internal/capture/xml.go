@@ -0,0 +1,213 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+/* ───────── XML / SOAP awareness ───────── */
+
+// For XML request bodies the root element goes to xml.root; SOAP envelopes
+// add soap.version, soap.operation (the first element inside Body) and
+// soap.action (SOAPAction header or the action parameter of
+// application/soap+xml). Elements matched by the redact paths have their
+// content replaced in both bodies; paths use local names, either absolute
+// (/Envelope/Body/Login/Password) or at any depth (//Password, //Login/Password).
+//
+//	"xml": {
+//	  "redact":      ["//Password", "/Envelope/Header/Security"],
+//	  "replacement": "***"
+//	}
+
+// XML holds the xml options.
+type XML struct {
+	redact      [][]string // local names; a leading "" means any depth
+	replacement []byte
+}
+
+// ParseXML reads xml; nil when disabled.
+func ParseXML(v interface{}) (*XML, error) {
+	o := &XML{replacement: []byte("***")}
+	switch b := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !b {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		if r, ok := b["replacement"].(string); ok {
+			o.replacement = []byte(r)
+		}
+		paths, _ := b["redact"].([]interface{})
+		for _, p := range paths {
+			s, _ := p.(string)
+			var steps []string
+			switch {
+			case strings.HasPrefix(s, "//"):
+				steps = append([]string{""}, strings.Split(s[2:], "/")...)
+			case strings.HasPrefix(s, "/"):
+				steps = strings.Split(s[1:], "/")
+			default:
+				return nil, fmt.Errorf("xml redact path %q must start with / or //", s)
+			}
+			tail := steps
+			if steps[0] == "" {
+				tail = steps[1:]
+			}
+			if len(tail) == 0 || slices.Contains(tail, "") {
+				return nil, fmt.Errorf("xml redact path %q has an empty step", s)
+			}
+			o.redact = append(o.redact, steps)
+		}
+	default:
+		return nil, fmt.Errorf("xml must be true or an object")
+	}
+	return o, nil
+}
+
+func applyXML(o *XML, ev *Event) {
+	if isXML(ev.ReqHeader, ev.ReqBody) {
+		root, op, version := xmlShape(ev.ReqBody)
+		if root != "" {
+			ev.Meta.Set("xml.root", root)
+		}
+		if version != "" {
+			ev.Meta.Set("soap.version", version)
+			if op != "" {
+				ev.Meta.Set("soap.operation", op)
+			}
+			if a := soapAction(ev.ReqHeader); a != "" {
+				ev.Meta.Set("soap.action", a)
+			}
+		}
+		if len(o.redact) > 0 {
+			ev.ReqBody = o.redactBody(ev.ReqBody)
+		}
+	}
+	if len(o.redact) > 0 && isXML(ev.RespHeader, ev.RespBody) {
+		ev.RespBody = o.redactBody(ev.RespBody)
+	}
+}
+
+func isXML(h http.Header, body []byte) bool {
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt != "" {
+		return strings.HasSuffix(mt, "/xml") || strings.HasSuffix(mt, "+xml")
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// xmlShape returns the root element and, for SOAP envelopes, the operation
+// element and SOAP version.
+func xmlShape(body []byte) (root, op, version string) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	depth, inBody := 0, false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1:
+				root = e.Name.Local
+				if root != "Envelope" {
+					return
+				}
+				switch e.Name.Space {
+				case "http://schemas.xmlsoap.org/soap/envelope/":
+					version = "1.1"
+				case "http://www.w3.org/2003/05/soap-envelope":
+					version = "1.2"
+				default:
+					return
+				}
+			case depth == 2 && e.Name.Local == "Body":
+				inBody = true
+			case depth == 3 && inBody:
+				op = e.Name.Local
+				return
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+func soapAction(h http.Header) string {
+	if a := strings.Trim(h.Get("SOAPAction"), `"`); a != "" {
+		return a
+	}
+	_, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return params["action"]
+}
+
+// redactBody replaces the content of matching elements, leaving every other
+// byte of the document as it was. When the document ends (e.g. clipped by
+// max_capture_kb) inside a redacted element, the rest is dropped.
+func (o *XML) redactBody(body []byte) []byte {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	var out bytes.Buffer
+	var stack []string
+	copied := int64(0)
+	redactAt, redactFrom := -1, int64(0) // depth and start of redacted content
+	for {
+		off := d.InputOffset()
+		t, err := d.RawToken()
+		if err != nil {
+			break
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, e.Name.Local)
+			if redactAt < 0 && o.matches(stack) {
+				redactAt, redactFrom = len(stack), d.InputOffset()
+			}
+		case xml.EndElement:
+			if redactAt == len(stack) {
+				if off > redactFrom { // not <x/>
+					out.Write(body[copied:redactFrom])
+					out.Write(o.replacement)
+					copied = off
+				}
+				redactAt = -1
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if redactAt >= 0 {
+		out.Write(body[copied:redactFrom])
+		out.Write(o.replacement)
+		return out.Bytes()
+	}
+	if copied == 0 {
+		return body
+	}
+	out.Write(body[copied:])
+	return out.Bytes()
+}
+
+func (o *XML) matches(stack []string) bool {
+	for _, p := range o.redact {
+		if p[0] == "" { // any depth: match the tail
+			tail := p[1:]
+			if len(stack) >= len(tail) && slices.Equal(stack[len(stack)-len(tail):], tail) {
+				return true
+			}
+		} else if slices.Equal(stack, p) {
+			return true
+		}
+	}
+	return false
+}
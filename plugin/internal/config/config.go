@@ -0,0 +1,472 @@
+// Package config turns a backend's extra_config block into a capture
+// configuration and its sink.
+//
+// SPDX-License-Identifier: Apache-2.0
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"trace-plugin/internal/capture"
+	"trace-plugin/internal/sink"
+)
+
+/* ─────────────────── defaults ─────────────────── */
+
+const (
+	defTimeoutMS    = 2_000 // per-event deadline (ms)
+	defMaxCaptureKB = 256   // body capture limit
+	tag             = capture.Tag
+)
+
+// keys are the block's top-level keys besides the per-sink and per-format
+// option blocks.
+var keys = map[string]bool{
+	"tracking_url": true, "timeout_ms": true, "drain_timeout_ms": true, "max_capture_kb": true, "capture_tail_kb": true, "verbose": true,
+	"cloud_metadata": true, "labels": true, "tag_headers": true, "endpoint": true,
+	"backend": true, "trusted_proxies": true, "sink": true, "payload_format": true,
+	"graphql": true, "xml": true, "protobuf": true, "normalize_json": true,
+	"binary_bodies": true, "charsets": true, "content_encoding": true,
+	"extract_fields": true, "capture_if": true, "transform": true,
+	"starlark": true, "wasm": true, "shadow": true, "admin_port": true, "recent_events": true,
+	"self_test": true, "dry_run": true, "fault_injection": true, "tenant": true,
+	"tracking_urls": true, "balance": true, "queue": true, "split_phases": true,
+	"profile": true, "sink_rules": true, "consent": true, "delivery_mode": true,
+	"classification": true, "retention_days": true, "tokenize": true, "dedupe": true,
+	"cookies": true, "tls_meta": true, "capture_headers": true, "health_check": true, "sampling": true,
+	"feature_flag": true, "max_pending_mb": true, "overflow": true, "pipeline_stats": true,
+	"anonymize_ip": true, "audit": true, "sink_tls": true, "upstream_tls": true, "vault": true,
+	"avro": true, "template": true, "cloudevents": true, // payload_format options
+}
+
+// binaryFormats carry bodies as bytes, so binary_bodies defaults to raw.
+var binaryFormats = map[string]bool{"msgpack": true, "cbor": true, "proto": true}
+
+// Parse reads the plugin block and builds its sink; unknown keys are
+// ignored, invalid values fail.
+func Parse(block map[string]interface{}) (*capture.Config, error) {
+	block, err := Resolve(block)
+	if err != nil {
+		return nil, err
+	}
+	effective := masked(block, "", false).(map[string]interface{}) // before vault fills in secrets
+	block, watch, err := withVault(block)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(block)
+	if err != nil {
+		return nil, err
+	}
+	c.Effective = effective
+	switch v := block["cloud_metadata"].(type) {
+	case string:
+		capture.LoadCloudIdentity(v)
+	case bool:
+		if v {
+			capture.LoadCloudIdentity("auto")
+		}
+	}
+	if c.AdminPort > 0 {
+		if err := capture.ServeAdmin(c.AdminPort); err != nil {
+			return nil, fmt.Errorf("%s admin server: %w", tag, err)
+		}
+	}
+	capture.KeepRecent(c.RecentEvents)
+	if c.DryRun {
+		capture.Log("dry_run: payloads of", c.URL.Redacted(), "are logged, not sent")
+		return c, nil
+	}
+	if _, ok := block["fault_injection"]; ok && os.Getenv(sink.FaultEnv) != "1" {
+		return nil, fmt.Errorf("%s fault_injection is for testing and needs %s=1", tag, sink.FaultEnv)
+	}
+	if c.Sink, err = sink.New(c.URL, c.Timeout, c.Format, block); err != nil {
+		return nil, err
+	}
+	if watch != nil {
+		watch(c)
+	}
+	if err := capture.SelfTest(c); err != nil {
+		return nil, err
+	}
+	capture.StartHealthCheck(c)
+	capture.StartSampling(c)
+	capture.StartFeatureFlag(c)
+	capture.StartPipelineStats(c)
+	return c, nil
+}
+
+// Validate parses block like Parse without side effects: no cloud metadata
+// lookup, no admin server or self-test, and local sinks (which create
+// directories) are not built.
+func Validate(block map[string]interface{}) (*capture.Config, error) {
+	block, err := Resolve(block)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(block)
+	if err != nil {
+		return nil, err
+	}
+	kind := sink.Kind(c.URL, block)
+	if !slices.Contains(sink.Kinds, kind) {
+		return nil, fmt.Errorf("%s unknown sink %q", tag, kind)
+	}
+	if !sink.Local[kind] {
+		if c.Sink, err = sink.New(c.URL, c.Timeout, c.Format, block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Unknown lists the keys of block nothing reads, sorted; usually typos.
+func Unknown(block map[string]interface{}) []string {
+	var out []string
+	for k := range block {
+		if !keys[k] && !slices.Contains(sink.Kinds, k) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func parse(block map[string]interface{}) (*capture.Config, error) {
+	// mandatory tracking_url (local sinks have nowhere to send to)
+	rawURL, _ := block["tracking_url"].(string)
+	if rawURL == "" {
+		rawURL = sink.FirstTarget(block) // with tracking_urls
+	}
+	target := &url.URL{Scheme: "local"}
+	var err error
+	if rawURL != "" || !sink.Local[fmt.Sprint(block["sink"])] {
+		if target, err = url.ParseRequestURI(rawURL); err != nil {
+			return nil, fmt.Errorf("%s invalid tracking_url: %w", tag, err)
+		}
+	}
+
+	c := &capture.Config{
+		URL:        target,
+		Timeout:    defTimeoutMS * time.Millisecond,
+		MaxCapture: defMaxCaptureKB * 1024,
+		Verbose:    false,
+		Format:     capture.PayloadFormats["v1"],
+	}
+	if v, ok := block["timeout_ms"].(float64); ok && v > 0 {
+		c.Timeout = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := block["drain_timeout_ms"].(float64); ok {
+		if v < 0 {
+			return nil, fmt.Errorf("%s invalid drain_timeout_ms: must not be negative", tag)
+		}
+		c.DrainTimeout = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := block["max_capture_kb"].(float64); ok && v > 0 {
+		c.MaxCapture = int(v * 1024)
+	}
+	if v, ok := block["max_pending_mb"].(float64); ok {
+		if v <= 0 {
+			return nil, fmt.Errorf("%s invalid max_pending_mb: must be positive", tag)
+		}
+		c.MaxPending = int64(v * (1 << 20))
+	}
+	if v, ok := block["capture_tail_kb"].(float64); ok {
+		if v < 0 {
+			return nil, fmt.Errorf("%s invalid capture_tail_kb: must not be negative", tag)
+		}
+		c.CaptureTail = int(v * 1024)
+	}
+	if v, ok := block["verbose"].(bool); ok {
+		c.Verbose = v
+	}
+	if v, ok := block["labels"].(map[string]interface{}); ok {
+		c.Labels = make(map[string]string, len(v))
+		for k, l := range v {
+			c.Labels[k] = fmt.Sprint(l)
+		}
+	}
+	// KrakenD hands http-client plugins the backend extra_config only, so the
+	// endpoint pattern (lost once path params are substituted) is declared here
+	if v, ok := block["endpoint"].(string); ok {
+		c.Endpoint = v
+	}
+	if v, ok := block["backend"].(string); ok {
+		c.Backend = v
+	}
+	if v, ok := block["trusted_proxies"].([]interface{}); ok {
+		if c.TrustedProxies, err = capture.ParseTrustedProxies(v); err != nil {
+			return nil, fmt.Errorf("%s invalid trusted_proxies: %w", tag, err)
+		}
+	}
+	if v, ok := block["tag_headers"].(map[string]interface{}); ok {
+		c.TagHeaders = make(map[string]string, len(v))
+		for h, f := range v {
+			name, ok := f.(string)
+			if !ok || name == "" {
+				continue
+			}
+			if capture.ReservedField(name) {
+				return nil, fmt.Errorf("%s tag_headers: %s would overwrite the built-in field %q", tag, h, name)
+			}
+			c.TagHeaders[http.CanonicalHeaderKey(h)] = name
+		}
+	}
+	if v, ok := block["payload_format"].(string); ok && v != "" {
+		if c.Format, err = capture.NewPayloadFormat(c, v, block); err != nil {
+			return nil, err
+		}
+	}
+	c.GraphQL = capture.ParseGraphQL(block["graphql"])
+	if c.XML, err = capture.ParseXML(block["xml"]); err != nil {
+		return nil, fmt.Errorf("%s invalid xml: %w", tag, err)
+	}
+	if v, ok := block["protobuf"].(map[string]interface{}); ok {
+		if c.Protobuf, err = capture.ParseProtobuf(v); err != nil {
+			return nil, fmt.Errorf("%s invalid protobuf: %w", tag, err)
+		}
+	}
+	if v, ok := block["normalize_json"].(string); ok && v != "" {
+		if c.NormalizeJSON, err = capture.ParseNormalizeJSON(v); err != nil {
+			return nil, fmt.Errorf("%s invalid normalize_json: %w", tag, err)
+		}
+	}
+	bb, _ := block["binary_bodies"].(string)
+	if bb == "" && binaryFormats[c.Format.Name] {
+		bb = "raw"
+	}
+	if c.Base64Bodies, err = capture.ParseBinaryBodies(bb); err != nil {
+		return nil, fmt.Errorf("%s invalid binary_bodies: %w", tag, err)
+	}
+	cs, _ := block["charsets"].(string)
+	if c.Charsets, err = capture.ParseCharsets(cs); err != nil {
+		return nil, fmt.Errorf("%s invalid charsets: %w", tag, err)
+	}
+	ce, _ := block["content_encoding"].(string)
+	if c.Decompress, err = capture.ParseContentEncoding(ce); err != nil {
+		return nil, fmt.Errorf("%s invalid content_encoding: %w", tag, err)
+	}
+	if v, ok := block["extract_fields"].(map[string]interface{}); ok {
+		if c.Extract, err = capture.ParseExtractFields(v); err != nil {
+			return nil, fmt.Errorf("%s invalid extract_fields: %w", tag, err)
+		}
+	}
+	if v, ok := block["capture_if"].(string); ok && v != "" {
+		if c.CaptureIf, err = capture.CompileExpr(v); err != nil {
+			return nil, fmt.Errorf("%s invalid capture_if: %w", tag, err)
+		}
+	}
+	if v, ok := block["transform"].([]interface{}); ok {
+		if c.Transform, err = capture.ParseTransform(v); err != nil {
+			return nil, fmt.Errorf("%s invalid transform: %w", tag, err)
+		}
+	}
+	if v, ok := block["starlark"].(map[string]interface{}); ok {
+		if c.Starlark, err = capture.NewStarlarkTransform(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := block["wasm"].(map[string]interface{}); ok {
+		if c.WASM, err = capture.NewWASMTransform(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := block["shadow"].(map[string]interface{}); ok {
+		if c.Shadow, err = capture.NewShadow(c, v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := block["admin_port"].(float64); ok {
+		if c.AdminPort = int(v); c.AdminPort <= 0 || c.AdminPort > 65535 {
+			return nil, fmt.Errorf("%s invalid admin_port %v", tag, v)
+		}
+	}
+	if v, ok := block["recent_events"].(float64); ok && v > 0 {
+		if c.AdminPort == 0 {
+			return nil, fmt.Errorf("%s recent_events needs admin_port", tag)
+		}
+		c.RecentEvents = int(v)
+	}
+	if v, ok := block["tenant"].(map[string]interface{}); ok {
+		if c.Tenant, err = capture.ParseTenant(v); err != nil {
+			return nil, fmt.Errorf("%s invalid tenant: %w", tag, err)
+		}
+		if l, ok := v["limits"].(map[string]interface{}); ok {
+			if c.TenantLimits, err = capture.ParseTenantLimits(l); err != nil {
+				return nil, fmt.Errorf("%s invalid tenant limits: %w", tag, err)
+			}
+		}
+	}
+	if c.SelfTest, err = capture.ParseSelfTest(block["self_test"]); err != nil {
+		return nil, fmt.Errorf("%s invalid self_test: %w", tag, err)
+	}
+	if v, ok := block["dry_run"].(bool); ok {
+		c.DryRun = v
+	}
+	if v, ok := block["consent"].(map[string]interface{}); ok {
+		if c.Consent, err = capture.ParseConsent(v); err != nil {
+			return nil, fmt.Errorf("%s invalid consent: %w", tag, err)
+		}
+	}
+	switch v := block["classification"].(type) {
+	case string:
+		c.Classification = []string{v}
+	case []interface{}:
+		for _, l := range v {
+			s, ok := l.(string)
+			if !ok || s == "" || strings.Contains(s, ",") {
+				return nil, fmt.Errorf("%s invalid classification %v", tag, l)
+			}
+			c.Classification = append(c.Classification, s)
+		}
+	}
+	if v, ok := block["retention_days"].(float64); ok {
+		if c.RetentionDays = int(v); c.RetentionDays < 1 {
+			return nil, fmt.Errorf("%s invalid retention_days %v", tag, v)
+		}
+	}
+	if v, ok := block["tokenize"].(map[string]interface{}); ok {
+		if c.Tokenize, err = capture.ParseTokenize(v); err != nil {
+			return nil, fmt.Errorf("%s invalid tokenize: %w", tag, err)
+		}
+	}
+	if c.AnonymizeIP, err = capture.ParseIPMask(block["anonymize_ip"]); err != nil {
+		return nil, fmt.Errorf("%s invalid anonymize_ip: %w", tag, err)
+	}
+	if c.Cookies, err = capture.ParseCookies(block["cookies"]); err != nil {
+		return nil, fmt.Errorf("%s invalid cookies: %w", tag, err)
+	}
+	if c.TLSMeta, err = capture.ParseTLSMeta(block["tls_meta"]); err != nil {
+		return nil, fmt.Errorf("%s invalid tls_meta: %w", tag, err)
+	}
+	if v, ok := block["capture_headers"].(map[string]interface{}); ok {
+		if c.Headers, err = capture.ParseHeaderLists(v); err != nil {
+			return nil, fmt.Errorf("%s invalid capture_headers: %w", tag, err)
+		}
+	}
+	if v, ok := block["audit"].(map[string]interface{}); ok {
+		if c.Audit, err = capture.ParseAudit(v); err != nil {
+			return nil, fmt.Errorf("%s invalid audit: %w", tag, err)
+		}
+		if kind := sink.Reencodes(c.URL, c.Format.Name, block); kind != "" {
+			return nil, fmt.Errorf("%s invalid audit: %s stores events encoded again, not the hashed payload, so the chain cannot be verified", tag, kind)
+		}
+	}
+	if v, ok := block["upstream_tls"].(map[string]interface{}); ok {
+		t, err := capture.ParseTLS("upstream_tls", v)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid upstream_tls: %w", tag, err)
+		}
+		c.Upstream = capture.HTTPClient(t)
+	}
+	if v, ok := block["split_phases"].(bool); ok {
+		c.SplitPhases = v
+	}
+	if v, ok := block["queue"].(map[string]interface{}); ok {
+		if c.Queue, err = capture.ParseQueue(v); err != nil {
+			return nil, fmt.Errorf("%s invalid queue: %w", tag, err)
+		}
+		switch bp, _ := v["backpressure"].(string); bp { // before overflow
+		case "", "drop":
+		case "block":
+			if c.Overflow, err = capture.ParseOverflow(map[string]interface{}{"policy": "block",
+				"block_ms": v["block_ms"]}); err != nil {
+				return nil, fmt.Errorf("%s invalid queue: %w", tag, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s invalid queue: backpressure must be drop or block, not %q", tag, bp)
+		}
+	}
+	if v, ok := block["overflow"].(map[string]interface{}); ok {
+		if c.Overflow, err = capture.ParseOverflow(v); err != nil {
+			return nil, fmt.Errorf("%s invalid overflow: %w", tag, err)
+		}
+	}
+	if v, ok := block["sampling"].(map[string]interface{}); ok {
+		if c.Sampling, err = capture.ParseSampling(v); err != nil {
+			return nil, fmt.Errorf("%s invalid sampling: %w", tag, err)
+		}
+	}
+	if v, ok := block["feature_flag"].(map[string]interface{}); ok {
+		if c.Flag, err = capture.ParseFeatureFlag(v); err != nil {
+			return nil, fmt.Errorf("%s invalid feature_flag: %w", tag, err)
+		}
+	}
+	if v, ok := block["pipeline_stats"]; ok {
+		if c.Stats, err = capture.ParsePipelineStats(v); err != nil {
+			return nil, fmt.Errorf("%s invalid pipeline_stats: %w", tag, err)
+		}
+	}
+	if v, ok := block["health_check"].(map[string]interface{}); ok {
+		if c.Health, err = capture.ParseHealthCheck(v); err != nil {
+			return nil, fmt.Errorf("%s invalid health_check: %w", tag, err)
+		}
+	}
+	if v, ok := block["dedupe"].(map[string]interface{}); ok {
+		if c.Dedupe, err = capture.ParseDedupe(v); err != nil {
+			return nil, fmt.Errorf("%s invalid dedupe: %w", tag, err)
+		}
+	}
+	switch v, _ := block["delivery_mode"].(string); v {
+	case "", "async":
+	case "sync":
+		if c.Queue != nil {
+			return nil, fmt.Errorf("%s delivery_mode sync cannot be combined with a queue", tag)
+		}
+		c.SyncDelivery = true
+	default:
+		return nil, fmt.Errorf("%s invalid delivery_mode %q: async or sync", tag, v)
+	}
+	return c, nil
+}
+
+/* ───────── effective configuration ───────── */
+
+// secretKeys mark the strings /debug/config does not show; every value of a
+// headers object is masked as well, URLs lose their password and Azure
+// connection strings their SharedAccessKey.
+var secretKeys = []string{"password", "secret", "token", "api_key", "access_key", "private_key",
+	"credentials", "authorization", "connection_string"}
+
+var sharedAccessKey = regexp.MustCompile(`(?i)(SharedAccessKey=)[^;]*`)
+
+// masked copies the resolved block for /debug/config.
+func masked(v interface{}, key string, inHeaders bool) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			out[k] = masked(e, k, strings.EqualFold(key, "headers"))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = masked(e, key, false)
+		}
+		return out
+	case string:
+		secret := inHeaders
+		for _, s := range secretKeys {
+			secret = secret || strings.Contains(strings.ToLower(key), s)
+		}
+		if secret && x != "" {
+			return "****"
+		}
+		if u, err := url.Parse(x); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		if sharedAccessKey.MatchString(x) {
+			return sharedAccessKey.ReplaceAllString(x, "${1}****")
+		}
+	}
+	return v
+}
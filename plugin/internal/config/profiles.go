@@ -0,0 +1,105 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/* ───────── capture profiles ───────── */
+
+// A profile is a named, partial plugin block defined once for the service
+// and referenced from each backend:
+//
+//	"krakend-trace-plugin": {"profile": "pii-strict", "endpoint": "/users/{id}"}
+//
+// KrakenD hands http-client plugins the backend extra_config only, so the
+// profiles live in a JSON file named by TRACE_PLUGIN_PROFILES:
+//
+//	{
+//	  "pii-strict": {"tracking_url": "https://collector/ingest", "max_capture_kb": 16,
+//	                 "transform": [{"redact": {"pattern": "\\d{16}", "with": "****"}}]},
+//	  "errors-only": {"capture_if": "response.status >= 500"}
+//	}
+//
+// "profile" is a name or a list of names applied in order; the backend's own
+// keys override the profiles' (top-level keys are replaced, not merged).
+
+// ProfilesEnv names the profiles file.
+const ProfilesEnv = "TRACE_PLUGIN_PROFILES"
+
+var (
+	profilesMu   sync.Mutex
+	profilesPath string
+	profiles     map[string]map[string]interface{}
+)
+
+// Resolve returns block with its profiles applied, without the "profile"
+// key; block itself is not modified.
+func Resolve(block map[string]interface{}) (map[string]interface{}, error) {
+	var names []string
+	switch v := block["profile"].(type) {
+	case nil:
+		return block, nil
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, n := range v {
+			s, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s profile names must be strings", tag)
+			}
+			names = append(names, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s profile must be a name or a list of names", tag)
+	}
+	all, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	for _, n := range names {
+		p, ok := all[n]
+		if !ok {
+			return nil, fmt.Errorf("%s unknown profile %q", tag, n)
+		}
+		for k, v := range p {
+			out[k] = v
+		}
+	}
+	for k, v := range block {
+		out[k] = v
+	}
+	delete(out, "profile")
+	return out, nil
+}
+
+// loadProfiles reads the profiles file once per path.
+func loadProfiles() (map[string]map[string]interface{}, error) {
+	path := os.Getenv(ProfilesEnv)
+	if path == "" {
+		return nil, fmt.Errorf("%s profile needs %s to name the profiles file", tag, ProfilesEnv)
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if path == profilesPath {
+		return profiles, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s profiles: %w", tag, err)
+	}
+	var all map[string]map[string]interface{}
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, fmt.Errorf("%s profiles %s: %w", tag, path, err)
+	}
+	for n, p := range all {
+		if _, ok := p["profile"]; ok {
+			return nil, fmt.Errorf("%s profile %q: profiles cannot reference profiles", tag, n)
+		}
+	}
+	profilesPath, profiles = path, all
+	return all, nil
+}
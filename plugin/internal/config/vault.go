@@ -0,0 +1,410 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trace-plugin/internal/capture"
+	"trace-plugin/internal/sink"
+)
+
+/* ───────── Vault secrets ───────── */
+
+// A "vault" block lets any string of the plugin block name a secret in a
+// HashiCorp Vault KV v2 engine instead of holding it:
+//
+//	"vault": {
+//	  "address":   "https://vault.internal:8200",   // default VAULT_ADDR
+//	  "namespace": "ops",                           // optional (Enterprise)
+//	  "approle":   {"role_id": "…", "secret_id_file": "/secrets/vault-secret-id"},
+//	  "kubernetes": {"role": "krakend", "jwt_file": "…"},  // or this
+//	  "refresh_s": 300,                              // re-read the secrets, 0 to never
+//	  "tls":       {"ca_file": "/etc/ssl/vault-ca.pem"}     // as sink_tls
+//	},
+//	"elasticsearch": {"api_key": "vault:secret/krakend-trace#es_api_key"}
+//
+// "vault:<mount>/<path>#<key>" reads key of the secret at path in the engine
+// mounted at mount (a path with /data/ in it is used as is). Without approle
+// or kubernetes the token is VAULT_TOKEN. The login token is renewed at two
+// thirds of its TTL and the login repeated when renewal fails. When a secret
+// changes the sink is rebuilt with the new values; the other options and the
+// tracking_url keep the values read at startup.
+
+const vaultPrefix = "vault:"
+
+type vault struct {
+	addr, namespace string
+	client          *http.Client
+	login           func(ctx context.Context) error // nil: static token
+	refresh         time.Duration
+
+	once      sync.Once
+	mu        sync.Mutex
+	token     string
+	ttl       time.Duration
+	renewable bool
+}
+
+var (
+	vaultsMu sync.Mutex
+	vaults   = map[string]*vault{} // by block, so backends share a login
+)
+
+// vaultFor returns the client of a vault block, logging in on first use.
+func vaultFor(v map[string]interface{}) (*vault, error) {
+	key, _ := json.Marshal(v)
+	vaultsMu.Lock()
+	defer vaultsMu.Unlock()
+	if vc, ok := vaults[string(key)]; ok {
+		return vc, nil
+	}
+	vc := &vault{client: http.DefaultClient, refresh: 5 * time.Minute}
+	vc.addr, _ = v["address"].(string)
+	if vc.addr == "" {
+		vc.addr = os.Getenv("VAULT_ADDR")
+	}
+	if vc.addr == "" {
+		return nil, fmt.Errorf("address missing (or VAULT_ADDR)")
+	}
+	vc.addr = strings.TrimRight(vc.addr, "/")
+	vc.namespace, _ = v["namespace"].(string)
+	if n, ok := v["refresh_s"].(float64); ok && n >= 0 {
+		vc.refresh = time.Duration(n * float64(time.Second))
+	}
+	if t, ok := v["tls"].(map[string]interface{}); ok {
+		cfg, err := capture.ParseTLS("vault.tls", t)
+		if err != nil {
+			return nil, err
+		}
+		vc.client = capture.HTTPClient(cfg)
+	}
+	if a, ok := v["approle"].(map[string]interface{}); ok {
+		vc.login = vc.appRole(a)
+	} else if k, ok := v["kubernetes"].(map[string]interface{}); ok {
+		vc.login = vc.kubernetes(k)
+	} else if vc.token = os.Getenv("VAULT_TOKEN"); vc.token == "" {
+		return nil, fmt.Errorf("needs approle, kubernetes or VAULT_TOKEN")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var err error
+	if vc.login != nil {
+		err = vc.login(ctx)
+	} else {
+		err = vc.lookupSelf(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	vaults[string(key)] = vc
+	return vc, nil
+}
+
+func (vc *vault) appRole(a map[string]interface{}) func(context.Context) error {
+	mount := optString(a, "mount", "approle")
+	return func(ctx context.Context) error {
+		secret, _ := a["secret_id"].(string)
+		if path, _ := a["secret_id_file"].(string); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			secret = strings.TrimSpace(string(b))
+		}
+		return vc.authenticate(ctx, mount, map[string]string{"role_id": fmt.Sprint(a["role_id"]), "secret_id": secret})
+	}
+}
+
+func (vc *vault) kubernetes(k map[string]interface{}) func(context.Context) error {
+	mount := optString(k, "mount", "kubernetes")
+	path := optString(k, "jwt_file", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	return func(ctx context.Context) error {
+		jwt, err := os.ReadFile(path) // re-read, projected tokens rotate
+		if err != nil {
+			return err
+		}
+		return vc.authenticate(ctx, mount, map[string]string{"role": fmt.Sprint(k["role"]), "jwt": strings.TrimSpace(string(jwt))})
+	}
+}
+
+func optString(m map[string]interface{}, key, def string) string {
+	if s, _ := m[key].(string); s != "" {
+		return s
+	}
+	return def
+}
+
+type vaultAuth struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Data *struct {
+		TTL       int  `json:"ttl"`
+		Renewable bool `json:"renewable"`
+	} `json:"data"`
+}
+
+func (vc *vault) authenticate(ctx context.Context, mount string, body map[string]string) error {
+	var out vaultAuth
+	if err := vc.call(ctx, http.MethodPost, "auth/"+mount+"/login", body, &out); err != nil {
+		return err
+	}
+	if out.Auth == nil || out.Auth.ClientToken == "" {
+		return fmt.Errorf("login: no token")
+	}
+	vc.mu.Lock()
+	vc.token, vc.ttl, vc.renewable = out.Auth.ClientToken, time.Duration(out.Auth.LeaseDuration)*time.Second, out.Auth.Renewable
+	vc.mu.Unlock()
+	return nil
+}
+
+func (vc *vault) lookupSelf(ctx context.Context) error {
+	var out vaultAuth
+	if err := vc.call(ctx, http.MethodGet, "auth/token/lookup-self", nil, &out); err != nil {
+		return err
+	}
+	if out.Data != nil {
+		vc.mu.Lock()
+		vc.ttl, vc.renewable = time.Duration(out.Data.TTL)*time.Second, out.Data.Renewable
+		vc.mu.Unlock()
+	}
+	return nil
+}
+
+// keepAlive renews the token at two thirds of its TTL, logging in again when
+// that fails; tokens without a TTL are left alone.
+func (vc *vault) keepAlive() {
+	for {
+		vc.mu.Lock()
+		ttl, renewable := vc.ttl, vc.renewable
+		vc.mu.Unlock()
+		if ttl <= 0 || (!renewable && vc.login == nil) {
+			return
+		}
+		time.Sleep(ttl * 2 / 3)
+		vc.renew(renewable)
+	}
+}
+
+// vaultRetry is how soon a failed renewal is tried again.
+var vaultRetry = 30 * time.Second
+
+// renew runs one renewal. A panic counts as a failed renewal, so the loop
+// keeps going and the lease does not lapse silently.
+func (vc *vault) renew(renewable bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			capture.Log("vault:", err)
+			vc.mu.Lock()
+			vc.ttl = vaultRetry
+			vc.mu.Unlock()
+		}
+	}()
+	defer capture.Recover("vault token renewal", &err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = fmt.Errorf("token not renewable")
+	if renewable {
+		var out vaultAuth
+		err = vc.call(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &out)
+		switch {
+		case err != nil:
+		case out.Auth == nil || out.Auth.LeaseDuration < 60:
+			err = fmt.Errorf("token at its max TTL")
+		default:
+			vc.mu.Lock()
+			vc.ttl = time.Duration(out.Auth.LeaseDuration) * time.Second
+			vc.mu.Unlock()
+		}
+	}
+	if err != nil && vc.login != nil {
+		err = vc.login(ctx)
+	}
+}
+
+// call sends one API request; out receives the JSON answer.
+func (vc *vault) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	r, err := http.NewRequestWithContext(ctx, method, vc.addr+"/v1/"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	vc.mu.Lock()
+	if vc.token != "" {
+		r.Header.Set("X-Vault-Token", vc.token)
+	}
+	vc.mu.Unlock()
+	if vc.namespace != "" {
+		r.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	resp, err := vc.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// read returns key of the KV v2 secret named by ref ("<mount>/<path>#<key>").
+func (vc *vault) read(ctx context.Context, ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || key == "" {
+		return "", fmt.Errorf("reference %q needs a #key", ref)
+	}
+	if !strings.Contains(path, "/data/") {
+		mount, rest, _ := strings.Cut(path, "/")
+		path = mount + "/data/" + rest
+	}
+	var out struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := vc.call(ctx, http.MethodGet, path, nil, &out); err != nil {
+		return "", err
+	}
+	v, ok := out.Data.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", path, key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// resolve returns block with the vault: references replaced; block is
+// not modified. secrets lists the values read, for change detection.
+func (vc *vault) resolve(ctx context.Context, block map[string]interface{}) (map[string]interface{}, []string, error) {
+	var secrets []string
+	var walk func(v interface{}) (interface{}, error)
+	walk = func(v interface{}) (interface{}, error) {
+		switch x := v.(type) {
+		case string:
+			ref, ok := strings.CutPrefix(x, vaultPrefix)
+			if !ok {
+				return x, nil
+			}
+			s, err := vc.read(ctx, ref)
+			secrets = append(secrets, s)
+			return s, err
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(x))
+			for k, e := range x {
+				if k == "vault" {
+					out[k] = e
+					continue
+				}
+				var err error
+				if out[k], err = walk(e); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		case []interface{}:
+			out := make([]interface{}, len(x))
+			for i, e := range x {
+				var err error
+				if out[i], err = walk(e); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		}
+		return v, nil
+	}
+	out, err := walk(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.(map[string]interface{}), secrets, nil
+}
+
+// withVault resolves the references of block; the returned function, when
+// not nil, starts re-reading them once the sink of c is built.
+func withVault(block map[string]interface{}) (map[string]interface{}, func(c *capture.Config), error) {
+	v, ok := block["vault"].(map[string]interface{})
+	if !ok {
+		return block, nil, nil
+	}
+	vc, err := vaultFor(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s vault: %w", tag, err)
+	}
+	vc.once.Do(func() { go vc.keepAlive() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resolved, secrets, err := vc.resolve(ctx, block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s vault: %w", tag, err)
+	}
+	if vc.refresh == 0 || len(secrets) == 0 {
+		return resolved, nil, nil
+	}
+	return resolved, func(c *capture.Config) {
+		s, first := &swapSink{}, c.Sink
+		s.cur.Store(&first)
+		c.Sink = s
+		go vc.watch(c, block, secrets, s)
+	}, nil
+}
+
+// watch rebuilds the sink whenever the secrets of block change.
+func (vc *vault) watch(c *capture.Config, block map[string]interface{}, secrets []string, s *swapSink) {
+	for range time.Tick(vc.refresh) {
+		secrets = vc.reload(c, block, secrets, s)
+	}
+}
+
+// reload runs one refresh and returns the secrets now in use; a panic is
+// logged and the next tick tries again.
+func (vc *vault) reload(c *capture.Config, block map[string]interface{}, secrets []string, s *swapSink) (inUse []string) {
+	inUse = secrets // also after a panic
+	defer capture.Recover("vault refresh", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	resolved, now, err := vc.resolve(ctx, block)
+	cancel()
+	if err != nil {
+		capture.Log("vault refresh:", err)
+		return secrets
+	}
+	if strings.Join(now, "\x00") == strings.Join(secrets, "\x00") {
+		return secrets
+	}
+	next, err := sink.New(c.URL, c.Timeout, c.Format, resolved)
+	if err != nil {
+		capture.Log("vault refresh: rebuilding the sink:", err)
+		return secrets
+	}
+	s.cur.Store(&next)
+	capture.Log("vault: secrets changed, sink rebuilt")
+	return now
+}
+
+// swapSink delivers to the current sink of a backend whose secrets rotate.
+type swapSink struct {
+	cur atomic.Pointer[capture.Sink]
+}
+
+func (s *swapSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	return (*s.cur.Load()).Send(ctx, ev, payload)
+}
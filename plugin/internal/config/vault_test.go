@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// panicOnce is a transport whose first round trip panics.
+type panicOnce struct{ calls atomic.Int32 }
+
+func (p *panicOnce) RoundTrip(r *http.Request) (*http.Response, error) {
+	if p.calls.Add(1) == 1 {
+		panic("transport bug")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestKeepAliveSurvivesAPanic(t *testing.T) {
+	renewed := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/renew-self" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"auth":{"client_token":"hvs.test","lease_duration":3600,"renewable":true}}`)
+		renewed <- struct{}{}
+	}))
+	defer srv.Close()
+	defer func(d time.Duration) { vaultRetry = d }(vaultRetry)
+	vaultRetry = 30 * time.Millisecond
+
+	rt := &panicOnce{}
+	vc := &vault{addr: srv.URL, client: &http.Client{Transport: rt}, token: "hvs.test", ttl: 30 * time.Millisecond, renewable: true}
+	go vc.keepAlive()
+
+	select {
+	case <-renewed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no renewal after the panicking one (%d calls)", rt.calls.Load())
+	}
+	// the answer is applied after the handler returns
+	var ttl time.Duration
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		vc.mu.Lock()
+		ttl = vc.ttl
+		vc.mu.Unlock()
+		if ttl == time.Hour {
+			break
+		}
+	}
+	if rt.calls.Load() != 2 || ttl != time.Hour {
+		t.Errorf("%d calls, ttl %v, want the second renewal to set 1h", rt.calls.Load(), ttl)
+	}
+}
@@ -0,0 +1,1158 @@
+// Package mockcollector is an in-memory tracking endpoint: it records every
+// payload POSTed to it, decoding the v1 and v2 text formats, JSON,
+// MessagePack, CBOR and protobuf TraceEvent payloads and OTLP log exports,
+// so the plugin can be exercised end-to-end without a real collector. It
+// backs the trace-collector-mock command and the plugin's integration tests.
+//
+// SPDX-License-Identifier: Apache-2.0
+package mockcollector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one received payload.
+type Event struct {
+	Received    time.Time         `json:"received"`
+	Path        string            `json:"path"`
+	ContentType string            `json:"content_type"`
+	Body        string            `json:"body"`
+	Fields      map[string]string `json:"fields,omitempty"` // v1 / v2 sections (responseBody, requestUrl, …)
+	Meta        map[string]string `json:"meta,omitempty"`   // v1 {$meta} pairs
+	Doc         json.RawMessage   `json:"doc,omitempty"`    // JSON payloads, binary ones as JSON
+}
+
+// Collector is an http.Handler. POST (any path) records a payload; GET
+// /events lists them, DELETE /events forgets them. A gRPC TraceCollector
+// Stream call (over HTTP/2) records each StreamRequest and acks it, a
+// WebSocket connection each message; ServeMQTT, ServeNATS, ServeRedis,
+// ServeAMQP and the GELF listeners add brokers.
+type Collector struct {
+	Status  int           // response status for POSTs, default 200
+	Delay   time.Duration // added before answering a POST
+	Max     int           // events kept, oldest dropped first; 0 = unbounded
+	OnEvent func(Event)   // optional, called for every recorded event
+	Ack     bool          // answer X-Trace-Receipt for X-Trace-Event-Id
+
+	mu         sync.Mutex
+	events     []Event
+	notify     chan struct{}
+	websockets int
+	mqtt       map[net.Conn]bool
+}
+
+// New returns a collector answering 200 and keeping every event.
+func New() *Collector {
+	return &Collector{notify: make(chan struct{})}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		c.serveWebSocket(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc"):
+		c.serveStream(w, r)
+	case r.Method == http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.record(Decode(r.URL.Path, r.Header.Get("Content-Type"), body))
+		if c.Delay > 0 {
+			time.Sleep(c.Delay)
+		}
+		if id := r.Header.Get("X-Trace-Event-Id"); c.Ack && id != "" {
+			w.Header().Set("X-Trace-Receipt", id)
+		}
+		if c.Status != 0 {
+			w.WriteHeader(c.Status)
+		}
+	case r.URL.Path == "/events" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Events())
+	case r.URL.Path == "/events" && r.Method == http.MethodDelete:
+		c.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveStream answers a TraceCollector Stream call: every StreamRequest is
+// recorded like a POST of its payload and acked, with an error when Status
+// is not 2xx.
+func (c *Collector) serveStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+		flush()
+	}
+	head := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r.Body, head); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(head[1:]))
+		if _, err := io.ReadFull(r.Body, msg); err != nil {
+			break
+		}
+		var id uint64
+		var contentType string
+		var payload []byte
+		protoFields(msg, func(n, v uint64, raw []byte) error {
+			switch n {
+			case 1:
+				id = v
+			case 2:
+				contentType = string(raw)
+			case 3:
+				payload = raw
+			}
+			return nil
+		})
+		c.record(Decode(r.URL.Path, contentType, payload))
+		if c.Delay > 0 {
+			time.Sleep(c.Delay)
+		}
+		ack := binary.AppendUvarint([]byte{1 << 3}, id)
+		if c.Status != 0 && c.Status/100 != 2 {
+			reason := "status " + strconv.Itoa(c.Status)
+			ack = append(append(ack, 2<<3|2, byte(len(reason))), reason...)
+		}
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(ack)))
+		w.Write(append(frame, ack...))
+		flush()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// serveWebSocket records every text or binary message of a WebSocket
+// connection like a POST with the handshake's Content-Type, and answers
+// pings. Messages come in single frames, as the plugin sends them.
+func (c *Collector) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket needs HTTP/1.1", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	c.mu.Lock()
+	c.websockets++
+	c.mu.Unlock()
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	rw.Flush()
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(rw, head[:]); err != nil {
+			return
+		}
+		n := uint64(head[1] & 0x7f)
+		if n >= 126 {
+			b := make([]byte, 2+6*(n-126))
+			if _, err := io.ReadFull(rw, b); err != nil {
+				return
+			}
+			if n == 126 {
+				n = uint64(binary.BigEndian.Uint16(b))
+			} else {
+				n = binary.BigEndian.Uint64(b)
+			}
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(rw, mask[:]); err != nil {
+				return
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+		switch head[0] & 0x0f {
+		case 0x1, 0x2:
+			c.record(Decode(r.URL.Path, r.Header.Get("Content-Type"), payload))
+		case 0x8:
+			rw.Write([]byte{0x88, 0})
+			rw.Flush()
+			return
+		case 0x9:
+			rw.Write(append([]byte{0x8a, byte(len(payload))}, payload...))
+			rw.Flush()
+		}
+	}
+}
+
+// ServeMQTT runs a minimal MQTT 3.1.1 broker on l until it is closed: every
+// PUBLISH is recorded with its topic as Path, QoS 1 ones acked. A client's
+// will is recorded when its connection ends without a DISCONNECT.
+func (c *Collector) ServeMQTT(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveMQTT(conn)
+	}
+}
+
+// DropMQTT closes the MQTT connections as a broker does when a client's
+// keepalive expires, so their wills are published.
+func (c *Collector) DropMQTT() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.mqtt {
+		conn.Close()
+	}
+}
+
+func (c *Collector) serveMQTT(conn net.Conn) {
+	defer conn.Close()
+	c.mu.Lock()
+	if c.mqtt == nil {
+		c.mqtt = map[net.Conn]bool{}
+	}
+	c.mqtt[conn] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.mqtt, conn)
+		c.mu.Unlock()
+	}()
+	br := bufio.NewReader(conn)
+	str := func(b []byte) (string, []byte) {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return "", nil
+		}
+		n := 2 + int(binary.BigEndian.Uint16(b))
+		return string(b[2:n]), b[n:]
+	}
+	var will *Event
+	for {
+		head, body, err := readMQTT(br)
+		if err != nil {
+			if will != nil {
+				will.Received = time.Now().UTC()
+				c.record(*will)
+			}
+			return
+		}
+		switch head >> 4 {
+		case 1: // CONNECT
+			if len(body) < 10 {
+				return
+			}
+			flags := body[7]
+			_, rest := str(body[10:]) // client id
+			if flags&0x04 != 0 {
+				topic, rest2 := str(rest)
+				msg, _ := str(rest2)
+				will = &Event{Path: topic, Body: msg}
+			}
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			topic, rest := str(body)
+			qos := head >> 1 & 3
+			if qos > 0 && len(rest) >= 2 {
+				conn.Write([]byte{0x40, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			c.record(Decode(topic, "", rest))
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func readMQTT(br *bufio.Reader) (byte, []byte, error) {
+	head, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 || shift > 21 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(br, body)
+	return head, body, err
+}
+
+// ServeNATS runs a minimal NATS server on l until it is closed: every PUB is
+// recorded with its subject as Path. A PUB with a reply subject is answered
+// with a JetStream publish ack on the client's inbox subscription.
+func (c *Collector) ServeNATS(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveNATS(conn)
+	}
+}
+
+func (c *Collector) serveNATS(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"mock\",\"version\":\"2.10.0\",\"headers\":true,\"max_payload\":%d}\r\n", 8<<20)
+	br := bufio.NewReader(conn)
+	subs := map[string]string{} // subject prefix of a wildcard SUB → sid
+	var seq int
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB": // SUB <subject> [queue] <sid>
+			if len(f) >= 3 {
+				subs[strings.TrimSuffix(f[1], "*")] = f[len(f)-1]
+			}
+		case "PUB": // PUB <subject> [reply] <size>
+			n, err := strconv.Atoi(f[len(f)-1])
+			if err != nil || len(f) < 3 {
+				conn.Write([]byte("-ERR 'Unknown Protocol Operation'\r\n"))
+				return
+			}
+			body := make([]byte, n+2)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return
+			}
+			c.record(Decode(f[1], "", body[:n]))
+			if len(f) == 4 {
+				for prefix, sid := range subs {
+					if strings.HasPrefix(f[2], prefix) {
+						seq++
+						ack := fmt.Sprintf(`{"stream":"TRACES","seq":%d}`, seq)
+						fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", f[2], sid, len(ack), ack)
+					}
+				}
+			}
+		}
+	}
+}
+
+// ServeRedis runs a minimal Redis server on l until it is closed: the value
+// of every XADD is recorded with the stream as Path. AUTH and SELECT are
+// accepted, other commands refused.
+func (c *Collector) ServeRedis(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveRedis(conn)
+	}
+}
+
+func (c *Collector) serveRedis(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var seq int
+	for {
+		args, err := readRESP(br)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH", "SELECT":
+			conn.Write([]byte("+OK\r\n"))
+		case "XADD": // XADD <stream> [MAXLEN [~] <n>] * <field> <value> …
+			if len(args) < 5 || args[len(args)-3] != "*" {
+				conn.Write([]byte("-ERR wrong number of arguments for 'xadd' command\r\n"))
+				continue
+			}
+			c.record(Decode(args[1], "", []byte(args[len(args)-1])))
+			seq++
+			id := fmt.Sprintf("%d-%d", time.Now().UnixMilli(), seq)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// readRESP reads one command, an array of bulk strings.
+func readRESP(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 || line[0] != '*' {
+		return nil, fmt.Errorf("redis: not a command: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("redis: not a bulk string: %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// ServeAMQP runs a minimal AMQP 0.9.1 broker on l until it is closed: every
+// basic.publish is recorded with its routing key as Path and the content
+// type of its header, and acked on channels in confirm mode. Any login and
+// vhost are accepted.
+func (c *Collector) ServeAMQP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveAMQP(conn)
+	}
+}
+
+func (c *Collector) serveAMQP(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	var proto [8]byte
+	if _, err := io.ReadFull(br, proto[:]); err != nil || string(proto[:]) != "AMQP\x00\x00\x09\x01" {
+		conn.Write([]byte("AMQP\x00\x00\x09\x01"))
+		return
+	}
+	send := func(typ byte, ch uint16, p []byte) {
+		f := append([]byte{typ}, binary.BigEndian.AppendUint16(nil, ch)...)
+		f = binary.BigEndian.AppendUint32(f, uint32(len(p)))
+		conn.Write(append(append(f, p...), 0xce))
+	}
+	method := func(class, id uint16, args ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(class)<<16|uint32(id)), args...)
+	}
+	// connection.start: 0-9, no server properties, PLAIN, en_US
+	start := method(10, 10, 0, 9, 0, 0, 0, 0)
+	start = append(binary.BigEndian.AppendUint32(start, 5), "PLAIN"...)
+	start = append(binary.BigEndian.AppendUint32(start, 5), "en_US"...)
+	send(1, 0, start)
+
+	confirm := map[uint16]bool{}
+	var tag uint64
+	var key, contentType string
+	var body []byte
+	var size uint64
+	for {
+		var h [7]byte
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return
+		}
+		ch := binary.BigEndian.Uint16(h[1:])
+		p := make([]byte, binary.BigEndian.Uint32(h[3:])+1)
+		if _, err := io.ReadFull(br, p); err != nil || p[len(p)-1] != 0xce {
+			return
+		}
+		p = p[:len(p)-1]
+		switch h[0] {
+		case 2: // content header: class, weight, body size, flags, content-type first
+			if len(p) < 14 {
+				return
+			}
+			size, body, contentType = binary.BigEndian.Uint64(p[4:]), nil, ""
+			if flags := binary.BigEndian.Uint16(p[12:]); flags&0x8000 != 0 && len(p) > 14 && len(p) >= 15+int(p[14]) {
+				contentType = string(p[15 : 15+int(p[14])])
+			}
+		case 3: // content body
+			body = append(body, p...)
+		}
+		if h[0] == 2 || h[0] == 3 {
+			if uint64(len(body)) == size {
+				c.record(Decode(key, contentType, body))
+				if confirm[ch] {
+					tag++
+					send(1, ch, method(60, 80, append(binary.BigEndian.AppendUint64(nil, tag), 0)...))
+				}
+			}
+			continue
+		}
+		if h[0] != 1 || len(p) < 4 {
+			continue
+		}
+		switch binary.BigEndian.Uint32(p) {
+		case 10<<16 | 11: // connection.start-ok
+			send(1, 0, method(10, 30, 0, 0, 0, 2, 0, 0, 0, 0)) // tune: frame_max 131072, no heartbeat
+		case 10<<16 | 40: // connection.open
+			send(1, 0, method(10, 41, 0))
+		case 10<<16 | 50: // connection.close
+			send(1, 0, method(10, 51))
+			return
+		case 20<<16 | 10: // channel.open
+			send(1, ch, method(20, 11, 0, 0, 0, 0))
+		case 85<<16 | 10: // confirm.select
+			confirm[ch] = true
+			send(1, ch, method(85, 11))
+		case 60<<16 | 40: // basic.publish: reserved, exchange, routing key, flags
+			if len(p) < 7 || len(p) < 7+int(p[6]) {
+				return
+			}
+			rest := p[7+int(p[6]):]
+			if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+				return
+			}
+			key = string(rest[1 : 1+int(rest[0])])
+		}
+	}
+}
+
+// ServeGELF records the NUL-delimited GELF messages of every TCP connection
+// accepted on l, with Path "gelf+tcp", until l is closed.
+func (c *Collector) ServeGELF(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			for {
+				msg, err := br.ReadBytes(0)
+				if err != nil {
+					return
+				}
+				c.record(Decode("gelf+tcp", "application/json", msg[:len(msg)-1]))
+			}
+		}()
+	}
+}
+
+// ServeGELFUDP records the GELF datagrams read from pc, with Path
+// "gelf+udp", until it is closed. Chunked messages are reassembled and
+// gzip'd ones inflated.
+func (c *Collector) ServeGELFUDP(pc net.PacketConn) error {
+	chunks := map[string][][]byte{} // message id → chunks by sequence number
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		if len(msg) >= 12 && msg[0] == 0x1e && msg[1] == 0x0f {
+			id, seq, count := string(msg[2:10]), int(msg[10]), int(msg[11])
+			if seq >= count {
+				continue
+			}
+			if chunks[id] == nil {
+				chunks[id] = make([][]byte, count)
+			}
+			chunks[id][seq] = msg[12:]
+			complete := true
+			for _, ch := range chunks[id] {
+				complete = complete && ch != nil
+			}
+			if !complete {
+				continue
+			}
+			msg = bytes.Join(chunks[id], nil)
+			delete(chunks, id)
+		}
+		if len(msg) > 2 && msg[0] == 0x1f && msg[1] == 0x8b {
+			zr, err := gzip.NewReader(bytes.NewReader(msg))
+			if err != nil {
+				continue
+			}
+			if msg, err = io.ReadAll(zr); err != nil {
+				continue
+			}
+		}
+		c.record(Decode("gelf+udp", "application/json", msg))
+	}
+}
+
+// WebSockets is the number of WebSocket connections accepted so far.
+func (c *Collector) WebSockets() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.websockets
+}
+
+func (c *Collector) record(e Event) {
+	c.mu.Lock()
+	c.events = append(c.events, e)
+	if c.Max > 0 && len(c.events) > c.Max {
+		c.events = c.events[len(c.events)-c.Max:]
+	}
+	close(c.notify)
+	c.notify = make(chan struct{})
+	c.mu.Unlock()
+	if c.OnEvent != nil {
+		c.OnEvent(e)
+	}
+}
+
+// Events returns a copy of the recorded events, oldest first.
+func (c *Collector) Events() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+// Reset forgets the recorded events.
+func (c *Collector) Reset() {
+	c.mu.Lock()
+	c.events = nil
+	c.mu.Unlock()
+}
+
+// Wait blocks until at least n events were recorded or the timeout expires,
+// and returns what was recorded.
+func (c *Collector) Wait(n int, timeout time.Duration) []Event {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		if len(c.events) >= n {
+			out := append([]Event(nil), c.events...)
+			c.mu.Unlock()
+			return out
+		}
+		ch := c.notify
+		c.mu.Unlock()
+		select {
+		case <-ch:
+		case <-deadline:
+			return c.Events()
+		}
+	}
+}
+
+// Decode turns a received payload into an Event.
+func Decode(path, contentType string, body []byte) Event {
+	e := Event{Received: time.Now().UTC(), Path: path, ContentType: contentType, Body: string(body)}
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(body, []byte("{$")):
+		e.Fields, e.Meta = parseV1(string(body))
+	case bytes.HasPrefix(body, []byte("schema_version ")):
+		e.Fields, e.Meta = parseV2(body)
+	case json.Valid(trimmed):
+		e.Doc = json.RawMessage(trimmed)
+	case strings.HasPrefix(contentType, "application/msgpack"):
+		if v, rest, err := unpack(body); err == nil && len(rest) == 0 {
+			e.Doc, _ = json.Marshal(v)
+		}
+	case strings.HasPrefix(contentType, "application/cbor"):
+		if v, rest, err := uncbor(body); err == nil && len(rest) == 0 {
+			e.Doc, _ = json.Marshal(v)
+		}
+	case strings.Contains(contentType, "messageType=krakend.trace.v1.TraceEvent"):
+		if v, err := untrace(body); err == nil {
+			e.Doc, _ = json.Marshal(v)
+		}
+	case strings.HasSuffix(path, "/v1/logs") && strings.HasPrefix(contentType, "application/x-protobuf"):
+		if v, err := unotlp(body); err == nil {
+			e.Doc, _ = json.Marshal(v)
+		}
+	}
+	return e
+}
+
+// parseV2 reads the "<name> <length>\n<value>\n" sections; meta is
+// url-decoded. A malformed section ends the payload.
+func parseV2(b []byte) (map[string]string, map[string]string) {
+	fields := map[string]string{}
+	var meta map[string]string
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			break
+		}
+		name, size, ok := strings.Cut(string(b[:nl]), " ")
+		n, err := strconv.Atoi(size)
+		if !ok || err != nil || n < 0 || nl+1+n >= len(b) || b[nl+1+n] != '\n' {
+			break
+		}
+		v := string(b[nl+1 : nl+1+n])
+		b = b[nl+2+n:]
+		if name == "meta" {
+			meta = map[string]string{}
+			q, _ := url.ParseQuery(v)
+			for k := range q {
+				meta[k] = q.Get(k)
+			}
+		} else {
+			fields[name] = v
+		}
+	}
+	return fields, meta
+}
+
+// parseV1 splits {$name}value{/name} sections; {$meta} is url-decoded.
+func parseV1(s string) (map[string]string, map[string]string) {
+	fields := map[string]string{}
+	var meta map[string]string
+	for {
+		i := strings.Index(s, "{$")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		name := s[i+2 : i+j]
+		rest := s[i+j+1:]
+		end := strings.Index(rest, "{/"+name+"}")
+		if end < 0 {
+			break
+		}
+		if name == "meta" {
+			meta = map[string]string{}
+			q, _ := url.ParseQuery(rest[:end])
+			for k := range q {
+				meta[k] = q.Get(k)
+			}
+		} else {
+			fields[name] = rest[:end]
+		}
+		s = rest[end+len(name)+3:]
+	}
+	return fields, meta
+}
+
+// unpack decodes one MessagePack value; bin values become []byte (base64 in
+// the JSON document).
+func unpack(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	t, b := b[0], b[1:]
+	size := func(n int) (int, error) {
+		if len(b) < n {
+			return 0, io.ErrUnexpectedEOF
+		}
+		var v uint64
+		for _, c := range b[:n] {
+			v = v<<8 | uint64(c)
+		}
+		b = b[n:]
+		return int(v), nil
+	}
+	raw := func(n int, err error) ([]byte, []byte, error) {
+		if err != nil || len(b) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return b[:n], b[n:], nil
+	}
+	str := func(n int, err error) (interface{}, []byte, error) {
+		s, rest, err := raw(n, err)
+		return string(s), rest, err
+	}
+	switch {
+	case t < 0x80:
+		return int64(t), b, nil
+	case t >= 0xe0:
+		return int64(int8(t)), b, nil
+	case t&0xe0 == 0xa0:
+		return str(int(t&0x1f), nil)
+	case t&0xf0 == 0x80:
+		return unpackMap(b, int(t&0x0f))
+	case t&0xf0 == 0x90:
+		return unpackArray(b, int(t&0x0f))
+	}
+	switch t {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2, 0xc3:
+		return t == 0xc3, b, nil
+	case 0xd9:
+		return str(size(1))
+	case 0xda:
+		return str(size(2))
+	case 0xdb:
+		return str(size(4))
+	case 0xc4, 0xc5, 0xc6:
+		return raw(size(1 << (t - 0xc4)))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := size(1 << (t - 0xcc))
+		return int64(n), b, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		w := 1 << (t - 0xd0)
+		n, err := size(w)
+		return int64(n) << (64 - 8*w) >> (64 - 8*w), b, err
+	case 0xca:
+		n, err := size(4)
+		return float64(math.Float32frombits(uint32(n))), b, err
+	case 0xcb:
+		if len(b) < 8 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case 0xde, 0xdf:
+		n, err := size(2 << (t - 0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return unpackMap(b, n)
+	case 0xdc, 0xdd:
+		n, err := size(2 << (t - 0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return unpackArray(b, n)
+	}
+	return nil, nil, fmt.Errorf("msgpack type 0x%02x not supported", t)
+}
+
+func unpackMap(b []byte, n int) (interface{}, []byte, error) {
+	m := make(map[string]interface{}, min(n, 64))
+	for i := 0; i < n; i++ {
+		k, rest, err := unpack(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, rest, err := unpack(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[fmt.Sprint(k)], b = v, rest
+	}
+	return m, b, nil
+}
+
+func unpackArray(b []byte, n int) (interface{}, []byte, error) {
+	a := make([]interface{}, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		v, rest, err := unpack(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		a, b = append(a, v), rest
+	}
+	return a, b, nil
+}
+
+// uncbor decodes one CBOR data item of definite length; byte strings become
+// []byte, tags are dropped in favour of their content.
+func uncbor(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	major, info, b := b[0]>>5, b[0]&0x1f, b[1:]
+	n := uint64(info)
+	if info >= 24 && info <= 27 {
+		w := 1 << (info - 24)
+		if len(b) < w {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		n = 0
+		for _, c := range b[:w] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[w:]
+	} else if info > 27 {
+		return nil, nil, fmt.Errorf("cbor additional info %d not supported", info)
+	}
+	switch major {
+	case 0:
+		return n, b, nil
+	case 1:
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if major == 2 {
+			return b[:n], b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		a := make([]interface{}, 0, min(n, 64))
+		for i := uint64(0); i < n; i++ {
+			v, rest, err := uncbor(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			a, b = append(a, v), rest
+		}
+		return a, b, nil
+	case 5:
+		m := make(map[string]interface{}, min(n, 64))
+		for i := uint64(0); i < n; i++ {
+			k, rest, err := uncbor(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, rest, err := uncbor(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[fmt.Sprint(k)], b = v, rest
+		}
+		return m, b, nil
+	case 6:
+		return uncbor(b)
+	}
+	switch info {
+	case 20, 21:
+		return info == 21, b, nil
+	case 22, 23:
+		return nil, b, nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), b, nil
+	case 27:
+		return math.Float64frombits(n), b, nil
+	}
+	return nil, nil, fmt.Errorf("cbor simple value %d not supported", info)
+}
+
+// traceEventFields name the fields of schema/trace_event.proto.
+var traceEventFields = map[uint64]string{1: "timestamp", 2: "instance_id", 3: "seq", 4: "method",
+	5: "url", 6: "query", 7: "status", 8: "duration_us", 9: "upstream_us", 10: "endpoint",
+	11: "backend", 12: "client_ip", 13: "request_headers", 14: "request_body",
+	15: "response_headers", 16: "response_body", 17: "meta"}
+
+// unotlp decodes an OTLP ExportLogsServiceRequest into {"resource": {…},
+// "records": [...]}: resource attributes of the last resource, and each log
+// record with its time, severity, body, attributes and hex trace and span
+// ids. Scopes are skipped.
+func unotlp(b []byte) (map[string]interface{}, error) {
+	resource := map[string]interface{}{}
+	records := []interface{}{}
+	err := protoFields(b, func(_, _ uint64, rl []byte) error {
+		return protoFields(rl, func(n, _ uint64, raw []byte) error {
+			switch n {
+			case 1:
+				return protoFields(raw, func(n, _ uint64, kv []byte) error {
+					if n != 1 {
+						return nil
+					}
+					k, v, err := otlpKeyValue(kv)
+					resource[k] = v
+					return err
+				})
+			case 2:
+				return protoFields(raw, func(n, _ uint64, lr []byte) error {
+					if n != 2 {
+						return nil
+					}
+					rec, err := otlpRecord(lr)
+					records = append(records, rec)
+					return err
+				})
+			}
+			return nil
+		})
+	})
+	return map[string]interface{}{"resource": resource, "records": records}, err
+}
+
+func otlpRecord(b []byte) (map[string]interface{}, error) {
+	rec := map[string]interface{}{}
+	attrs := map[string]interface{}{}
+	err := protoFields(b, func(n, v uint64, raw []byte) error {
+		switch n {
+		case 1:
+			rec["time_unix_nano"] = v
+		case 2:
+			rec["severity_number"] = v
+		case 3:
+			rec["severity_text"] = string(raw)
+		case 5:
+			body, err := otlpAnyValue(raw)
+			rec["body"] = body
+			return err
+		case 6:
+			k, v, err := otlpKeyValue(raw)
+			attrs[k] = v
+			return err
+		case 8:
+			rec["flags"] = v
+		case 9:
+			rec["trace_id"] = fmt.Sprintf("%x", raw)
+		case 10:
+			rec["span_id"] = fmt.Sprintf("%x", raw)
+		}
+		return nil
+	})
+	rec["attributes"] = attrs
+	return rec, err
+}
+
+func otlpKeyValue(b []byte) (key string, value interface{}, err error) {
+	err = protoFields(b, func(n, _ uint64, raw []byte) error {
+		var err error
+		if n == 1 {
+			key = string(raw)
+		} else if n == 2 {
+			value, err = otlpAnyValue(raw)
+		}
+		return err
+	})
+	return key, value, err
+}
+
+// otlpAnyValue reads the string, bool, int and bytes variants of AnyValue.
+func otlpAnyValue(b []byte) (value interface{}, err error) {
+	err = protoFields(b, func(n, v uint64, raw []byte) error {
+		switch n {
+		case 1:
+			value = string(raw)
+		case 2:
+			value = v != 0
+		case 3:
+			value = int64(v)
+		case 7:
+			value = raw
+		}
+		return nil
+	})
+	return value, err
+}
+
+// untrace decodes a krakend.trace.v1.TraceEvent with the proto field names;
+// the timestamp becomes RFC 3339, headers {"name", "values"} objects, bodies
+// []byte. Unknown fields are skipped.
+func untrace(b []byte) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	meta := map[string]string{}
+	err := protoFields(b, func(num, v uint64, raw []byte) error {
+		name := traceEventFields[num]
+		switch num {
+		case 1:
+			var sec, nsec uint64
+			err := protoFields(raw, func(n, v uint64, _ []byte) error {
+				if n == 1 {
+					sec = v
+				} else if n == 2 {
+					nsec = v
+				}
+				return nil
+			})
+			doc[name] = time.Unix(int64(sec), int64(nsec)).UTC().Format(time.RFC3339Nano)
+			return err
+		case 3, 7, 8, 9:
+			doc[name] = v
+		case 13, 15:
+			h := map[string]interface{}{"values": []string{}}
+			err := protoFields(raw, func(n, _ uint64, s []byte) error {
+				if n == 1 {
+					h["name"] = string(s)
+				} else if n == 2 {
+					h["values"] = append(h["values"].([]string), string(s))
+				}
+				return nil
+			})
+			list, _ := doc[name].([]interface{})
+			doc[name] = append(list, h)
+			return err
+		case 14, 16:
+			doc[name] = raw
+		case 17:
+			var k, val string
+			err := protoFields(raw, func(n, _ uint64, s []byte) error {
+				if n == 1 {
+					k = string(s)
+				} else if n == 2 {
+					val = string(s)
+				}
+				return nil
+			})
+			meta[k] = val
+			return err
+		default:
+			if name != "" {
+				doc[name] = string(raw)
+			}
+		}
+		return nil
+	})
+	if len(meta) > 0 {
+		doc["meta"] = meta
+	}
+	return doc, err
+}
+
+// protoFields calls f with each varint or fixed-size (v) and
+// length-delimited (raw) field of b.
+func protoFields(b []byte, f func(num, v uint64, raw []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		b = b[n:]
+		var v uint64
+		var raw []byte
+		switch key & 7 {
+		case 0, 2:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			b = b[n:]
+			if key&7 == 2 {
+				if uint64(len(b)) < v {
+					return io.ErrUnexpectedEOF
+				}
+				raw, b, v = b[:v], b[v:], 0
+			}
+		case 1:
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 5:
+			if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("protobuf wire type %d not supported", key&7)
+		}
+		if err := f(key>>3, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── acknowledged delivery ───────── */
+
+// Without "ack" the HTTP sink delivers at most once: a 2xx answer counts as
+// delivered and failures are not retried. With it the collector confirms
+// every event and the sink retries, then spools, until it does:
+//
+//	"http": {"ack": {
+//	  "retries":    5,     // after the first attempt, default 3
+//	  "backoff_ms": 100,   // doubled after each attempt, default 100
+//	  "spool_dir":  "/var/spool/krakend-trace",   // optional
+//	  "replay_s":   30     // spool scan interval, default 30
+//	}}
+//
+// Each request carries X-Trace-Event-Id (instance_id-seq, plus -request for
+// the request event of split_phases); the collector acknowledges by answering
+// 2xx with X-Trace-Receipt set to the same id. Anything else is a failed
+// attempt. Retries stop at timeout_ms; the event is then written to
+// spool_dir and re-sent in the background until a receipt comes back, which
+// makes delivery at least once: collectors drop events whose id they have
+// already stored. Without spool_dir an event still unacknowledged at the
+// deadline is lost. Spooled events survive restarts; each sink replays its
+// own files only.
+
+const (
+	eventIDHeader = "X-Trace-Event-Id"
+	receiptHeader = "X-Trace-Receipt"
+)
+
+type ackPolicy struct {
+	retries int
+	backoff time.Duration
+	spool   string // "" for none
+	prefix  string // spool files of this sink
+	replay  time.Duration
+	timeout time.Duration
+	once    sync.Once // starts the replay
+}
+
+// spooled is a spool file: enough to re-send without the event.
+type spooled struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Payload []byte `json:"payload"`
+}
+
+func newAckPolicy(c *cfg, opts map[string]interface{}, url string) (*ackPolicy, error) {
+	v, ok := opts["ack"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	a := &ackPolicy{retries: 3, backoff: 100 * time.Millisecond, replay: 30 * time.Second, timeout: c.timeout}
+	if n, ok := v["retries"].(float64); ok && n >= 0 {
+		a.retries = int(n)
+	}
+	if n, ok := v["backoff_ms"].(float64); ok && n > 0 {
+		a.backoff = time.Duration(n) * time.Millisecond
+	}
+	if n, ok := v["replay_s"].(float64); ok && n > 0 {
+		a.replay = time.Duration(n * float64(time.Second))
+	}
+	if dir, _ := v["spool_dir"].(string); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("%s ack spool_dir: %w", tag, err)
+		}
+		h := fnv.New32a()
+		h.Write([]byte(url))
+		a.spool, a.prefix = dir, fmt.Sprintf("%08x-", h.Sum32())
+	}
+	return a, nil
+}
+
+// receiptID is the id the collector has to acknowledge.
+func receiptID(ev *capture.Event) string {
+	id := ev.Meta.Get("instance_id") + "-" + ev.Meta.Get("seq")
+	if ev.Meta.Get("phase") == "request" {
+		id += "-request"
+	}
+	return id
+}
+
+// sendAcked posts until a receipt comes back or ctx ends, then spools.
+func (s *httpSink) sendAcked(ctx context.Context, u, id string, payload []byte) error {
+	a := s.ack
+	if a.spool != "" {
+		a.once.Do(func() { go s.replaySpool() })
+	}
+	wait := a.backoff
+	var err error
+retry:
+	for attempt := 0; ; attempt++ {
+		if err = s.post(ctx, u, id, payload); err == nil {
+			return nil
+		}
+		if attempt == a.retries {
+			break
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+			wait *= 2
+		case <-ctx.Done():
+			t.Stop()
+			break retry
+		}
+	}
+	if a.spool == "" {
+		return err
+	}
+	if serr := a.write(spooled{ID: id, URL: u, Payload: payload}); serr != nil {
+		return fmt.Errorf("%w; spooling failed: %v", err, serr)
+	}
+	return fmt.Errorf("%w; spooled for replay", err)
+}
+
+func (a *ackPolicy) write(sp spooled) error {
+	b, _ := json.Marshal(sp)
+	name := filepath.Join(a.spool, a.prefix+strings.ReplaceAll(sp.ID, string(filepath.Separator), "_")+".json")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// replaySpool re-sends the spooled events of s every replay interval; a
+// file is removed once its receipt arrives.
+func (s *httpSink) replaySpool() {
+	for {
+		s.replayOnce(context.Background())
+		time.Sleep(s.ack.replay)
+	}
+}
+
+// drainSpool replays the spool once on teardown and returns the number of
+// events left in it.
+func (s *httpSink) drainSpool(ctx context.Context) int {
+	s.replayOnce(ctx)
+	files, _ := filepath.Glob(filepath.Join(s.ack.spool, s.ack.prefix+"*.json"))
+	return len(files)
+}
+
+func (s *httpSink) replayOnce(parent context.Context) {
+	defer capture.Recover("ack replay", nil)
+	a := s.ack
+	files, _ := filepath.Glob(filepath.Join(a.spool, a.prefix+"*.json"))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		var sp spooled
+		if err != nil || json.Unmarshal(b, &sp) != nil {
+			capture.Log("ack spool: unreadable", f)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(parent, a.timeout)
+		err = s.post(ctx, sp.URL, sp.ID, sp.Payload)
+		cancel()
+		if err != nil {
+			return // collector still unavailable, try again later
+		}
+		os.Remove(f)
+	}
+}
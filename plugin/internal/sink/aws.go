@@ -0,0 +1,340 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── AWS credentials and SigV4 ───────── */
+
+// awsCreds resolves credentials in the order of the AWS SDKs' default chain:
+// AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY (/ AWS_SESSION_TOKEN), the shared
+// credentials file (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials,
+// profile AWS_PROFILE or "default"), web identity (AWS_WEB_IDENTITY_TOKEN_FILE
+// + AWS_ROLE_ARN, as on EKS), the ECS / EKS pod identity container endpoint,
+// then EC2 IMDSv2. Temporary credentials are cached until five minutes
+// before they expire.
+
+type awsKeys struct {
+	id, secret, token string
+	expiry            time.Time // zero for static keys
+}
+
+type awsCreds struct {
+	profile string
+
+	mu   sync.Mutex
+	keys *awsKeys
+}
+
+func (a *awsCreds) get(ctx context.Context) (*awsKeys, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keys != nil && (a.keys.expiry.IsZero() || time.Now().Before(a.keys.expiry.Add(-5*time.Minute))) {
+		return a.keys, nil
+	}
+	k, err := a.resolve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials: %w", err)
+	}
+	a.keys = k
+	return k, nil
+}
+
+func (a *awsCreds) resolve(ctx context.Context) (*awsKeys, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsKeys{id: id, secret: os.Getenv("AWS_SECRET_ACCESS_KEY"), token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if k, ok := a.sharedFile(); ok {
+		return k, nil
+	}
+	if file, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); file != "" && role != "" {
+		return awsWebIdentity(ctx, file, role)
+	}
+	if k, ok, err := awsContainer(ctx); ok {
+		return k, err
+	}
+	return awsIMDS(ctx)
+}
+
+// sharedFile reads the static keys of the profile from the credentials file.
+func (a *awsCreds) sharedFile() (*awsKeys, bool) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, false
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	profile := a.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	k, section := &awsKeys{}, ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, v, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			k.id = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			k.secret = strings.TrimSpace(v)
+		case "aws_session_token":
+			k.token = strings.TrimSpace(v)
+		}
+	}
+	return k, k.id != "" && k.secret != ""
+}
+
+func awsWebIdentity(ctx context.Context, file, role string) (*awsKeys, error) {
+	tok, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sts := "https://sts.amazonaws.com/"
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		sts = "https://sts." + r + ".amazonaws.com/"
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "krakend-trace-" + capture.InstanceID()
+	}
+	q := url.Values{"Action": {"AssumeRoleWithWebIdentity"}, "Version": {"2011-06-15"},
+		"RoleArn": {role}, "RoleSessionName": {session}, "WebIdentityToken": {strings.TrimSpace(string(tok))}}
+	b, err := capture.MetadataGet(ctx, http.MethodGet, sts+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Creds struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	c := res.Creds
+	return &awsKeys{id: c.AccessKeyID, secret: c.SecretAccessKey, token: c.SessionToken, expiry: c.Expiration}, nil
+}
+
+// awsContainer asks the ECS task / EKS pod identity endpoint; ok is false
+// when neither is configured.
+func awsContainer(ctx context.Context) (*awsKeys, bool, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	if u == "" {
+		return nil, false, nil
+	}
+	hdr := map[string]string{}
+	if t := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); t != "" {
+		hdr["Authorization"] = t
+	} else if f := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); f != "" {
+		if t, err := os.ReadFile(f); err == nil {
+			hdr["Authorization"] = strings.TrimSpace(string(t))
+		}
+	}
+	b, err := capture.MetadataGet(ctx, http.MethodGet, u, hdr)
+	if err != nil {
+		return nil, true, err
+	}
+	k, err := awsJSONKeys(b)
+	return k, true, err
+}
+
+func awsIMDS(ctx context.Context) (*awsKeys, error) {
+	token, err := capture.MetadataGet(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600"})
+	if err != nil {
+		return nil, fmt.Errorf("no credentials found (imds: %w)", err)
+	}
+	hdr := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	base := "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	role, err := capture.MetadataGet(ctx, http.MethodGet, base, hdr)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	b, err := capture.MetadataGet(ctx, http.MethodGet, base+name, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return awsJSONKeys(b)
+}
+
+func awsJSONKeys(b []byte) (*awsKeys, error) {
+	var c struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID == "" {
+		return nil, fmt.Errorf("no AccessKeyId in the credentials response")
+	}
+	return &awsKeys{id: c.AccessKeyID, secret: c.SecretAccessKey, token: c.Token, expiry: c.Expiration}, nil
+}
+
+/* ───────── SigV4 ───────── */
+
+// sigv4 signs requests of a sink; "sigv4" in the sink options:
+//
+//	"sigv4": {"region": "eu-west-1", "service": "execute-api", "profile": "tracing"}
+//
+// service is execute-api (API Gateway), es (OpenSearch), aoss (OpenSearch
+// Serverless) or lambda (function URLs); profile is optional.
+type sigv4 struct {
+	region, service string
+	creds           *awsCreds
+}
+
+func newSigV4(opts map[string]interface{}) (*sigv4, error) {
+	v, ok := opts["sigv4"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	s := &sigv4{creds: &awsCreds{}}
+	s.region, _ = v["region"].(string)
+	s.service, _ = v["service"].(string)
+	s.creds.profile, _ = v["profile"].(string)
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" || s.service == "" {
+		return nil, fmt.Errorf("%s sigv4 needs a region and a service", tag)
+	}
+	return s, nil
+}
+
+// sign adds the SigV4 headers to r, whose body is payload.
+func (s *sigv4) sign(ctx context.Context, r *http.Request, payload []byte) error {
+	k, err := s.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(payload)
+	r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if k.token != "" {
+		r.Header.Set("X-Amz-Security-Token", k.token)
+	}
+	signRequest(r, hex.EncodeToString(sum[:]), k, s.region, s.service, time.Now())
+	return nil
+}
+
+// signRequest signs host, content-type and the x-amz-* headers of r.
+func signRequest(r *http.Request, payloadHash string, k *awsKeys, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	r.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": r.URL.Host}
+	for name, vs := range r.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.Join(strings.Fields(strings.Join(vs, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for n := range headers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, n := range names {
+		canonHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canon := strings.Join([]string{r.Method, awsEscape(path, false), awsQuery(r.URL.Query()),
+		canonHeaders.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	h := sha256.Sum256([]byte(canon))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+k.secret), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+k.id+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsQuery is the canonical query string: sorted, RFC 3986 escaped.
+func awsQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters (and
+// "/" unless slash is set). Paths are escaped on top of their escaped form,
+// as SigV4 asks for every service but S3.
+func awsEscape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
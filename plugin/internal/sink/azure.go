@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Azure credentials ───────── */
+
+// Azure data-plane calls are authorized (see authorizer) with a shared
+// access signature from a connection string or an AAD bearer token from the
+// managed identity endpoint.
+
+// azureConnString parses "Endpoint=sb://…/;SharedAccessKeyName=…;…".
+func azureConnString(s string) map[string]string {
+	kv := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			kv[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return kv
+}
+
+type azureSAS struct {
+	resource string // scheme-less, e.g. ns.servicebus.windows.net/hub
+	keyName  string
+	key      string
+}
+
+func (a *azureSAS) authorization(context.Context) (string, error) {
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	res := url.QueryEscape("https://" + a.resource)
+	mac := hmac.New(sha256.New, []byte(a.key))
+	mac.Write([]byte(res + "\n" + exp))
+	sig := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", res, sig, exp, a.keyName), nil
+}
+
+// azureManagedIdentity covers App Service / Functions (IDENTITY_ENDPOINT) and
+// VMs / AKS pods (IMDS). clientID selects a user-assigned identity.
+type azureManagedIdentity struct {
+	resource string
+	clientID string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (m *azureManagedIdentity) authorization(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expiry) {
+		return "Bearer " + m.token, nil
+	}
+
+	q := url.Values{"resource": {m.resource}}
+	if m.clientID != "" {
+		q.Set("client_id", m.clientID)
+	}
+	u, hdr := "", map[string]string{}
+	if ep := os.Getenv("IDENTITY_ENDPOINT"); ep != "" {
+		q.Set("api-version", "2019-08-01")
+		u = ep + "?" + q.Encode()
+		hdr["X-IDENTITY-HEADER"] = os.Getenv("IDENTITY_HEADER")
+	} else {
+		q.Set("api-version", "2018-02-01")
+		u = "http://169.254.169.254/metadata/identity/oauth2/token?" + q.Encode()
+		hdr["Metadata"] = "true"
+	}
+	b, err := capture.MetadataGet(ctx, http.MethodGet, u, hdr)
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return "", err
+	}
+	exp, _ := tok.ExpiresOn.Int64()
+	m.token, m.expiry = tok.AccessToken, time.Unix(exp, 0).Add(-time.Minute)
+	return "Bearer " + m.token, nil
+}
+
+// azureClientSecret is the client credentials grant of an app registration
+// (Microsoft identity platform v2.0).
+type azureClientSecret struct {
+	authority, tenant string
+	clientID, secret  string
+	scope             string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (a *azureClientSecret) authorization(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expiry) {
+		return "Bearer " + a.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientID},
+		"client_secret": {a.secret},
+		"scope":         {a.scope},
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := postForm(ctx, a.authority+"/"+url.PathEscape(a.tenant)+"/oauth2/v2.0/token", form, &tok); err != nil {
+		return "", err
+	}
+	a.token, a.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn-60)*time.Second)
+	return "Bearer " + a.token, nil
+}
+
+/* ───────── Azure AD auth for HTTP sinks ───────── */
+
+// newAzureAuth reads "azure_auth" in the sink options, for collectors behind
+// API Management or App Service authentication (Easy Auth):
+//
+//	"azure_auth": {
+//	  "resource":      "api://trace-collector",  // app ID URI or client id of the API
+//	  "tenant_id":     "…",                      // with client_secret
+//	  "client_id":     "…",                      // app, or user-assigned identity
+//	  "client_secret": "…",                      // omit for managed identity
+//	  "authority":     "https://login.microsoftonline.com"  // sovereign clouds
+//	}
+//
+// tenant_id, client_id and client_secret default to AZURE_TENANT_ID,
+// AZURE_CLIENT_ID and AZURE_CLIENT_SECRET. With a secret the app's client
+// credentials are used, otherwise the managed identity of the host.
+func newAzureAuth(opts map[string]interface{}) (authorizer, error) {
+	v, ok := opts["azure_auth"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	str := func(key, env string) string {
+		if s, _ := v[key].(string); s != "" {
+			return s
+		}
+		return os.Getenv(env)
+	}
+	resource, _ := v["resource"].(string)
+	if resource == "" {
+		return nil, fmt.Errorf("%s azure_auth needs a resource", tag)
+	}
+	resource = strings.TrimSuffix(resource, "/.default")
+	clientID, secret := str("client_id", "AZURE_CLIENT_ID"), str("client_secret", "AZURE_CLIENT_SECRET")
+	if secret == "" {
+		return &azureManagedIdentity{resource: resource, clientID: clientID}, nil
+	}
+	a := &azureClientSecret{authority: "https://login.microsoftonline.com", tenant: str("tenant_id", "AZURE_TENANT_ID"),
+		clientID: clientID, secret: secret, scope: resource + "/.default"}
+	if s, _ := v["authority"].(string); s != "" {
+		a.authority = strings.TrimRight(s, "/")
+	}
+	if a.tenant == "" || a.clientID == "" {
+		return nil, fmt.Errorf("%s azure_auth client_secret needs tenant_id and client_id", tag)
+	}
+	return a, nil
+}
@@ -0,0 +1,299 @@
+package sink
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── weighted balancing ───────── */
+
+// tracking_urls spreads events over several collectors of the same kind by
+// weight (smooth weighted round-robin). A target failing fail_threshold sends
+// in a row is taken out for cooldown_ms, doubled on every further ejection up
+// to max_cooldown_ms; afterwards it gets traffic again and one success makes
+// it healthy. A failed send is retried once on another target.
+//
+//	"tracking_urls": [
+//	  {"url": "http://collector-a:9000/ingest", "weight": 3},
+//	  "http://collector-b:9000/ingest"                        // weight 1
+//	],
+//	"balance": {"fail_threshold": 3, "cooldown_ms": 5000, "max_cooldown_ms": 60000}
+//
+// Every target uses the block's sink and sink options; tracking_url may be
+// left out.
+//
+// With "strategy": "hash" the targets form a consistent hash ring (100
+// points per weight unit, placed by URL) and an event goes to the target
+// owning its key, the request id by default (see capture.RequestID), so every
+// event of a request lands on the same collector, from any gateway node with
+// the same tracking_urls. Adding or removing a target moves only its share of
+// the keys. hash_key / hash_key_expr set another key as for partition keys;
+// an ejected target's keys move to the next target on the ring until it
+// recovers, and events without a key are balanced by weight.
+//
+//	"balance": {"strategy": "hash", "hash_key": "{tenant}"}
+
+type target struct {
+	name   string // redacted URL
+	sink   capture.Sink
+	weight int
+
+	current   int // smooth round-robin state
+	fails     int
+	downUntil time.Time
+	cooldown  time.Duration
+}
+
+type balancer struct {
+	threshold             int
+	cooldown, maxCooldown time.Duration
+	ring                  []ringPoint // "hash" strategy only, sorted
+	key                   *partitionKey
+
+	mu      sync.Mutex
+	targets []*target
+}
+
+var (
+	balancersMu sync.Mutex
+	balancers   []*balancer
+)
+
+func init() {
+	capture.AddDiagnostics("tracking_targets", circuits)
+}
+
+type ringPoint struct {
+	hash uint64
+	t    *target
+}
+
+// FirstTarget is the first URL of tracking_urls, or "".
+func FirstTarget(block map[string]interface{}) string {
+	list, _ := block["tracking_urls"].([]interface{})
+	if len(list) == 0 {
+		return ""
+	}
+	u, _ := targetSpec(list[0])
+	return u
+}
+
+func targetSpec(v interface{}) (string, int) {
+	switch v := v.(type) {
+	case string:
+		return v, 1
+	case map[string]interface{}:
+		u, _ := v["url"].(string)
+		w, ok := v["weight"].(float64)
+		if !ok {
+			w = 1
+		}
+		return u, int(w)
+	}
+	return "", 0
+}
+
+func newBalancer(c *cfg, block map[string]interface{}) (*balancer, error) {
+	list, _ := block["tracking_urls"].([]interface{})
+	opts, _ := block["balance"].(map[string]interface{})
+	b := &balancer{threshold: 3, cooldown: 5 * time.Second, maxCooldown: time.Minute}
+	if v, ok := opts["fail_threshold"].(float64); ok && v >= 1 {
+		b.threshold = int(v)
+	}
+	if v, ok := opts["cooldown_ms"].(float64); ok && v > 0 {
+		b.cooldown = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := opts["max_cooldown_ms"].(float64); ok && v > 0 {
+		b.maxCooldown = max(time.Duration(v)*time.Millisecond, b.cooldown)
+	}
+	for i, v := range list {
+		raw, weight := targetSpec(v)
+		u, err := url.ParseRequestURI(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s tracking_urls[%d]: %w", tag, i, err)
+		}
+		if weight < 1 {
+			return nil, fmt.Errorf("%s tracking_urls[%d]: weight must be at least 1", tag, i)
+		}
+		s, err := newSink(c.at(u), block)
+		if err != nil {
+			return nil, err
+		}
+		b.targets = append(b.targets, &target{name: u.Redacted(), sink: s, weight: weight, cooldown: b.cooldown})
+	}
+	if len(b.targets) == 0 {
+		return nil, fmt.Errorf("%s tracking_urls is empty", tag)
+	}
+	switch strategy, _ := opts["strategy"].(string); strategy {
+	case "", "weighted":
+	case "hash":
+		var err error
+		if b.key, err = parseKey(opts, "hash_key"); err != nil {
+			return nil, err
+		}
+		for _, t := range b.targets {
+			for i := 0; i < 100*t.weight; i++ {
+				b.ring = append(b.ring, ringPoint{hash: hashKey(t.name + "#" + strconv.Itoa(i)), t: t})
+			}
+		}
+		slices.SortFunc(b.ring, func(x, y ringPoint) int { return cmp.Compare(x.hash, y.hash) })
+	default:
+		return nil, fmt.Errorf("%s unknown balance strategy %q", tag, strategy)
+	}
+	balancersMu.Lock()
+	balancers = append(balancers, b)
+	balancersMu.Unlock()
+	return b, nil
+}
+
+// circuits lists every target of tracking_urls for the diagnostic dump:
+// closed (healthy), open (ejected) or half_open (back after its cooldown,
+// one success away from healthy).
+func circuits() interface{} {
+	balancersMu.Lock()
+	list := slices.Clone(balancers)
+	balancersMu.Unlock()
+	now := time.Now()
+	out := []map[string]interface{}{}
+	for _, b := range list {
+		b.mu.Lock()
+		for _, t := range b.targets {
+			state := "closed"
+			switch {
+			case now.Before(t.downUntil):
+				state = "open"
+			case t.fails >= b.threshold:
+				state = "half_open"
+			}
+			d := map[string]interface{}{"target": t.name, "weight": t.weight, "circuit": state, "failures": t.fails}
+			if state == "open" {
+				d["ejected_until"] = t.downUntil.UTC()
+			}
+			out = append(out, d)
+		}
+		b.mu.Unlock()
+	}
+	return out
+}
+
+// hashKey is 64-bit FNV-1a with a final mix, so that similar keys spread
+// over the whole ring.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (b *balancer) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	key := b.keyOf(ev)
+	t := b.pick(key, nil)
+	err := t.sink.Send(ctx, ev, payload)
+	b.report(t, err)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if next := b.pick(key, t); next != nil {
+		err = next.sink.Send(ctx, ev, payload)
+		b.report(next, err)
+	}
+	return err
+}
+
+// keyOf is the hash key of ev, "" without the hash strategy.
+func (b *balancer) keyOf(ev *capture.Event) string {
+	switch {
+	case b.ring == nil:
+		return ""
+	case b.key != nil:
+		return b.key.of(ev)
+	}
+	return capture.RequestID(ev)
+}
+
+// pick returns the next healthy target other than skip: the owner of key on
+// the ring, or by weight without a key. When none is healthy it returns the
+// one that comes back first, and nil only when skip is the single target.
+func (b *balancer) pick(key string, skip *target) *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if key != "" {
+		return b.onRing(key, skip, now)
+	}
+	var best, soonest *target
+	total := 0
+	for _, t := range b.targets {
+		if t == skip {
+			continue
+		}
+		if soonest == nil || t.downUntil.Before(soonest.downUntil) {
+			soonest = t
+		}
+		if now.Before(t.downUntil) {
+			continue
+		}
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	if best == nil {
+		return soonest
+	}
+	best.current -= total
+	return best
+}
+
+func (b *balancer) report(t *target, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if t.fails >= b.threshold {
+			capture.Log("tracking target", t.name, "is healthy again")
+		}
+		t.fails, t.cooldown = 0, b.cooldown
+		return
+	}
+	if t.fails++; t.fails >= b.threshold {
+		t.downUntil = time.Now().Add(t.cooldown)
+		capture.Log("tracking target", t.name, "taken out for", t.cooldown, "after", t.fails, "failures:", err)
+		t.cooldown = min(2*t.cooldown, b.maxCooldown)
+	}
+}
+
+// onRing walks the ring clockwise from key to the first healthy target other
+// than skip; the caller holds mu.
+func (b *balancer) onRing(key string, skip *target, now time.Time) *target {
+	h := hashKey(key)
+	i, _ := slices.BinarySearchFunc(b.ring, h, func(p ringPoint, h uint64) int { return cmp.Compare(p.hash, h) })
+	var soonest *target
+	for j := range b.ring {
+		t := b.ring[(i+j)%len(b.ring)].t
+		if t == skip {
+			continue
+		}
+		if !now.Before(t.downUntil) {
+			return t
+		}
+		if soonest == nil || t.downUntil.Before(soonest.downUntil) {
+			soonest = t
+		}
+	}
+	return soonest
+}
@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── client-side batching ───────── */
+
+// batcher groups events for sinks whose API accepts many per request. A batch
+// is flushed when it reaches maxItems / maxBytes or maxDelay after its first
+// event; every caller in the batch gets the result of that single flush.
+
+type batchItem struct {
+	ev      *capture.Event
+	payload []byte
+	done    chan error
+}
+
+type batcher struct {
+	maxItems int
+	maxBytes int
+	maxDelay time.Duration
+	timeout  time.Duration // per flush
+	flush    func(ctx context.Context, items []batchItem) error
+
+	mu    sync.Mutex
+	items []batchItem
+	size  int
+	timer *time.Timer
+}
+
+func newBatcher(opts map[string]interface{}, items, bytes int, timeout time.Duration,
+	flush func(context.Context, []batchItem) error) *batcher {
+	b := &batcher{
+		maxItems: items,
+		maxBytes: bytes,
+		maxDelay: 50 * time.Millisecond,
+		timeout:  timeout,
+		flush:    flush,
+	}
+	if v, ok := opts["batch_size"].(float64); ok && v > 0 && int(v) < items {
+		b.maxItems = int(v)
+	}
+	if v, ok := opts["batch_kb"].(float64); ok && v > 0 && int(v*1024) < bytes {
+		b.maxBytes = int(v * 1024)
+	}
+	if v, ok := opts["batch_delay_ms"].(float64); ok && v >= 0 {
+		b.maxDelay = time.Duration(v) * time.Millisecond
+	}
+	return b
+}
+
+func (b *batcher) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	it := batchItem{ev: ev, payload: payload, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	if len(b.items) > 0 && b.size+len(payload) > b.maxBytes {
+		b.cutLocked()
+	}
+	b.items = append(b.items, it)
+	b.size += len(payload)
+	switch {
+	case len(b.items) >= b.maxItems || b.size >= b.maxBytes:
+		b.cutLocked()
+	case len(b.items) == 1:
+		b.timer = time.AfterFunc(b.maxDelay, b.tick)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-it.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) tick() {
+	b.mu.Lock()
+	b.cutLocked()
+	b.mu.Unlock()
+}
+
+// cutLocked detaches the pending batch and flushes it in the background.
+func (b *batcher) cutLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.items) == 0 {
+		return
+	}
+	items := b.items
+	b.items, b.size = nil, 0
+	go func() {
+		var err error
+		defer func() {
+			for _, it := range items {
+				it.done <- err
+			}
+		}()
+		defer capture.Recover("batch flush", &err)
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		defer cancel()
+		err = b.flush(ctx, items)
+	}()
+}
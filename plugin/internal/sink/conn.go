@@ -0,0 +1,150 @@
+package sink
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── HTTP connection reuse ───────── */
+
+// Every HTTP sink sends through a transport that drains response bodies on
+// Close (up to 64 KB, beyond that the connection is dropped), so keep-alive
+// connections go back to the pool even after errors or partly read answers,
+// and counts per sink host what happened. The admin server shows the counts:
+//
+//	GET /debug/sinks
+//	{"collector.internal:443": {"requests": 1200, "new_conns": 4, "reused_conns": 1196,
+//	                            "idle_reused": 1190, "errors": 0, "status": {"200": 1200}}}
+//
+// reused_conns close to requests means keep-alive works; new_conns growing
+// with requests means connections are not reused (a sink closing them, or an
+// answer the transport cannot drain).
+
+const drainMax = 64 << 10
+
+type hostStats struct {
+	requests, newConns, reusedConns, idleReused, errors atomic.Int64
+
+	mu     sync.Mutex
+	status map[int]int64
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = map[string]*hostStats{}
+)
+
+func init() {
+	capture.HandleAdmin("GET /debug/sinks", serveSinkStats)
+	capture.AddDiagnostics("sinks", func() interface{} { return sinkStats() })
+}
+
+func statsFor(host string) *hostStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	st, ok := stats[host]
+	if !ok {
+		st = &hostStats{status: map[int]int64{}}
+		stats[host] = st
+	}
+	return st
+}
+
+// pooled wraps the transport of client.
+func pooled(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &countingTransport{base: base}
+	return &c
+}
+
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	st := statsFor(canonicalHost(r))
+	st.requests.Add(1)
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		switch {
+		case !info.Reused:
+			st.newConns.Add(1)
+		case info.WasIdle:
+			st.reusedConns.Add(1)
+			st.idleReused.Add(1)
+		default:
+			st.reusedConns.Add(1)
+		}
+	}}
+	resp, err := t.base.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if err != nil {
+		st.errors.Add(1)
+		return nil, err
+	}
+	st.mu.Lock()
+	st.status[resp.StatusCode]++
+	st.mu.Unlock()
+	resp.Body = &drainingBody{resp.Body}
+	return resp, nil
+}
+
+func canonicalHost(r *http.Request) string {
+	host := r.URL.Host
+	if r.URL.Port() == "" {
+		port := "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+		host += ":" + port
+	}
+	return host
+}
+
+// drainingBody reads what is left of the body before closing it.
+type drainingBody struct {
+	io.ReadCloser
+}
+
+func (b *drainingBody) Close() error {
+	io.Copy(io.Discard, io.LimitReader(b.ReadCloser, drainMax))
+	return b.ReadCloser.Close()
+}
+
+func serveSinkStats(w http.ResponseWriter, _ *http.Request) {
+	capture.WriteJSON(w, sinkStats())
+}
+
+type hostView struct {
+	Requests    int64            `json:"requests"`
+	NewConns    int64            `json:"new_conns"`
+	ReusedConns int64            `json:"reused_conns"`
+	IdleReused  int64            `json:"idle_reused"`
+	Errors      int64            `json:"errors"`
+	Status      map[string]int64 `json:"status"`
+}
+
+func sinkStats() map[string]hostView {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	out := make(map[string]hostView, len(stats))
+	for h, st := range stats {
+		v := hostView{Requests: st.requests.Load(), NewConns: st.newConns.Load(), ReusedConns: st.reusedConns.Load(),
+			IdleReused: st.idleReused.Load(), Errors: st.errors.Load(), Status: map[string]int64{}}
+		st.mu.Lock()
+		for code, n := range st.status {
+			v.Status[strconv.Itoa(code)] = n
+		}
+		st.mu.Unlock()
+		out[h] = v
+	}
+	return out
+}
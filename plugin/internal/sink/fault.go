@@ -0,0 +1,106 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── fault injection (testing only) ───────── */
+
+// fault_injection wraps the configured sink and makes a share of the sends
+// slow, fail or hang, to see how the gateway and the delivery path behave
+// before a collector outage does it for real:
+//
+//	"fault_injection": {
+//	  "latency_ms":   300,    // extra delay…
+//	  "latency_rate": 0.5,    // …for this share of the events
+//	  "error_rate":   0.1,    // fail without sending
+//	  "timeout_rate": 0.05,   // hang until the event deadline (timeout_ms)
+//	  "panic_rate":   0.01,   // panic in Send (see capture.Recover)
+//	  "seed":         42      // optional, for reproducible runs
+//	}
+//
+// Rates are between 0 and 1 and drawn independently per event; the error
+// events reporting a panic are never faulted. The plugin
+// refuses the block unless TRACE_PLUGIN_FAULT_INJECTION=1 is set, so a test
+// configuration cannot reach production by accident.
+
+// FaultEnv must be "1" for fault_injection to be accepted.
+const FaultEnv = "TRACE_PLUGIN_FAULT_INJECTION"
+
+// ErrInjected is returned for the sends error_rate fails.
+var ErrInjected = errors.New("fault injection: injected error")
+
+type faultSink struct {
+	next                           capture.Sink
+	latency                        time.Duration
+	latencyRate, errRate, hangRate float64
+	panicRate                      float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newFaultSink(next capture.Sink, opts map[string]interface{}) (*faultSink, error) {
+	s := &faultSink{next: next}
+	for key, dst := range map[string]*float64{
+		"latency_rate": &s.latencyRate, "error_rate": &s.errRate, "timeout_rate": &s.hangRate,
+		"panic_rate": &s.panicRate,
+	} {
+		v, _ := opts[key].(float64)
+		if v < 0 || v > 1 {
+			return nil, fmt.Errorf("%s fault_injection: %s must be between 0 and 1", tag, key)
+		}
+		*dst = v
+	}
+	if v, ok := opts["latency_ms"].(float64); ok && v > 0 {
+		s.latency = time.Duration(v) * time.Millisecond
+	}
+	if s.latencyRate > 0 && s.latency == 0 {
+		return nil, fmt.Errorf("%s fault_injection: latency_rate needs latency_ms", tag)
+	}
+	seed := uint64(time.Now().UnixNano())
+	if v, ok := opts["seed"].(float64); ok {
+		seed = uint64(v)
+	}
+	s.rnd = rand.New(rand.NewPCG(seed, seed))
+	capture.Log("fault_injection: latency", s.latency, "at", s.latencyRate,
+		"errors at", s.errRate, "timeouts at", s.hangRate, "panics at", s.panicRate)
+	return s, nil
+}
+
+func (s *faultSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	if ev.Meta.Get("error_class") == "panic" {
+		return s.next.Send(ctx, ev, payload)
+	}
+	s.mu.Lock()
+	slow, fail, hang := s.rnd.Float64() < s.latencyRate, s.rnd.Float64() < s.errRate, s.rnd.Float64() < s.hangRate
+	crash := s.rnd.Float64() < s.panicRate
+	s.mu.Unlock()
+
+	if crash {
+		panic("fault injection: injected panic")
+	}
+
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if slow {
+		select {
+		case <-time.After(s.latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return ErrInjected
+	}
+	return s.next.Send(ctx, ev, payload)
+}
@@ -0,0 +1,340 @@
+package sink
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Google application default credentials ───────── */
+
+// gcpCreds resolves credentials the way Google client libraries do: an
+// explicit file, then GOOGLE_APPLICATION_CREDENTIALS, then the gcloud user
+// file, then the metadata server (GCE, GKE workload identity, Cloud Run).
+// Access and ID tokens are cached until a minute before they expire.
+
+const gcpTokenURI = "https://oauth2.googleapis.com/token"
+
+type gcpCreds struct {
+	scope string
+	file  *gcpCredFile // nil → metadata server
+
+	mu       sync.Mutex
+	token    string
+	expiry   time.Time
+	idToken  string // for idAud
+	idAud    string
+	idExpiry time.Time
+}
+
+type gcpCredFile struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	key *rsa.PrivateKey
+}
+
+func newGCPCreds(path, scope string) (*gcpCreds, error) {
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			p := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(p); err == nil {
+				path = p
+			}
+		}
+	}
+	g := &gcpCreds{scope: scope}
+	if path == "" {
+		return g, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("gcp credentials: %w", err)
+	}
+	f := &gcpCredFile{}
+	if err := json.Unmarshal(raw, f); err != nil {
+		return nil, fmt.Errorf("gcp credentials: %w", err)
+	}
+	switch f.Type {
+	case "service_account":
+		blk, _ := pem.Decode([]byte(f.PrivateKey))
+		if blk == nil {
+			return nil, errors.New("gcp credentials: no PEM private key")
+		}
+		k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("gcp credentials: %w", err)
+		}
+		var ok bool
+		if f.key, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("gcp credentials: private key is not RSA")
+		}
+		if f.TokenURI == "" {
+			f.TokenURI = gcpTokenURI
+		}
+	case "authorized_user":
+	default:
+		return nil, fmt.Errorf("gcp credentials: unsupported type %q", f.Type)
+	}
+	g.file = f
+	return g, nil
+}
+
+// accessToken returns a cached or freshly minted OAuth2 access token.
+func (g *gcpCreds) accessToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expiry) {
+		return g.token, nil
+	}
+
+	var form url.Values
+	switch {
+	case g.file == nil:
+		return g.metadataToken(ctx)
+	case g.file.Type == "service_account":
+		jwt, err := g.file.assertion(map[string]interface{}{"scope": g.scope})
+		if err != nil {
+			return "", err
+		}
+		form = url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {jwt},
+		}
+	default:
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {g.file.ClientID},
+			"client_secret": {g.file.ClientSecret},
+			"refresh_token": {g.file.RefreshToken},
+		}
+	}
+	uri := gcpTokenURI
+	if g.file.TokenURI != "" {
+		uri = g.file.TokenURI
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := postForm(ctx, uri, form, &tok); err != nil {
+		return "", err
+	}
+	g.token, g.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn-60)*time.Second)
+	return g.token, nil
+}
+
+func (g *gcpCreds) metadataToken(ctx context.Context) (string, error) {
+	u := "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	if g.scope != "" {
+		u += "?scopes=" + url.QueryEscape(g.scope)
+	}
+	b, err := capture.MetadataGet(ctx, http.MethodGet, u, map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return "", err
+	}
+	g.token, g.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn-60)*time.Second)
+	return g.token, nil
+}
+
+// identityToken returns a cached or freshly minted Google-signed ID token
+// for audience, as Cloud Run, Cloud Functions and IAP expect. Only service
+// accounts can mint them: the metadata server's or a key file's.
+func (g *gcpCreds) identityToken(ctx context.Context, audience string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.idToken != "" && g.idAud == audience && time.Now().Before(g.idExpiry) {
+		return g.idToken, nil
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	switch {
+	case g.file == nil:
+		u := "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?format=full&audience=" +
+			url.QueryEscape(audience)
+		b, err := capture.MetadataGet(ctx, http.MethodGet, u, map[string]string{"Metadata-Flavor": "Google"})
+		if err != nil {
+			return "", err
+		}
+		tok.IDToken = strings.TrimSpace(string(b))
+	case g.file.Type == "service_account":
+		jwt, err := g.file.assertion(map[string]interface{}{"target_audience": audience})
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {jwt},
+		}
+		if err := postForm(ctx, g.file.TokenURI, form, &tok); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("gcp credentials: user credentials cannot mint ID tokens, use a service account")
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("gcp credentials: no id_token in the answer")
+	}
+	g.idToken, g.idAud, g.idExpiry = tok.IDToken, audience, jwtExpiry(tok.IDToken).Add(-time.Minute)
+	return g.idToken, nil
+}
+
+// jwtExpiry reads the exp claim of a compact JWT; an unreadable one counts
+// as valid for the usual hour.
+func jwtExpiry(token string) time.Time {
+	if parts := strings.Split(token, "."); len(parts) == 3 {
+		var c struct {
+			Exp int64 `json:"exp"`
+		}
+		if b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "=")); err == nil &&
+			json.Unmarshal(b, &c) == nil && c.Exp > 0 {
+			return time.Unix(c.Exp, 0)
+		}
+	}
+	return time.Now().Add(time.Hour)
+}
+
+// assertion builds the RS256 JWT a service account exchanges for a token.
+func (f *gcpCredFile) assertion(claims map[string]interface{}) (string, error) {
+	now := time.Now().Unix()
+	claims["iss"] = f.ClientEmail
+	claims["aud"] = f.TokenURI
+	claims["iat"] = now
+	claims["exp"] = now + 3600
+
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+/* ───────── Google auth for HTTP sinks ───────── */
+
+// gcpAuth sends Google-issued bearer tokens with the requests of a sink, so
+// the collector can be a Cloud Run service that only admits authenticated
+// callers; "gcp_auth" in the sink options:
+//
+//	"gcp_auth": {
+//	  "audience":         "https://collector-abc-ew.a.run.app",  // default: tracking_url origin
+//	  "token":            "id",                                  // or "access"
+//	  "scope":            "https://www.googleapis.com/auth/cloud-platform",  // for "access"
+//	  "credentials_file": "/secrets/sa.json"                     // default: ADC
+//	}
+//
+// "gcp_auth": true takes all defaults. ID tokens suit Cloud Run, Cloud
+// Functions and IAP; access tokens suit Google APIs and endpoints that check
+// them (API Gateway, ESPv2).
+type gcpAuth struct {
+	creds    *gcpCreds
+	audience string // "" → access token
+}
+
+func newGCPAuth(opts map[string]interface{}, origin string) (*gcpAuth, error) {
+	v, ok := opts["gcp_auth"].(map[string]interface{})
+	if !ok {
+		if on, _ := opts["gcp_auth"].(bool); !on {
+			return nil, nil
+		}
+		v = map[string]interface{}{}
+	}
+	file, _ := v["credentials_file"].(string)
+	scope, _ := v["scope"].(string)
+	a := &gcpAuth{audience: origin}
+	switch kind, _ := v["token"].(string); kind {
+	case "", "id":
+		if aud, _ := v["audience"].(string); aud != "" {
+			a.audience = aud
+		}
+	case "access":
+		a.audience = ""
+		if scope == "" {
+			scope = "https://www.googleapis.com/auth/cloud-platform"
+		}
+	default:
+		return nil, fmt.Errorf("%s gcp_auth token must be id or access, not %q", tag, kind)
+	}
+	var err error
+	if a.creds, err = newGCPCreds(file, scope); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *gcpAuth) authorization(ctx context.Context) (string, error) {
+	var tok string
+	var err error
+	if a.audience != "" {
+		tok, err = a.creds.identityToken(ctx, a.audience)
+	} else {
+		tok, err = a.creds.accessToken(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + tok, nil
+}
+
+/* ───────── OAuth helpers ───────── */
+
+// postForm posts an urlencoded form and decodes the JSON answer into out.
+func postForm(ctx context.Context, uri string, form url.Values, out interface{}) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("token endpoint %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"fmt"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── partition / ordering keys ───────── */
+
+// Sinks with partitions take their key either as a template over event
+// fields ("ordering_key": "{tenant}") or as an expression over the event, the
+// language of capture_if ("ordering_key_expr": "meta.tenant + ':' +
+// request.path"). An expression that fails to evaluate yields no key.
+
+type partitionKey struct {
+	tmpl string
+	expr *capture.Expr
+}
+
+// parseKey reads opts[name] and opts[name+"_expr"]; nil means no key.
+func parseKey(opts map[string]interface{}, name string) (*partitionKey, error) {
+	tmpl, _ := opts[name].(string)
+	src, _ := opts[name+"_expr"].(string)
+	switch {
+	case tmpl != "" && src != "":
+		return nil, fmt.Errorf("%s set %s or %s_expr, not both", tag, name, name)
+	case src != "":
+		e, err := capture.CompileExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid %s_expr: %w", tag, name, err)
+		}
+		return &partitionKey{expr: e}, nil
+	case tmpl != "":
+		return &partitionKey{tmpl: tmpl}, nil
+	}
+	return nil, nil
+}
+
+func (k *partitionKey) of(ev *capture.Event) string {
+	if k == nil {
+		return ""
+	}
+	if k.expr == nil {
+		return expand(k.tmpl, ev, func(v string) string { return v })
+	}
+	v, err := k.expr.Text(ev)
+	if err != nil {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── conditional sinks ───────── */
+
+// sink_rules sends events matching a condition to further sinks, next to the
+// block's own. A rule's "if" is an expression in the capture_if language, the
+// rest of the rule a small sink block as in tenant routes, payload_format
+// included:
+//
+//	"sink_rules": [
+//	  {"if": "response.status >= 500", "tracking_url": "https://hooks.example/errors"},
+//	  {"if": "request.path.startsWith('/admin')", "sink": "sqlite", "sqlite": {"path": "/var/lib/krakend/audit.db"}, "stop": true}
+//	]
+//
+// Every matching rule gets the event, in parallel, and so does the block's
+// sink; a matching rule with "stop" keeps the event from the later rules and
+// from the block's sink. A condition that fails to evaluate does not match.
+
+type sinkRule struct {
+	cond *capture.Expr
+	sink capture.Sink
+	stop bool
+}
+
+type ruleRouter struct {
+	rules    []sinkRule
+	fallback capture.Sink
+}
+
+func newRuleRouter(c *cfg, fallback capture.Sink, list []interface{}) (capture.Sink, error) {
+	r := &ruleRouter{fallback: fallback}
+	for i, v := range list {
+		block, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s sink_rules[%d] must be an object", tag, i)
+		}
+		src, _ := block["if"].(string)
+		if src == "" {
+			return nil, fmt.Errorf("%s sink_rules[%d]: if missing", tag, i)
+		}
+		cond, err := capture.CompileExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s sink_rules[%d]: %w", tag, i, err)
+		}
+		s, err := routeSink(c, block)
+		if err != nil {
+			return nil, fmt.Errorf("%s sink_rules[%d]: %w", tag, i, err)
+		}
+		stop, _ := block["stop"].(bool)
+		r.rules = append(r.rules, sinkRule{cond: cond, sink: s, stop: stop})
+	}
+	return r, nil
+}
+
+func (r *ruleRouter) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	targets := make([]capture.Sink, 0, 2)
+	stopped := false
+	for _, rule := range r.rules {
+		if ok, _ := rule.cond.Match(ev); ok {
+			targets = append(targets, rule.sink)
+			if stopped = rule.stop; stopped {
+				break
+			}
+		}
+	}
+	if !stopped {
+		targets = append(targets, r.fallback)
+	}
+	if len(targets) == 1 {
+		return targets[0].Send(ctx, ev, payload)
+	}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, s := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer capture.Recover("sink_rules", &errs[i])
+			errs[i] = s.Send(ctx, ev, payload)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
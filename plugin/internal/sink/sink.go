@@ -0,0 +1,434 @@
+// Package sink holds the destinations events are delivered to. Each
+// implements capture.Sink; New picks one for a backend block.
+//
+// SPDX-License-Identifier: Apache-2.0
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── sinks ───────── */
+
+const tag = capture.Tag
+
+// cfg is what the sinks need from the capture config.
+type cfg struct {
+	url     *url.URL
+	timeout time.Duration
+	format  capture.PayloadFormat
+	tls     *tls.Config  // sink_tls, nil for the defaults
+	client  *http.Client // HTTP sinks, with tls and connection stats
+}
+
+// at is c for another target URL.
+func (c *cfg) at(u *url.URL) *cfg {
+	d := *c
+	d.url = u
+	return &d
+}
+
+// tlsFor is the TLS setup of a connection to host: sink_tls, with host as
+// the server name unless it names one.
+func (c *cfg) tlsFor(host string) *tls.Config {
+	t := &tls.Config{}
+	if c.tls != nil {
+		t = c.tls.Clone()
+	}
+	if t.ServerName == "" {
+		t.ServerName = host
+	}
+	return t
+}
+
+// Local sinks write on the gateway host and need no tracking_url.
+var Local = map[string]bool{"stdout": true, "sqlite": true, "file": true, "parquet": true}
+
+// New builds the sink for block; target is the parsed tracking_url.
+func New(target *url.URL, timeout time.Duration, format capture.PayloadFormat, block map[string]interface{}) (capture.Sink, error) {
+	c := &cfg{url: target, timeout: timeout, format: format}
+	if v, ok := block["sink_tls"].(map[string]interface{}); ok {
+		var err error
+		if c.tls, err = capture.ParseTLS("sink_tls", v); err != nil {
+			return nil, fmt.Errorf("%s invalid sink_tls: %w", tag, err)
+		}
+	}
+	c.client = pooled(capture.HTTPClient(c.tls))
+	s, err := build(c, block)
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := block["sink_rules"].([]interface{}); ok && len(list) > 0 {
+		if s, err = newRuleRouter(c, s, list); err != nil {
+			return nil, err
+		}
+	}
+	if opts, ok := block["tenant"].(map[string]interface{}); ok {
+		if s, err = newTenantRouter(c, s, opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts, ok := block["fault_injection"].(map[string]interface{}); ok {
+		return newFaultSink(s, opts)
+	}
+	return s, nil
+}
+
+// Kinds are the sink names; each sink reads its options from a block of the
+// same name.
+var Kinds = []string{"http", "nats", "redis", "amqp", "pubsub", "eventhubs", "elasticsearch",
+	"loki", "clickhouse", "gelf", "otlp", "grpc", "websocket", "mqtt", "unix", "stdout", "sqlite", "file", "parquet"}
+
+// Kind is the sink block selects: the explicit "sink" key or, failing that,
+// the one for the tracking_url scheme.
+func Kind(target *url.URL, block map[string]interface{}) string {
+	if kind, _ := block["sink"].(string); kind != "" {
+		return kind
+	}
+	switch target.Scheme {
+	case "nats", "tls":
+		return "nats"
+	case "redis", "rediss":
+		return "redis"
+	case "amqp", "amqps":
+		return "amqp"
+	case "pubsub", "eventhubs":
+		return target.Scheme
+	case "gelf+udp", "gelf+tcp":
+		return "gelf"
+	case "unix":
+		return "unix"
+	case "grpc", "grpcs":
+		return "grpc"
+	case "ws", "wss":
+		return "websocket"
+	case "mqtt", "mqtts":
+		return "mqtt"
+	}
+	return "http"
+}
+
+// documentSinks store a document of their own built from the event rather
+// than the encoded payload.
+var documentSinks = map[string]bool{"stdout": true, "sqlite": true, "file": true, "parquet": true,
+	"elasticsearch": true, "clickhouse": true}
+
+// Reencodes names the first sink of block, its sink_rules and tenant routes
+// included, that does not send the payload as format encoded it, or "".
+// The audit chain hashes that payload, so such a sink breaks verification.
+func Reencodes(target *url.URL, format string, block map[string]interface{}) string {
+	if kind := reencodes(target, block); kind != "" {
+		return kind
+	}
+	var routes []interface{}
+	if list, ok := block["sink_rules"].([]interface{}); ok {
+		routes = append(routes, list...)
+	}
+	if opts, ok := block["tenant"].(map[string]interface{}); ok {
+		m, _ := opts["routes"].(map[string]interface{})
+		for _, v := range m {
+			routes = append(routes, v)
+		}
+	}
+	for _, v := range routes {
+		r, _ := v.(map[string]interface{})
+		if name, _ := r["payload_format"].(string); name != "" && name != format {
+			return "payload_format " + name
+		}
+		u := &url.URL{Scheme: "local"}
+		if raw, _ := r["tracking_url"].(string); raw != "" {
+			if parsed, err := url.ParseRequestURI(raw); err == nil {
+				u = parsed
+			}
+		}
+		if kind := reencodes(u, r); kind != "" {
+			return kind
+		}
+	}
+	return ""
+}
+
+// reencodes checks the sink of a single block (or its first tracking_urls entry).
+func reencodes(target *url.URL, block map[string]interface{}) string {
+	if raw := FirstTarget(block); raw != "" {
+		if u, err := url.ParseRequestURI(raw); err == nil {
+			target = u
+		}
+	}
+	kind := Kind(target, block)
+	if documentSinks[kind] {
+		return kind
+	}
+	if opts, _ := block[kind].(map[string]interface{}); kind == "unix" && opts["mode"] == "ndjson" {
+		return "unix ndjson"
+	}
+	return ""
+}
+
+// build returns the balancer over tracking_urls or the single sink of block.
+func build(c *cfg, block map[string]interface{}) (capture.Sink, error) {
+	if _, ok := block["tracking_urls"]; ok {
+		return newBalancer(c, block)
+	}
+	return newSink(c, block)
+}
+
+func newSink(c *cfg, block map[string]interface{}) (capture.Sink, error) {
+	kind := Kind(c.url, block)
+	opts, _ := block[kind].(map[string]interface{})
+
+	switch kind {
+	case "http":
+		u := unbrace.Replace(c.url.String())
+		s := &httpSink{url: u, mime: c.format.ContentType, templated: strings.Contains(u, "{"), client: c.client}
+		var err error
+		if s.signer, err = newSigV4(opts); err != nil {
+			return nil, err
+		}
+		gcp, err := newGCPAuth(opts, c.url.Scheme+"://"+c.url.Host)
+		if err != nil {
+			return nil, err
+		}
+		if gcp != nil {
+			s.auth = gcp
+		}
+		if s.ack, err = newAckPolicy(c, opts, u); err != nil {
+			return nil, err
+		}
+		if s.ack != nil && s.ack.spool != "" {
+			capture.AddDrain(s.drainSpool)
+		}
+		if s.auth == nil {
+			if s.auth, err = newAzureAuth(opts); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.batched(c, opts); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "nats":
+		return newNATSSink(c, opts)
+	case "redis":
+		return newRedisSink(c, opts)
+	case "amqp":
+		return newAMQPSink(c, opts)
+	case "pubsub":
+		return newPubSubSink(c, opts)
+	case "eventhubs":
+		return newEventHubsSink(c, opts)
+	case "elasticsearch":
+		return newElasticSink(c, opts)
+	case "loki":
+		return newLokiSink(c, opts)
+	case "clickhouse":
+		return newClickHouseSink(c, opts)
+	case "gelf":
+		return newGELFSink(c, opts)
+	case "otlp":
+		return newOTLPSink(c, opts)
+	case "grpc":
+		return newGRPCSink(c, opts)
+	case "websocket":
+		return newWebSocketSink(c, opts)
+	case "mqtt":
+		return newMQTTSink(c, opts)
+	case "unix":
+		return newUnixSink(c, opts)
+	case "stdout":
+		return &stdoutSink{}, nil
+	case "sqlite":
+		return newSQLiteSink(opts)
+	case "file":
+		return newFileSink(opts)
+	case "parquet":
+		return newParquetSink(opts)
+	}
+	return nil, fmt.Errorf("%s unknown sink %q", tag, kind)
+}
+
+/* ───────── HTTP (default) ───────── */
+
+// The tracking_url may hold placeholders in its path and query, expanded per
+// event (see expand):
+//
+//	"tracking_url": "https://collector.example/{tenant}/{yyyy-mm-dd}/events"
+//
+// With "http": {"sigv4": {…}} requests are signed for IAM-protected
+// endpoints (see sigv4); with "gcp_auth" or "azure_auth" they carry a Google
+// or Azure AD token (see gcpAuth, newAzureAuth); with "ack" delivery is
+// acknowledged (see ackPolicy); with "batch" CloudEvents are posted in the
+// batched content mode (see batched).
+type httpSink struct {
+	url, mime string
+	templated bool
+	signer    *sigv4
+	auth      authorizer
+	client    *http.Client
+	ack       *ackPolicy // nil: at most once
+	batch     *batcher   // nil: one POST per event
+}
+
+// authorizer produces the Authorization header of a sink request.
+type authorizer interface {
+	authorization(ctx context.Context) (string, error)
+}
+
+// unbrace undoes the escaping of placeholders by url.URL.String.
+var unbrace = strings.NewReplacer("%7B", "{", "%7D", "}")
+
+// urlToken escapes a value for a path segment or a query value.
+func urlToken(v string) string {
+	return queryReserved.Replace(url.PathEscape(v))
+}
+
+var queryReserved = strings.NewReplacer("&", "%26", "=", "%3D", "+", "%2B")
+
+func (s *httpSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	u := s.url
+	if s.templated {
+		u = expand(u, ev, urlToken)
+	}
+	if s.ack != nil {
+		return s.sendAcked(ctx, u, receiptID(ev), payload)
+	}
+	if s.batch != nil {
+		return s.batch.Send(ctx, ev, payload)
+	}
+	return s.post(ctx, u, "", payload)
+}
+
+// batched sets up the CloudEvents batched content mode: with
+//
+//	"payload_format": "cloudevents",
+//	"http": {"batch": {"batch_size": 100, "batch_kb": 1024, "batch_delay_ms": 200}}
+//
+// (or "batch": true for the defaults) events are grouped by the batcher and
+// posted as one JSON array, application/cloudevents-batch+json. Every event
+// of a batch gets the result of its POST. Acknowledged delivery and a
+// templated tracking_url are per event, so they cannot be combined with it.
+func (s *httpSink) batched(c *cfg, opts map[string]interface{}) error {
+	var bopts map[string]interface{}
+	switch v := opts["batch"].(type) {
+	case nil:
+		return nil
+	case bool:
+		if !v {
+			return nil
+		}
+	case map[string]interface{}:
+		bopts = v
+	default:
+		return fmt.Errorf("%s http.batch must be true or an object", tag)
+	}
+	switch {
+	case c.format.Name != "cloudevents":
+		return fmt.Errorf("%s http.batch needs payload_format cloudevents", tag)
+	case s.ack != nil:
+		return fmt.Errorf("%s http.batch cannot be combined with http.ack", tag)
+	case s.templated:
+		return fmt.Errorf("%s http.batch needs a tracking_url without placeholders", tag)
+	}
+	s.mime = capture.CloudEventsBatch
+	s.batch = newBatcher(bopts, 1000, 4<<20, c.timeout, func(ctx context.Context, items []batchItem) error {
+		var b bytes.Buffer
+		b.WriteByte('[')
+		for i, it := range items {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(it.payload)
+		}
+		b.WriteByte(']')
+		return s.post(ctx, s.url, "", b.Bytes())
+	})
+	return nil
+}
+
+// post sends one request; with an id, the answer has to carry its receipt.
+func (s *httpSink) post(ctx context.Context, u, id string, payload []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", s.mime)
+	if id != "" {
+		r.Header.Set(eventIDHeader, id)
+	}
+	if s.auth != nil {
+		a, err := s.auth.authorization(ctx)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", a)
+	}
+	if s.signer != nil {
+		if err := s.signer.sign(ctx, r, payload); err != nil {
+			return err
+		}
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("http: %s", resp.Status)
+	}
+	if id != "" && resp.Header.Get(receiptHeader) != id {
+		return fmt.Errorf("http: %s without receipt for %s", resp.Status, id)
+	}
+	return nil
+}
+
+/* ───────── templating ───────── */
+
+// expand replaces {field} placeholders with event meta values,
+// {header.Name} with request headers, {claim.path} with bearer JWT claims and
+// date patterns such as {yyyy.MM.dd} with the (UTC) request time; unknown
+// fields become "unknown" so a template never yields an empty token.
+func expand(tmpl string, ev *capture.Event, esc func(string) string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		j := strings.IndexByte(tmpl[i+1:], '}')
+		if i < 0 || j < 0 {
+			b.WriteString(tmpl)
+			return b.String()
+		}
+		b.WriteString(tmpl[:i])
+		key := tmpl[i+1 : i+1+j]
+		v := ev.Meta.Get(key)
+		if h, ok := strings.CutPrefix(key, "header."); ok && v == "" {
+			v = ev.ReqHeader.Get(h)
+		}
+		if c, ok := strings.CutPrefix(key, "claim."); ok && v == "" {
+			v = capture.Claim(ev.ReqHeader, c)
+		}
+		if v == "" && strings.Contains(key, "yyyy") {
+			v = ev.At.UTC().Format(datePattern.Replace(key))
+		}
+		if v == "" {
+			v = "unknown"
+		}
+		b.WriteString(esc(v))
+		tmpl = tmpl[i+j+2:]
+	}
+}
+
+// datePattern maps yyyy / MM (or mm) / dd / HH tokens onto Go layouts.
+var datePattern = strings.NewReplacer("yyyy", "2006", "MM", "01", "mm", "01", "dd", "02", "HH", "15")
@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/* ───────── ClickHouse sink ───────── */
+
+// Inserts batches through the HTTP interface as JSONEachRow. The expected
+// table layout is published in schema/clickhouse.sql.
+//
+//	"tracking_url": "https://clickhouse.svc:8443",
+//	"sink": "clickhouse",
+//	"clickhouse": {
+//	  "database": "default",
+//	  "table":    "krakend_traces",
+//	  "username": "", "password": "",
+//	  "async_insert": false,
+//	  "batch_size": 1000, "batch_kb": 8192, "batch_delay_ms": 1000
+//	}
+
+type clickhouseSink struct {
+	url      string
+	client   *http.Client
+	user     string
+	password string
+	*batcher
+}
+
+type clickhouseRow struct {
+	Timestamp    string            `json:"timestamp"`
+	InstanceID   string            `json:"instance_id"`
+	Seq          uint64            `json:"seq"`
+	Endpoint     string            `json:"endpoint"`
+	Backend      string            `json:"backend"`
+	Status       int               `json:"status"`
+	ClientIP     string            `json:"client_ip"`
+	URL          string            `json:"url"`
+	Query        string            `json:"query"`
+	RequestBody  string            `json:"request_body"`
+	ResponseBody string            `json:"response_body"`
+	Meta         map[string]string `json:"meta"`
+}
+
+func newClickHouseSink(c *cfg, opts map[string]interface{}) (*clickhouseSink, error) {
+	table := "krakend_traces"
+	if v, ok := opts["table"].(string); ok && v != "" {
+		table = v
+	}
+	if v, ok := opts["database"].(string); ok && v != "" {
+		table = v + "." + table
+	}
+	q := url.Values{
+		"query":                  {"INSERT INTO " + table + " FORMAT JSONEachRow"},
+		"date_time_input_format": {"best_effort"},
+	}
+	if v, ok := opts["async_insert"].(bool); ok && v {
+		q.Set("async_insert", "1")
+		q.Set("wait_for_async_insert", "1")
+	}
+	s := &clickhouseSink{url: strings.TrimRight(c.url.String(), "/") + "/?" + q.Encode(), client: c.client}
+	s.user, _ = opts["username"].(string)
+	s.password, _ = opts["password"].(string)
+	s.batcher = newBatcher(opts, 10_000, 16<<20, c.timeout, s.insert)
+	return s, nil
+}
+
+func (s *clickhouseSink) insert(ctx context.Context, items []batchItem) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, it := range items {
+		ev := it.ev
+		seq, _ := strconv.ParseUint(ev.Meta.Get("seq"), 10, 64)
+		row := clickhouseRow{
+			Timestamp:    ev.At.UTC().Format("2006-01-02 15:04:05.000"),
+			InstanceID:   ev.Meta.Get("instance_id"),
+			Seq:          seq,
+			Endpoint:     ev.Meta.Get("endpoint"),
+			Backend:      ev.Meta.Get("backend"),
+			Status:       ev.Status,
+			ClientIP:     ev.Meta.Get("client_ip"),
+			URL:          ev.URL.String(),
+			Query:        ev.URL.RawQuery,
+			RequestBody:  string(ev.ReqBody),
+			ResponseBody: string(ev.RespBody),
+			Meta:         make(map[string]string, len(ev.Meta)),
+		}
+		for k := range ev.Meta {
+			row.Meta[k] = ev.Meta.Get(k)
+		}
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		r.Header.Set("X-ClickHouse-User", s.user)
+		r.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("clickhouse: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
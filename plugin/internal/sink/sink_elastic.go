@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Elasticsearch bulk sink ───────── */
+
+// Events are indexed as JSON documents through the _bulk API. Throttling
+// (HTTP 429 for the whole request or per item) is retried with exponential
+// backoff until the flush deadline; other item failures fail the batch. With
+// payload_format "ecs" the documents follow the Elastic Common Schema.
+//
+//	"tracking_url": "https://es.svc:9200",
+//	"sink": "elasticsearch",
+//	"elasticsearch": {
+//	  "index":    "traces-{yyyy.MM.dd}",  // date and {field} placeholders
+//	  "username": "", "password": "",     // basic auth
+//	  "api_key":  "",                     // or id:key / encoded API key
+//	  "sigv4":    {"region": "eu-west-1", "service": "es"},  // or AWS SigV4 (OpenSearch)
+//	  "batch_size": 500, "batch_kb": 5120, "batch_delay_ms": 200
+//	}
+
+type elasticSink struct {
+	url    string
+	client *http.Client
+	index  string
+	auth   string
+	signer *sigv4
+	ecs    bool
+	*batcher
+}
+
+func newElasticSink(c *cfg, opts map[string]interface{}) (*elasticSink, error) {
+	s := &elasticSink{
+		client: c.client,
+		url:    strings.TrimRight(c.url.String(), "/") + "/_bulk",
+		index:  "krakend-traces-{yyyy.MM.dd}",
+		ecs:    c.format.Name == "ecs",
+	}
+	if v, ok := opts["index"].(string); ok && v != "" {
+		s.index = v
+	}
+	if v, ok := opts["api_key"].(string); ok && v != "" {
+		if strings.Contains(v, ":") {
+			v = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		s.auth = "ApiKey " + v
+	} else if u, ok := opts["username"].(string); ok && u != "" {
+		p, _ := opts["password"].(string)
+		s.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u+":"+p))
+	}
+	var err error
+	if s.signer, err = newSigV4(opts); err != nil {
+		return nil, err
+	}
+	s.batcher = newBatcher(opts, 1000, 10<<20, c.timeout, s.bulk)
+	return s, nil
+}
+
+func (s *elasticSink) bulk(ctx context.Context, items []batchItem) error {
+	backoff := 100 * time.Millisecond
+	for {
+		retry, err := s.post(ctx, items)
+		if err != nil || len(retry) == 0 {
+			return err
+		}
+		capture.Log("elasticsearch throttled,", len(retry), "docs retried in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("elasticsearch: %d docs still throttled: %w", len(retry), ctx.Err())
+		}
+		items, backoff = retry, backoff*2
+	}
+}
+
+// post sends one bulk request and returns the items rejected with 429.
+func (s *elasticSink) post(ctx context.Context, items []batchItem) ([]batchItem, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, it := range items {
+		enc.Encode(map[string]interface{}{"index": map[string]string{
+			"_index": expand(s.index, it.ev, strings.ToLower),
+		}})
+		if s.ecs {
+			enc.Encode(it.ev.ECSDoc())
+		} else {
+			enc.Encode(it.ev.Doc())
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	if s.auth != "" {
+		r.Header.Set("Authorization", s.auth)
+	}
+	if s.signer != nil {
+		if err := s.signer.sign(ctx, r, body.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(io.Discard, resp.Body)
+		return items, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("elasticsearch: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var res struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("elasticsearch: bad bulk response: %w", err)
+	}
+	if !res.Errors {
+		return nil, nil
+	}
+	var retry []batchItem
+	failed, reason := 0, ""
+	for i, item := range res.Items {
+		for _, r := range item {
+			switch {
+			case r.Status == http.StatusTooManyRequests && i < len(items):
+				retry = append(retry, items[i])
+			case r.Status/100 != 2:
+				failed++
+				reason = r.Error.Type + ": " + r.Error.Reason
+			}
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("elasticsearch: %d docs rejected (%s)", failed, reason)
+	}
+	return retry, nil
+}
@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── rolling HAR files ───────── */
+
+// Keeps the last hours of traffic on the gateway host as hourly HAR files
+// (traces-YYYYMMDD-HH.har), kept valid after every write so they load into
+// devtools as they grow, pruned by age and total size. The queryable store is
+// the sqlite sink.
+//
+//	"sink": "file",
+//	"file": {
+//	  "dir":           "/var/lib/krakend/traces",
+//	  "format":        "har",  // the only one
+//	  "max_age_hours": 24,
+//	  "max_mb":        1024
+//	}
+
+const fileSegmentLayout = "20060102-15"
+
+// harTrailer closes the entries array of a rolling HAR segment; each append
+// overwrites it.
+const harTrailer = "]}}\n"
+
+type fileSink struct {
+	dir    string
+	maxAge time.Duration
+	maxMB  int64
+
+	mu      sync.Mutex
+	f       *os.File
+	segment string
+	size    int64 // of the HAR segment being written
+	writes  int
+}
+
+func newFileSink(opts map[string]interface{}) (*fileSink, error) {
+	s := &fileSink{maxAge: 24 * time.Hour, maxMB: 1024}
+	s.dir, _ = opts["dir"].(string)
+	if s.dir == "" {
+		return nil, fmt.Errorf("%s file sink needs a dir", tag)
+	}
+	switch v, _ := opts["format"].(string); v {
+	case "", "har":
+	case "ndjson":
+		return nil, fmt.Errorf("%s the file sink writes HAR files; the sqlite sink is the local store", tag)
+	default:
+		return nil, fmt.Errorf("%s unknown file format %q", tag, v)
+	}
+	if v, ok := opts["max_age_hours"].(float64); ok && v > 0 {
+		s.maxAge = time.Duration(v * float64(time.Hour))
+	}
+	if v, ok := opts["max_mb"].(float64); ok && v > 0 {
+		s.maxMB = int64(v)
+	}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("%s file sink: %w", tag, err)
+	}
+	s.prune(time.Now())
+	return s, nil
+}
+
+func (s *fileSink) Send(_ context.Context, ev *capture.Event, _ []byte) error {
+	entry, err := json.Marshal(ev.HAREntry())
+	if err != nil {
+		return err
+	}
+	entry = append(entry, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if seg := now.Format(fileSegmentLayout); seg != s.segment || s.f == nil {
+		if s.f != nil {
+			s.f.Close()
+		}
+		name := filepath.Join(s.dir, "traces-"+seg+".har")
+		// not O_APPEND: entries go in front of the trailer
+		if s.f, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0o640); err != nil {
+			s.f = nil
+			return err
+		}
+		s.size = -1
+		s.segment = seg
+		s.prune(now)
+	}
+	if err = s.writeHAR(entry); err != nil {
+		return err
+	}
+	// size cap is checked every few hundred writes, not on each one
+	if s.writes++; s.writes%256 == 0 {
+		s.prune(now)
+	}
+	return nil
+}
+
+// writeHAR adds one entry to the current HAR segment, starting the log when
+// the segment is new.
+func (s *fileSink) writeHAR(entry []byte) error {
+	if s.size < 0 {
+		fi, err := s.f.Stat()
+		if err != nil {
+			return err
+		}
+		s.size = fi.Size()
+	}
+	var b []byte
+	at := s.size - int64(len(harTrailer))
+	if at <= 0 {
+		at = 0
+		b = []byte(`{"log":{"version":"1.2","creator":{"name":"krakend-trace-plugin","version":"1.0"},"entries":[` + "\n")
+	} else {
+		b = []byte(",")
+	}
+	b = append(append(b, entry...), harTrailer...)
+	if _, err := s.f.WriteAt(b, at); err != nil {
+		return err
+	}
+	s.size = at + int64(len(b))
+	return nil
+}
+
+// prune removes segments older than maxAge, then the oldest ones until the
+// directory fits in maxMB. The segment being written is never removed.
+func (s *fileSink) prune(now time.Time) {
+	names, _ := filepath.Glob(filepath.Join(s.dir, "traces-*.har"))
+	sort.Strings(names) // segment names sort chronologically
+	cutoff := now.Add(-s.maxAge).UTC().Format(fileSegmentLayout)
+
+	var total int64
+	sizes := make([]int64, len(names))
+	for i, n := range names {
+		if fi, err := os.Stat(n); err == nil {
+			sizes[i] = fi.Size()
+			total += fi.Size()
+		}
+	}
+	for i, n := range names {
+		seg := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(n), "traces-"), ".har")
+		if seg == s.segment {
+			break
+		}
+		if seg >= cutoff && total <= s.maxMB<<20 {
+			break
+		}
+		if os.Remove(n) == nil {
+			total -= sizes[i]
+		}
+	}
+}
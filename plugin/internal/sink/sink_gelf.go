@@ -0,0 +1,168 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Graylog GELF sink ───────── */
+
+// GELF 1.1 over UDP (optionally gzip'd, chunked above chunk_size) or TCP
+// (uncompressed, NUL-delimited). The payload goes to full_message, event meta
+// becomes additional _fields.
+//
+//	"tracking_url": "gelf+udp://graylog.svc:12201",   // or gelf+tcp://
+//	"gelf": {
+//	  "compress":   true,   // UDP only
+//	  "chunk_size": 1420    // UDP datagram budget
+//	}
+
+const gelfMaxChunks = 128
+
+type gelfSink struct {
+	network   string
+	addr      string
+	host      string
+	compress  bool
+	chunkSize int
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newGELFSink(c *cfg, opts map[string]interface{}) (*gelfSink, error) {
+	s := &gelfSink{
+		network:   "udp",
+		addr:      c.url.Host,
+		compress:  true,
+		chunkSize: 1420,
+		timeout:   c.timeout,
+	}
+	if strings.HasSuffix(c.url.Scheme, "tcp") {
+		s.network = "tcp"
+	}
+	if c.url.Port() == "" {
+		s.addr = net.JoinHostPort(c.url.Hostname(), "12201")
+	}
+	if v, ok := opts["compress"].(bool); ok {
+		s.compress = v
+	}
+	if v, ok := opts["chunk_size"].(float64); ok && v > 12 {
+		s.chunkSize = int(v)
+	}
+	s.host, _ = os.Hostname()
+	return s, nil
+}
+
+func (s *gelfSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	msg, err := s.message(ev, payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		d := net.Dialer{Timeout: s.timeout}
+		if s.conn, err = d.DialContext(ctx, s.network, s.addr); err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(dl)
+	}
+	if s.network == "tcp" {
+		_, err = s.conn.Write(append(msg, 0))
+	} else {
+		err = s.writeUDP(msg)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *gelfSink) message(ev *capture.Event, payload []byte) ([]byte, error) {
+	level := 6 // informational
+	if ev.Status >= 500 || ev.Status == 0 {
+		level = 3 // error
+	}
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          s.host,
+		"short_message": ev.URL.Path + " " + strconv.Itoa(ev.Status),
+		"full_message":  string(payload),
+		"timestamp":     float64(ev.At.UnixMilli()) / 1000,
+		"level":         level,
+	}
+	for k := range ev.Meta {
+		m["_"+gelfField(k)] = ev.Meta.Get(k)
+	}
+	delete(m, "_id") // reserved by Graylog
+	return json.Marshal(m)
+}
+
+func (s *gelfSink) writeUDP(msg []byte) error {
+	if s.compress {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(msg)
+		zw.Close()
+		msg = b.Bytes()
+	}
+	if len(msg) <= s.chunkSize {
+		_, err := s.conn.Write(msg)
+		return err
+	}
+
+	// chunked: 0x1e 0x0f, 8-byte message id, sequence number, sequence count
+	body := s.chunkSize - 12
+	n := (len(msg) + body - 1) / body
+	if n > gelfMaxChunks {
+		return errors.New("gelf: message too large for UDP (" + strconv.Itoa(len(msg)) + " B)")
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	hdr := make([]byte, 12, s.chunkSize)
+	hdr[0], hdr[1] = 0x1e, 0x0f
+	copy(hdr[2:10], id[:])
+	hdr[11] = byte(n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * body
+		if end > len(msg) {
+			end = len(msg)
+		}
+		hdr[10] = byte(i)
+		if _, err := s.conn.Write(append(hdr[:12], msg[i*body:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gelfField keeps additional field names within [\w.-].
+func gelfField(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, k)
+}
@@ -0,0 +1,300 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── gRPC streaming sink ───────── */
+
+// Keeps one bidirectional gRPC stream open to the collector and writes every
+// event on it, so high rates cost a length-prefixed message each instead of
+// a request. The service is krakend.trace.v1.TraceCollector in
+// schema/trace_collector.proto:
+//
+//	"tracking_url": "grpcs://collector.svc:4443",
+//	"grpc": {
+//	  "metadata":        {"authorization": "Bearer …"},  // request metadata
+//	  "max_in_flight":   1000,   // unacknowledged events before Send waits
+//	  "reconnect_max_ms": 5000   // backoff cap between failed connects
+//	}
+//
+// Each StreamRequest carries the payload of payload_format and its content
+// type; the collector answers a StreamAck per id, and an ack with an error
+// fails that event's Send. HTTP/2 flow control and max_in_flight bound what
+// is buffered. When the stream ends, every unacknowledged Send fails and the
+// next Send reconnects, backing off from 100ms up to reconnect_max_ms while
+// connects keep failing. The stream runs over TLS with sink_tls; cleartext
+// h2c needs a newer Go than the plugin builds with.
+
+const grpcMethod = "/krakend.trace.v1.TraceCollector/Stream"
+
+// grpcMaxAck bounds the messages the reader accepts; StreamAcks are a few
+// bytes, so a larger length prefix is a broken or hostile peer.
+const grpcMaxAck = 1 << 20
+
+type grpcSink struct {
+	url     string
+	client  *http.Client
+	mime    string
+	md      map[string]string
+	window  chan struct{}
+	backoff time.Duration
+
+	next atomic.Uint64
+
+	mu      sync.Mutex
+	st      *grpcStream
+	fails   int
+	retryAt time.Time
+	lastErr error
+}
+
+func newGRPCSink(c *cfg, opts map[string]interface{}) (*grpcSink, error) {
+	if c.url.Scheme != "grpcs" {
+		return nil, fmt.Errorf("%s grpc sink needs TLS: use a grpcs:// tracking_url", tag)
+	}
+	u := url.URL{Scheme: "https", Host: c.url.Host, Path: grpcMethod}
+	s := &grpcSink{url: u.String(), client: c.client, mime: c.format.ContentType,
+		md: map[string]string{}, backoff: 5 * time.Second}
+	if m, ok := opts["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			s.md[k] = fmt.Sprint(v)
+		}
+	}
+	window := 1000
+	if v, ok := opts["max_in_flight"].(float64); ok && v >= 1 {
+		window = int(v)
+	}
+	s.window = make(chan struct{}, window)
+	if v, ok := opts["reconnect_max_ms"].(float64); ok && v >= 100 {
+		s.backoff = time.Duration(v) * time.Millisecond
+	}
+	return s, nil
+}
+
+func (s *grpcSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	select {
+	case s.window <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.window }()
+
+	st, err := s.stream()
+	if err != nil {
+		return err
+	}
+	id := s.next.Add(1)
+	ack := make(chan error, 1)
+	if err := st.expect(id, ack); err != nil {
+		return err
+	}
+	defer st.forget(id)
+
+	var m pb
+	m.varint(1, id)
+	m.str(2, s.mime)
+	m.bytes(3, payload)
+	m.str(4, receiptID(ev))
+	// a pipe write cannot be interrupted; a collector that stops reading for
+	// longer than the send timeout loses the stream instead.
+	stop := context.AfterFunc(ctx, func() { st.fail(fmt.Errorf("grpc: write stalled: %w", ctx.Err())) })
+	err = st.write(m.Bytes())
+	stop()
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stream is the open stream, connecting a new one unless the last connects
+// failed within the backoff.
+func (s *grpcSink) stream() (*grpcStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.st != nil {
+		select {
+		case <-s.st.done:
+			if !s.st.acked.Load() {
+				s.fails++
+			} else {
+				s.fails = 1
+			}
+			s.lastErr = s.st.err
+			s.retryAt = time.Now().Add(min(100*time.Millisecond<<min(s.fails-1, 10), s.backoff))
+			s.st = nil
+		default:
+			return s.st, nil
+		}
+	}
+	if time.Now().Before(s.retryAt) {
+		return nil, fmt.Errorf("grpc: reconnecting after %w", s.lastErr)
+	}
+	pr, pw := io.Pipe()
+	r, err := http.NewRequest(http.MethodPost, s.url, pr)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	for k, v := range s.md {
+		r.Header.Set(k, v)
+	}
+	s.st = &grpcStream{body: pw, pending: map[uint64]chan error{}, done: make(chan struct{})}
+	go s.st.run(s.client, r)
+	return s.st, nil
+}
+
+/* ───────── stream ───────── */
+
+// grpcStream is one call: the request body is a pipe Send writes messages
+// to, run reads the acks off the response.
+type grpcStream struct {
+	body  *io.PipeWriter
+	wmu   sync.Mutex
+	acked atomic.Bool // an ack arrived, the connect worked
+
+	mu      sync.Mutex
+	pending map[uint64]chan error
+	err     error
+	done    chan struct{}
+}
+
+func (st *grpcStream) expect(id uint64, ack chan error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return st.err
+	}
+	st.pending[id] = ack
+	return nil
+}
+
+func (st *grpcStream) forget(id uint64) {
+	st.mu.Lock()
+	delete(st.pending, id)
+	st.mu.Unlock()
+}
+
+// write sends one length-prefixed, uncompressed message.
+func (st *grpcStream) write(msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	_, err := st.body.Write(append(frame, msg...))
+	return err
+}
+
+// fail ends the stream with err, failing every unacknowledged Send.
+func (st *grpcStream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return
+	}
+	st.err = err
+	for id, ack := range st.pending {
+		ack <- err
+		delete(st.pending, id)
+	}
+	close(st.done)
+	st.body.CloseWithError(err)
+}
+
+func (st *grpcStream) run(client *http.Client, r *http.Request) {
+	var err error
+	defer func() {
+		if err != nil {
+			st.fail(err)
+		}
+	}()
+	defer capture.Recover("grpc stream", &err)
+	resp, err := client.Do(r)
+	if err != nil {
+		st.fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		st.fail(fmt.Errorf("grpc: %s", resp.Status))
+		return
+	case resp.ProtoMajor != 2:
+		st.fail(fmt.Errorf("grpc: collector answered %s, not HTTP/2", resp.Proto))
+		return
+	case resp.Header.Get("Grpc-Status") != "" && resp.Header.Get("Grpc-Status") != "0":
+		st.fail(fmt.Errorf("grpc: status %s: %s", resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")))
+		return
+	}
+	head := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(resp.Body, head); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+				if code := resp.Trailer.Get("Grpc-Status"); code != "" {
+					err = fmt.Errorf("grpc: stream closed with status %s: %s", code, resp.Trailer.Get("Grpc-Message"))
+				}
+			}
+			st.fail(err)
+			return
+		}
+		if head[0] != 0 {
+			st.fail(errors.New("grpc: compressed acks are not supported"))
+			return
+		}
+		n := binary.BigEndian.Uint32(head[1:])
+		if n > grpcMaxAck {
+			st.fail(fmt.Errorf("grpc: %d byte ack exceeds %d", n, grpcMaxAck))
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			st.fail(err)
+			return
+		}
+		st.acked.Store(true)
+		st.ack(msg)
+	}
+}
+
+// ack resolves the Send of a StreamAck: id = 1, error = 2.
+func (st *grpcStream) ack(msg []byte) {
+	var id uint64
+	var reason []byte
+	pbFields(msg, func(num, v uint64, raw []byte) {
+		switch num {
+		case 1:
+			id = v
+		case 2:
+			reason = raw
+		}
+	})
+	var err error
+	if len(reason) > 0 {
+		err = fmt.Errorf("grpc: collector rejected the event: %s", bytes.TrimSpace(reason))
+	}
+	st.mu.Lock()
+	if ack, ok := st.pending[id]; ok {
+		ack <- err
+		delete(st.pending, id)
+	}
+	st.mu.Unlock()
+}
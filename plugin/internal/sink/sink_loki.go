@@ -0,0 +1,144 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Grafana Loki sink ───────── */
+
+// Pushes payloads as log lines to /loki/api/v1/push. Stream labels are
+// templates over event fields plus {status_class} (2xx, 4xx, …); keep them
+// low-cardinality, Loki indexes every distinct label set as its own stream.
+//
+//	"tracking_url": "http://loki.svc:3100",
+//	"sink": "loki",
+//	"loki": {
+//	  "labels": {"job": "krakend-trace", "endpoint": "{endpoint}", "status": "{status_class}"},
+//	  "tenant": "acme",   // X-Scope-OrgID, template allowed
+//	  "batch_size": 500, "batch_kb": 1024, "batch_delay_ms": 500
+//	}
+
+type lokiSink struct {
+	url    string
+	client *http.Client
+	labels map[string]string
+	tenant string
+	*batcher
+}
+
+func newLokiSink(c *cfg, opts map[string]interface{}) (*lokiSink, error) {
+	u := strings.TrimRight(c.url.String(), "/")
+	if !strings.HasSuffix(u, "/loki/api/v1/push") {
+		u += "/loki/api/v1/push"
+	}
+	s := &lokiSink{
+		client: c.client,
+		url:    u,
+		labels: map[string]string{"job": "krakend-trace", "endpoint": "{endpoint}", "status": "{status_class}"},
+	}
+	if v, ok := opts["labels"].(map[string]interface{}); ok && len(v) > 0 {
+		s.labels = make(map[string]string, len(v))
+		for k, l := range v {
+			s.labels[k] = fmt.Sprint(l)
+		}
+	}
+	if v, ok := opts["tenant"].(string); ok {
+		s.tenant = v
+	}
+	s.batcher = newBatcher(opts, 1000, 4<<20, c.timeout, s.push)
+	return s, nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (s *lokiSink) push(ctx context.Context, items []batchItem) error {
+	// group by tenant, then by label set
+	byTenant := map[string]map[string]*lokiStream{}
+	for _, it := range items {
+		labels := make(map[string]string, len(s.labels))
+		keys := make([]string, 0, len(s.labels))
+		for k, tmpl := range s.labels {
+			labels[k] = lokiExpand(tmpl, it.ev)
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var id strings.Builder
+		for _, k := range keys {
+			id.WriteString(k + "=" + labels[k] + ",")
+		}
+		tenant := lokiExpand(s.tenant, it.ev)
+		streams := byTenant[tenant]
+		if streams == nil {
+			streams = map[string]*lokiStream{}
+			byTenant[tenant] = streams
+		}
+		st := streams[id.String()]
+		if st == nil {
+			st = &lokiStream{Stream: labels}
+			streams[id.String()] = st
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(it.ev.At.UnixNano(), 10), string(it.payload)})
+	}
+
+	for tenant, streams := range byTenant {
+		list := make([]*lokiStream, 0, len(streams))
+		for _, st := range streams {
+			list = append(list, st)
+		}
+		if err := s.post(ctx, tenant, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lokiSink) post(ctx context.Context, tenant string, streams []*lokiStream) error {
+	body, err := json.Marshal(map[string]interface{}{"streams": streams})
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		r.Header.Set("X-Scope-OrgID", tenant)
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("loki: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func lokiExpand(tmpl string, ev *capture.Event) string {
+	if tmpl == "" {
+		return ""
+	}
+	class := "unknown"
+	if ev.Status > 0 {
+		class = strconv.Itoa(ev.Status/100) + "xx"
+	}
+	tmpl = strings.ReplaceAll(tmpl, "{status_class}", class)
+	return expand(tmpl, ev, func(v string) string { return v })
+}
@@ -0,0 +1,430 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── MQTT sink ───────── */
+
+// Publishes payloads to an MQTT 3.1.1 broker, the ingestion bus of many IoT
+// platforms:
+//
+//	"tracking_url": "mqtts://broker.svc:8883",   // or mqtt://, port 1883
+//	"mqtt": {
+//	  "topic":       "krakend/traces/{backend}/{status}",   // template
+//	  "qos":         1,          // 0 (default) or 1: wait for the PUBACK
+//	  "client_id":   "gw-eu-1",  // default krakend-trace-<instance_id>
+//	  "username": "…", "password": "…",
+//	  "keepalive_s": 30,
+//	  "will": {                  // instance-down detection, optional
+//	    "topic":   "krakend/status/{instance_id}",
+//	    "payload": "offline", "online": "online", "retain": true
+//	  }
+//	}
+//
+// Topic placeholders are those of a templated tracking_url; "+" and "#" in
+// values become "_", and a "/" inside a value adds topic levels (the ones at
+// its ends are dropped). With will
+// the broker publishes its payload when the gateway disappears without a
+// DISCONNECT, and the online payload is published on every connect with the
+// same retain flag, so the topic always holds the instance's state. One
+// connection is kept open and pinged every keepalive_s; a broken connection
+// fails the in-flight QoS 1 sends and the next Send reconnects.
+
+type mqttSink struct {
+	addr      string
+	tls       *tls.Config // mqtts only
+	timeout   time.Duration
+	topic     string
+	qos       byte
+	clientID  string
+	user      string
+	pass      string
+	keepalive time.Duration
+	will      *mqttWill
+
+	mu   sync.Mutex
+	conn *mqttConn
+}
+
+type mqttWill struct {
+	topic, payload, online string
+	retain                 bool
+}
+
+func newMQTTSink(c *cfg, opts map[string]interface{}) (*mqttSink, error) {
+	s := &mqttSink{timeout: c.timeout, topic: "krakend/traces", keepalive: 30 * time.Second,
+		clientID: "krakend-trace-" + capture.InstanceID()}
+	port := "1883"
+	switch c.url.Scheme {
+	case "mqtt":
+	case "mqtts":
+		s.tls = c.tlsFor(c.url.Hostname())
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("%s mqtt sink needs a mqtt:// or mqtts:// tracking_url", tag)
+	}
+	s.addr = c.url.Host
+	if c.url.Port() == "" {
+		s.addr = net.JoinHostPort(c.url.Hostname(), port)
+	}
+	if v, ok := opts["topic"].(string); ok && v != "" {
+		s.topic = v
+	}
+	if v, ok := opts["qos"].(float64); ok {
+		if v != 0 && v != 1 {
+			return nil, fmt.Errorf("%s mqtt.qos must be 0 or 1", tag)
+		}
+		s.qos = byte(v)
+	}
+	if v, ok := opts["client_id"].(string); ok && v != "" {
+		s.clientID = v
+	}
+	s.user, _ = opts["username"].(string)
+	s.pass, _ = opts["password"].(string)
+	if v, ok := opts["keepalive_s"].(float64); ok && v >= 1 && v <= 0xffff {
+		s.keepalive = time.Duration(v) * time.Second
+	}
+	w, ok := opts["will"].(map[string]interface{})
+	if opts["will"] == true {
+		w, ok = map[string]interface{}{}, true
+	}
+	if ok {
+		s.will = &mqttWill{topic: "krakend/status/{instance_id}", payload: "offline", online: "online", retain: true}
+		if v, ok := w["topic"].(string); ok && v != "" {
+			s.will.topic = v
+		}
+		s.will.topic = strings.ReplaceAll(s.will.topic, "{instance_id}", capture.InstanceID())
+		if v, ok := w["payload"].(string); ok {
+			s.will.payload = v
+		}
+		if v, ok := w["online"].(string); ok {
+			s.will.online = v
+		}
+		if v, ok := w["retain"].(bool); ok {
+			s.will.retain = v
+		}
+	}
+	return s, nil
+}
+
+// mqttToken keeps a value from adding wildcards or empty levels to a topic.
+func mqttToken(v string) string {
+	return strings.Trim(mqttWildcards.Replace(v), "/")
+}
+
+var mqttWildcards = strings.NewReplacer("+", "_", "#", "_")
+
+func (s *mqttSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	topic := strings.Trim(expand(s.topic, ev, mqttToken), "/")
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.publish(ctx, topic, payload, s.qos, false)
+}
+
+// connect returns the open connection or dials a new one.
+func (s *mqttSink) connect(ctx context.Context) (*mqttConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !s.conn.closed() {
+		return s.conn, nil
+	}
+	s.conn = nil
+	d := net.Dialer{Timeout: s.timeout}
+	var nc net.Conn
+	var err error
+	if s.tls != nil {
+		td := tls.Dialer{NetDialer: &d, Config: s.tls}
+		nc, err = td.DialContext(ctx, "tcp", s.addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(dl)
+	}
+	br := bufio.NewReader(nc)
+	if _, err := nc.Write(s.connectPacket()); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	typ, body, err := mqttRead(br)
+	switch {
+	case err != nil:
+	case typ != 0x20 || len(body) != 2:
+		err = fmt.Errorf("mqtt: expected CONNACK, got packet type %d", typ>>4)
+	case body[1] != 0:
+		err = fmt.Errorf("mqtt: connection refused: %s", mqttRefusals[body[1]])
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := &mqttConn{nc: nc, pending: map[uint16]chan error{}, done: make(chan struct{})}
+	c.seen.Store(time.Now().UnixNano())
+	go c.read(br)
+	go c.ping(s.keepalive)
+	if s.will != nil {
+		if err := c.publish(ctx, s.will.topic, []byte(s.will.online), 1, s.will.retain); err != nil {
+			c.close(err)
+			return nil, fmt.Errorf("mqtt: online message: %w", err)
+		}
+	}
+	s.conn = c
+	return c, nil
+}
+
+var mqttRefusals = map[byte]string{1: "unacceptable protocol version", 2: "identifier rejected",
+	3: "server unavailable", 4: "bad user name or password", 5: "not authorized"}
+
+// connectPacket is CONNECT with a clean session.
+func (s *mqttSink) connectPacket() []byte {
+	flags := byte(0x02)
+	var p []byte
+	p = mqttString(p, "MQTT")
+	p = append(p, 4, 0) // protocol level 3.1.1, flags below
+	p = binary.BigEndian.AppendUint16(p, uint16(s.keepalive/time.Second))
+	p = mqttString(p, s.clientID)
+	if s.will != nil {
+		flags |= 0x04 | 1<<3 // will at QoS 1
+		if s.will.retain {
+			flags |= 0x20
+		}
+		p = mqttString(p, s.will.topic)
+		p = mqttString(p, s.will.payload)
+	}
+	if s.user != "" {
+		flags |= 0x80
+		p = mqttString(p, s.user)
+	}
+	if s.pass != "" {
+		flags |= 0x40
+		p = mqttString(p, s.pass)
+	}
+	p[7] = flags
+	return mqttPacket(0x10, p)
+}
+
+/* ───────── connection ───────── */
+
+type mqttConn struct {
+	nc   net.Conn
+	wmu  sync.Mutex
+	seen atomic.Int64 // unix nanos of the last packet from the broker
+
+	mu      sync.Mutex
+	next    uint16
+	pending map[uint16]chan error
+	err     error
+	done    chan struct{}
+}
+
+func (c *mqttConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close drops the connection, failing the sends waiting for a PUBACK.
+func (c *mqttConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, ack := range c.pending {
+		ack <- err
+		delete(c.pending, id)
+	}
+	close(c.done)
+	c.nc.Close()
+}
+
+func (c *mqttConn) write(ctx context.Context, packet []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	deadline, _ := ctx.Deadline()
+	c.nc.SetWriteDeadline(deadline)
+	_, err := c.nc.Write(packet)
+	return err
+}
+
+// publish sends one PUBLISH; at QoS 1 it waits for the PUBACK. A write
+// error drops the connection.
+func (c *mqttConn) publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	head := byte(0x30) | qos<<1
+	if retain {
+		head |= 0x01
+	}
+	p := mqttString(nil, topic)
+	var ack chan error
+	var id uint16
+	if qos == 1 {
+		ack = make(chan error, 1)
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return c.err
+		}
+		for {
+			c.next++
+			if _, used := c.pending[c.next]; c.next != 0 && !used {
+				break
+			}
+		}
+		id = c.next
+		c.pending[id] = ack
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, id)
+			c.mu.Unlock()
+		}()
+		p = binary.BigEndian.AppendUint16(p, id)
+	}
+	if err := c.write(ctx, mqttPacket(head, append(p, payload...))); err != nil {
+		c.close(err)
+		return err
+	}
+	if ack == nil {
+		return nil
+	}
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// read resolves PUBACKs until the connection breaks.
+func (c *mqttConn) read(br *bufio.Reader) {
+	var err error
+	defer func() {
+		if err != nil {
+			c.close(err)
+		}
+	}()
+	defer capture.Recover("mqtt reader", &err)
+	for {
+		typ, body, err := mqttRead(br)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.seen.Store(time.Now().UnixNano())
+		if typ&0xf0 == 0x40 && len(body) == 2 {
+			id := binary.BigEndian.Uint16(body)
+			c.mu.Lock()
+			if ack, ok := c.pending[id]; ok {
+				ack <- nil
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// ping sends PINGREQ every interval and drops the connection when nothing,
+// not even a PINGRESP, came back from the broker for two intervals.
+func (c *mqttConn) ping(interval time.Duration) {
+	var err error
+	defer func() {
+		if err != nil {
+			c.close(err)
+		}
+	}()
+	defer capture.Recover("mqtt ping", &err)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		if time.Since(time.Unix(0, c.seen.Load())) > 2*interval {
+			c.close(errors.New("mqtt: broker stopped answering pings"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.write(ctx, []byte{0xc0, 0})
+		cancel()
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+/* ───────── wire format ───────── */
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket prefixes body with the fixed header: type and flags, then the
+// remaining length in 7-bit groups.
+func mqttPacket(head byte, body []byte) []byte {
+	p := []byte{head}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttRead(br *bufio.Reader) (byte, []byte, error) {
+	head, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(br, body)
+	return head, body, err
+}
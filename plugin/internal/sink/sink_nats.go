@@ -0,0 +1,364 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── NATS / JetStream sink ───────── */
+
+// Minimal client for the NATS text protocol: CONNECT, PUB, PING/PONG and, for
+// JetStream, a wildcard inbox subscription that collects publish acks. The
+// connection is dialled lazily and re-dialled on the next event after a
+// failure, so a broker restart costs the events in flight only.
+//
+//	"nats": {
+//	  "subject":   "trace.{backend}",   // template over event fields
+//	  "jetstream": true,                // wait for the stream ack
+//	  "user": "", "password": "", "token": ""
+//	}
+
+type natsSink struct {
+	addr      string
+	useTLS    bool
+	tlsConf   *tls.Config
+	subject   string
+	jetstream bool
+	timeout   time.Duration
+	connect   []byte
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+type natsConn struct {
+	nc    net.Conn
+	wmu   sync.Mutex
+	w     *bufio.Writer
+	inbox string
+	next  uint64
+
+	amu  sync.Mutex
+	acks map[string]chan error
+	err  error // set once the reader stops
+	done chan struct{}
+}
+
+func newNATSSink(c *cfg, opts map[string]interface{}) (*natsSink, error) {
+	s := &natsSink{
+		addr:    c.url.Host,
+		useTLS:  c.url.Scheme == "tls",
+		tlsConf: c.tlsFor(c.url.Hostname()),
+		subject: "krakend.trace",
+		timeout: c.timeout,
+	}
+	if c.url.Port() == "" {
+		s.addr = net.JoinHostPort(c.url.Hostname(), "4222")
+	}
+	if v, ok := opts["subject"].(string); ok && v != "" {
+		s.subject = v
+	}
+	if v, ok := opts["jetstream"].(bool); ok {
+		s.jetstream = v
+	}
+
+	connect := map[string]interface{}{
+		"verbose": false, "pedantic": false, "lang": "go", "version": "1",
+		"name": "krakend-trace-plugin", "protocol": 1,
+		"headers": true, "no_responders": true,
+	}
+	if u := c.url.User; u != nil {
+		connect["user"] = u.Username()
+		connect["pass"], _ = u.Password()
+	}
+	if v, ok := opts["user"].(string); ok && v != "" {
+		connect["user"] = v
+	}
+	if v, ok := opts["password"].(string); ok && v != "" {
+		connect["pass"] = v
+	}
+	if v, ok := opts["token"].(string); ok && v != "" {
+		connect["auth_token"] = v
+	}
+	s.connect, _ = json.Marshal(connect)
+	return s, nil
+}
+
+func (s *natsSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	nc, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	subject := expand(s.subject, ev, natsToken)
+
+	if !s.jetstream {
+		if err := nc.pub(subject, "", payload); err != nil {
+			s.drop(nc)
+			return err
+		}
+		return nil
+	}
+
+	reply, ack := nc.expect()
+	defer nc.forget(reply)
+	if err := nc.pub(subject, reply, payload); err != nil {
+		s.drop(nc)
+		return err
+	}
+	select {
+	case err := <-ack:
+		return err
+	case <-nc.done:
+		return nc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *natsSink) get(ctx context.Context) (*natsConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		select {
+		case <-s.conn.done:
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+	nc, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = nc
+	return nc, nil
+}
+
+func (s *natsSink) drop(nc *natsConn) {
+	nc.nc.Close()
+	s.mu.Lock()
+	if s.conn == nc {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *natsSink) dial(ctx context.Context) (*natsConn, error) {
+	d := net.Dialer{Timeout: s.timeout}
+	raw, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(s.timeout))
+	conn := raw
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		raw.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(line[5:]), &info)
+
+	if s.useTLS || info.TLSRequired {
+		tc := tls.Client(raw, s.tlsConf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	nc := &natsConn{
+		nc:    conn,
+		w:     bufio.NewWriter(conn),
+		inbox: "_INBOX." + capture.RandomID(),
+		acks:  map[string]chan error{},
+		done:  make(chan struct{}),
+	}
+	nc.w.WriteString("CONNECT ")
+	nc.w.Write(s.connect)
+	nc.w.WriteString("\r\n")
+	if s.jetstream {
+		nc.w.WriteString("SUB " + nc.inbox + ".* 1\r\n")
+	}
+	nc.w.WriteString("PING\r\n")
+	if err := nc.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the first PONG confirms CONNECT was accepted
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, errors.New("nats: " + line)
+		}
+	}
+	raw.SetDeadline(time.Time{})
+	go nc.read(r)
+	return nc, nil
+}
+
+func (nc *natsConn) pub(subject, reply string, payload []byte) error {
+	nc.wmu.Lock()
+	defer nc.wmu.Unlock()
+	nc.w.WriteString("PUB ")
+	nc.w.WriteString(subject)
+	if reply != "" {
+		nc.w.WriteString(" " + reply)
+	}
+	nc.w.WriteString(" " + strconv.Itoa(len(payload)) + "\r\n")
+	nc.w.Write(payload)
+	nc.w.WriteString("\r\n")
+	return nc.w.Flush()
+}
+
+func (nc *natsConn) expect() (string, chan error) {
+	nc.amu.Lock()
+	defer nc.amu.Unlock()
+	nc.next++
+	reply := nc.inbox + "." + strconv.FormatUint(nc.next, 10)
+	ch := make(chan error, 1)
+	nc.acks[reply] = ch
+	return reply, ch
+}
+
+func (nc *natsConn) forget(reply string) {
+	nc.amu.Lock()
+	delete(nc.acks, reply)
+	nc.amu.Unlock()
+}
+
+func (nc *natsConn) resolve(reply string, err error) {
+	nc.amu.Lock()
+	ch := nc.acks[reply]
+	nc.amu.Unlock()
+	if ch != nil {
+		ch <- err
+	}
+}
+
+// read serves PINGs and routes JetStream acks until the connection breaks.
+func (nc *natsConn) read(r *bufio.Reader) {
+	var err error
+	defer func() {
+		nc.err = err
+		close(nc.done)
+		nc.nc.Close()
+	}()
+	defer capture.Recover("nats reader", &err)
+	for {
+		var line string
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "PING":
+			nc.wmu.Lock()
+			nc.w.WriteString("PONG\r\n")
+			nc.w.Flush()
+			nc.wmu.Unlock()
+		case "-ERR":
+			capture.Log("nats:", strings.TrimSpace(line))
+		case "MSG": // MSG <subject> <sid> [reply] <size>
+			var n int
+			if n, err = natsSize(f); err != nil {
+				return
+			}
+			body := make([]byte, n+2)
+			if _, err = io.ReadFull(r, body); err != nil {
+				return
+			}
+			nc.resolve(f[1], jsAckError(body[:n]))
+		case "HMSG": // HMSG <subject> <sid> [reply] <hdr size> <total size>
+			var n int
+			if n, err = natsSize(f); err != nil {
+				return
+			}
+			body := make([]byte, n+2)
+			if _, err = io.ReadFull(r, body); err != nil {
+				return
+			}
+			// header-only replies are status messages, e.g. 503 no responders
+			status := strings.Fields(strings.SplitN(string(body), "\r\n", 2)[0])
+			msg := "nats: no stream for subject"
+			if len(status) > 1 && status[1] != "503" {
+				msg = "nats: status " + strings.Join(status[1:], " ")
+			}
+			nc.resolve(f[1], errors.New(msg))
+		}
+	}
+}
+
+// natsMaxAck bounds the messages the reader accepts: only acks and status
+// replies arrive on the inbox.
+const natsMaxAck = 1 << 20
+
+// natsSize reads the size ending a MSG or HMSG line.
+func natsSize(f []string) (int, error) {
+	n, err := strconv.Atoi(f[len(f)-1])
+	if err != nil || n < 0 || n > natsMaxAck {
+		return 0, fmt.Errorf("nats: bad message size in %q", strings.Join(f, " "))
+	}
+	return n, nil
+}
+
+func jsAckError(body []byte) error {
+	var ack struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &ack); err != nil {
+		return fmt.Errorf("nats: bad ack: %w", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("nats: jetstream %d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	return nil
+}
+
+// natsToken keeps template values inside a single subject token.
+func natsToken(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
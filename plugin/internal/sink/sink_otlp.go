@@ -0,0 +1,298 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── OpenTelemetry (OTLP/HTTP logs) ───────── */
+
+// Exports events as OTLP log records over HTTP with protobuf encoding, the
+// protocol an OpenTelemetry Collector's otlp receiver serves on port 4318,
+// so a gateway limited to HTTPS egress can feed a collector directly:
+//
+//	"tracking_url": "https://otel-collector.svc:4318",   // /v1/logs is appended
+//	"sink": "otlp",
+//	"otlp": {
+//	  "headers": {"Authorization": "Bearer …"},
+//	  "service_name": "krakend",                          // resource service.name
+//	  "compression": "gzip",                              // or "none" (default)
+//	  "batch_size": 500, "batch_kb": 1024, "batch_delay_ms": 200
+//	}
+//
+// Each record's body is the payload of payload_format (a string when it is
+// UTF-8, bytes otherwise) and its attributes are http.request.method,
+// url.full, http.response.status_code, http.route (the endpoint) and every
+// meta field as krakend.<name>. Severity is ERROR for 5xx responses and
+// failed upstream calls, WARN for 4xx and INFO otherwise; a traceparent
+// request header sets the trace and span ids. The resource carries
+// service.name and service.instance.id (the instance_id). Non-2xx answers
+// and records rejected in a partial success fail the send.
+
+type otlpSink struct {
+	url      string
+	client   *http.Client
+	headers  map[string]string
+	service  string
+	compress bool
+	*batcher
+}
+
+func newOTLPSink(c *cfg, opts map[string]interface{}) (*otlpSink, error) {
+	u := strings.TrimRight(c.url.String(), "/")
+	if !strings.HasSuffix(u, "/v1/logs") {
+		u += "/v1/logs"
+	}
+	s := &otlpSink{url: u, client: c.client, service: "krakend", headers: map[string]string{}}
+	if h, ok := opts["headers"].(map[string]interface{}); ok {
+		for k, v := range h {
+			s.headers[k] = fmt.Sprint(v)
+		}
+	}
+	if v, ok := opts["service_name"].(string); ok && v != "" {
+		s.service = v
+	}
+	switch v, _ := opts["compression"].(string); v {
+	case "", "none":
+	case "gzip":
+		s.compress = true
+	default:
+		return nil, fmt.Errorf("%s invalid otlp.compression %q: gzip or none", tag, v)
+	}
+	s.batcher = newBatcher(opts, 1000, 4<<20, c.timeout, s.export)
+	return s, nil
+}
+
+// export posts one ExportLogsServiceRequest holding the batch.
+func (s *otlpSink) export(ctx context.Context, items []batchItem) error {
+	var scope pb
+	var name pb
+	name.str(1, "krakend-trace-plugin")
+	scope.msg(1, name.Bytes())
+	for _, it := range items {
+		scope.msg(2, otlpRecord(it.ev, it.payload))
+	}
+	var res pb
+	res.msg(1, otlpAttr("service.name", s.service))
+	res.msg(1, otlpAttr("service.instance.id", capture.InstanceID()))
+	var rl pb
+	rl.msg(1, res.Bytes())
+	rl.msg(2, scope.Bytes())
+	var req pb
+	req.msg(1, rl.Bytes())
+
+	body := req.Bytes()
+	if s.compress {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(body)
+		zw.Close()
+		body = b.Bytes()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	if s.compress {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s: %s", resp.Status, bytes.TrimSpace(answer))
+	}
+	if rejected, msg := otlpPartial(answer); rejected > 0 {
+		return fmt.Errorf("otlp: %d of %d log records rejected: %s", rejected, len(items), msg)
+	}
+	return nil
+}
+
+// otlpRecord encodes ev as a LogRecord.
+func otlpRecord(ev *capture.Event, payload []byte) []byte {
+	var r pb
+	r.fixed64(1, uint64(ev.At.UnixNano()))
+	severity, text := uint64(9), "INFO"
+	switch {
+	case ev.Status == 0 || ev.Status >= 500:
+		severity, text = 17, "ERROR"
+	case ev.Status >= 400:
+		severity, text = 13, "WARN"
+	}
+	r.varint(2, severity)
+	r.str(3, text)
+	var body pb
+	if utf8.Valid(payload) {
+		body.str(1, string(payload))
+	} else {
+		body.bytes(7, payload)
+	}
+	r.msg(5, body.Bytes())
+	r.msg(6, otlpAttr("http.request.method", ev.Method))
+	r.msg(6, otlpAttr("url.full", ev.URL.String()))
+	if ev.Status > 0 {
+		r.msg(6, otlpAttr("http.response.status_code", int64(ev.Status)))
+	}
+	if e := ev.Meta.Get("endpoint"); e != "" {
+		r.msg(6, otlpAttr("http.route", e))
+	}
+	keys := make([]string, 0, len(ev.Meta))
+	for k := range ev.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.msg(6, otlpAttr("krakend."+k, ev.Meta.Get(k)))
+	}
+	if traceID, spanID, flags, ok := traceparent(ev.ReqHeader.Get("Traceparent")); ok {
+		r.fixed32(8, uint32(flags))
+		r.bytes(9, traceID)
+		r.bytes(10, spanID)
+	}
+	return r.Bytes()
+}
+
+// otlpAttr encodes a KeyValue with a string or an int value.
+func otlpAttr(key string, v interface{}) []byte {
+	var val pb
+	switch v := v.(type) {
+	case string:
+		val.str(1, v)
+	case int64:
+		val.varint(3, uint64(v))
+	}
+	var kv pb
+	kv.str(1, key)
+	kv.msg(2, val.Bytes())
+	return kv.Bytes()
+}
+
+// traceparent reads a W3C traceparent header: 00-<trace id>-<span id>-<flags>.
+func traceparent(h string) (traceID, spanID []byte, flags byte, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, nil, 0, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	f, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, nil, 0, false
+	}
+	return traceID, spanID, f[0], true
+}
+
+// otlpPartial reads partial_success of an ExportLogsServiceResponse.
+func otlpPartial(b []byte) (rejected int64, msg string) {
+	pbFields(b, func(num, _ uint64, raw []byte) {
+		if num == 1 {
+			pbFields(raw, func(num, v uint64, raw []byte) {
+				switch num {
+				case 1:
+					rejected = int64(v)
+				case 2:
+					msg = string(raw)
+				}
+			})
+		}
+	})
+	return rejected, msg
+}
+
+/* ───────── protobuf wire format ───────── */
+
+// pb appends protobuf fields; empty strings, bytes and zero varints are left
+// out as proto3 does, messages always written.
+type pb struct{ bytes.Buffer }
+
+func (p *pb) tag(field, wire uint64) { p.Write(binary.AppendUvarint(nil, field<<3|wire)) }
+
+func (p *pb) varint(field, v uint64) {
+	if v != 0 {
+		p.tag(field, 0)
+		p.Write(binary.AppendUvarint(nil, v))
+	}
+}
+
+func (p *pb) fixed64(field, v uint64) {
+	p.tag(field, 1)
+	p.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (p *pb) fixed32(field uint64, v uint32) {
+	p.tag(field, 5)
+	p.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (p *pb) msg(field uint64, b []byte) {
+	p.tag(field, 2)
+	p.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	p.Write(b)
+}
+
+func (p *pb) bytes(field uint64, b []byte) {
+	if len(b) > 0 {
+		p.msg(field, b)
+	}
+}
+
+func (p *pb) str(field uint64, s string) { p.bytes(field, []byte(s)) }
+
+// pbFields calls f with the fields of b: v for varints, raw for
+// length-delimited fields. Fixed-size fields are skipped, and b ends at the
+// first malformed field.
+func pbFields(b []byte, f func(num, v uint64, raw []byte)) {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return
+		}
+		b = b[n:]
+		var v uint64
+		var raw []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return
+			}
+			b = b[n:]
+		case 1, 5:
+			w := 8
+			if key&7 == 5 {
+				w = 4
+			}
+			if len(b) < w {
+				return
+			}
+			b = b[w:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return
+			}
+			raw, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return
+		}
+		f(key>>3, v, raw)
+	}
+}
@@ -0,0 +1,316 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Parquet file sink ───────── */
+
+// Buffers events and writes them as Parquet files, hive-partitioned by hour
+// (dt=YYYY-MM-DD/hour=HH/part-<instance>-<n>.parquet) so DuckDB, Athena or
+// Spark can query the directory as one table. Files hold one row group of
+// REQUIRED, PLAIN-encoded columns with GZIP pages; the schema is listed in
+// parquetColumns. Files are written locally: ship them to object storage with
+// the usual sync tooling.
+//
+//	"sink": "parquet",
+//	"parquet": {
+//	  "dir":              "/var/lib/krakend/parquet",
+//	  "max_rows":         10000,  // rows per file
+//	  "flush_interval_s": 300     // max age of a buffered file
+//	}
+
+type parquetColumn struct {
+	name      string
+	ptype     int32 // physical type
+	converted int32 // -1 when none
+	value     func(ev *capture.Event) interface{}
+}
+
+const (
+	pqInt32     = 1
+	pqInt64     = 2
+	pqByteArray = 6
+
+	pqUTF8            = 0
+	pqTimestampMillis = 9
+)
+
+var parquetColumns = []parquetColumn{
+	{"timestamp", pqInt64, pqTimestampMillis, func(ev *capture.Event) interface{} { return ev.At.UnixMilli() }},
+	{"instance_id", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.Meta.Get("instance_id") }},
+	{"seq", pqInt64, -1, func(ev *capture.Event) interface{} {
+		n, _ := strconv.ParseInt(ev.Meta.Get("seq"), 10, 64)
+		return n
+	}},
+	{"endpoint", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.Meta.Get("endpoint") }},
+	{"backend", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.Meta.Get("backend") }},
+	{"status", pqInt32, -1, func(ev *capture.Event) interface{} { return int32(ev.Status) }},
+	{"client_ip", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.Meta.Get("client_ip") }},
+	{"url", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.URL.String() }},
+	{"query", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { return ev.URL.RawQuery }},
+	{"request_body", pqByteArray, -1, func(ev *capture.Event) interface{} { return string(ev.ReqBody) }},
+	{"response_body", pqByteArray, -1, func(ev *capture.Event) interface{} { return string(ev.RespBody) }},
+	{"meta", pqByteArray, pqUTF8, func(ev *capture.Event) interface{} { // JSON object
+		m := make(map[string]string, len(ev.Meta))
+		for k := range ev.Meta {
+			m[k] = ev.Meta.Get(k)
+		}
+		b, _ := json.Marshal(m)
+		return string(b)
+	}},
+}
+
+type parquetSink struct {
+	dir      string
+	maxRows  int
+	interval time.Duration
+
+	mu    sync.Mutex
+	rows  []*capture.Event
+	hour  string
+	timer *time.Timer
+}
+
+var parquetFiles atomic.Uint64 // keeps part names unique across backends
+
+func newParquetSink(opts map[string]interface{}) (*parquetSink, error) {
+	s := &parquetSink{maxRows: 10_000, interval: 5 * time.Minute}
+	s.dir, _ = opts["dir"].(string)
+	if s.dir == "" {
+		return nil, fmt.Errorf("%s parquet sink needs a dir", tag)
+	}
+	if v, ok := opts["max_rows"].(float64); ok && v > 0 {
+		s.maxRows = int(v)
+	}
+	if v, ok := opts["flush_interval_s"].(float64); ok && v > 0 {
+		s.interval = time.Duration(v * float64(time.Second))
+	}
+	return s, os.MkdirAll(s.dir, 0o750)
+}
+
+// send only buffers; the event is on disk once its file is flushed.
+func (s *parquetSink) Send(_ context.Context, ev *capture.Event, _ []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hour := ev.At.UTC().Format("2006-01-02/15")
+	if len(s.rows) > 0 && hour != s.hour {
+		s.flushLocked()
+	}
+	if len(s.rows) == 0 {
+		s.hour = hour
+		s.timer = time.AfterFunc(s.interval, func() {
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+		})
+	}
+	s.rows = append(s.rows, ev)
+	if len(s.rows) >= s.maxRows {
+		s.flushLocked()
+	}
+	return nil
+}
+
+func (s *parquetSink) flushLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.rows) == 0 {
+		return
+	}
+	rows := s.rows
+	s.rows = nil
+	dir := filepath.Join(s.dir, "dt="+s.hour[:10], "hour="+s.hour[11:])
+	name := filepath.Join(dir, fmt.Sprintf("part-%s-%06d.parquet", capture.InstanceID(), parquetFiles.Add(1)))
+	go func() {
+		defer capture.Recover("parquet", nil)
+		if err := writeParquetFile(name, rows); err != nil {
+			capture.Log("parquet: write", name, "failed:", err)
+		}
+	}()
+}
+
+func writeParquetFile(name string, rows []*capture.Event) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	out.WriteString("PAR1")
+
+	chunks := make([]*thrift, len(parquetColumns))
+	var total int64
+	for i, col := range parquetColumns {
+		var plain bytes.Buffer
+		for _, ev := range rows {
+			switch v := col.value(ev).(type) {
+			case int32:
+				binary.Write(&plain, binary.LittleEndian, v)
+			case int64:
+				binary.Write(&plain, binary.LittleEndian, v)
+			case string:
+				binary.Write(&plain, binary.LittleEndian, uint32(len(v)))
+				plain.WriteString(v)
+			}
+		}
+		var zipped bytes.Buffer
+		zw := gzip.NewWriter(&zipped)
+		zw.Write(plain.Bytes())
+		zw.Close()
+
+		hdr := &thrift{}
+		hdr.i32(1, 0) // DATA_PAGE
+		hdr.i32(2, int32(plain.Len()))
+		hdr.i32(3, int32(zipped.Len()))
+		hdr.begin(5, thriftStruct) // data_page_header
+		hdr.i32(1, int32(len(rows)))
+		hdr.i32(2, 0) // PLAIN
+		hdr.i32(3, 3) // RLE
+		hdr.i32(4, 3) // RLE
+		hdr.end()
+		hdr.stop()
+
+		offset := int64(out.Len())
+		out.Write(hdr.Bytes())
+		out.Write(zipped.Bytes())
+		size := int64(hdr.Len() + zipped.Len())
+		usize := int64(hdr.Len() + plain.Len())
+		total += usize
+
+		cc := &thrift{}
+		cc.i64(2, offset) // file_offset
+		cc.begin(3, thriftStruct)
+		cc.i32(1, col.ptype)
+		cc.list(2, thriftI32, 1)
+		cc.varint(0) // PLAIN
+		cc.list(3, thriftBinary, 1)
+		cc.binary(col.name)
+		cc.i32(4, 2) // GZIP
+		cc.i64(5, int64(len(rows)))
+		cc.i64(6, usize)
+		cc.i64(7, size)
+		cc.i64(9, offset) // data_page_offset
+		cc.end()
+		cc.stop()
+		chunks[i] = cc
+	}
+
+	fm := &thrift{}
+	fm.i32(1, 1)
+	fm.list(2, thriftStruct, len(parquetColumns)+1)
+	fm.push()
+	fm.stringField(4, "schema")
+	fm.i32(5, int32(len(parquetColumns)))
+	fm.stop()
+	fm.pop()
+	for _, col := range parquetColumns {
+		fm.push()
+		fm.i32(1, col.ptype)
+		fm.i32(3, 0) // REQUIRED
+		fm.stringField(4, col.name)
+		if col.converted >= 0 {
+			fm.i32(6, col.converted)
+		}
+		fm.stop()
+		fm.pop()
+	}
+	fm.i64(3, int64(len(rows)))
+	fm.list(4, thriftStruct, 1)
+	fm.push() // row group
+	fm.list(1, thriftStruct, len(chunks))
+	for _, cc := range chunks {
+		fm.Write(cc.Bytes())
+	}
+	fm.i64(2, total)
+	fm.i64(3, int64(len(rows)))
+	fm.stop()
+	fm.pop()
+	fm.stringField(6, "krakend-trace-plugin")
+	fm.stop()
+
+	out.Write(fm.Bytes())
+	binary.Write(&out, binary.LittleEndian, uint32(fm.Len()))
+	out.WriteString("PAR1")
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+/* ───────── Thrift compact protocol (write only) ───────── */
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thrift struct {
+	bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *thrift) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thrift) varint(v int64) {
+	u := uint64(v<<1) ^ uint64(v>>63) // zigzag
+	t.uvarint(u)
+}
+
+func (t *thrift) uvarint(u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.Write(b[:binary.PutUvarint(b[:], u)])
+}
+
+func (t *thrift) i32(id int16, v int32) { t.field(id, thriftI32); t.varint(int64(v)) }
+func (t *thrift) i64(id int16, v int64) { t.field(id, thriftI64); t.varint(v) }
+func (t *thrift) binary(s string)       { t.uvarint(uint64(len(s))); t.WriteString(s) }
+func (t *thrift) stringField(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+func (t *thrift) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.WriteByte(0xF0 | elem)
+		t.uvarint(uint64(n))
+	}
+}
+
+// begin opens a struct-typed field, push a struct list element; both are
+// closed with stop + end / pop.
+func (t *thrift) begin(id int16, typ byte) { t.field(id, typ); t.push() }
+func (t *thrift) end()                     { t.stop(); t.pop() }
+func (t *thrift) stop()                    { t.WriteByte(0) }
+func (t *thrift) push()                    { t.stack = append(t.stack, t.last); t.last = 0 }
+func (t *thrift) pop()                     { t.last = t.stack[len(t.stack)-1]; t.stack = t.stack[:len(t.stack)-1] }
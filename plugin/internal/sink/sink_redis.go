@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Redis Streams sink ───────── */
+
+// Events are appended with XADD, trimmed with MAXLEN so the stream acts as a
+// bounded buffer between the gateway and its processors.
+//
+//	"tracking_url": "rediss://:secret@redis.svc:6379/0",
+//	"redis": {
+//	  "stream":    "trace:{backend}",  // template over event fields
+//	  "maxlen":    100000,             // 0 disables trimming
+//	  "approx":    true,               // MAXLEN ~ (cheaper trimming)
+//	  "pool_size": 4
+//	}
+
+type redisSink struct {
+	addr     string
+	useTLS   bool
+	tlsConf  *tls.Config
+	user     string
+	password string
+	db       int
+	stream   string
+	maxlen   int
+	approx   bool
+	timeout  time.Duration
+
+	idle  chan *redisConn
+	slots chan struct{} // bounds open connections to pool_size
+}
+
+type redisConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func newRedisSink(c *cfg, opts map[string]interface{}) (*redisSink, error) {
+	s := &redisSink{
+		addr:    c.url.Host,
+		useTLS:  c.url.Scheme == "rediss",
+		tlsConf: c.tlsFor(c.url.Hostname()),
+		stream:  "krakend:trace",
+		maxlen:  100_000,
+		approx:  true,
+		timeout: c.timeout,
+	}
+	if c.url.Port() == "" {
+		s.addr = net.JoinHostPort(c.url.Hostname(), "6379")
+	}
+	if u := c.url.User; u != nil {
+		s.user = u.Username()
+		s.password, _ = u.Password()
+	}
+	if db := strings.Trim(c.url.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid redis database %q", tag, db)
+		}
+		s.db = n
+	}
+	if v, ok := opts["stream"].(string); ok && v != "" {
+		s.stream = v
+	}
+	if v, ok := opts["maxlen"].(float64); ok && v >= 0 {
+		s.maxlen = int(v)
+	}
+	if v, ok := opts["approx"].(bool); ok {
+		s.approx = v
+	}
+	if v, ok := opts["username"].(string); ok && v != "" {
+		s.user = v
+	}
+	if v, ok := opts["password"].(string); ok && v != "" {
+		s.password = v
+	}
+	pool := 4
+	if v, ok := opts["pool_size"].(float64); ok && v > 0 {
+		pool = int(v)
+	}
+	s.idle = make(chan *redisConn, pool)
+	s.slots = make(chan struct{}, pool)
+	return s, nil
+}
+
+func (s *redisSink) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	rc, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		rc.nc.SetDeadline(dl)
+	}
+
+	args := []string{"XADD", expand(s.stream, ev, func(v string) string { return v })}
+	if s.maxlen > 0 {
+		args = append(args, "MAXLEN")
+		if s.approx {
+			args = append(args, "~")
+		}
+		args = append(args, strconv.Itoa(s.maxlen))
+	}
+	args = append(args, "*", "payload")
+	_, err = rc.do(args, payload)
+	s.put(rc, err)
+	return err
+}
+
+func (s *redisSink) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case rc := <-s.idle:
+		return rc, nil
+	default:
+	}
+	select {
+	case rc := <-s.idle:
+		return rc, nil
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rc, err := s.dial(ctx)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return rc, nil
+}
+
+// put returns a healthy connection to the pool; broken ones free their slot.
+func (s *redisSink) put(rc *redisConn, err error) {
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		rc.nc.Close()
+		<-s.slots
+		return
+	}
+	rc.nc.SetDeadline(time.Time{})
+	s.idle <- rc
+}
+
+func (s *redisSink) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: s.timeout}
+	var nc net.Conn
+	var err error
+	if s.useTLS {
+		td := tls.Dialer{NetDialer: &d, Config: s.tlsConf}
+		nc, err = td.DialContext(ctx, "tcp", s.addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(s.timeout))
+	rc := &redisConn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.user != "" {
+			args = []string{"AUTH", s.user, s.password}
+		}
+		if _, err := rc.do(args, nil); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do([]string{"SELECT", strconv.Itoa(s.db)}, nil); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+/* ───────── RESP ───────── */
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do writes args (plus an optional trailing binary argument) as a RESP array
+// and returns the first line of the reply.
+func (rc *redisConn) do(args []string, last []byte) (string, error) {
+	n := len(args)
+	if last != nil {
+		n++
+	}
+	rc.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+	for _, a := range args {
+		rc.w.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	if last != nil {
+		rc.w.WriteString("$" + strconv.Itoa(len(last)) + "\r\n")
+		rc.w.Write(last)
+		rc.w.WriteString("\r\n")
+	}
+	if err := rc.w.Flush(); err != nil {
+		return "", err
+	}
+	return rc.reply()
+}
+
+// redisMaxBulk is Redis's own proto-max-bulk-len default; a longer bulk
+// string is a broken stream, not a reply.
+const redisMaxBulk = 512 << 20
+
+func (rc *redisConn) reply() (string, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > redisMaxBulk {
+			return "", fmt.Errorf("redis: bad bulk length in %q", line)
+		}
+		if n == -1 { // nil
+			return "", nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return "", fmt.Errorf("redis: bad array length in %q", line)
+		}
+		var first string
+		for i := 0; i < n; i++ {
+			v, err := rc.reply()
+			if err != nil {
+				return "", err
+			}
+			if i == 0 {
+				first = v
+			}
+		}
+		return first, nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply %q", line)
+}
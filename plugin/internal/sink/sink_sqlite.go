@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // pure-Go driver, no cgo
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── local capture store ───────── */
+
+// Keeps the last hours of traffic on the gateway host in an embedded SQLite
+// database, one row per event holding the same JSON document the stdout sink
+// prints. The database runs in WAL mode, so trace-query and trace-replay can
+// read it while the gateway writes. Rows older than max_age_hours, then the
+// oldest rows beyond max_mb, are pruned; freed pages go back to the file
+// system (auto_vacuum=incremental).
+//
+//	"sink": "sqlite",
+//	"sqlite": {
+//	  "path":          "/var/lib/krakend/traces.db",
+//	  "max_age_hours": 24,
+//	  "max_mb":        1024
+//	}
+
+// sqliteSchema is the store layout; trace-query reads it.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS traces (
+	id       INTEGER PRIMARY KEY,
+	at       INTEGER NOT NULL, -- capture time, unix milliseconds
+	endpoint TEXT NOT NULL,
+	status   INTEGER NOT NULL,
+	doc      TEXT NOT NULL     -- the event document (JSON)
+);
+CREATE INDEX IF NOT EXISTS traces_at ON traces (at);`
+
+type sqliteSink struct {
+	db     *sql.DB
+	maxAge time.Duration
+	maxMB  int64
+
+	mu     sync.Mutex // serializes pruning; SQLite has a single writer anyway
+	writes int
+}
+
+func newSQLiteSink(opts map[string]interface{}) (*sqliteSink, error) {
+	s := &sqliteSink{maxAge: 24 * time.Hour, maxMB: 1024}
+	path, _ := opts["path"].(string)
+	if path == "" {
+		return nil, fmt.Errorf("%s sqlite sink needs a path", tag)
+	}
+	if v, ok := opts["max_age_hours"].(float64); ok && v > 0 {
+		s.maxAge = time.Duration(v * float64(time.Hour))
+	}
+	if v, ok := opts["max_mb"].(float64); ok && v > 0 {
+		s.maxMB = int64(v)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("%s sqlite sink: %w", tag, err)
+	}
+	var err error
+	if s.db, err = openSQLite(path); err != nil {
+		return nil, fmt.Errorf("%s sqlite sink %s: %w", tag, path, err)
+	}
+	s.prune(time.Now())
+	return s, nil
+}
+
+// openSQLite opens (creating) the store at path. auto_vacuum only takes
+// effect on a new database, so it comes before the schema.
+func openSQLite(path string) (*sql.DB, error) {
+	q := url.Values{"_pragma": {"auto_vacuum(incremental)", "journal_mode(wal)", "synchronous(normal)", "busy_timeout(5000)"}}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer; queue workers wait on the pool, not on SQLITE_BUSY
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *sqliteSink) Send(ctx context.Context, ev *capture.Event, _ []byte) error {
+	doc, err := json.Marshal(ev.Doc())
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO traces (at, endpoint, status, doc) VALUES (?, ?, ?, ?)`,
+		ev.At.UnixMilli(), ev.Meta.Get("endpoint"), ev.Status, string(doc)); err != nil {
+		return err
+	}
+	// limits are checked every few hundred writes, not on each one
+	s.mu.Lock()
+	s.writes++
+	due := s.writes%256 == 0
+	s.mu.Unlock()
+	if due {
+		s.prune(time.Now())
+	}
+	return nil
+}
+
+// prune deletes rows older than maxAge, then the oldest rows until the live
+// pages fit in maxMB, and returns the freed pages to the file system.
+func (s *sqliteSink) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.db.Exec(`DELETE FROM traces WHERE at < ?`, now.Add(-s.maxAge).UnixMilli()); err != nil {
+		capture.Log("sqlite: prune failed:", err)
+		return
+	}
+	var pages, free, pageSize, rows int64
+	s.db.QueryRow(`PRAGMA page_count`).Scan(&pages)
+	s.db.QueryRow(`PRAGMA freelist_count`).Scan(&free)
+	s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize)
+	s.db.QueryRow(`SELECT count(*) FROM traces`).Scan(&rows)
+	if used, limit := (pages-free)*pageSize, s.maxMB<<20; used > limit && rows > 0 {
+		// rows are about the same size: drop the share that is over the limit
+		n := rows*(used-limit)/used + 1
+		if _, err := s.db.Exec(`DELETE FROM traces WHERE id IN (SELECT id FROM traces ORDER BY id LIMIT ?)`, n); err != nil {
+			capture.Log("sqlite: prune failed:", err)
+		}
+	}
+	s.db.Exec(`PRAGMA incremental_vacuum`)
+}
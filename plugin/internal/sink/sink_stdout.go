@@ -0,0 +1,28 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── stdout sink (local development) ───────── */
+
+// stdoutSink prints every event as one JSON document per line, the document
+// the sqlite sink stores, so endpoint configs can be tried without a
+// collector and the output piped through jq.
+type stdoutSink struct{ mu sync.Mutex }
+
+func (s *stdoutSink) Send(_ context.Context, ev *capture.Event, _ []byte) error {
+	out, err := json.Marshal(ev.Doc())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = os.Stdout.Write(append(out, '\n'))
+	return err
+}
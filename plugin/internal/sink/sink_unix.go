@@ -0,0 +1,113 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── Unix domain socket sink ───────── */
+
+// For sidecar agents on the same host: either the usual HTTP POST carried over
+// the socket, or one JSON document per line on a long-lived stream.
+//
+//	"tracking_url": "unix:///var/run/trace.sock",
+//	"unix": {
+//	  "mode": "http",        // or "ndjson"
+//	  "path": "/events"      // HTTP request path (mode http)
+//	}
+
+func newUnixSink(c *cfg, opts map[string]interface{}) (capture.Sink, error) {
+	sock := c.url.Path
+	if sock == "" {
+		return nil, fmt.Errorf("%s unix tracking_url needs a socket path", tag)
+	}
+	mode, _ := opts["mode"].(string)
+	switch mode {
+	case "", "http":
+		path, _ := opts["path"].(string)
+		if path == "" {
+			path = "/"
+		}
+		d := net.Dialer{Timeout: c.timeout}
+		return &unixHTTPSink{
+			url:  "http://localhost" + path,
+			mime: c.format.ContentType,
+			client: &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", sock)
+				},
+				MaxIdleConns: 4,
+			}},
+		}, nil
+	case "ndjson":
+		return &unixStreamSink{sock: sock, timeout: c.timeout}, nil
+	}
+	return nil, fmt.Errorf("%s unknown unix mode %q", tag, mode)
+}
+
+type unixHTTPSink struct {
+	url    string
+	mime   string
+	client *http.Client
+}
+
+func (s *unixHTTPSink) Send(ctx context.Context, _ *capture.Event, payload []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", s.mime)
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unix: %s", resp.Status)
+	}
+	return nil
+}
+
+type unixStreamSink struct {
+	sock    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *unixStreamSink) Send(ctx context.Context, ev *capture.Event, _ []byte) error {
+	line, err := json.Marshal(ev.Doc())
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		d := net.Dialer{Timeout: s.timeout}
+		if s.conn, err = d.DialContext(ctx, "unix", s.sock); err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(dl)
+	}
+	if _, err = s.conn.Write(line); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
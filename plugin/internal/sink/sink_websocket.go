@@ -0,0 +1,357 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── WebSocket sink ───────── */
+
+// For collectors reachable only through a WebSocket-terminating edge: one
+// connection stays open and every payload goes out as a message.
+//
+//	"tracking_url": "wss://edge.example/trace",
+//	"websocket": {
+//	  "headers":         {"Authorization": "Bearer …"},  // handshake headers
+//	  "subprotocol":     "krakend-trace",
+//	  "frames":          "auto",   // "text", "binary" or auto: text when UTF-8
+//	  "ping_ms":         15000,    // 0 disables the pings
+//	  "pong_timeout_ms": 5000
+//	}
+//
+// The handshake announces the payload Content-Type. A ping goes out every
+// ping_ms; without a pong within pong_timeout_ms, or on a write error or a
+// close frame, the connection is dropped and the next Send dials a new one.
+// Messages are not acknowledged: a send succeeds once its frame is written.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+type wsSink struct {
+	url         *url.URL
+	tls         *tls.Config // wss only
+	mime        string
+	headers     map[string]string
+	subprotocol string
+	frames      string
+	ping, pong  time.Duration
+	timeout     time.Duration
+
+	mu   sync.Mutex
+	conn *wsConn
+}
+
+func newWebSocketSink(c *cfg, opts map[string]interface{}) (*wsSink, error) {
+	s := &wsSink{url: c.url, mime: c.format.ContentType, headers: map[string]string{}, frames: "auto",
+		ping: 15 * time.Second, pong: 5 * time.Second, timeout: c.timeout}
+	switch c.url.Scheme {
+	case "ws":
+	case "wss":
+		s.tls = c.tlsFor(c.url.Hostname())
+	default:
+		return nil, fmt.Errorf("%s websocket sink needs a ws:// or wss:// tracking_url", tag)
+	}
+	if h, ok := opts["headers"].(map[string]interface{}); ok {
+		for k, v := range h {
+			s.headers[k] = fmt.Sprint(v)
+		}
+	}
+	s.subprotocol, _ = opts["subprotocol"].(string)
+	switch v, _ := opts["frames"].(string); v {
+	case "":
+	case "auto", "text", "binary":
+		s.frames = v
+	default:
+		return nil, fmt.Errorf("%s invalid websocket.frames %q: auto, text or binary", tag, v)
+	}
+	if v, ok := opts["ping_ms"].(float64); ok && v >= 0 {
+		s.ping = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := opts["pong_timeout_ms"].(float64); ok && v > 0 {
+		s.pong = time.Duration(v) * time.Millisecond
+	}
+	return s, nil
+}
+
+func (s *wsSink) Send(ctx context.Context, _ *capture.Event, payload []byte) error {
+	op := byte(wsBinary)
+	if s.frames == "text" || s.frames == "auto" && utf8.Valid(payload) {
+		op = wsText
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.closed() {
+		s.conn = nil
+	}
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	deadline, _ := ctx.Deadline()
+	if err := s.conn.write(op, payload, deadline); err != nil {
+		s.conn.close(err)
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// dial opens the connection and runs the opening handshake of RFC 6455.
+func (s *wsSink) dial(ctx context.Context) (*wsConn, error) {
+	u := *s.url
+	u.Scheme = "http"
+	if s.tls != nil {
+		u.Scheme = "https"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+	d := net.Dialer{Timeout: s.timeout}
+	var nc net.Conn
+	var err error
+	if s.tls != nil {
+		td := tls.Dialer{NetDialer: &d, Config: s.tls}
+		nc, err = td.DialContext(ctx, "tcp", host)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(dl)
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	r, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Content-Type", s.mime)
+	if s.subprotocol != "" {
+		r.Header.Set("Sec-WebSocket-Protocol", s.subprotocol)
+	}
+	for k, v := range s.headers {
+		r.Header.Set(k, v)
+	}
+	br := bufio.NewReader(nc)
+	if err := r.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		err = fmt.Errorf("websocket: handshake answered %s", resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]):
+		err = errors.New("websocket: invalid handshake answer")
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := &wsConn{nc: nc, done: make(chan struct{})}
+	go c.read(br)
+	if s.ping > 0 {
+		go c.keepalive(s.ping, s.pong)
+	}
+	return c, nil
+}
+
+/* ───────── connection ───────── */
+
+type wsConn struct {
+	nc       net.Conn
+	wmu      sync.Mutex
+	lastPong atomic.Int64 // unix nanos
+	once     sync.Once
+	done     chan struct{}
+}
+
+func (c *wsConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsConn) close(err error) {
+	c.once.Do(func() {
+		capture.Log("websocket connection dropped:", err)
+		close(c.done)
+		c.nc.Close()
+	})
+}
+
+// write sends one masked, unfragmented frame.
+func (c *wsConn) write(op byte, payload []byte, deadline time.Time) error {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= mask[i&3]
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.SetWriteDeadline(deadline)
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+// read handles the frames of the collector: answers pings, records pongs and
+// ends the connection on a close frame or a read error.
+func (c *wsConn) read(br *bufio.Reader) {
+	var err error
+	defer func() {
+		if err != nil {
+			c.close(err)
+		}
+	}()
+	defer capture.Recover("websocket reader", &err)
+	head := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(br, head); err != nil {
+			c.close(err)
+			return
+		}
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(br, b[:]); err != nil {
+				c.close(err)
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(br, b[:]); err != nil {
+				c.close(err)
+				return
+			}
+			n = binary.BigEndian.Uint64(b[:])
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(br, mask[:]); err != nil {
+				c.close(err)
+				return
+			}
+		}
+		if n > 1<<20 {
+			c.close(fmt.Errorf("websocket: %d byte frame from the collector", n))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			c.close(err)
+			return
+		}
+		if head[1]&0x80 != 0 {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+		switch head[0] & 0x0f {
+		case wsPing:
+			if err := c.write(wsPong, payload, time.Now().Add(5*time.Second)); err != nil {
+				c.close(err)
+				return
+			}
+		case wsPong:
+			c.lastPong.Store(time.Now().UnixNano())
+		case wsClose:
+			c.write(wsClose, payload, time.Now().Add(time.Second))
+			c.close(errors.New("websocket: closed by the collector"))
+			return
+		}
+	}
+}
+
+// keepalive pings every interval and drops the connection when a pong does
+// not arrive within timeout.
+func (c *wsConn) keepalive(interval, timeout time.Duration) {
+	var err error
+	defer func() {
+		if err != nil {
+			c.close(err)
+		}
+	}()
+	defer capture.Recover("websocket keepalive", &err)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		sent := time.Now()
+		if err := c.write(wsPing, nil, sent.Add(timeout)); err != nil {
+			c.close(err)
+			return
+		}
+		time.AfterFunc(timeout, func() {
+			if c.lastPong.Load() < sent.UnixNano() {
+				c.close(fmt.Errorf("websocket: no pong within %s", timeout))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"trace-plugin/internal/capture"
+)
+
+/* ───────── tenant routing ───────── */
+
+// With tenant routes, each tenant's events go to its own sink; tenants
+// without a route, and events without a tenant, use the block's own sink.
+// A route is a small sink block of its own (the timeout is shared, and so is
+// the payload format unless the route names one without options, such as
+// "payload_format": "cbor"; the event is then encoded again for the route):
+//
+//	"tenant": {
+//	  "header": "X-Tenant-Id",
+//	  "routes": {
+//	    "acme":   {"tracking_url": "https://acme.collector.example/ingest"},
+//	    "globex": {"tracking_url": "nats://nats:4222", "nats": {"subject": "traces.globex"}}
+//	  }
+//	}
+
+type tenantRouter struct {
+	routes   map[string]capture.Sink
+	fallback capture.Sink
+}
+
+func newTenantRouter(c *cfg, fallback capture.Sink, opts map[string]interface{}) (capture.Sink, error) {
+	routes, _ := opts["routes"].(map[string]interface{})
+	if len(routes) == 0 {
+		return fallback, nil
+	}
+	r := &tenantRouter{routes: make(map[string]capture.Sink, len(routes)), fallback: fallback}
+	for tenant, v := range routes {
+		block, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s tenant route %q must be an object", tag, tenant)
+		}
+		s, err := routeSink(c, block)
+		if err != nil {
+			return nil, fmt.Errorf("%s tenant route %q: %w", tag, tenant, err)
+		}
+		r.routes[tenant] = s
+	}
+	return r, nil
+}
+
+// routeSink builds the sink of a route block: its tracking_url (or
+// tracking_urls), "sink", sink options and payload_format, with the timeout
+// of c.
+func routeSink(c *cfg, block map[string]interface{}) (capture.Sink, error) {
+	raw, _ := block["tracking_url"].(string)
+	if raw == "" {
+		raw = FirstTarget(block)
+	}
+	target := &url.URL{Scheme: "local"}
+	if raw != "" {
+		var err error
+		if target, err = url.ParseRequestURI(raw); err != nil {
+			return nil, fmt.Errorf("invalid tracking_url: %w", err)
+		}
+	} else if kind, _ := block["sink"].(string); !Local[kind] {
+		return nil, fmt.Errorf("tracking_url missing")
+	}
+	c = c.at(target)
+	name, _ := block["payload_format"].(string)
+	if name == "" || name == c.format.Name {
+		return build(c, block)
+	}
+	f, ok := capture.PayloadFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("payload_format %q is unknown or takes options, which routes do not support", name)
+	}
+	c.format = f
+	s, err := build(c, block)
+	if err != nil {
+		return nil, err
+	}
+	return &reformat{format: f, next: s}, nil
+}
+
+// reformat encodes the events of a route with a payload_format of its own.
+type reformat struct {
+	format capture.PayloadFormat
+	next   capture.Sink
+}
+
+func (r *reformat) Send(ctx context.Context, ev *capture.Event, _ []byte) error {
+	payload, err := r.format.Encode(ev)
+	if err != nil {
+		return fmt.Errorf("%s payload_format %s: %w", tag, r.format.Name, err)
+	}
+	return r.next.Send(ctx, ev, payload)
+}
+
+func (r *tenantRouter) Send(ctx context.Context, ev *capture.Event, payload []byte) error {
+	if s, ok := r.routes[ev.Meta.Get("tenant")]; ok {
+		return s.Send(ctx, ev, payload)
+	}
+	return r.fallback.Send(ctx, ev, payload)
+}